@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAuditTampered = errors.New("Audit log fails verification")
+
+// AuditEntry is one line of the audit log: who changed which key, and the
+// SHA-256 of the value written, or who created or dropped which family. WALSeq is the seq of the WAL record of the
+// write, the last one for an import. Hash is the SHA-256 of the entry's JSON
+// without it, which includes the hash of the entry before, so changing,
+// dropping or reordering entries breaks the chain from there on.
+type AuditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Addr      string    `json:"addr"`
+	Op        string    `json:"op"`
+	CF        string    `json:"cf,omitempty"`
+	Key       string    `json:"key"`
+	ValueHash string    `json:"value_sha256,omitempty"`
+	WALSeq    uint64    `json:"wal_seq,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func valueHash(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog appends entries to the end of the chain in a file. It is
+// written like the WAL, without an fsync for each entry. Once a write to
+// the file fails, nothing more is appended.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+	head string
+	err  error
+	// writes is held by auditGuard from a write to its entries, so they
+	// are in the order of the WAL
+	writes sync.Mutex
+}
+
+// auditLog records the writes of the HTTP API, with -audit
+var auditLog *AuditLog
+
+// OpenAuditLog opens the audit log at path to add to it, after checking
+// its chain.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	report, err := VerifyAuditLog(path, nil)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l := &AuditLog{}
+	if report != nil {
+		if report.Broken != "" {
+			return nil, fmt.Errorf("%w: %s", ErrAuditTampered, report.Broken)
+		}
+		l.seq, l.head = report.Entries, report.Head
+	}
+	l.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append chains entries to the log, filling in their Seq, Time, Prev and
+// Hash.
+func (l *AuditLog) Append(entries ...AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+
+	var buf bytes.Buffer
+	seq, head := l.seq, l.head
+	now := time.Now().UTC()
+	for _, e := range entries {
+		seq++
+		e.Seq, e.Time, e.Prev = seq, now, head
+		e.Hash = e.computeHash()
+		head = e.Hash
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	// One write, so the lines of a batch are there together or not at all
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		// Part of it may be in the file, the chain can't go on after it
+		l.err = err
+		return err
+	}
+	l.seq, l.head = seq, head
+	return nil
+}
+
+// Err returns the error that stopped the log, if any.
+func (l *AuditLog) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *AuditLog) Close() error {
+	return l.file.Close()
+}
+
+// AuditReport is what kvctl audit verify finds in a log: the entries that
+// match its filters, and where the chain breaks if it does.
+type AuditReport struct {
+	File    string       `json:"file"`
+	Entries uint64       `json:"entries"`
+	Head    string       `json:"head"`
+	Matched []AuditEntry `json:"matched"`
+	Broken  string       `json:"broken,omitempty"`
+}
+
+// VerifyAuditLog checks the chain of the log at path, keeping the entries
+// match returns true for, or all of them when it is nil. The chain being
+// broken isn't an error, the report says where. The head is the hash of the
+// last good entry: kept elsewhere, it shows entries cut from the end.
+func VerifyAuditLog(path string, match func(AuditEntry) bool) (*AuditReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	report := &AuditReport{File: path, Matched: []AuditEntry{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			report.Broken = fmt.Sprintf("line %d doesn't parse: %v", line, err)
+			break
+		}
+		switch {
+		case e.Seq != report.Entries+1:
+			report.Broken = fmt.Sprintf("line %d has seq %d after %d", line, e.Seq, report.Entries)
+		case e.Prev != report.Head:
+			report.Broken = fmt.Sprintf("line %d doesn't follow the entry before", line)
+		case e.Hash != e.computeHash():
+			report.Broken = fmt.Sprintf("line %d was changed", line)
+		}
+		if report.Broken != "" {
+			break
+		}
+		report.Entries, report.Head = e.Seq, e.Hash
+		if match == nil || match(e) {
+			report.Matched = append(report.Matched, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+type principalKey struct{}
+
+// withPrincipal records who authGuard found a request to be from.
+func withPrincipal(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, name))
+}
+
+// principal returns who a request is from: the name of its token in the
+// ACL, else its client certificate, else anonymous.
+func principal(r *http.Request) string {
+	if name, ok := r.Context().Value(principalKey{}).(string); ok {
+		return name
+	}
+	if name := certIdentity(r); name != "" {
+		return "cert:" + name
+	}
+	return "anonymous"
+}
+
+// auditWriter holds a response back until its write is in the audit log.
+type auditWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *auditWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// send passes the response on.
+func (w *auditWriter) send(to http.ResponseWriter) {
+	for name, values := range w.header {
+		to.Header()[name] = values
+	}
+	if w.status != 0 {
+		to.WriteHeader(w.status)
+	}
+	to.Write(w.body.Bytes())
+}
+
+// auditGuard adds the writes of the requests that succeed to auditLog,
+// before answering them: a write that can't be audited fails with a 500 and
+// the writes after it are refused. It goes inside authGuard, which knows
+// the principal, and in front of the Raft handler, whose redirects to the
+// leader aren't writes here.
+func auditGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auditLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entries, fromResponse, hasher, err := auditEntries(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if entries == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auditLog.writes.Lock()
+		defer auditLog.writes.Unlock()
+		if err := auditLog.Err(); err != nil {
+			http.Error(w, "Audit log unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		aw := &auditWriter{header: http.Header{}}
+		next.ServeHTTP(aw, r)
+		if aw.status < 200 || aw.status >= 300 {
+			aw.send(w)
+			return
+		}
+
+		// With -audit the other front ends are off, the last record is
+		// this write's
+		memMutex.Lock()
+		db := mem
+		memMutex.Unlock()
+		db.mu.Lock()
+		seq := db.wal.seq
+		db.mu.Unlock()
+
+		who, addr := principal(r), r.RemoteAddr
+		for i := range entries {
+			entries[i].Principal, entries[i].Addr, entries[i].WALSeq = who, addr, seq
+			if fromResponse {
+				entries[i].ValueHash = valueHash(aw.body.Bytes())
+			}
+			if hasher != nil {
+				entries[i].ValueHash = hex.EncodeToString(hasher.Sum(nil))
+			}
+		}
+		if err := auditLog.Append(entries...); err != nil {
+			fmt.Println("Error writing the audit log:", err)
+			http.Error(w, "Error writing the audit log: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		aw.send(w)
+	})
+}
+
+// auditEntries returns the entries of the writes of a request, nil if it
+// doesn't write. For /incr and /append the value is the response; an
+// import is one entry with the hash of the whole body, from the hasher.
+// Creating and dropping a family are entries without a key.
+func auditEntries(r *http.Request) ([]AuditEntry, bool, *bodyHasher, error) {
+	query := r.URL.Query()
+	cf := ""
+	if raftNode != nil {
+		cf = query.Get("cf")
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/set":
+		return []AuditEntry{{Op: "set", CF: cf, Key: query.Get("key"), ValueHash: valueHash([]byte(query.Get("value")))}}, false, nil, nil
+	case path == "/del":
+		return []AuditEntry{{Op: "del", CF: cf, Key: query.Get("key")}}, false, nil, nil
+	case path == "/incr" || path == "/append":
+		return []AuditEntry{{Op: strings.TrimPrefix(path, "/"), Key: query.Get("key")}}, true, nil, nil
+	case strings.HasPrefix(path, "/cf/") && !strings.Contains(strings.TrimPrefix(path, "/cf/"), "/"):
+		name := strings.TrimPrefix(path, "/cf/")
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			return []AuditEntry{{Op: "create_cf", CF: name}}, false, nil, nil
+		case http.MethodDelete:
+			return []AuditEntry{{Op: "drop_cf", CF: name}}, false, nil, nil
+		}
+	case strings.HasPrefix(path, "/cf/") && strings.Contains(path, "/kv/"):
+		cf, key, _ := kvPath(r)
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			value, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, false, nil, err
+			}
+			r.Body = io.NopCloser(bytes.NewReader(value))
+			return []AuditEntry{{Op: "set", CF: cf, Key: key, ValueHash: valueHash(value)}}, false, nil, nil
+		case http.MethodDelete:
+			return []AuditEntry{{Op: "del", CF: cf, Key: key}}, false, nil, nil
+		}
+	case path == "/batch":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Ops []batchOpJSON `json:"ops"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, false, nil, err
+		}
+		entries := []AuditEntry{}
+		for _, op := range req.Ops {
+			e := AuditEntry{Op: op.Op, CF: op.CF, Key: op.Key}
+			if op.Op == "set" {
+				e.ValueHash = valueHash(op.Value)
+			}
+			entries = append(entries, e)
+		}
+		return entries, false, nil, nil
+	case path == "/import":
+		hasher := &bodyHasher{ReadCloser: r.Body, sum: sha256.New()}
+		r.Body = hasher
+		return []AuditEntry{{Op: "import", CF: query.Get("cf")}}, false, hasher, nil
+	}
+	return nil, false, nil, nil
+}
+
+// bodyHasher hashes a request body as the handler reads it.
+type bodyHasher struct {
+	io.ReadCloser
+	sum hash.Hash
+}
+
+func (b *bodyHasher) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.sum.Write(p[:n])
+	return n, err
+}
+
+func (b *bodyHasher) Sum(in []byte) []byte {
+	return b.sum.Sum(in)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	useTempDir(t)
+	db := openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	mem = db
+	if _, err := db.CreateColumnFamily("orders", CFOptions{}); err != nil {
+		t.Fatalf("Error creating family: %v", err)
+	}
+
+	dir := t.TempDir()
+	aclPath := filepath.Join(dir, "acl")
+	writeACL(t, aclPath, "alice a1 all *", "bob b0b read,write users/")
+	if err := useACLFile(aclPath); err != nil {
+		t.Fatalf("Error loading ACL: %v", err)
+	}
+	defer useACLFile("")
+	path := filepath.Join(dir, "audit.log")
+	var err error
+	auditLog, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("Error opening the audit log: %v", err)
+	}
+	defer func() {
+		auditLog.Close()
+		auditLog = nil
+	}()
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	handler := authGuard(auditGuard(readOnlyGuard(mux)))
+	do := func(method, target, token, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	do("GET", "/set?key=users/1&value=v1", "b0b", "")
+	do("GET", "/get?key=users/1", "b0b", "")
+	do("GET", "/set?key=admins/1&value=v", "b0b", "")
+	do("GET", "/del?key=missing", "a1", "")
+	do("PUT", "/cf/orders/kv/o1", "a1", "order")
+	do("GET", "/incr?key=count&by=5", "a1", "")
+	do("POST", "/batch", "a1", `{"ops": [{"op": "set", "key": "users/1", "value": "djI="}, {"op": "del", "cf": "orders", "key": "o1"}]}`)
+	do("GET", "/del?key=users/1", "a1", "")
+	do("PUT", "/cf/events", "a1", "")
+	do("GET", "/append?key=log&value=x", "a1", "")
+	do("DELETE", "/cf/events", "a1", "")
+
+	// Only the writes that were made, by whom and of what value
+	report, err := VerifyAuditLog(path, nil)
+	if err != nil || report.Broken != "" || report.Entries != 9 {
+		t.Fatalf("Unexpected audit log: %+v (%v)", report, err)
+	}
+	var ops []string
+	for _, e := range report.Matched {
+		ops = append(ops, e.Principal+" "+e.Op+" "+e.CF+"/"+e.Key)
+		if e.Addr == "" || e.Time.IsZero() {
+			t.Fatalf("Expected the source and time of %+v", e)
+		}
+	}
+	if got := strings.Join(ops, ", "); got != "bob set /users/1, alice set orders/o1, alice incr /count, alice set /users/1, alice del orders/o1, alice del /users/1, alice create_cf events/, alice append /log, alice drop_cf events/" {
+		t.Fatalf("Unexpected entries: %s", got)
+	}
+	if report.Matched[0].ValueHash != valueHash([]byte("v1")) || report.Matched[2].ValueHash != valueHash([]byte("5")) || report.Matched[3].ValueHash != valueHash([]byte("v2")) {
+		t.Fatalf("Unexpected value hashes: %+v", report.Matched)
+	}
+
+	// In the order of the WAL, a batch under the seq of its record
+	for i, e := range report.Matched[1:] {
+		if prev := report.Matched[i].WALSeq; e.WALSeq <= prev && !(i == 3 && e.WALSeq == prev) {
+			t.Fatalf("Expected the WAL seqs in order, got %+v", report.Matched)
+		}
+	}
+	if last := report.Matched[8].WALSeq; last != db.wal.seq {
+		t.Fatalf("Expected the last entry at seq %d, got %d", db.wal.seq, last)
+	}
+	if create, drop := report.Matched[6], report.Matched[8]; create.WALSeq != drop.WALSeq-2 {
+		t.Fatalf("Expected the family's create and drop at their WAL records, got %+v and %+v", create, drop)
+	}
+
+	report, _ = VerifyAuditLog(path, func(e AuditEntry) bool { return e.Key == "users/1" && e.Principal == "alice" })
+	if len(report.Matched) != 2 {
+		t.Fatalf("Expected 2 entries of alice on users/1, got %+v", report.Matched)
+	}
+	if code := kvctlMain([]string{"audit", "verify", "-key", "users/1", path}); code != 0 {
+		t.Fatalf("Expected kvctl audit verify to pass, got %d", code)
+	}
+
+	// The chain goes on after a restart
+	auditLog.Close()
+	if auditLog, err = OpenAuditLog(path); err != nil {
+		t.Fatalf("Error reopening the audit log: %v", err)
+	}
+	do("GET", "/set?key=users/2&value=v", "b0b", "")
+	if report, _ := VerifyAuditLog(path, nil); report.Broken != "" || report.Entries != 10 {
+		t.Fatalf("Unexpected audit log after reopening: %+v", report)
+	}
+
+	// A write that can't be audited fails, and the ones after it aren't made
+	auditLog.file.Close()
+	if code := do("GET", "/set?key=users/3&value=v", "b0b", ""); code != http.StatusInternalServerError {
+		t.Fatalf("Expected a 500 when the audit log fails, got %d", code)
+	}
+	if code := do("GET", "/set?key=users/4&value=v", "b0b", ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a 503 after the audit log failed, got %d", code)
+	}
+	if _, err := db.Get([]byte("users/4")); err == nil {
+		t.Fatal("Expected no write after the audit log failed")
+	}
+	if code := do("GET", "/get?key=users/2", "b0b", ""); code != http.StatusOK {
+		t.Fatalf("Expected reads to go on, got %d", code)
+	}
+
+	// Changing or dropping an entry is found
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for name, tampered := range map[string][]byte{
+		"line 2 was changed":       bytes.Replace(data, []byte(`"orders"`), []byte(`"users"`), 1),
+		"line 3 has seq 4 after 2": bytes.Join(append(append([][]byte{}, lines[:2]...), lines[3:]...), nil),
+		"line 1 has seq 2 after 0": bytes.Join([][]byte{lines[1], lines[0]}, nil),
+	} {
+		if err := os.WriteFile(path, tampered, 0600); err != nil {
+			t.Fatal(err)
+		}
+		report, err := VerifyAuditLog(path, nil)
+		if err != nil || !strings.Contains(report.Broken, name) {
+			t.Fatalf("Expected %q, got %+v (%v)", name, report, err)
+		}
+		if _, err := OpenAuditLog(path); !errors.Is(err, ErrAuditTampered) {
+			t.Fatalf("Expected a tampered log not to open, got %v", err)
+		}
+		if code := kvctlMain([]string{"audit", "verify", path}); code != 1 {
+			t.Fatalf("Expected kvctl audit verify to fail, got %d", code)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnauthorized = errors.New("Missing or unknown token")
+	ErrForbidden    = errors.New("Not allowed by the ACL")
+)
+
+// The operations a token may be granted.
+const (
+	opRead = 1 << iota
+	opWrite
+	opDelete
+	opScan
+	opAdmin
+)
+
+var aclOps = map[string]int{
+	"read":   opRead,
+	"write":  opWrite,
+	"delete": opDelete,
+	"scan":   opScan,
+	"admin":  opAdmin,
+	"all":    opRead | opWrite | opDelete | opScan | opAdmin,
+}
+
+// ACL maps the bearer tokens of the clients to what they may do. It is read
+// from a file of lines like
+//
+//	# name   token               ops              keys
+//	app      s3cret              read,write       default:users/ orders:
+//	reports  sha256:9f86d08...   read,scan        *:reports/
+//	ops      0p3rat0r            all              *
+//	billing  cert:billing-svc    read             orders:
+//
+// The token is given as it is or as the hex of its SHA-256, only the hash is
+// kept; cert:name is instead the client certificate with that common name,
+// with mutual TLS. A key is family:prefix, the family being default for the
+// one of /get and /set and * for any; a key without a family is a prefix of
+// the default one and * is every key. admin covers everything that isn't a key:
+// families, checkpoints, replication, Raft and the stats. Lines with the
+// same token add up.
+type ACL struct {
+	tokens map[[sha256.Size]byte]*aclToken
+	certs  map[string]*aclToken
+}
+
+type aclToken struct {
+	name   string
+	grants []aclGrant
+}
+
+type aclGrant struct {
+	ops    int
+	cf     string
+	prefix string
+}
+
+var (
+	aclMu   sync.RWMutex
+	acl     *ACL
+	aclPath string
+)
+
+// LoadACL reads an ACL file.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &ACL{tokens: map[[sha256.Size]byte]*aclToken{}, certs: map[string]*aclToken{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%s:%d: expected a name, a token, the ops and the keys", path, n)
+		}
+
+		var hash [sha256.Size]byte
+		if strings.HasPrefix(fields[1], "sha256:") {
+			decoded, err := hex.DecodeString(strings.TrimPrefix(fields[1], "sha256:"))
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("%s:%d: bad token hash", path, n)
+			}
+			copy(hash[:], decoded)
+		} else {
+			hash = sha256.Sum256([]byte(fields[1]))
+		}
+
+		ops := 0
+		for _, op := range strings.Split(fields[2], ",") {
+			bit, ok := aclOps[op]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown op %q", path, n, op)
+			}
+			ops |= bit
+		}
+
+		var t *aclToken
+		if cert := strings.TrimPrefix(fields[1], "cert:"); cert != fields[1] {
+			if a.certs[cert] == nil {
+				a.certs[cert] = &aclToken{name: fields[0]}
+			}
+			t = a.certs[cert]
+		} else {
+			if a.tokens[hash] == nil {
+				a.tokens[hash] = &aclToken{name: fields[0]}
+			}
+			t = a.tokens[hash]
+		}
+		if t.name != fields[0] {
+			return nil, fmt.Errorf("%s:%d: token of %s given to %s", path, n, t.name, fields[0])
+		}
+		for _, key := range fields[3:] {
+			g := aclGrant{ops: ops, cf: "default", prefix: key}
+			if key == "*" {
+				g.cf, g.prefix = "*", ""
+			} else if i := strings.Index(key, ":"); i >= 0 {
+				g.cf, g.prefix = key[:i], key[i+1:]
+			}
+			t.grants = append(t.grants, g)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// useACLFile loads the ACL of path and keeps path for ReloadACL. An empty
+// path turns authentication off.
+func useACLFile(path string) error {
+	var a *ACL
+	if path != "" {
+		var err error
+		a, err = LoadACL(path)
+		if err != nil {
+			return err
+		}
+	}
+	aclMu.Lock()
+	acl, aclPath = a, path
+	aclMu.Unlock()
+	return nil
+}
+
+// ReloadACL reads the ACL file again. The old ACL stays when the file
+// doesn't load.
+func ReloadACL() error {
+	aclMu.RLock()
+	path := aclPath
+	aclMu.RUnlock()
+	if path == "" {
+		return errors.New("No ACL file to reload")
+	}
+	return useACLFile(path)
+}
+
+func currentACL() *ACL {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+	return acl
+}
+
+// identify returns the grants of the bearer token of a request, or else of
+// its client certificate, nil for neither.
+func (a *ACL) identify(r *http.Request) *aclToken {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return a.lookup(header)
+	}
+	if name := certIdentity(r); name != "" {
+		return a.certs[name]
+	}
+	return nil
+}
+
+// lookup returns the token of an Authorization header, or nil.
+func (a *ACL) lookup(header string) *aclToken {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	return a.tokens[sha256.Sum256([]byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))))]
+}
+
+// allows reports whether t may do op on the keys of cf from start to end,
+// exclusive, a nil end being the end of the family.
+func (t *aclToken) allows(op int, cf string, start, end []byte) bool {
+	if cf == "" {
+		cf = "default"
+	}
+	for _, g := range t.grants {
+		if g.ops&op == 0 || (g.cf != "*" && g.cf != cf) || bytes.Compare(start, []byte(g.prefix)) < 0 {
+			continue
+		}
+		limit := prefixEnd([]byte(g.prefix))
+		if limit == nil || (end != nil && bytes.Compare(end, limit) <= 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *aclToken) allowsKey(op int, cf, key string) bool {
+	return t.allows(op, cf, []byte(key), append([]byte(key), 0))
+}
+
+func (t *aclToken) isAdmin() bool {
+	for _, g := range t.grants {
+		if g.ops&opAdmin != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixEnd returns the first key after all those starting with prefix, nil
+// when there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// authGuard answers 401 to requests without a known bearer token and 403 to
+// those the ACL doesn't allow, when an ACL is loaded. It goes in front of
+// the Raft handler too, which serves keys itself.
+func authGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := currentACL()
+		if a == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t := a.identify(r)
+		if t == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kv"`)
+			http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		allowed, err := authorize(r, t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !allowed {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, withPrincipal(r, t.name))
+	})
+}
+
+// authorize checks a request against the grants of t. Whatever isn't a key
+// needs admin.
+func authorize(r *http.Request, t *aclToken) (bool, error) {
+	query := r.URL.Query()
+	// /get, /set and /del only take ?cf= in Raft mode
+	cf := ""
+	if raftNode != nil {
+		cf = query.Get("cf")
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/get":
+		return t.allowsKey(opRead, cf, query.Get("key")), nil
+	case path == "/set":
+		return t.allowsKey(opWrite, cf, query.Get("key")), nil
+	case path == "/del":
+		return t.allowsKey(opDelete, cf, query.Get("key")), nil
+	case path == "/incr" || path == "/append":
+		return t.allowsKey(opWrite, "", query.Get("key")), nil
+	case strings.HasPrefix(path, "/cf/") && strings.Contains(path, "/kv/"):
+		cf, key, _ := kvPath(r)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			return t.allowsKey(opRead, cf, key), nil
+		case http.MethodPut, http.MethodPost:
+			return t.allowsKey(opWrite, cf, key), nil
+		case http.MethodDelete:
+			return t.allowsKey(opDelete, cf, key), nil
+		}
+		return t.isAdmin(), nil
+	case path == "/scan":
+		var start, end []byte
+		if query.Get("start") != "" {
+			start = []byte(query.Get("start"))
+		}
+		if query.Get("end") != "" {
+			end = []byte(query.Get("end"))
+		}
+		return t.allows(opScan, query.Get("cf"), start, end), nil
+	case path == "/watch":
+		prefix := []byte(query.Get("prefix"))
+		return t.allows(opScan, query.Get("cf"), prefix, prefixEnd(prefix)), nil
+	case path == "/import":
+		return t.allows(opWrite, query.Get("cf"), nil, nil), nil
+	case path == "/batch":
+		return authorizeBatch(r, t)
+	}
+	return t.isAdmin(), nil
+}
+
+// authorizeBatch checks every op of a /batch, and puts the body back for
+// the handler.
+func authorizeBatch(r *http.Request, t *aclToken) (bool, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return false, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var req struct {
+		Ops []batchOpJSON `json:"ops"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return false, err
+	}
+	for _, op := range req.Ops {
+		needed := opWrite
+		if op.Op == "del" {
+			needed = opDelete
+		}
+		if !t.allowsKey(needed, op.CF, op.Key) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func ACLReloadHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles POST /admin/acl/reload, the ACL file is read again
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := ReloadACL(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// apiToken is the bearer token this process sends to other servers: its
+// primary, its Raft peers, or the server kvctl and kvbackup talk to.
+var apiToken string
+
+// tokenTransport adds a bearer token to the requests that don't carry one.
+// Being on the transport, it is sent again after a redirect, which the
+// client would drop the Authorization header of.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.token == "" || req.Header.Get("Authorization") != "" {
+		return base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return base.RoundTrip(req)
+}
+
+// tokenClient returns a client that sends token, over clientTLS.
+func tokenClient(token string) *http.Client {
+	return &http.Client{Transport: &tokenTransport{token: token, base: clientTransport()}}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"PersistentKVstoreGo/kvclient"
+)
+
+func writeACL(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("Error writing ACL: %v", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	useTempDir(t)
+	db := openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	mem = db
+	if _, err := db.CreateColumnFamily("orders", CFOptions{}); err != nil {
+		t.Fatalf("Error creating family: %v", err)
+	}
+
+	hash := sha256.Sum256([]byte("r3ports"))
+	path := filepath.Join(t.TempDir(), "acl")
+	writeACL(t, path,
+		"# name token ops keys",
+		"app s3cret read,write default:users/ orders:",
+		"reports sha256:"+hex.EncodeToString(hash[:])+" read,scan *:reports/",
+		"ops 0p3rat0r all *",
+	)
+	if err := useACLFile(path); err != nil {
+		t.Fatalf("Error loading ACL: %v", err)
+	}
+	defer useACLFile("")
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	handler := authGuard(readOnlyGuard(mux))
+	do := func(method, target, token, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("Expected a challenge with the 401 of %s %s", method, target)
+		}
+		return rec.Code
+	}
+
+	for _, c := range []struct {
+		method, target, token, body string
+		code                        int
+	}{
+		{"GET", "/get?key=users/1", "", "", http.StatusUnauthorized},
+		{"GET", "/get?key=users/1", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/set?key=users/1&value=a", "s3cret", "", http.StatusOK},
+		{"GET", "/get?key=users/1", "s3cret", "", http.StatusOK},
+		{"GET", "/set?key=admins/1&value=a", "s3cret", "", http.StatusForbidden},
+		{"GET", "/del?key=users/1", "s3cret", "", http.StatusForbidden},
+		{"GET", "/incr?key=users/n", "s3cret", "", http.StatusOK},
+		{"PUT", "/cf/orders/kv/o1", "s3cret", "x", http.StatusOK},
+		{"GET", "/cf/orders/kv/o1", "s3cret", "", http.StatusOK},
+		{"DELETE", "/cf/orders/kv/o1", "s3cret", "", http.StatusForbidden},
+		// Keys the mux would clean come in the query
+		{"GET", "/cf/orders/kv/?key=o1", "s3cret", "", http.StatusOK},
+		{"DELETE", "/cf/orders/kv/?key=o1", "s3cret", "", http.StatusForbidden},
+		{"GET", "/scan?start=users/&end=users0", "s3cret", "", http.StatusForbidden},
+		// The hash of a token works like the token
+		{"GET", "/scan?cf=orders&start=reports/&end=reports/z", "r3ports", "", http.StatusOK},
+		{"GET", "/scan?cf=orders&start=reports/", "r3ports", "", http.StatusForbidden},
+		{"GET", "/scan?cf=orders", "r3ports", "", http.StatusForbidden},
+		{"GET", "/set?key=reports/1&value=a", "r3ports", "", http.StatusForbidden},
+		{"POST", "/batch", "s3cret", `{"ops": [{"op": "set", "key": "users/2", "value": "YQ=="}, {"op": "set", "cf": "orders", "key": "o2", "value": "YQ=="}]}`, http.StatusOK},
+		{"POST", "/batch", "s3cret", `{"ops": [{"op": "set", "key": "users/3", "value": "YQ=="}, {"op": "del", "key": "users/2"}]}`, http.StatusForbidden},
+		{"POST", "/import?cf=orders", "s3cret", `{"key": "o3", "value": "YQ=="}`, http.StatusOK},
+		{"POST", "/import", "s3cret", `{"key": "users/4", "value": "YQ=="}`, http.StatusForbidden},
+		// What isn't a key needs admin
+		{"GET", "/admin/stats", "s3cret", "", http.StatusForbidden},
+		{"PUT", "/cf/logs", "s3cret", "", http.StatusForbidden},
+		{"GET", "/replication/status", "r3ports", "", http.StatusForbidden},
+		{"GET", "/admin/stats", "0p3rat0r", "", http.StatusOK},
+		{"PUT", "/cf/logs", "0p3rat0r", "", http.StatusOK},
+		{"GET", "/del?key=users/1", "0p3rat0r", "", http.StatusOK},
+	} {
+		if code := do(c.method, c.target, c.token, c.body); code != c.code {
+			t.Fatalf("%s %s with %q: expected %d, got %d", c.method, c.target, c.token, c.code, code)
+		}
+	}
+
+	// The watch of a prefix needs scan on all of it
+	watch := func(target string) bool {
+		allowed, _ := authorize(httptest.NewRequest("GET", target, nil), currentACL().lookup("Bearer r3ports"))
+		return allowed
+	}
+	if !watch("/watch?cf=logs&prefix=reports/2024") || watch("/watch?cf=logs&prefix=rep") || watch("/watch?cf=logs") {
+		t.Fatal("Expected only the watches within reports/ to be allowed")
+	}
+
+	// Clients and peers send their token
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, err := kvclient.New(server.URL, kvclient.Options{Token: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Set(context.Background(), "users/5", []byte("v")); err != nil {
+		t.Fatalf("Expected the client's token to be sent, got %v", err)
+	}
+	resp, err := tokenClient("0p3rat0r").Get(server.URL + "/replication/status")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the peer's token to be sent, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+
+	// Reloading takes the new file, a bad one keeps the old ACL
+	writeACL(t, path, "ops 0p3rat0r all *", "app s3cret read users/")
+	if code := do("POST", "/admin/acl/reload", "0p3rat0r", ""); code != http.StatusOK {
+		t.Fatalf("Expected the reload to work, got %d", code)
+	}
+	if code := do("GET", "/set?key=users/1&value=b", "s3cret", ""); code != http.StatusForbidden {
+		t.Fatalf("Expected the write to be refused after the reload, got %d", code)
+	}
+	if code := do("GET", "/get?key=reports/1", "r3ports", ""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the removed token to be refused, got %d", code)
+	}
+	writeACL(t, path, "ops 0p3rat0r everything *")
+	if err := ReloadACL(); err == nil || !strings.Contains(err.Error(), "everything") {
+		t.Fatalf("Expected the bad ACL to be refused, got %v", err)
+	}
+	if code := do("GET", "/get?key=users/1", "s3cret", ""); code != http.StatusNotFound {
+		t.Fatalf("Expected the old ACL to stay, got %d", code)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manifest describes a checkpoint: the sequence number it stops at and every
+// file needed to open it, with their checksums.
+type Manifest struct {
+	Seq     uint64         `json:"seq"`
+	Created time.Time      `json:"created"`
+	Files   []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Checkpoint writes a consistent copy of the store to dir, which must not
+// exist yet. SSTs never change once written, so they are hard-linked when dir
+// is on the same filesystem; the live WAL, which holds what is still in the
+// memtables, is copied. dir can be opened as a store of its own.
+func (mem *memDB) Checkpoint(dir string) (*Manifest, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return nil, errors.New("Checkpoint directory already exists")
+	}
+	if err := os.MkdirAll(dir+"/"+sstDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Only the copy needs the lock, checksums are computed on the copy
+	mem.mu.Lock()
+	seq := mem.wal.seq
+	files, err := storeFiles(mem.wal.root)
+	if err == nil {
+		for _, path := range files {
+			if err = linkOrCopy(storePath(mem.wal.root, path), dir+"/"+path); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = copyFile(storePath(mem.wal.root, "wal.txt"), dir+"/wal.txt")
+		files = append(files, "wal.txt")
+	}
+	mem.mu.Unlock()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	manifest := &Manifest{Seq: seq, Created: time.Now().UTC()}
+	for _, path := range files {
+		file, err := describeFile(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	if err := writeManifest(dir+"/MANIFEST", manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// storeFiles lists the SSTs and family options of the store in root,
+// relative to it.
+func storeFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(storePath(root, sstDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if !info.IsDir() && (strings.HasPrefix(name, "sst") || name == "OPTIONS") {
+			if root != "" {
+				path, _ = filepath.Rel(root, path)
+			}
+			files = append(files, filepath.ToSlash(path))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func fileSHA256(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+func describeFile(dir, path string) (ManifestFile, error) {
+	sum, size, err := fileSHA256(dir + "/" + path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Path: path, Size: size, SHA256: sum}, nil
+}
+
+func writeManifest(path string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func readManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
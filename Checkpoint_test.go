@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointBackupAndRestore(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+	users, err := db.CreateColumnFamily("users", CFOptions{})
+	if err != nil {
+		t.Fatalf("Error creating column family: %v", err)
+	}
+
+	// Some keys in SSTs, some only in the memtable and the WAL
+	for _, k := range []string{"a", "b", "c", "d"} {
+		db.Set([]byte(k), []byte("v"+k))
+	}
+	users.Set([]byte("alice"), []byte("admin"))
+
+	if _, err := db.Checkpoint("checkpoint"); err != nil {
+		t.Fatalf("Error taking checkpoint: %v", err)
+	}
+	db.Set([]byte("a"), []byte("changed"))
+
+	backup, copied, err := BackupCheckpoint("checkpoint", "repo")
+	if err != nil || backup != "backup1" {
+		t.Fatalf("Error backing up: %s %v", backup, err)
+	}
+	os.RemoveAll("checkpoint")
+
+	// A second backup only copies what changed
+	db.Set([]byte("e"), []byte("ve"))
+	db.Set([]byte("f"), []byte("vf"))
+	if _, err := db.Checkpoint("checkpoint"); err != nil {
+		t.Fatalf("Error taking checkpoint: %v", err)
+	}
+	backup, copiedAgain, err := BackupCheckpoint("checkpoint", "repo")
+	if err != nil {
+		t.Fatalf("Error backing up: %v", err)
+	}
+	second, _ := readManifest("repo/" + backup + "/MANIFEST")
+	if copiedAgain >= len(second.Files) {
+		t.Fatalf("Expected the unchanged SST and options not to be copied again, copied %d of %d", copiedAgain, len(second.Files))
+	}
+	objects, _ := os.ReadDir("repo/files")
+	if len(objects) != copied+copiedAgain {
+		t.Fatalf("Expected %d files in the repository, got %d", copied+copiedAgain, len(objects))
+	}
+
+	if err := RestoreBackup("repo", "backup1", "restored"); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir("restored")
+	repl, err = NewInMem()
+	if err != nil {
+		t.Fatalf("Error opening restored store: %v", err)
+	}
+	restored := repl.handler.(*memDB)
+	if err := recoverFromWAL(restored); err != nil {
+		t.Fatalf("Error recovering restored store: %v", err)
+	}
+	for k, expected := range map[string]string{"a": "va", "b": "vb", "d": "vd"} {
+		if v, err := restored.Get([]byte(k)); err != nil || string(v) != expected {
+			t.Fatalf("Expected %s to be %s in the backup, got %s (%v)", k, expected, v, err)
+		}
+	}
+	restoredUsers, err := restored.Family("users")
+	if err != nil {
+		t.Fatalf("Expected the column family in the backup: %v", err)
+	}
+	if v, err := restoredUsers.Get([]byte("alice")); err != nil || string(v) != "admin" {
+		t.Fatalf("Expected alice in the backup, got %s (%v)", v, err)
+	}
+	restored.wal.file.Close()
+	os.Chdir(wd)
+
+	// A damaged file is caught on restore
+	manifest, _ := readManifest("repo/backup1/MANIFEST")
+	os.WriteFile("repo/files/"+manifest.Files[0].SHA256, []byte("garbage"), 0644)
+	err = RestoreBackup("repo", "backup1", "restored-again")
+	if err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		t.Fatalf("Expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestPointInTimeRestore(t *testing.T) {
+	useTempDir(t)
+	defer func() { walArchiveDir = "" }()
+	walArchiveDir = "WALArchive"
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+
+	for _, k := range []string{"a", "b", "c"} {
+		db.Set([]byte(k), []byte("v"+k))
+	}
+	if _, err := db.Checkpoint("checkpoint"); err != nil {
+		t.Fatalf("Error taking checkpoint: %v", err)
+	}
+	if _, _, err := BackupCheckpoint("checkpoint", "repo"); err != nil {
+		t.Fatalf("Error backing up: %v", err)
+	}
+	for _, k := range []string{"d", "e", "f"} {
+		db.Set([]byte(k), []byte("v"+k))
+	}
+
+	// An accidental bulk delete, seqs 7 to 12, then one more write
+	time.Sleep(time.Millisecond)
+	beforeDelete := time.Now()
+	batch := &WriteBatch{}
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		batch.Del("", []byte(k))
+	}
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	db.Set([]byte("g"), []byte("vg"))
+
+	restore := func(target, liveWAL string, stopSeq uint64, stopTime time.Time) uint64 {
+		if err := RestoreBackup("repo", "backup1", target); err != nil {
+			t.Fatalf("Error restoring: %v", err)
+		}
+		seq, err := RestoreToPoint(walArchiveDir, liveWAL, target, stopSeq, stopTime)
+		if err != nil {
+			t.Fatalf("Error restoring to a point: %v", err)
+		}
+		return seq
+	}
+	check := func(target string, present, absent []string) {
+		wd, _ := os.Getwd()
+		os.Chdir(target)
+		defer os.Chdir(wd)
+		repl, err := NewInMem()
+		if err != nil {
+			t.Fatalf("Error opening restored store: %v", err)
+		}
+		restored := repl.handler.(*memDB)
+		defer restored.wal.file.Close()
+		if err := recoverFromWAL(restored); err != nil {
+			t.Fatalf("Error recovering restored store: %v", err)
+		}
+		for _, k := range present {
+			if v, err := restored.Get([]byte(k)); err != nil || string(v) != "v"+k {
+				t.Fatalf("Expected %s in %s, got %s (%v)", k, target, v, err)
+			}
+		}
+		for _, k := range absent {
+			if v, err := restored.Get([]byte(k)); err == nil {
+				t.Fatalf("Expected %s not to be in %s, got %s", k, target, v)
+			}
+		}
+	}
+
+	// The batch is dropped as a whole when the stop point falls inside it
+	if seq := restore("by-seq", "", 8, time.Time{}); seq != 6 {
+		t.Fatalf("Expected to stop at seq 6, got %d", seq)
+	}
+	check("by-seq", []string{"a", "b", "c", "d", "e", "f"}, []string{"g"})
+
+	if seq := restore("by-time", "", 0, beforeDelete); seq != 6 {
+		t.Fatalf("Expected to stop at seq 6, got %d", seq)
+	}
+	check("by-time", []string{"a", "f"}, []string{"g"})
+
+	// Everything, including what is only in the live WAL
+	if seq := restore("latest", "wal.txt", 0, time.Time{}); seq != 13 {
+		t.Fatalf("Expected to stop at seq 13, got %d", seq)
+	}
+	check("latest", []string{"g"}, []string{"a", "f"})
+}
+
+func TestWALArchivePruning(t *testing.T) {
+	useTempDir(t)
+	set := func(db *memDB, keys ...string) {
+		for _, k := range keys {
+			db.Set([]byte(k), []byte("v"+k))
+		}
+	}
+	archived := func() []uint64 {
+		segments, err := archivedSegments("WALArchive")
+		if err != nil {
+			t.Fatalf("Error listing the archive: %v", err)
+		}
+		var firsts []uint64
+		for _, segment := range segments {
+			firsts = append(firsts, segment.first)
+		}
+		return firsts
+	}
+
+	// Off unless asked for
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+	set(db, "a", "b", "c", "d", "e", "f")
+	db.wal.file.Close()
+	if _, err := os.Stat("WALArchive"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no archive by default, got %v", err)
+	}
+
+	defer func() { walArchiveDir, walArchiveRepo = "", "" }()
+	walArchiveDir, walArchiveRepo = "WALArchive", "repo"
+	if repl, err = NewInMem(); err != nil {
+		t.Fatalf("Error reopening database: %v", err)
+	}
+	db = repl.handler.(*memDB)
+	defer func() { db.wal.file.Close() }()
+	if err := recoverFromWAL(db); err != nil {
+		t.Fatalf("Error recovering: %v", err)
+	}
+
+	// Without a backup everything is kept. A flush every 3 writes seals
+	// seqs 7-9, 10-12 and 13-15
+	set(db, "g", "h", "i", "j", "k", "l", "m", "n", "o")
+	if got := fmt.Sprint(archived()); got != "[7 10 13]" {
+		t.Fatalf("Unexpected archive %s", got)
+	}
+
+	// Once backed up at seq 16, the segments before it go at the next rotation
+	set(db, "p")
+	if _, err := db.Checkpoint("checkpoint1"); err != nil {
+		t.Fatalf("Error taking checkpoint: %v", err)
+	}
+	if backup, _, err := BackupCheckpoint("checkpoint1", "repo"); err != nil || backup != "backup1" {
+		t.Fatalf("Error backing up: %s %v", backup, err)
+	}
+	set(db, "q", "r")
+	if got := fmt.Sprint(archived()); got != "[16]" {
+		t.Fatalf("Expected the segments before the backup to be pruned, got %s", got)
+	}
+
+	// Removing the oldest backup lets the archive go up to the next one
+	set(db, "s", "t", "u", "v")
+	if _, err := db.Checkpoint("checkpoint2"); err != nil {
+		t.Fatalf("Error taking checkpoint: %v", err)
+	}
+	if backup, _, err := BackupCheckpoint("checkpoint2", "repo"); err != nil || backup != "backup2" {
+		t.Fatalf("Error backing up: %s %v", backup, err)
+	}
+	os.RemoveAll("repo/backup1")
+	set(db, "w", "x", "y")
+	if got := fmt.Sprint(archived()); got != "[22]" {
+		t.Fatalf("Expected the segments before backup2 to be pruned, got %s", got)
+	}
+	if backup, _, err := BackupCheckpoint("checkpoint2", "repo"); err != nil || backup != "backup3" {
+		t.Fatalf("Expected backup3 after backup2, got %s %v", backup, err)
+	}
+
+	// What is left still restores backup2 to the latest write
+	if err := RestoreBackup("repo", "backup2", "restored"); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if seq, err := RestoreToPoint("WALArchive", "wal.txt", "restored", 0, time.Time{}); err != nil || seq != db.wal.seq {
+		t.Fatalf("Expected to replay up to seq %d, got %d (%v)", db.wal.seq, seq, err)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elliotchance/orderedmap"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sstDir holds the SSTs of the default column family. Every other family
+// gets a subdirectory of its own.
+const sstDir = "SSTFiles"
+
+var ErrColumnFamilyDropped = errors.New("Column family dropped")
+var ErrColumnFamilyNotFound = errors.New("Column family not found")
+
+// CFOptions are the per family settings. Zero values fall back to the
+// store wide defaults. A RegionSplitBytes partitions the family into
+// regions, see Region.
+type CFOptions struct {
+	FlushThreshold   int
+	RegionSplitBytes int64
+	RegionMergeBytes int64
+	// Compression is the codec of the SSTs of each level, see codecForLevel
+	Compression []string
+}
+
+func (mem *memDB) flushThreshold() int {
+	if mem.options.FlushThreshold > 0 {
+		return mem.options.FlushThreshold
+	}
+	return flushThreshold
+}
+
+// logWAL writes a record for this family to the shared WAL and returns its
+// sequence number.
+func (mem *memDB) logWAL(op Cmd, key, value []byte) (uint64, error) {
+	walOp, walKey := walKey(mem.name, byte(op), key)
+	seq := mem.wal.seq + 1
+	if err := writeWAL(mem.wal, seq, walOp, walKey, value); err != nil {
+		return 0, err
+	}
+	mem.wal.seq = seq
+	return seq, nil
+}
+
+// writableWithNoLock refuses the writes of a replica, whichever front end
+// they come from, before they touch the memtable.
+func (mem *memDB) writableWithNoLock() error {
+	if mem.wal.readOnly {
+		return ErrReadOnlyReplica
+	}
+	return nil
+}
+
+// applyWALRecord replays one WAL record into the memtable of its family.
+// It is used both by recovery and by Write, so a batch is applied the same
+// way whether it was just written or read back after a crash.
+func (mem *memDB) applyWALRecord(rec walRecord) {
+	records, err := rec.batchRecords()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, rec := range records {
+		name, op, key := splitWALKey(rec.op, rec.key)
+		switch op {
+		case byte(CreateCF):
+			if err := mem.applyCreateColumnFamilyWithNoLock(name, rec.value); err != nil {
+				fmt.Println("Error creating column family:", err)
+			}
+			continue
+		case byte(DropCF):
+			if err := mem.applyDropColumnFamilyWithNoLock(name, rec.value); err != nil {
+				fmt.Println("Error dropping column family:", err)
+			}
+			continue
+		}
+		cf, ok := mem.families[name]
+		if !ok {
+			// The family was dropped since
+			continue
+		}
+
+		switch op {
+		case byte(Set):
+			cf.SetMap(key, rec.value)
+		case byte(Del):
+			cf.DelMap(key)
+		case byte(Merge):
+			cf.MergeMap(key, rec.value)
+		case byte(Ingest):
+			// The files are in place already, the record only holds a
+			// sequence number
+		default:
+			fmt.Printf("Unknown operation in WAL: %v\n", op)
+		}
+	}
+}
+
+func validColumnFamilyName(name string) bool {
+	if name == "" || name == "default" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (mem *memDB) newColumnFamily(name string, options CFOptions) *memDB {
+	return &memDB{
+		values:   orderedmap.NewOrderedMap(),
+		mu:       mem.mu,
+		wal:      mem.wal,
+		name:     name,
+		dir:      storePath(mem.wal.root, sstDir) + "/" + name,
+		options:  options,
+		families: mem.families,
+		hub:      mem.hub,
+	}
+}
+
+// openColumnFamilies registers the families found on disk, one per
+// subdirectory of sstDir.
+func (mem *memDB) openColumnFamilies() error {
+	dirEntries, err := os.ReadDir(storePath(mem.wal.root, sstDir))
+	if err != nil {
+		return err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || !validColumnFamilyName(dirEntry.Name()) {
+			continue
+		}
+		cf := mem.newColumnFamily(dirEntry.Name(), CFOptions{})
+		cf.options, cf.incarnation = readCFOptions(cf.dir)
+		mem.families[cf.name] = cf
+		if err := finishSSTRewrite(cf.dir); err != nil {
+			return err
+		}
+	}
+
+	// Once they are all there, as the regions are in a family too
+	for _, cf := range mem.families {
+		if cf.regionsEnabled() {
+			if err := cf.loadRegionsWithNoLock(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readCFOptions reads the OPTIONS file of a family, one key=value per line,
+// and its incarnation.
+func readCFOptions(dir string) (CFOptions, uint64) {
+	data, err := os.ReadFile(dir + "/OPTIONS")
+	if err != nil {
+		return CFOptions{}, 0
+	}
+	return parseCFOptions(data)
+}
+
+// parseCFOptions reads the options of a family as cfOptionsData writes them.
+func parseCFOptions(data []byte) (CFOptions, uint64) {
+	var options CFOptions
+	var incarnation uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "flush_threshold":
+			options.FlushThreshold, _ = strconv.Atoi(parts[1])
+		case "region_split_bytes":
+			options.RegionSplitBytes, _ = strconv.ParseInt(parts[1], 10, 64)
+		case "region_merge_bytes":
+			options.RegionMergeBytes, _ = strconv.ParseInt(parts[1], 10, 64)
+		case "compression":
+			options.Compression, _ = parseCompression(parts[1])
+		case "incarnation":
+			incarnation, _ = strconv.ParseUint(parts[1], 10, 64)
+		}
+	}
+	return options, incarnation
+}
+
+// cfOptionsData is the OPTIONS file of a family, and the value of the WAL
+// record that creates it.
+func cfOptionsData(options CFOptions, incarnation uint64) []byte {
+	data := fmt.Sprintf("flush_threshold=%d\n", options.FlushThreshold)
+	if options.RegionSplitBytes > 0 {
+		data += fmt.Sprintf("region_split_bytes=%d\nregion_merge_bytes=%d\n", options.RegionSplitBytes, options.RegionMergeBytes)
+	}
+	if len(options.Compression) > 0 {
+		data += fmt.Sprintf("compression=%s\n", strings.Join(options.Compression, ","))
+	}
+	if incarnation > 0 {
+		data += fmt.Sprintf("incarnation=%d\n", incarnation)
+	}
+	return []byte(data)
+}
+
+// CreateColumnFamily adds a named family with its own memtable and SSTs.
+func (mem *memDB) CreateColumnFamily(name string, options CFOptions) (*memDB, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if err := mem.writableWithNoLock(); err != nil {
+		return nil, err
+	}
+
+	if options.RegionSplitBytes > 0 {
+		if _, ok := mem.families[regionFamily]; !ok && name != regionFamily {
+			if _, err := mem.createColumnFamilyWithNoLock(regionFamily, CFOptions{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return mem.createColumnFamilyWithNoLock(name, options)
+}
+
+func (mem *memDB) createColumnFamilyWithNoLock(name string, options CFOptions) (*memDB, error) {
+	if !validColumnFamilyName(name) || name == regionFamily && options.RegionSplitBytes > 0 {
+		return nil, errors.New("Invalid column family name")
+	}
+	if _, err := parseCompression(strings.Join(options.Compression, ",")); err != nil {
+		return nil, err
+	}
+	if _, ok := mem.families[name]; ok {
+		return nil, errors.New("Column family already exists")
+	}
+
+	// Logged so that replicas and restores create it too, its seq telling
+	// it from the families of the same name before it
+	incarnation := mem.wal.seq + 1
+	cf, err := mem.addColumnFamilyWithNoLock(name, options, incarnation)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cf.logWAL(CreateCF, nil, cfOptionsData(options, incarnation)); err != nil {
+		delete(mem.families, name)
+		os.RemoveAll(cf.dir)
+		return nil, err
+	}
+	return cf, nil
+}
+
+// addColumnFamilyWithNoLock makes the directory of a family and registers
+// it.
+func (mem *memDB) addColumnFamilyWithNoLock(name string, options CFOptions, incarnation uint64) (*memDB, error) {
+	cf := mem.newColumnFamily(name, options)
+	cf.incarnation = incarnation
+	if err := os.Mkdir(cf.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(cf.dir+"/OPTIONS", cfOptionsData(options, incarnation), 0644); err != nil {
+		return nil, err
+	}
+	mem.families[name] = cf
+	if cf.regionsEnabled() {
+		// The regions of a family dropped under the same name are gone
+		if err := cf.loadRegionsWithNoLock(); err != nil {
+			return nil, err
+		}
+	}
+	return cf, nil
+}
+
+// applyCreateColumnFamilyWithNoLock replays the record that created a
+// family. The family is there already unless it was created on another
+// store, the primary of a replica or the one a restore comes from.
+func (mem *memDB) applyCreateColumnFamilyWithNoLock(name string, value []byte) error {
+	if _, ok := mem.families[name]; ok {
+		return nil
+	}
+	options, incarnation := parseCFOptions(value)
+	_, err := mem.addColumnFamilyWithNoLock(name, options, incarnation)
+	return err
+}
+
+// applyDropColumnFamilyWithNoLock replays the record that dropped a family,
+// if the family is still the one it dropped.
+func (mem *memDB) applyDropColumnFamilyWithNoLock(name string, value []byte) error {
+	cf, ok := mem.families[name]
+	if !ok || strconv.FormatUint(cf.incarnation, 10) != string(value) {
+		return nil
+	}
+	return mem.dropColumnFamilyWithNoLock(cf)
+}
+
+// DropColumnFamily removes a family and deletes its SSTs. Handles on it
+// fail with ErrColumnFamilyDropped from then on.
+func (mem *memDB) DropColumnFamily(name string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if err := mem.writableWithNoLock(); err != nil {
+		return err
+	}
+
+	cf, ok := mem.families[name]
+	if !ok || name == "" {
+		return ErrColumnFamilyNotFound
+	}
+
+	if _, err := cf.logWAL(DropCF, nil, []byte(strconv.FormatUint(cf.incarnation, 10))); err != nil {
+		return err
+	}
+	if err := mem.dropColumnFamilyWithNoLock(cf); err != nil {
+		return err
+	}
+	// Flush the other families so the watermark moves past every record
+	// of this one and recovery doesn't replay them
+	return mem.flushAll()
+}
+
+func (mem *memDB) dropColumnFamilyWithNoLock(cf *memDB) error {
+	if cf.regionsEnabled() {
+		if err := cf.saveRegionsWithNoLock(nil); err != nil {
+			return err
+		}
+	}
+	cf.values = orderedmap.NewOrderedMap()
+	delete(mem.families, cf.name)
+	cf.dropped = true
+	return os.RemoveAll(cf.dir)
+}
+
+// Family returns the handle of a column family, "" being the default one.
+func (mem *memDB) Family(name string) (*memDB, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if name == "default" {
+		name = ""
+	}
+	cf, ok := mem.families[name]
+	if !ok {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf, nil
+}
+
+// ColumnFamilies lists the names of the named families.
+func (mem *memDB) ColumnFamilies() []string {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	var names []string
+	for name := range mem.families {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type batchOp struct {
+	cf    string
+	op    Cmd
+	key   []byte
+	value []byte
+}
+
+// WriteBatch groups writes, possibly to several column families, that are
+// logged as a single WAL record and so applied all or nothing.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func (b *WriteBatch) Set(cf string, key, value []byte) {
+	b.ops = append(b.ops, batchOp{cf: cf, op: Set, key: key, value: value})
+}
+
+func (b *WriteBatch) Del(cf string, key []byte) {
+	b.ops = append(b.ops, batchOp{cf: cf, op: Del, key: key})
+}
+
+func (b *WriteBatch) Merge(cf string, key []byte, name string, operand []byte) {
+	b.ops = append(b.ops, batchOp{cf: cf, op: Merge, key: key, value: encodeOperand(name, operand)})
+}
+
+// Write commits a batch atomically.
+func (mem *memDB) Write(b *WriteBatch) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	return mem.WriteWithNoLock(b)
+}
+func (mem *memDB) WriteWithNoLock(b *WriteBatch) error {
+	if err := mem.writableWithNoLock(); err != nil {
+		return err
+	}
+	if len(b.ops) == 0 {
+		// A record would repeat the last seq
+		return nil
+	}
+	var records []byte
+	touched := map[string]*memDB{}
+	seq := mem.wal.seq
+	for _, o := range b.ops {
+		name := o.cf
+		if name == "default" {
+			name = ""
+		}
+		cf, ok := mem.families[name]
+		if !ok {
+			return ErrColumnFamilyNotFound
+		}
+		if o.op == Merge {
+			opName, operand, _ := decodeOperand(o.value)
+			op, ok := mergeOperators[opName]
+			if !ok {
+				return errors.New("Unknown merge operator: " + opName)
+			}
+			if err := op.Validate(operand); err != nil {
+				return err
+			}
+		}
+		touched[name] = cf
+
+		// Every write of the batch gets its own sequence number, the batch
+		// record carries the last one
+		seq++
+		op, key := walKey(name, byte(o.op), o.key)
+		records = append(records, encodeWALRecord(seq, op, key, o.value)...)
+	}
+
+	if err := writeWAL(mem.wal, seq, byte(Batch), nil, records); err != nil {
+		return err
+	}
+	mem.wal.seq = seq
+	batch := walRecord{op: byte(Batch), seq: seq, value: records}
+	mem.applyWALRecord(batch)
+	mem.publishRecord(batch)
+
+	for _, cf := range touched {
+		cf.checkSizeAndFlush()
+	}
+
+	return nil
+}
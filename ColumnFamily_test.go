@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestColumnFamilies(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+
+	users, err := db.CreateColumnFamily("users", CFOptions{FlushThreshold: 2})
+	if err != nil {
+		t.Fatalf("Error creating column family: %v", err)
+	}
+	if _, err := db.CreateColumnFamily("users", CFOptions{}); err == nil {
+		t.Fatalf("Expected an error creating the same family twice")
+	}
+
+	// The same key lives independently in each family
+	if err := db.Set([]byte("k"), []byte("default")); err != nil {
+		t.Fatalf("Error setting key: %v", err)
+	}
+	if err := users.Set([]byte("k"), []byte("users")); err != nil {
+		t.Fatalf("Error setting key: %v", err)
+	}
+	if err := users.Set([]byte("k2"), []byte("flushed")); err != nil {
+		t.Fatalf("Error setting key: %v", err)
+	}
+
+	b := &WriteBatch{}
+	b.Set("", []byte("a"), []byte("1"))
+	b.Set("users", []byte("a"), []byte("2"))
+	b.Del("users", []byte("k2"))
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	b = &WriteBatch{}
+	b.Set("", []byte("x"), []byte("1"))
+	b.Set("nope", []byte("x"), []byte("1"))
+	if err := db.Write(b); err != ErrColumnFamilyNotFound {
+		t.Fatalf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+	seq, records := db.wal.seq, metrics.walRecords.value()
+	if err := db.Write(&WriteBatch{}); err != nil || db.wal.seq != seq || metrics.walRecords.value() != records {
+		t.Fatalf("Expected an empty batch to write nothing, got seq %d after %d (%v)", db.wal.seq, seq, err)
+	}
+
+	// Reopen and replay the WAL
+	db.wal.file.Close()
+	repl, err = NewInMem()
+	if err != nil {
+		t.Fatalf("Error reopening database: %v", err)
+	}
+	db = repl.handler.(*memDB)
+	if err := recoverFromWAL(db); err != nil {
+		t.Fatalf("Error recovering from WAL: %v", err)
+	}
+	users, err = db.Family("users")
+	if err != nil {
+		t.Fatalf("Expected the family to survive a restart: %v", err)
+	}
+	if users.flushThreshold() != 2 {
+		t.Fatalf("Expected the family options to survive a restart")
+	}
+
+	for _, c := range []struct {
+		cf       *memDB
+		key      string
+		expected string
+	}{{db, "k", "default"}, {users, "k", "users"}, {db, "a", "1"}, {users, "a", "2"}} {
+		v, err := c.cf.Get([]byte(c.key))
+		if err != nil || string(v) != c.expected {
+			t.Fatalf("Expected %s in %q to be %s, got %s (%v)", c.key, c.cf.name, c.expected, v, err)
+		}
+	}
+	if _, err := users.Get([]byte("k2")); err == nil {
+		t.Fatalf("Expected k2 to be deleted by the batch")
+	}
+	if _, err := db.Get([]byte("x")); err == nil {
+		t.Fatalf("Expected the failed batch to write nothing")
+	}
+
+	if err := db.DropColumnFamily("users"); err != nil {
+		t.Fatalf("Error dropping column family: %v", err)
+	}
+	if _, err := os.Stat(sstDir + "/users"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the family's files to be removed")
+	}
+	if _, err := users.Get([]byte("k")); err != ErrColumnFamilyDropped {
+		t.Fatalf("Expected ErrColumnFamilyDropped, got %v", err)
+	}
+	if v, err := db.Get([]byte("k")); err != nil || string(v) != "default" {
+		t.Fatalf("Expected the default family to be untouched, got %s (%v)", v, err)
+	}
+}
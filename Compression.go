@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var ErrBadBlock = errors.New("Bad compressed block")
+
+const (
+	codecNone byte = iota
+	codecFlate
+	codecSnappy
+)
+
+// compressBlockSize is the most an SST block holds before compression.
+const compressBlockSize = 32 << 10
+
+// blockMagic starts the stream of a compressed SST, before any encryption.
+// The SST itself follows in blocks, each the id of its codec, the size of
+// its data before and after compression, then the data. A block that
+// doesn't get smaller is stored as is, under codecNone.
+var blockMagic = []byte("\xfeKVBLK01")
+
+// sstCompression is the codec of each level for families that don't set
+// their own, from -compression. None by default.
+var sstCompression []string
+
+// blockCodec compresses the blocks of an SST.
+type blockCodec struct {
+	name       string
+	compress   func(src []byte) ([]byte, error)
+	decompress func(src []byte, size int) ([]byte, error)
+}
+
+// blockCodecs are the codecs by the id written in block headers.
+var blockCodecs = map[byte]blockCodec{
+	codecNone:   {"none", nil, nil},
+	codecFlate:  {"flate", flateCompress, flateDecompress},
+	codecSnappy: {"snappy", snappyEncode, snappyDecode},
+}
+
+func codecByName(name string) (byte, error) {
+	for id, codec := range blockCodecs {
+		if codec.name == name {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown compression %q, expected none, flate or snappy", name)
+}
+
+// parseCompression reads a list of codecs, one per level, like
+// none,snappy,flate.
+func parseCompression(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	names := strings.Split(list, ",")
+	for _, name := range names {
+		if _, err := codecByName(name); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// codecForLevel returns the codec SSTs of a level are written with. There
+// are no levels as such: SSTs written by flushes are level 0 and the ones
+// rewritten by region compaction level 1. The last codec given applies to
+// the levels after it.
+func (mem *memDB) codecForLevel(level int) byte {
+	names := mem.options.Compression
+	if len(names) == 0 {
+		names = sstCompression
+	}
+	if len(names) == 0 {
+		return codecNone
+	}
+	if level >= len(names) {
+		level = len(names) - 1
+	}
+	id, err := codecByName(names[level])
+	if err != nil {
+		return codecNone
+	}
+	return id
+}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+func flateCompress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func flateDecompress(src []byte, size int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	out := make([]byte, size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return nil, errors.New("Data after the end of the block")
+	}
+	return out, nil
+}
+
+// snappyEncode compresses src in the snappy block format: its length as a
+// varint, then literals and copies of earlier bytes. Blocks are small, so
+// copies never need the 4-byte offsets. TestSnappyVectors holds it to blocks
+// of the reference implementation.
+func snappyEncode(src []byte) ([]byte, error) {
+	dst := make([]byte, binary.MaxVarintLen64, len(src)/2+16)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	var table [1 << 14]int32
+	literal, i := 0, 0
+	for i+4 <= len(src) {
+		word := binary.LittleEndian.Uint32(src[i:])
+		h := (word * 0x1e35a7bd) >> 18
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > 65535 || binary.LittleEndian.Uint32(src[candidate:]) != word {
+			i++
+			continue
+		}
+		dst = snappyLiteral(dst, src[literal:i])
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return snappyLiteral(dst, src[literal:]), nil
+}
+
+func snappyLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	default:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return append(dst, literal...)
+}
+
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		if n >= 4 && n <= 11 && offset < 2048 {
+			dst = append(dst, byte(1|(n-4)<<2|(offset>>8)<<5), byte(offset))
+		} else {
+			dst = append(dst, byte(2|(n-1)<<2), byte(offset), byte(offset>>8))
+		}
+		length -= n
+	}
+	return dst
+}
+
+var errSnappy = errors.New("Corrupt snappy data")
+
+func snappyDecode(src []byte, size int) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length != uint64(size) {
+		return nil, errSnappy
+	}
+	src = src[n:]
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		tag := src[0]
+		if tag&3 == 0 {
+			n := int(tag >> 2)
+			src = src[1:]
+			if n >= 60 {
+				extra := n - 59
+				if len(src) < extra {
+					return nil, errSnappy
+				}
+				n = 0
+				for i := 0; i < extra; i++ {
+					n |= int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			n++
+			if len(src) < n || len(dst)+n > size {
+				return nil, errSnappy
+			}
+			dst = append(dst, src[:n]...)
+			src = src[n:]
+			continue
+		}
+
+		var n, offset int
+		switch tag & 3 {
+		case 1:
+			if len(src) < 2 {
+				return nil, errSnappy
+			}
+			n = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errSnappy
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		default:
+			if len(src) < 5 {
+				return nil, errSnappy
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset == 0 || offset > len(dst) || len(dst)+n > size {
+			return nil, errSnappy
+		}
+		// Byte by byte, as a copy can overlap what it writes
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != size {
+		return nil, errSnappy
+	}
+	return dst, nil
+}
+
+// blockWriter compresses what is written to it in blocks.
+type blockWriter struct {
+	w     io.Writer
+	codec byte
+	buf   []byte
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := compressBlockSize - len(bw.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		bw.buf = append(bw.buf, p[:room]...)
+		p = p[room:]
+		if len(bw.buf) == compressBlockSize {
+			if err := bw.writeBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last block. It doesn't close the underlying writer.
+func (bw *blockWriter) Close() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+	return bw.writeBlock()
+}
+
+func (bw *blockWriter) writeBlock() error {
+	codec, stored := bw.codec, bw.buf
+	if compress := blockCodecs[codec].compress; compress != nil {
+		compressed, err := compress(bw.buf)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(bw.buf) {
+			stored = compressed
+		} else {
+			codec = codecNone
+		}
+	}
+	header := make([]byte, 9)
+	header[0] = codec
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(bw.buf)))
+	binary.LittleEndian.PutUint32(header[5:], uint32(len(stored)))
+	if _, err := bw.w.Write(header); err != nil {
+		return err
+	}
+	_, err := bw.w.Write(stored)
+	bw.buf = bw.buf[:0]
+	return err
+}
+
+// blockReader reads back what a blockWriter wrote.
+type blockReader struct {
+	r     io.Reader
+	name  string
+	buf   []byte
+	index int
+}
+
+// readBlockHeader reads the header of the next block: its codec, and its
+// size before and after compression. It returns io.EOF after the last one.
+func readBlockHeader(r io.Reader, name string, index int) (blockCodec, int, int, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return blockCodec{}, 0, 0, io.EOF
+		}
+		return blockCodec{}, 0, 0, io.ErrUnexpectedEOF
+	}
+	codec, ok := blockCodecs[header[0]]
+	if !ok {
+		return codec, 0, 0, fmt.Errorf("%w: unknown codec %d in block %d of %s", ErrBadBlock, header[0], index, name)
+	}
+	size := int(binary.LittleEndian.Uint32(header[1:]))
+	stored := int(binary.LittleEndian.Uint32(header[5:]))
+	if size > compressBlockSize || stored > size || (codec.decompress == nil && stored != size) {
+		return codec, 0, 0, fmt.Errorf("%w: bad sizes in block %d of %s", ErrBadBlock, index, name)
+	}
+	return codec, size, stored, nil
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.buf) == 0 {
+		codec, size, stored, err := readBlockHeader(br.r, br.name, br.index)
+		if err != nil {
+			return 0, err
+		}
+		data := make([]byte, stored)
+		if _, err := io.ReadFull(br.r, data); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if codec.decompress != nil {
+			if data, err = codec.decompress(data, size); err != nil {
+				return 0, fmt.Errorf("%w: block %d of %s: %v", ErrBadBlock, br.index, br.name, err)
+			}
+		}
+		metrics.sstBlocks.add(1)
+		metrics.sstRead.add(stored)
+		metrics.sstRaw.add(size)
+		br.buf = data
+		br.index++
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return n, nil
+}
+
+// decompressReader returns the reader of the SST in a stream, which is r
+// itself for an SST that isn't compressed.
+func decompressReader(r *bufio.Reader, name string) *bufio.Reader {
+	if magic, err := r.Peek(len(blockMagic)); err != nil || !bytes.Equal(magic, blockMagic) {
+		return r
+	}
+	r.Discard(len(blockMagic))
+	return bufio.NewReader(&blockReader{r: r, name: name})
+}
+
+// CompressionStats are the sizes of SST blocks before and after
+// compression. Files that aren't compressed count as one block.
+type CompressionStats struct {
+	Blocks      int64   `json:"blocks"`
+	RawBytes    int64   `json:"raw_bytes"`
+	StoredBytes int64   `json:"stored_bytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+func (s *CompressionStats) add(blocks, raw, stored int64) {
+	s.Blocks += blocks
+	s.RawBytes += raw
+	s.StoredBytes += stored
+	if s.StoredBytes > 0 {
+		s.Ratio = float64(s.RawBytes) / float64(s.StoredBytes)
+	}
+}
+
+// FamilyStats are the compression stats of the SSTs of a family, in all
+// and by codec.
+type FamilyStats struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	CompressionStats
+	Codecs map[string]*CompressionStats `json:"codecs"`
+}
+
+// CompressionStats reads the block headers of the SSTs of the family.
+func (mem *memDB) CompressionStats() (*FamilyStats, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.dropped {
+		return nil, ErrColumnFamilyDropped
+	}
+
+	name := mem.name
+	if name == "" {
+		name = "default"
+	}
+	stats := &FamilyStats{Name: name, Codecs: map[string]*CompressionStats{}}
+	count, err := countSSTFiles(mem.dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i <= count; i++ {
+		if err := addSSTStats(stats, fmt.Sprintf("%s/sst%d.txt", mem.dir, i)); err != nil {
+			return nil, err
+		}
+		stats.Files++
+	}
+	return stats, nil
+}
+
+func addSSTStats(stats *FamilyStats, name string) error {
+	file, r, err := openSSTStream(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	codecStats := func(name string) *CompressionStats {
+		if stats.Codecs[name] == nil {
+			stats.Codecs[name] = &CompressionStats{}
+		}
+		return stats.Codecs[name]
+	}
+
+	if magic, err := r.Peek(len(blockMagic)); err != nil || !bytes.Equal(magic, blockMagic) {
+		size, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return err
+		}
+		codecStats("none").add(1, size, size)
+		stats.add(1, size, size)
+		return nil
+	}
+	r.Discard(len(blockMagic))
+	for i := 0; ; i++ {
+		codec, size, stored, err := readBlockHeader(r, name, i)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := r.Discard(stored); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		codecStats(codec.name).add(1, int64(size), int64(stored))
+		stats.add(1, int64(size), int64(stored))
+	}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWrongKey     = errors.New("Wrong encryption key")
+	ErrMissingKey   = errors.New("Encryption key not found")
+	ErrNoKeyfile    = errors.New("File is encrypted and no keyfile was given")
+	ErrCorruptBlock = errors.New("Encrypted data failed authentication")
+)
+
+// KeyProvider gives out the master keys that wrap the data key of each
+// encrypted file. New files are written under the current key; the others
+// are kept to read files written before a rotation.
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+// encryption is the key provider of the process, nil to write files in the
+// clear. Files written in the clear can always be read.
+var encryption KeyProvider
+
+// SetKeyProvider sets the master keys files are written and read with, nil
+// to stop encrypting new files.
+func SetKeyProvider(p KeyProvider) {
+	encryption = p
+	fileKeys.mu.Lock()
+	fileKeys.keys = nil
+	fileKeys.mu.Unlock()
+}
+
+// useKeyfile loads the -keyfile of a command, if it was given.
+func useKeyfile(path string) error {
+	if path == "" {
+		return nil
+	}
+	p, err := LoadKeyfile(path)
+	if err != nil {
+		return err
+	}
+	SetKeyProvider(p)
+	return nil
+}
+
+const (
+	// encryptionKeySize is the size of master and data keys, for AES-256.
+	encryptionKeySize = 32
+	nonceSize         = 12
+	// sealedBlockSize is the most plaintext an SST block holds.
+	sealedBlockSize = 64 << 10
+	// walSealed is the op byte of an encrypted WAL record.
+	walSealed = 0xFE
+)
+
+// sealedMagic starts an encrypted SST. The first 4 bytes of a plain SST
+// are its entry count, which would have to be over a billion to match.
+var sealedMagic = []byte("\xfeKVSEAL1")
+
+// keyfileProvider reads its keys from a file with one key per line, an id
+// and 32 bytes in hex. The last key is the current one, so a key is rotated
+// by adding a line and running kvctl rotate-key.
+type keyfileProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func LoadKeyfile(path string) (KeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &keyfileProvider{keys: map[string][]byte{}}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return nil, fmt.Errorf("Invalid keyfile line %d: expected an id and a key", n+1)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("Invalid keyfile line %d: the key must be %d bytes in hex", n+1, encryptionKeySize)
+		}
+		p.keys[fields[0]] = key
+		p.current = fields[0]
+	}
+	if p.current == "" {
+		return nil, fmt.Errorf("No keys in keyfile %s", path)
+	}
+	return p, nil
+}
+
+func (p *keyfileProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *keyfileProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrMissingKey, id)
+	}
+	return key, nil
+}
+
+// newKeyfileLine returns a line for a keyfile with a new random key.
+func newKeyfileLine(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, " \t\n") || len(id) > 255 {
+		return "", fmt.Errorf("Invalid key id %q", id)
+	}
+	key, err := randomBytes(encryptionKeySize)
+	if err != nil {
+		return "", err
+	}
+	return id + " " + hex.EncodeToString(key), nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, buf)
+	return buf, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fileKey is the data key of one file, and its wrapped form that is stored
+// in the file: the id of the master key, a nonce and the sealed data key.
+type fileKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+}
+
+func newFileKey() (*fileKey, error) {
+	id, master, err := encryption.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	key, err := randomBytes(encryptionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := append([]byte{byte(len(id))}, id...)
+	wrapped = append(wrapped, nonce...)
+	wrapped = wrap.Seal(wrapped, nonce, key, []byte(id))
+	return &fileKey{aead: aead, wrapped: wrapped}, nil
+}
+
+// fileKeys caches unwrapped data keys by their wrapped form, as every WAL
+// record carries the key of its file.
+var fileKeys struct {
+	mu   sync.Mutex
+	keys map[string]cipher.AEAD
+}
+
+// readFileKey reads a wrapped data key and unwraps it.
+func readFileKey(r io.Reader) (cipher.AEAD, error) {
+	idLen := make([]byte, 1)
+	if _, err := io.ReadFull(r, idLen); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rest := make([]byte, int(idLen[0])+nonceSize+encryptionKeySize+16)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	wrapped := append(idLen, rest...)
+
+	fileKeys.mu.Lock()
+	aead, ok := fileKeys.keys[string(wrapped)]
+	fileKeys.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	id := string(rest[:idLen[0]])
+	nonce := rest[idLen[0] : int(idLen[0])+nonceSize]
+	if encryption == nil {
+		return nil, fmt.Errorf("%w (key %q)", ErrNoKeyfile, id)
+	}
+	master, err := encryption.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wrap.Open(nil, nonce, rest[int(idLen[0])+nonceSize:], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q does not open the data key", ErrWrongKey, id)
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+
+	fileKeys.mu.Lock()
+	if len(fileKeys.keys) >= 4096 || fileKeys.keys == nil {
+		fileKeys.keys = map[string]cipher.AEAD{}
+	}
+	fileKeys.keys[string(wrapped)] = aead
+	fileKeys.mu.Unlock()
+	return aead, nil
+}
+
+// sealRecord encrypts an encoded WAL record as the walSealed op byte, the
+// length of the rest, the wrapped key of the file, a nonce and the sealed
+// record. Each record stands alone, so a torn one is found like a plain one.
+// A nil key leaves the record in the clear.
+func (k *fileKey) sealRecord(record []byte) ([]byte, error) {
+	if k == nil {
+		return record, nil
+	}
+	nonce, err := randomBytes(nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	length := len(k.wrapped) + nonceSize + len(record) + k.aead.Overhead()
+	out := make([]byte, 5, 5+length)
+	out[0] = walSealed
+	binary.LittleEndian.PutUint32(out[1:], uint32(length))
+	out = append(out, k.wrapped...)
+	out = append(out, nonce...)
+	return k.aead.Seal(out, nonce, record, nil), nil
+}
+
+// openWALRecord reads the rest of a record sealed by sealRecord, once its
+// op byte was read.
+func openWALRecord(r io.Reader) (walRecord, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	if remaining, ok := r.(interface{ Len() int }); ok && int64(length) > int64(remaining.Len()) {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+
+	sr := bytes.NewReader(sealed)
+	aead, err := readFileKey(sr)
+	if err == io.ErrUnexpectedEOF {
+		return walRecord{}, fmt.Errorf("%w: WAL record too short for its key", ErrCorruptBlock)
+	}
+	if err != nil {
+		return walRecord{}, fmt.Errorf("Cannot decrypt WAL record: %w", err)
+	}
+	rest := sealed[len(sealed)-sr.Len():]
+	if len(rest) < nonceSize {
+		return walRecord{}, fmt.Errorf("%w: WAL record too short for its nonce", ErrCorruptBlock)
+	}
+	plain, err := aead.Open(nil, rest[:nonceSize], rest[nonceSize:], nil)
+	if err != nil {
+		return walRecord{}, fmt.Errorf("%w: WAL record", ErrCorruptBlock)
+	}
+
+	rec, err := readWALRecord(bytes.NewReader(plain))
+	if err != nil || rec.op == walSealed {
+		return walRecord{}, fmt.Errorf("%w: bad record inside a WAL record", ErrCorruptBlock)
+	}
+	rec.sealed = int64(5 + length)
+	return rec, nil
+}
+
+// sealedWriter encrypts what is written to it in blocks, each its length,
+// a nonce and the sealed plaintext. The plaintext of a block starts with a
+// byte set on the last one, and its index is authenticated with it, so
+// blocks can't be dropped, reordered or cut off at the end unnoticed.
+type sealedWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+func (sw *sealedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := sealedBlockSize - len(sw.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		sw.buf = append(sw.buf, p[:room]...)
+		p = p[room:]
+		if len(sw.buf) == sealedBlockSize {
+			if err := sw.writeBlock(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last block. It doesn't close the underlying writer.
+func (sw *sealedWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	return sw.writeBlock(true)
+}
+
+func (sw *sealedWriter) writeBlock(last bool) error {
+	plain := append([]byte{0}, sw.buf...)
+	if last {
+		plain[0] = 1
+	}
+	nonce, err := randomBytes(nonceSize)
+	if err != nil {
+		return err
+	}
+	block := make([]byte, 4, 4+nonceSize+len(plain)+sw.aead.Overhead())
+	binary.LittleEndian.PutUint32(block, uint32(nonceSize+len(plain)+sw.aead.Overhead()))
+	block = append(block, nonce...)
+	block = sw.aead.Seal(block, nonce, plain, blockIndex(sw.index))
+	sw.index++
+	sw.buf = sw.buf[:0]
+	_, err = sw.w.Write(block)
+	return err
+}
+
+func blockIndex(i uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, i)
+	return buf
+}
+
+// sealedReader reads back what a sealedWriter wrote.
+type sealedReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	name  string
+	buf   []byte
+	index uint64
+	done  bool
+}
+
+func (sr *sealedReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		if err := sr.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+func (sr *sealedReader) readBlock() error {
+	var length uint32
+	if err := binary.Read(sr.r, binary.LittleEndian, &length); err != nil {
+		// The last block is missing
+		return fmt.Errorf("%w: %s is cut short", ErrCorruptBlock, sr.name)
+	}
+	overhead := nonceSize + 1 + sr.aead.Overhead()
+	if int(length) < overhead || int(length) > overhead+sealedBlockSize {
+		return fmt.Errorf("%w: bad length of block %d of %s", ErrCorruptBlock, sr.index, sr.name)
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(sr.r, block); err != nil {
+		return fmt.Errorf("%w: %s is cut short", ErrCorruptBlock, sr.name)
+	}
+	plain, err := sr.aead.Open(nil, block[:nonceSize], block[nonceSize:], blockIndex(sr.index))
+	if err != nil {
+		return fmt.Errorf("%w: block %d of %s", ErrCorruptBlock, sr.index, sr.name)
+	}
+	sr.index++
+	sr.done = plain[0] == 1
+	sr.buf = plain[1:]
+	return nil
+}
+
+// openSST opens an SST for reading, decrypting and decompressing it if it
+// was written so.
+func openSST(name string) (*os.File, *bufio.Reader, error) {
+	file, reader, err := openSSTStream(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics.sstOpens.add(1)
+	return file, decompressReader(reader, name), nil
+}
+
+// openSSTStream opens an SST and decrypts it, leaving it compressed.
+func openSSTStream(name string) (*os.File, *bufio.Reader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(file)
+	plain, err := unsealReader(reader, name)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if plain != io.Reader(reader) {
+		reader = bufio.NewReader(plain)
+	}
+	return file, reader, nil
+}
+
+// unsealReader returns the reader of the plaintext of a file, which is r
+// itself for a file written in the clear.
+func unsealReader(r *bufio.Reader, name string) (io.Reader, error) {
+	if !isSealed(r) {
+		return r, nil
+	}
+	r.Discard(len(sealedMagic))
+	aead, err := readFileKey(r)
+	if err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: %s is too short for its key", ErrCorruptBlock, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt %s: %w", name, err)
+	}
+	return &sealedReader{r: r, aead: aead, name: name}, nil
+}
+
+func isSealed(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(sealedMagic))
+	return err == nil && bytes.Equal(magic, sealedMagic)
+}
+
+// isDamaged tells a damaged file from one that can't be read for a missing
+// or wrong key, which repair must leave alone.
+func isDamaged(err error) bool {
+	return err == io.ErrUnexpectedEOF || errors.Is(err, ErrCorruptBlock) || errors.Is(err, ErrBadBlock)
+}
+
+// readSSTData reads the plaintext of a whole SST. With a damaged block it
+// returns what came before it and the error.
+func readSSTData(name string) ([]byte, error) {
+	file, reader, err := openSST(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(reader)
+}
+
+// sstFileWriter writes an SST, compressed with its codec and then encrypted
+// when a key provider is set.
+type sstFileWriter struct {
+	file     *os.File
+	buf      *bufio.Writer
+	sealed   *sealedWriter
+	blocks   *blockWriter
+	finished bool
+}
+
+func createSST(name string, codec byte) (*sstFileWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &sstFileWriter{file: file, buf: bufio.NewWriter(file)}
+	if encryption != nil {
+		key, err := newFileKey()
+		if err != nil {
+			file.Close()
+			os.Remove(name)
+			return nil, err
+		}
+		f.buf.Write(sealedMagic)
+		f.buf.Write(key.wrapped)
+		f.sealed = &sealedWriter{w: f.buf, aead: key.aead}
+	}
+	if codec != codecNone {
+		f.blocks = &blockWriter{w: f.stream(), codec: codec}
+		f.stream().Write(blockMagic)
+	}
+	return f, nil
+}
+
+// stream is what the compressed stream is written to.
+func (f *sstFileWriter) stream() io.Writer {
+	if f.sealed != nil {
+		return f.sealed
+	}
+	return f.buf
+}
+
+func (f *sstFileWriter) Write(p []byte) (int, error) {
+	if f.blocks != nil {
+		return f.blocks.Write(p)
+	}
+	if f.sealed != nil {
+		return f.sealed.Write(p)
+	}
+	return f.buf.Write(p)
+}
+
+// finish writes out everything, the last block of an encrypted file too.
+// Nothing can be written after it.
+func (f *sstFileWriter) finish() error {
+	if f.finished {
+		return nil
+	}
+	f.finished = true
+	if f.blocks != nil {
+		if err := f.blocks.Close(); err != nil {
+			return err
+		}
+	}
+	if f.sealed != nil {
+		if err := f.sealed.Close(); err != nil {
+			return err
+		}
+	}
+	return f.buf.Flush()
+}
+
+// Sync finishes the file and syncs it to disk.
+func (f *sstFileWriter) Sync() error {
+	if err := f.finish(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Close finishes the file and closes it. It can be called again, to close
+// on every path.
+func (f *sstFileWriter) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.finish()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	f.file = nil
+	return err
+}
+
+// copySST copies an SST, encrypting it on the way when a key provider is
+// set and it was written in the clear. Otherwise it is linked or copied.
+func copySST(src, dst string) error {
+	if encryption == nil {
+		return linkOrCopy(src, dst)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	if isSealed(reader) {
+		return linkOrCopy(src, dst)
+	}
+	out, err := createSST(dst, codecNone)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// RotationReport is what RotateStoreKey rewrote.
+type RotationReport struct {
+	Key  string   `json:"key"`
+	SSTs int      `json:"ssts"`
+	WALs []string `json:"wals"`
+}
+
+// RotateStoreKey rewrites every SST and WAL file of the store in the current
+// directory, which must not be open, under a new data key wrapped by the
+// current master key. Files written in the clear are encrypted. Each file is
+// replaced whole, so a rotation cut short can be run again; the old master
+// key can be dropped from the keyfile once one has finished. The MANIFEST,
+// if there is one, is rebuilt, and byte offsets of the live WAL change.
+func RotateStoreKey() (*RotationReport, error) {
+	if encryption == nil {
+		return nil, errors.New("A keyfile is needed to rotate keys")
+	}
+	id, _, err := encryption.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	report := &RotationReport{Key: id}
+
+	files, err := storeFiles("")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		if !strings.HasPrefix(filepath.Base(path), "sst") {
+			continue
+		}
+		if err := rewriteSST(path); err != nil {
+			return nil, err
+		}
+		report.SSTs++
+	}
+
+	wals := []string{"wal.txt"}
+	segments, err := walSegments("")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, segment := range segments {
+		wals = append(wals, segment.path)
+	}
+	if walArchiveDir != "" {
+		archived, err := filepath.Glob(walArchiveDir + "/wal*.txt")
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(archived)
+		wals = append(wals, archived...)
+	}
+	for _, path := range wals {
+		if err := rewriteWAL(path, path == "wal.txt"); err != nil {
+			return nil, err
+		}
+		report.WALs = append(report.WALs, path)
+	}
+
+	if _, err := os.Stat("MANIFEST"); err == nil {
+		if _, err := rebuildManifest(); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// rewriteSST writes an SST again under a new data key, compressed as it
+// was.
+func rewriteSST(path string) error {
+	file, reader, err := openSSTStream(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tmp := path + ".rotate"
+	out, err := createSST(tmp, codecNone)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("Cannot rotate %s: %w", path, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// rewriteWAL writes a WAL file again with its records encrypted under a new
+// data key. The watermark of the live WAL is moved to the same record, and
+// a torn record at its end is dropped as recovery would.
+func rewriteWAL(path string, live bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	watermark, base, err := readWALHeader(file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(walHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	key, err := newFileKey()
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	reader := bufio.NewReader(file)
+	offset := int64(walHeaderSize)
+	newWatermark := watermark
+	for {
+		if watermark > walHeaderSize && offset == watermark {
+			newWatermark = int64(walHeaderSize + out.Len())
+		}
+		rec, err := readWALRecord(reader)
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && live) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot rotate %s at offset %d: %w", path, offset, err)
+		}
+		sealed, err := key.sealRecord(rec.encode())
+		if err != nil {
+			return err
+		}
+		out.Write(sealed)
+		offset += rec.size()
+	}
+	if watermark > offset {
+		newWatermark = int64(walHeaderSize + out.Len())
+	}
+
+	tmp := path + ".rotate"
+	rotated, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeWALHeader(rotated, newWatermark, base)
+	if err == nil {
+		_, err = rotated.WriteAt(out.Bytes(), walHeaderSize)
+	}
+	if err == nil {
+		start := time.Now()
+		err = rotated.Sync()
+		metrics.walFsync.since(start)
+	}
+	if cerr := rotated.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
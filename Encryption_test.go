@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T, id string) string {
+	t.Helper()
+	line, err := newKeyfileLine(id)
+	if err != nil {
+		t.Fatalf("Error making key %s: %v", id, err)
+	}
+	return line
+}
+
+// useKeys writes a keyfile with the given lines and sets it as the key
+// provider, the last line being the current key.
+func useKeys(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("Error writing keyfile: %v", err)
+	}
+	if err := useKeyfile(path); err != nil {
+		t.Fatalf("Error loading keyfile: %v", err)
+	}
+	t.Cleanup(func() { SetKeyProvider(nil) })
+}
+
+// plaintextFiles lists the files of the store in the current directory
+// that hold the secret in the clear.
+func plaintextFiles(t *testing.T, secret string) []string {
+	t.Helper()
+	var found []string
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte(secret)) {
+			found = append(found, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error reading the store: %v", err)
+	}
+	return found
+}
+
+func openTestStore(t *testing.T) *memDB {
+	t.Helper()
+	db, err := OpenStore("")
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	return db
+}
+
+func checkSecrets(t *testing.T, db *memDB, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil || string(value) != fmt.Sprintf("secret-%d", i) {
+			t.Fatalf("Expected key%d = secret-%d, got %q (%v)", i, i, value, err)
+		}
+	}
+}
+
+func TestEncryptionRotation(t *testing.T) {
+	useTempDir(t)
+	keyfile := filepath.Join(t.TempDir(), "keys")
+
+	// Written in the clear, then under a key: both are readable
+	db := openTestStore(t)
+	for i := 0; i < 10; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("secret-%d", i)))
+	}
+	if err := db.flushAll(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	db.wal.file.Close()
+	clear := map[string]bool{}
+	for _, path := range plaintextFiles(t, "secret-") {
+		clear[path] = true
+	}
+	if len(clear) == 0 {
+		t.Fatal("Expected the files written without a key to be in the clear")
+	}
+
+	k1 := newKey(t, "k1")
+	useKeys(t, keyfile, k1)
+	db = openTestStore(t)
+	for i := 10; i < 30; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("secret-%d", i)))
+		if i == 20 {
+			if err := db.flushAll(); err != nil {
+				t.Fatalf("Error flushing: %v", err)
+			}
+		}
+	}
+	sw, err := NewSSTWriter(filepath.Join(t.TempDir(), "ingest.sst"))
+	if err != nil {
+		t.Fatalf("Error creating SST writer: %v", err)
+	}
+	sw.Put([]byte("key30"), []byte("secret-30"))
+	if err := sw.Finish(); err != nil {
+		t.Fatalf("Error writing SST: %v", err)
+	}
+	if _, err := db.IngestExternalFiles([]string{sw.path}); err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	checkSecrets(t, db, 31)
+	db.wal.file.Close()
+
+	for _, path := range plaintextFiles(t, "secret-") {
+		if !clear[path] {
+			t.Fatalf("Expected %s to be encrypted", path)
+		}
+	}
+
+	// Rotating encrypts what was in the clear
+	report, err := RotateStoreKey()
+	if err != nil {
+		t.Fatalf("Error rotating: %v", err)
+	}
+	if report.Key != "k1" || report.SSTs < 3 {
+		t.Fatalf("Unexpected rotation: %+v", report)
+	}
+	if found := plaintextFiles(t, "secret-"); len(found) > 0 {
+		t.Fatalf("Expected every file to be encrypted, %v are not", found)
+	}
+
+	// Then to a new key, after which the old one isn't needed
+	k2 := newKey(t, "k2")
+	useKeys(t, keyfile, k1, k2)
+	if _, err := RotateStoreKey(); err != nil {
+		t.Fatalf("Error rotating to k2: %v", err)
+	}
+	useKeys(t, keyfile, k2)
+	if found, err := VerifyStore(); err != nil || len(found) > 0 {
+		t.Fatalf("Expected a clean store, got %v (%v)", found, err)
+	}
+	db = openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	checkSecrets(t, db, 31)
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	useTempDir(t)
+	keyfile := filepath.Join(t.TempDir(), "keys")
+	useKeys(t, keyfile, newKey(t, "k1"))
+
+	db := openTestStore(t)
+	for i := 0; i < 5; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("secret-%d", i)))
+	}
+	if err := db.flushAll(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	db.Set([]byte("key5"), []byte("secret-5"))
+	db.wal.file.Close()
+
+	// The same id with another key
+	useKeys(t, keyfile, newKey(t, "k1"))
+	if _, err := OpenStore(""); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Expected opening with the wrong key to fail, got %v", err)
+	}
+	if _, err := GetFromSST(sstDir, []byte("key1")); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Expected reading an SST with the wrong key to fail, got %v", err)
+	}
+	// Repair must not take it for damage
+	if _, err := VerifyStore(); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Expected verify to fail on the key, got %v", err)
+	}
+
+	useKeys(t, keyfile, newKey(t, "k2"))
+	if _, err := OpenStore(""); !errors.Is(err, ErrMissingKey) {
+		t.Fatalf("Expected opening without the key to fail, got %v", err)
+	}
+	SetKeyProvider(nil)
+	if _, err := OpenStore(""); !errors.Is(err, ErrNoKeyfile) {
+		t.Fatalf("Expected opening without a keyfile to fail, got %v", err)
+	}
+}
+
+func TestSealedSSTDamage(t *testing.T) {
+	useTempDir(t)
+	useKeys(t, filepath.Join(t.TempDir(), "keys"), newKey(t, "k1"))
+
+	// Big enough for several blocks
+	var entries []sstEntry
+	for i := 0; i < 5000; i++ {
+		entries = append(entries, sstEntry{byte(set), []byte(fmt.Sprintf("key%05d", i)), bytes.Repeat([]byte("v"), 40)})
+	}
+	path := filepath.Join(sstDir, "sst1.txt")
+	if err := writeSSTFile(path, entries, codecNone); err != nil {
+		t.Fatalf("Error writing SST: %v", err)
+	}
+	if problems, err := verifySST(path); err != nil || len(problems) > 0 {
+		t.Fatalf("Expected a clean SST, got %v (%v)", problems, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damage := func(name string, damaged []byte) []Corruption {
+		t.Helper()
+		if err := os.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		problems, err := verifySST(path)
+		if err != nil || len(problems) == 0 || !strings.Contains(problems[0].Problem, "encrypted") {
+			t.Fatalf("Expected %s to be found, got %v (%v)", name, problems, err)
+		}
+		return problems
+	}
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 1
+	damage("a flipped bit", flipped)
+	// Cut at a block boundary would otherwise look like a whole file
+	damage("a cut", data[:len(data)-200])
+
+	// Salvage keeps the blocks before the damage, under the key
+	if err := os.WriteFile(path, flipped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	kept, _, err := salvageSST(path)
+	if err != nil || kept == 0 || kept >= len(entries) {
+		t.Fatalf("Expected some entries salvaged, kept %d (%v)", kept, err)
+	}
+	if problems, err := verifySST(path); err != nil || len(problems) > 0 {
+		t.Fatalf("Expected the salvaged SST to be clean, got %v (%v)", problems, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// expiryFamily holds the deadline of the keys of the default family that
+// were given one through the Redis or memcached listeners, in Unix
+// milliseconds. The listeners check it on every read and delete a key they
+// find expired; sweepExpired catches the ones nobody reads, so the HTTP API
+// and the REPL stop seeing them too.
+const expiryFamily = "_expiry"
+
+// ensureExpiryFamily creates the expiry family if the store doesn't have it.
+// A replica gets it from its primary, keys have no deadline until then.
+func (mem *memDB) ensureExpiryFamily() error {
+	if _, err := mem.Family(expiryFamily); err == nil {
+		return nil
+	}
+	_, err := mem.CreateColumnFamily(expiryFamily, CFOptions{})
+	if err == ErrReadOnlyReplica {
+		return nil
+	}
+	return err
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// expiryWithNoLock returns the deadline of key, if it has one.
+func (mem *memDB) expiryWithNoLock(key []byte) (time.Time, bool) {
+	expiries, ok := mem.families[expiryFamily]
+	if !ok {
+		return time.Time{}, false
+	}
+	value, err := expiries.GetWithNoLock(key)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// liveWithNoLock gets key from the default family, deleting it instead if
+// it has expired.
+func (mem *memDB) liveWithNoLock(key []byte) ([]byte, bool) {
+	if deadline, ok := mem.expiryWithNoLock(key); ok && !time.Now().Before(deadline) {
+		b := &WriteBatch{}
+		b.Del("", key)
+		b.Del(expiryFamily, key)
+		mem.WriteWithNoLock(b)
+		return nil, false
+	}
+	value, err := mem.families[""].GetWithNoLock(key)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// batchSetWithNoLock adds a set of key to b, with a deadline if it isn't
+// zero, or dropping the one it had otherwise.
+func (mem *memDB) batchSetWithNoLock(b *WriteBatch, key, value []byte, deadline time.Time) {
+	b.Set("", key, value)
+	if deadline.IsZero() {
+		if _, ok := mem.expiryWithNoLock(key); ok {
+			b.Del(expiryFamily, key)
+		}
+	} else {
+		b.Set(expiryFamily, key, []byte(strconv.FormatInt(unixMillis(deadline), 10)))
+	}
+}
+
+// sweepExpired deletes the keys whose deadline has passed.
+func (mem *memDB) sweepExpired() error {
+	expiries, err := mem.Family(expiryFamily)
+	if err != nil {
+		return err
+	}
+	it, err := expiries.NewIterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	now := unixMillis(time.Now())
+	var expired [][]byte
+	for it.Next() {
+		if ms, err := strconv.ParseInt(string(it.Value()), 10, 64); err == nil && ms <= now {
+			expired = append(expired, it.Key())
+		}
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	for _, key := range expired {
+		// Checked again, it may have been set since
+		mem.liveWithNoLock(key)
+	}
+	return nil
+}
+
+// startExpirySweeper runs sweepExpired every interval.
+func (mem *memDB) startExpirySweeper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			mem.sweepExpired()
+		}
+	}()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// The formats of export and import. JSONL has one {"key", "value"} object
+// per line, the value in base64; CSV has a key,value header and raw values.
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// importChunk is how many keys go in each SST built by an import.
+var importChunk = 100000
+
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export writes every live key of the family to w, streaming them from an
+// iterator.
+func (mem *memDB) Export(w io.Writer, format string) (int, error) {
+	it, err := mem.NewIterator(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	out := bufio.NewWriter(w)
+	var enc *json.Encoder
+	var csvOut *csv.Writer
+	switch format {
+	case FormatJSONL:
+		enc = json.NewEncoder(out)
+	case FormatCSV:
+		csvOut = csv.NewWriter(out)
+		csvOut.Write([]string{"key", "value"})
+	default:
+		return 0, errors.New("Unknown format: " + format)
+	}
+
+	count := 0
+	for it.Next() {
+		if enc != nil {
+			err = enc.Encode(exportRecord{string(it.Key()), base64.StdEncoding.EncodeToString(it.Value())})
+		} else {
+			err = csvOut.Write([]string{string(it.Key()), string(it.Value())})
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if it.Err() != nil {
+		return count, it.Err()
+	}
+
+	if csvOut != nil {
+		csvOut.Flush()
+		if err := csvOut.Error(); err != nil {
+			return count, err
+		}
+	}
+	return count, out.Flush()
+}
+
+// importReader reads key/value pairs in one of the export formats.
+type importReader struct {
+	next func() ([]byte, []byte, error)
+}
+
+func newImportReader(r io.Reader, format string) (*importReader, error) {
+	switch format {
+	case FormatJSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		return &importReader{func() ([]byte, []byte, error) {
+			for scanner.Scan() {
+				line++
+				if len(scanner.Bytes()) == 0 {
+					continue
+				}
+				var rec exportRecord
+				if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+					return nil, nil, fmt.Errorf("Line %d: %v", line, err)
+				}
+				value, err := base64.StdEncoding.DecodeString(rec.Value)
+				if err != nil {
+					return nil, nil, fmt.Errorf("Line %d: value is not base64: %v", line, err)
+				}
+				return []byte(rec.Key), value, nil
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, io.EOF
+		}}, nil
+	case FormatCSV:
+		csvIn := csv.NewReader(r)
+		csvIn.FieldsPerRecord = 2
+		first := true
+		return &importReader{func() ([]byte, []byte, error) {
+			record, err := csvIn.Read()
+			if err != nil {
+				return nil, nil, err
+			}
+			if first && record[0] == "key" && record[1] == "value" {
+				// The header
+				record, err = csvIn.Read()
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			first = false
+			return []byte(record[0]), []byte(record[1]), nil
+		}}, nil
+	default:
+		return nil, errors.New("Unknown format: " + format)
+	}
+}
+
+// Import loads the pairs read from r into the family. They don't go through
+// the WAL and the memtable: they are sorted into SSTs of importChunk keys,
+// which are then ingested at once with IngestExternalFiles, so the import is
+// newer than anything written before. When a key appears more than once, the
+// last one wins. Watchers and WAL consumers don't see imported keys.
+func (mem *memDB) Import(r io.Reader, format string) (int, error) {
+	reader, err := newImportReader(r, format)
+	if err != nil {
+		return 0, err
+	}
+
+	var files []string
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	count := 0
+	var chunk []sstEntry
+	writeChunk := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		// Stable, so the last of a run of equal keys is the newest
+		sort.SliceStable(chunk, func(i, j int) bool { return compareKeys(chunk[i].key, chunk[j].key) < 0 })
+		var entries []sstEntry
+		for i, e := range chunk {
+			if i+1 < len(chunk) && isEqual(chunk[i+1].key, e.key) {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		name := fmt.Sprintf("%s/import-%d-%d.tmp", mem.dir, os.Getpid(), len(files))
+		files = append(files, name)
+		count += len(entries)
+		chunk = nil
+		return writeSSTFile(name, entries, mem.codecForLevel(0))
+	}
+
+	for {
+		key, value, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		chunk = append(chunk, sstEntry{byte(set), key, value})
+		if len(chunk) >= importChunk {
+			if err := writeChunk(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := writeChunk(); err != nil {
+		return 0, err
+	}
+
+	if _, err := mem.IngestExternalFiles(files); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
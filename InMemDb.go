@@ -16,6 +16,14 @@ const (
 	Del
 	Ext
 	Unk
+	Merge
+	Incr
+	Append
+	Batch
+	Use
+	CreateCF
+	DropCF
+	Ingest
 )
 
 type Error int
@@ -28,16 +36,25 @@ const (
 	Empty Error = iota
 )
 
+// ErrPreconditionFailed is returned by the conditional writes when the
+// stored value does not match what the caller expected.
+var ErrPreconditionFailed = errors.New("Precondition failed")
+
 type operation int
 
 const (
 	set operation = iota
 	del
+	merge
 )
 
+// entry is what the memtable holds for a key. op says where the base value
+// comes from (value for set, nothing for del, the SSTs for merge) and
+// operands are the merge operands to fold on top of it.
 type entry struct {
-	value interface{}
-	op    operation
+	value    interface{}
+	op       operation
+	operands [][]byte
 }
 
 type DB interface {
@@ -46,10 +63,25 @@ type DB interface {
 	DelMap(key []byte) ([]byte, error)
 }
 
+// memDB is a handle on one column family. All the families of a store
+// share the lock, the WAL and the families map; each has its own memtable
+// and SST directory.
 type memDB struct {
-	values *orderedmap.OrderedMap
-	mu     sync.Mutex
-	wal    *walFile
+	values   *orderedmap.OrderedMap
+	mu       *sync.Mutex
+	wal      *walFile
+	name     string
+	dir      string
+	options  CFOptions
+	families map[string]*memDB
+	hub      *watchHub
+	dropped  bool
+	regions  []Region
+	// incarnation is the seq of the record that created the family, so a
+	// family dropped and created again under its name isn't taken for the
+	// old one. 0 for the default family and the ones created before
+	// families were logged.
+	incarnation uint64
 }
 
 func (mem *memDB) SetMap(key, value []byte) error {
@@ -64,11 +96,7 @@ func (mem *memDB) GetMap(key []byte) ([]byte, error) {
 
 	//Get from map is different because we need to make sure that the key has the entry op set and not del
 	if v, ok := mem.values.Get(string(key)); ok {
-		entry := v.(entry)
-		if entry.op == del {
-			return nil, errors.New("Key not found")
-		}
-		return entry.value.([]byte), nil
+		return v.(entry).resolve(mem.dir, key)
 	}
 
 	return nil, errors.New("Key not found")
@@ -82,12 +110,16 @@ func (mem *memDB) DelMap(key []byte) ([]byte, error) {
 		oldEntry := v.(entry)
 
 		// Update the entry with the delete operation
-		newEntry := entry{value: oldEntry.value, op: del}
+		oldValue, _ := oldEntry.value.([]byte)
+		newEntry := entry{value: oldValue, op: del}
 		mem.values.Set(string(key), newEntry)
 
-		return oldEntry.value.([]byte), nil
+		return oldValue, nil
 	}
 
+	// The key may still live in an SST, so it needs the tombstone all the same
+	mem.values.Set(string(key), entry{op: del})
+
 	return nil, errors.New("Key not found")
 }
 
@@ -97,7 +129,7 @@ func (mem *memDB) flushTrigger() {
 	defer mem.mu.Unlock()
 
 	// Check if the size of the ordered map exceeds the threshold
-	if mem.values.Len() >= flushThreshold {
+	if mem.values.Len() >= mem.flushThreshold() {
 		err := mem.flushToSSTFromMap()
 		if err != nil {
 			fmt.Println("Error flushing to SST:", err)
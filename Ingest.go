@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrSSTKeyOrder = errors.New("Keys must be added in increasing order")
+
+// SSTWriter writes an SST in the engine's format from keys given in
+// increasing order, for IngestExternalFiles. The header, which comes first
+// in the file, is only known at the end, so entries go to a temporary file
+// that Finish copies behind it. With encryption on, the temporary file is
+// encrypted too, under a key that is never written anywhere.
+type SSTWriter struct {
+	path     string
+	body     *os.File
+	sealed   *sealedWriter
+	w        *bufio.Writer
+	codec    byte
+	count    uint32
+	smallest []byte
+	biggest  []byte
+}
+
+func NewSSTWriter(path string) (*SSTWriter, error) {
+	body, err := os.Create(path + ".entries")
+	if err != nil {
+		return nil, err
+	}
+	sw := &SSTWriter{path: path, body: body}
+	if encryption == nil {
+		sw.w = bufio.NewWriter(body)
+		return sw, nil
+	}
+	key, err := randomBytes(encryptionKeySize)
+	if err == nil {
+		var aead cipher.AEAD
+		if aead, err = newAEAD(key); err == nil {
+			sw.sealed = &sealedWriter{w: body, aead: aead}
+			sw.w = bufio.NewWriter(sw.sealed)
+			return sw, nil
+		}
+	}
+	sw.Abort()
+	return nil, err
+}
+
+func (sw *SSTWriter) Put(key, value []byte) error {
+	return sw.add(byte(set), key, value)
+}
+
+// Delete writes a tombstone, which hides the key in older SSTs.
+func (sw *SSTWriter) Delete(key []byte) error {
+	return sw.add(byte(del), key, nil)
+}
+
+func (sw *SSTWriter) add(op byte, key, value []byte) error {
+	if sw.count > 0 && compareKeys(key, sw.biggest) <= 0 {
+		return ErrSSTKeyOrder
+	}
+	if sw.count == 0 {
+		sw.smallest = append([]byte{}, key...)
+	}
+	sw.biggest = append(sw.biggest[:0], key...)
+	sw.count++
+
+	sw.w.WriteByte(op)
+	writeSSTBytes(sw.w, key)
+	writeSSTBytes(sw.w, value)
+	return nil
+}
+
+// Finish writes the SST and syncs it.
+func (sw *SSTWriter) Finish() error {
+	defer sw.Abort()
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	var entries io.Reader = sw.body
+	if sw.sealed != nil {
+		if err := sw.sealed.Close(); err != nil {
+			return err
+		}
+		entries = &sealedReader{r: bufio.NewReader(sw.body), aead: sw.sealed.aead, name: sw.body.Name()}
+	}
+	if _, err := sw.body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	file, err := createSST(sw.path, sw.codec)
+	if err != nil {
+		return err
+	}
+	binary.Write(file, binary.LittleEndian, sw.count)
+	writeSSTBytes(file, sw.smallest)
+	writeSSTBytes(file, sw.biggest)
+	if _, err := io.Copy(file, entries); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Abort drops what was written so far.
+func (sw *SSTWriter) Abort() {
+	sw.body.Close()
+	os.Remove(sw.body.Name())
+}
+
+// IngestExternalFiles adds SSTs written by SSTWriter to the family, as its
+// newest files in the order given, and returns the sequence number their
+// ingestion was logged under in the WAL. The files are checked first, and
+// linked or copied in so the originals are left alone. Files in the clear
+// are encrypted on the way in when encryption is on.
+//
+// There are no levels: ingested files always go on top of the existing SSTs.
+// The memtable is flushed first only if it holds keys in their ranges, as
+// those writes are older and would otherwise hide the ingested ones.
+//
+// All the files are renamed into place under the lock, and reads take it
+// too, so they see either all of the ingested keys or none of them.
+func (mem *memDB) IngestExternalFiles(paths []string) (uint64, error) {
+	var ranges [][2][]byte
+	for _, path := range paths {
+		problems, err := verifySST(path)
+		if err != nil {
+			return 0, err
+		}
+		if len(problems) > 0 {
+			return 0, fmt.Errorf("Cannot ingest %s: %s", path, problems[0])
+		}
+		header, err := readSSTFileHeader(path)
+		if err != nil {
+			return 0, err
+		}
+		if header.count > 0 {
+			ranges = append(ranges, [2][]byte{header.smallest, header.biggest})
+		}
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.dropped {
+		return 0, ErrColumnFamilyDropped
+	}
+	if err := mem.writableWithNoLock(); err != nil {
+		return 0, err
+	}
+
+	// Staged under names countSSTFiles doesn't see
+	var staged []string
+	defer func() {
+		for _, name := range staged {
+			os.Remove(name)
+		}
+	}()
+	for i, path := range paths {
+		name := fmt.Sprintf("%s/ingest-%d.tmp", mem.dir, i)
+		staged = append(staged, name)
+		if err := copySST(path, name); err != nil {
+			return 0, err
+		}
+	}
+
+	if mem.memtableOverlaps(ranges) {
+		if err := mem.flushAll(); err != nil {
+			return 0, err
+		}
+	}
+
+	count, err := countSSTFiles(mem.dir)
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for i, name := range staged {
+		target := fmt.Sprintf("%s/sst%d.txt", mem.dir, count+i+1)
+		if err := os.Rename(name, target); err != nil {
+			// Take back the ones already in place
+			for j := len(names) - 1; j >= 0; j-- {
+				os.Rename(fmt.Sprintf("%s/sst%d.txt", mem.dir, count+j+1), staged[j])
+			}
+			return 0, err
+		}
+		names = append(names, filepath.Base(target))
+	}
+	staged = nil
+
+	return mem.logWAL(Ingest, []byte(strings.Join(names, " ")), nil)
+}
+
+func (mem *memDB) memtableOverlaps(ranges [][2][]byte) bool {
+	for el := mem.values.Front(); el != nil; el = el.Next() {
+		key := []byte(el.Key.(string))
+		for _, r := range ranges {
+			if compareKeys(key, r[0]) >= 0 && compareKeys(key, r[1]) <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func readSSTFileHeader(path string) (sstHeader, error) {
+	file, reader, err := openSST(path)
+	if err != nil {
+		return sstHeader{}, err
+	}
+	defer file.Close()
+	return readSSTHeader(reader)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIngestExternalFiles(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+	db.Set([]byte("b"), []byte("old"))
+	db.Set([]byte("z"), []byte("outside"))
+
+	write := func(path string, pairs ...string) {
+		sw, err := NewSSTWriter(path)
+		if err != nil {
+			t.Fatalf("Error creating SST writer: %v", err)
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			if pairs[i+1] == "" {
+				err = sw.Delete([]byte(pairs[i]))
+			} else {
+				err = sw.Put([]byte(pairs[i]), []byte(pairs[i+1]))
+			}
+			if err != nil {
+				t.Fatalf("Error writing %s: %v", pairs[i], err)
+			}
+		}
+		if err := sw.Finish(); err != nil {
+			t.Fatalf("Error finishing %s: %v", path, err)
+		}
+	}
+
+	sw, _ := NewSSTWriter("unsorted.sst")
+	sw.Put([]byte("b"), []byte("1"))
+	if err := sw.Put([]byte("a"), []byte("2")); err != ErrSSTKeyOrder {
+		t.Fatalf("Expected ErrSSTKeyOrder, got %v", err)
+	}
+	sw.Abort()
+
+	// The second file is newer, so its tombstone for a wins
+	write("one.sst", "a", "1", "b", "new", "c", "1")
+	write("two.sst", "a", "", "d", "2")
+	seq, err := db.IngestExternalFiles([]string{"one.sst", "two.sst"})
+	if err != nil || seq != 3 {
+		t.Fatalf("Expected the ingestion to be logged at seq 3, got %d (%v)", seq, err)
+	}
+	for k, expected := range map[string]string{"b": "new", "c": "1", "d": "2", "z": "outside"} {
+		if v, err := db.Get([]byte(k)); err != nil || string(v) != expected {
+			t.Fatalf("Expected %s to be %s, got %s (%v)", k, expected, v, err)
+		}
+	}
+	if _, err := db.Get([]byte("a")); err == nil {
+		t.Fatalf("Expected a to be deleted by the newer file")
+	}
+	if n, _ := countSSTFiles(sstDir); n != 3 {
+		t.Fatalf("Expected the memtable flushed under the ingested files, got %d SSTs", n)
+	}
+	if _, err := os.Stat("one.sst"); err != nil {
+		t.Fatalf("Expected the original file to be left alone: %v", err)
+	}
+
+	// No overlap with the memtable, no flush
+	db.Set([]byte("m"), []byte("memtable"))
+	write("three.sst", "x", "3")
+	if _, err := db.IngestExternalFiles([]string{"three.sst"}); err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	if v, _ := db.Get([]byte("m")); string(v) != "memtable" || db.values.Len() != 1 {
+		t.Fatalf("Expected m to still be in the memtable")
+	}
+
+	// A damaged file is refused and nothing is ingested
+	write("four.sst", "e", "4")
+	data, _ := os.ReadFile("four.sst")
+	os.WriteFile("four.sst", data[:len(data)-1], 0644)
+	write("five.sst", "f", "5")
+	if _, err := db.IngestExternalFiles([]string{"five.sst", "four.sst"}); err == nil {
+		t.Fatalf("Expected a damaged file to be refused")
+	}
+	if _, err := db.Get([]byte("f")); err == nil {
+		t.Fatalf("Expected none of the files to be ingested")
+	}
+}
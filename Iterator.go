@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Iterator walks the live keys of a column family in order, merging the
+// memtable with every SST the way a Get would: the newest entry of a key
+// wins, tombstones hide it and merge operands are folded in. The memtable is
+// copied when the iterator is created and the SSTs are read as it goes, so
+// it sees the store as it was then without holding the lock.
+type Iterator struct {
+	ctx     context.Context
+	sources []iteratorSource
+	end     []byte
+	key     []byte
+	value   []byte
+	err     error
+}
+
+// iteratorSource yields the entries of the memtable or of one SST in key
+// order. Sources are kept newest first.
+type iteratorSource interface {
+	peek() (sstEntry, bool)
+	next() error
+	close()
+}
+
+// NewIterator returns an iterator over the keys from start, inclusive, to
+// end, exclusive. A nil start or end leaves that side open.
+func (mem *memDB) NewIterator(start, end []byte) (*Iterator, error) {
+	return mem.NewIteratorContext(context.Background(), start, end)
+}
+
+// NewIteratorContext is NewIterator stopping with ctx's error once it is
+// done.
+func (mem *memDB) NewIteratorContext(ctx context.Context, start, end []byte) (*Iterator, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	return mem.iteratorWithNoLock(ctx, start, end)
+}
+
+func (mem *memDB) iteratorWithNoLock(ctx context.Context, start, end []byte) (*Iterator, error) {
+	if mem.dropped {
+		return nil, ErrColumnFamilyDropped
+	}
+
+	memtable, err := mem.memtableSource(start)
+	if err != nil {
+		return nil, err
+	}
+	it := &Iterator{ctx: ctx, end: end, sources: []iteratorSource{memtable}}
+
+	count, err := countSSTFiles(mem.dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := count; i > 0; i-- {
+		source, err := openSSTSource(fmt.Sprintf("%s/sst%d.txt", mem.dir, i), start, end)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		if !source.valid {
+			// Out of the range, as most are with regions
+			source.close()
+			continue
+		}
+		it.sources = append(it.sources, source)
+	}
+	return it, nil
+}
+
+// Next moves to the next live key and reports whether there is one.
+func (it *Iterator) Next() bool {
+	for it.err == nil {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+
+		// The smallest key any source is at
+		var key []byte
+		for _, source := range it.sources {
+			if e, ok := source.peek(); ok && (key == nil || compareKeys(e.key, key) < 0) {
+				key = e.key
+			}
+		}
+		if key == nil || (it.end != nil && compareKeys(key, it.end) >= 0) {
+			return false
+		}
+
+		// Newest first, until a set or a delete ends the key's history
+		var operands [][]byte
+		var base []byte
+		var op byte = byte(merge)
+		for _, source := range it.sources {
+			e, ok := source.peek()
+			if !ok || !isEqual(e.key, key) {
+				continue
+			}
+			if op == byte(merge) {
+				switch e.op {
+				case byte(merge):
+					older, err := decodeOperands(e.value)
+					if err != nil {
+						it.err = err
+						return false
+					}
+					operands = append(older, operands...)
+				default:
+					op, base = e.op, e.value
+				}
+			}
+			if err := source.next(); err != nil {
+				it.err = err
+				return false
+			}
+		}
+
+		switch {
+		case op == byte(del) && len(operands) == 0:
+			continue
+		case len(operands) == 0:
+			it.key, it.value = key, base
+		default:
+			value, err := foldOperands(base, op == byte(set), operands)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.key, it.value = key, value
+		}
+		return true
+	}
+	return false
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) Close() error {
+	for _, source := range it.sources {
+		source.close()
+	}
+	it.sources = nil
+	return it.err
+}
+
+// memtableSource is a sorted copy of the memtable. Entries with a base value
+// are resolved right away; the ones with only merge operands are kept as a
+// merge entry, so older sources give the base.
+type memtableSource struct {
+	entries []sstEntry
+}
+
+func (mem *memDB) memtableSource(start []byte) (*memtableSource, error) {
+	source := &memtableSource{}
+	for el := mem.values.Front(); el != nil; el = el.Next() {
+		key := []byte(el.Key.(string))
+		if start != nil && compareKeys(key, start) < 0 {
+			continue
+		}
+		e := el.Value.(entry)
+		switch {
+		case e.op == merge:
+			source.entries = append(source.entries, sstEntry{byte(merge), key, encodeOperands(e.operands)})
+		case e.op == del && len(e.operands) == 0:
+			source.entries = append(source.entries, sstEntry{byte(del), key, nil})
+		default:
+			var base []byte
+			if e.op == set {
+				base = e.value.([]byte)
+			}
+			// A set with its own operands, or a delete with merges on top
+			value, err := foldOperands(base, e.op == set, e.operands)
+			if err != nil {
+				return nil, err
+			}
+			source.entries = append(source.entries, sstEntry{byte(set), key, value})
+		}
+	}
+	sort.Slice(source.entries, func(i, j int) bool {
+		return compareKeys(source.entries[i].key, source.entries[j].key) < 0
+	})
+	return source, nil
+}
+
+func (s *memtableSource) peek() (sstEntry, bool) {
+	if len(s.entries) == 0 {
+		return sstEntry{}, false
+	}
+	return s.entries[0], true
+}
+
+func (s *memtableSource) next() error {
+	s.entries = s.entries[1:]
+	return nil
+}
+
+func (s *memtableSource) close() {}
+
+// sstSource reads one SST an entry at a time.
+type sstSource struct {
+	file    *os.File
+	reader  *bufio.Reader
+	left    uint32
+	current sstEntry
+	valid   bool
+}
+
+func openSSTSource(name string, start, end []byte) (*sstSource, error) {
+	file, reader, err := openSST(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &sstSource{file: file, reader: reader}
+	header, err := readSSTHeader(s.reader)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Corrupt SST %s: %v", name, err)
+	}
+	s.left = header.count
+	if start != nil && header.count > 0 && compareKeys(header.biggest, start) < 0 {
+		// Nothing at or after start
+		s.left = 0
+	}
+	if end != nil && header.count > 0 && compareKeys(header.smallest, end) >= 0 {
+		// Nothing before end
+		s.left = 0
+	}
+	if err := s.next(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	for s.valid && start != nil && compareKeys(s.current.key, start) < 0 {
+		if err := s.next(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *sstSource) peek() (sstEntry, bool) {
+	return s.current, s.valid
+}
+
+func (s *sstSource) next() error {
+	if s.left == 0 {
+		s.valid = false
+		return nil
+	}
+	e, err := readSSTEntry(s.reader)
+	if err != nil {
+		s.valid = false
+		return fmt.Errorf("Corrupt SST %s: %v", s.file.Name(), err)
+	}
+	s.left--
+	s.current, s.valid = e, true
+	return nil
+}
+
+func (s *sstSource) close() {
+	s.file.Close()
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// flagsFamily holds the memcached client flags of the keys that have some,
+// written in the same batch as the value.
+const flagsFamily = "_flags"
+
+// memcachedServer speaks the memcached text protocol on top of the default
+// column family. Exptimes go to the expiry family, like Redis deadlines.
+type memcachedServer struct {
+	db          *memDB
+	started     time.Time
+	clients     int64
+	connections int64
+	gets        int64
+	hits        int64
+	sets        int64
+}
+
+// ServeMemcached accepts memcached clients on l until it is closed.
+func ServeMemcached(l net.Listener, db *memDB) error {
+	if err := db.ensureExpiryFamily(); err != nil {
+		return err
+	}
+	if _, err := db.Family(flagsFamily); err != nil {
+		if _, err := db.CreateColumnFamily(flagsFamily, CFOptions{}); err != nil {
+			return err
+		}
+	}
+	s := &memcachedServer{db: db, started: time.Now()}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// memcachedItem is what get and gets return for a key.
+type memcachedItem struct {
+	value []byte
+	flags uint32
+}
+
+// cas is the CAS unique of the item: like the ETags of the HTTP API, a hash
+// of what is stored, so it changes whenever the value or the flags do.
+func (item memcachedItem) cas() uint64 {
+	h := fnv.New64a()
+	h.Write(item.value)
+	fmt.Fprintf(h, "/%d", item.flags)
+	return h.Sum64()
+}
+
+func (s *memcachedServer) serve(conn net.Conn) {
+	defer conn.Close()
+	atomic.AddInt64(&s.clients, 1)
+	defer atomic.AddInt64(&s.clients, -1)
+	atomic.AddInt64(&s.connections, 1)
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if fields[0] == "quit" {
+			w.Flush()
+			return
+		} else if !s.execute(fields, r, w) {
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute runs one command and reports whether the connection can go on.
+func (s *memcachedServer) execute(fields []string, r *bufio.Reader, w *bufio.Writer) bool {
+	command, args := fields[0], fields[1:]
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	reply := func(s string) {
+		if !noreply {
+			w.WriteString(s + "\r\n")
+		}
+	}
+	for _, key := range args {
+		if command != "stats" && len(key) > 250 {
+			w.WriteString("CLIENT_ERROR key too long\r\n")
+			return true
+		}
+	}
+
+	switch command {
+	case "get", "gets":
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		s.db.mu.Lock()
+		for _, key := range args {
+			atomic.AddInt64(&s.gets, 1)
+			item, ok := s.itemWithNoLock([]byte(key))
+			if !ok {
+				continue
+			}
+			atomic.AddInt64(&s.hits, 1)
+			if command == "gets" {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.value), item.cas())
+			} else {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.flags, len(item.value))
+			}
+			w.Write(item.value)
+			w.WriteString("\r\n")
+		}
+		s.db.mu.Unlock()
+		w.WriteString("END\r\n")
+
+	case "set", "add", "replace", "cas":
+		want := 4
+		if command == "cas" {
+			want = 5
+		}
+		if len(args) != want {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		flags, err1 := strconv.ParseUint(args[1], 10, 32)
+		exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+		size, err3 := strconv.Atoi(args[3])
+		var unique uint64
+		var err4 error
+		if command == "cas" {
+			unique, err4 = strconv.ParseUint(args[4], 10, 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || size > 1024*1024 {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			// The data block can't be told apart from commands, give up
+			return false
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return false
+		}
+		if string(data[size:]) != "\r\n" {
+			w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return true
+		}
+		atomic.AddInt64(&s.sets, 1)
+		reply(s.store(command, []byte(args[0]), memcachedItem{data[:size], uint32(flags)}, exptime, unique))
+
+	case "delete":
+		if len(args) != 1 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		s.db.mu.Lock()
+		_, ok := s.itemWithNoLock([]byte(args[0]))
+		var err error
+		if ok {
+			err = s.db.WriteWithNoLock(s.deleteBatchWithNoLock([]byte(args[0])))
+		}
+		s.db.mu.Unlock()
+		switch {
+		case err != nil:
+			reply("SERVER_ERROR " + err.Error())
+		case ok:
+			reply("DELETED")
+		default:
+			reply("NOT_FOUND")
+		}
+
+	case "incr", "decr":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return true
+		}
+		reply(s.incr([]byte(args[0]), delta, command == "decr"))
+
+	case "touch":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			return true
+		}
+		reply(s.touch([]byte(args[0]), exptime))
+
+	case "stats":
+		s.stats(w)
+
+	case "version":
+		w.WriteString("VERSION 1.6.0\r\n")
+
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return true
+}
+
+// memcachedDeadline turns an exptime into a deadline: none for 0, a number
+// of seconds up to 30 days, a Unix time beyond. A negative one has already
+// passed.
+func memcachedDeadline(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Unix(1, 0)
+	case exptime <= 30*24*3600:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+func (s *memcachedServer) itemWithNoLock(key []byte) (memcachedItem, bool) {
+	value, ok := s.db.liveWithNoLock(key)
+	if !ok {
+		return memcachedItem{}, false
+	}
+	item := memcachedItem{value: value}
+	if flags, err := s.db.families[flagsFamily].GetWithNoLock(key); err == nil {
+		n, _ := strconv.ParseUint(string(flags), 10, 32)
+		item.flags = uint32(n)
+	}
+	return item, true
+}
+
+// storeBatchWithNoLock writes the value, the flags and the deadline of key
+// in one batch.
+func (s *memcachedServer) storeBatchWithNoLock(key []byte, item memcachedItem, deadline time.Time) *WriteBatch {
+	b := &WriteBatch{}
+	s.db.batchSetWithNoLock(b, key, item.value, deadline)
+	if item.flags != 0 {
+		b.Set(flagsFamily, key, []byte(strconv.FormatUint(uint64(item.flags), 10)))
+	} else if _, err := s.db.families[flagsFamily].GetWithNoLock(key); err == nil {
+		b.Del(flagsFamily, key)
+	}
+	return b
+}
+
+func (s *memcachedServer) deleteBatchWithNoLock(key []byte) *WriteBatch {
+	b := &WriteBatch{}
+	b.Del("", key)
+	if _, ok := s.db.expiryWithNoLock(key); ok {
+		b.Del(expiryFamily, key)
+	}
+	if _, err := s.db.families[flagsFamily].GetWithNoLock(key); err == nil {
+		b.Del(flagsFamily, key)
+	}
+	return b
+}
+
+func (s *memcachedServer) store(command string, key []byte, item memcachedItem, exptime int64, unique uint64) string {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	current, exists := s.itemWithNoLock(key)
+	switch {
+	case command == "add" && exists:
+		return "NOT_STORED"
+	case command == "replace" && !exists:
+		return "NOT_STORED"
+	case command == "cas" && !exists:
+		return "NOT_FOUND"
+	case command == "cas" && current.cas() != unique:
+		return "EXISTS"
+	}
+
+	if err := s.db.WriteWithNoLock(s.storeBatchWithNoLock(key, item, memcachedDeadline(exptime))); err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	return "STORED"
+}
+
+// incr adds delta to a decimal value, or takes it away without going below
+// zero. The deadline and flags of the key are kept.
+func (s *memcachedServer) incr(key []byte, delta uint64, decr bool) string {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	item, ok := s.itemWithNoLock(key)
+	if !ok {
+		return "NOT_FOUND"
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(item.value)), 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	}
+	switch {
+	case !decr:
+		n += delta
+	case delta > n:
+		n = 0
+	default:
+		n -= delta
+	}
+
+	deadline, _ := s.db.expiryWithNoLock(key)
+	item.value = []byte(strconv.FormatUint(n, 10))
+	if err := s.db.WriteWithNoLock(s.storeBatchWithNoLock(key, item, deadline)); err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	return string(item.value)
+}
+
+func (s *memcachedServer) touch(key []byte, exptime int64) string {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	item, ok := s.itemWithNoLock(key)
+	if !ok {
+		return "NOT_FOUND"
+	}
+	if err := s.db.WriteWithNoLock(s.storeBatchWithNoLock(key, item, memcachedDeadline(exptime))); err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	return "TOUCHED"
+}
+
+func (s *memcachedServer) stats(w *bufio.Writer) {
+	stats := []struct {
+		name  string
+		value int64
+	}{
+		{"pid", int64(os.Getpid())},
+		{"uptime", int64(time.Since(s.started) / time.Second)},
+		{"time", time.Now().Unix()},
+		{"curr_connections", atomic.LoadInt64(&s.clients)},
+		{"total_connections", atomic.LoadInt64(&s.connections)},
+		{"cmd_get", atomic.LoadInt64(&s.gets)},
+		{"cmd_set", atomic.LoadInt64(&s.sets)},
+		{"get_hits", atomic.LoadInt64(&s.hits)},
+		{"get_misses", atomic.LoadInt64(&s.gets) - atomic.LoadInt64(&s.hits)},
+	}
+	for _, stat := range stats {
+		fmt.Fprintf(w, "STAT %s %d\r\n", stat.name, stat.value)
+	}
+	w.WriteString("STAT version 1.6.0\r\n")
+	w.WriteString("END\r\n")
+}
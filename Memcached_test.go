@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemcachedServer(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go ServeMemcached(l, db)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// send writes a command and reads lines until one of the last ones
+	send := func(command string, last ...string) string {
+		fmt.Fprintf(conn, "%s\r\n", command)
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: error reading reply: %v", command, err)
+			}
+			line = strings.TrimSuffix(line, "\r\n")
+			lines = append(lines, line)
+			for _, l := range last {
+				if line == l || (l == "*" && len(lines) == 1) {
+					return strings.Join(lines, "|")
+				}
+			}
+		}
+	}
+	expect := func(expected, command string, last ...string) {
+		if got := send(command, last...); got != expected {
+			t.Fatalf("%q: expected %q, got %q", command, expected, got)
+		}
+	}
+
+	expect("STORED", "set a 5 0 5\r\nhello", "*")
+	expect("VALUE a 5 5|hello|END", "get a missing", "END")
+	expect("NOT_STORED", "add a 0 0 1\r\nx", "*")
+	expect("NOT_STORED", "replace b 0 0 1\r\nx", "*")
+	expect("STORED", "add b 0 0 2\r\n10", "*")
+
+	gets := send("gets a", "END")
+	var cas uint64
+	fmt.Sscanf(gets, "VALUE a 5 5 %d", &cas)
+	expect("STORED", fmt.Sprintf("cas a 7 0 3 %d\r\nnew", cas), "*")
+	expect("EXISTS", fmt.Sprintf("cas a 7 0 3 %d\r\nold", cas), "*")
+	expect("NOT_FOUND", "cas missing 0 0 1 1\r\nx", "*")
+	expect("VALUE a 7 3|new|END", "get a", "END")
+
+	expect("15", "incr b 5", "*")
+	expect("0", "decr b 20", "*")
+	expect("CLIENT_ERROR cannot increment or decrement non-numeric value", "incr a 1", "*")
+	expect("NOT_FOUND", "incr missing 1", "*")
+
+	// Flags are kept by incr, and the value is shared with the other APIs
+	expect("STORED", "set n 3 0 1\r\n1", "*")
+	expect("2", "incr n 1", "*")
+	expect("VALUE n 3 1|2|END", "get n", "END")
+	if v, err := db.Get([]byte("n")); err != nil || string(v) != "2" {
+		t.Fatalf("Expected n to be 2 in the store, got %s (%v)", v, err)
+	}
+
+	expect("DELETED", "delete a", "*")
+	expect("NOT_FOUND", "delete a", "*")
+	expect("END", "get a", "END")
+
+	// Exptimes, and touch to change them
+	expect("STORED", "set e 0 1 1\r\nx", "*")
+	expect("TOUCHED", "touch e 100", "*")
+	if deadline, ok := db.expiryWithNoLock([]byte("e")); !ok || time.Until(deadline) < 90*time.Second {
+		t.Fatalf("Expected touch to push the deadline back, got %v", deadline)
+	}
+	expect("TOUCHED", "touch e -1", "*")
+	expect("END", "get e", "END")
+	expect("NOT_FOUND", "touch e 10", "*")
+
+	// noreply, then a command to read the next reply from
+	fmt.Fprintf(conn, "set q 0 0 1 noreply\r\nq\r\n")
+	expect("VALUE q 0 1|q|END", "get q", "END")
+
+	if stats := send("stats", "END"); !strings.Contains(stats, "STAT cmd_get ") || !strings.Contains(stats, "STAT curr_connections 1") {
+		t.Fatalf("Unexpected stats: %s", stats)
+	}
+	expect("ERROR", "bogus", "*")
+}
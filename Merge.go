@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// MergeOperator folds a list of operands onto the existing value of a key.
+// Operands are stored as-is in the WAL, the memtable and the SSTs and only
+// folded when the key is read or flushed, so a merge never needs a read.
+type MergeOperator interface {
+	Name() string
+	// Validate checks an operand before it is written, since a bad one
+	// would only fail once the key is read.
+	Validate(operand []byte) error
+	// Merge applies operands, oldest first, to existing. exists is false
+	// when the key has no value yet.
+	Merge(existing []byte, exists bool, operands [][]byte) ([]byte, error)
+}
+
+var (
+	ErrBadOperand = errors.New("Operand is not valid for the merge operator")
+	ErrNotInteger = errors.New("Value is not an integer")
+)
+
+var mergeOperators = map[string]MergeOperator{}
+
+// RegisterMergeOperator makes op available to Merge under op.Name().
+func RegisterMergeOperator(op MergeOperator) {
+	mergeOperators[op.Name()] = op
+}
+
+func init() {
+	RegisterMergeOperator(addOperator{})
+	RegisterMergeOperator(appendOperator{})
+	RegisterMergeOperator(maxOperator{})
+}
+
+// addOperator treats values as base 10 int64 counters. A missing value
+// counts as 0, one that isn't a number is an error.
+type addOperator struct{}
+
+func (addOperator) Name() string { return "add" }
+
+func (addOperator) Validate(operand []byte) error {
+	if _, err := strconv.ParseInt(string(operand), 10, 64); err != nil {
+		return ErrBadOperand
+	}
+	return nil
+}
+
+func (addOperator) Merge(existing []byte, exists bool, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if exists {
+		n, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(string(operand), 10, 64)
+		if err != nil {
+			return nil, ErrBadOperand
+		}
+		sum += n
+	}
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+// appendOperator concatenates the operands to the value.
+type appendOperator struct{}
+
+func (appendOperator) Name() string { return "append" }
+
+func (appendOperator) Validate(operand []byte) error { return nil }
+
+func (appendOperator) Merge(existing []byte, exists bool, operands [][]byte) ([]byte, error) {
+	result := append([]byte{}, existing...)
+	for _, operand := range operands {
+		result = append(result, operand...)
+	}
+	return result, nil
+}
+
+// maxOperator keeps the biggest value, comparing numerically when both
+// sides are integers and bytewise otherwise.
+type maxOperator struct{}
+
+func (maxOperator) Name() string { return "max" }
+
+func (maxOperator) Validate(operand []byte) error { return nil }
+
+func (maxOperator) Merge(existing []byte, exists bool, operands [][]byte) ([]byte, error) {
+	result := existing
+	for _, operand := range operands {
+		if !exists || greater(operand, result) {
+			result = operand
+			exists = true
+		}
+	}
+	return result, nil
+}
+
+func greater(a, b []byte) bool {
+	x, errA := strconv.ParseInt(string(a), 10, 64)
+	y, errB := strconv.ParseInt(string(b), 10, 64)
+	if errA == nil && errB == nil {
+		return x > y
+	}
+	return bytes.Compare(a, b) > 0
+}
+
+// encodeOperand tags an operand with the name of its operator, since one
+// key may be merged with different operators over its lifetime.
+func encodeOperand(name string, operand []byte) []byte {
+	buf := append([]byte(name), 0)
+	return append(buf, operand...)
+}
+
+func decodeOperand(buf []byte) (string, []byte, error) {
+	i := bytes.IndexByte(buf, 0)
+	if i < 0 {
+		return "", nil, errors.New("Malformed merge operand")
+	}
+	return string(buf[:i]), buf[i+1:], nil
+}
+
+// encodeOperands packs a list of operands into a single SST value.
+func encodeOperands(operands [][]byte) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(len(operands)))
+	for _, operand := range operands {
+		lenOperand := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lenOperand, uint32(len(operand)))
+		buf = append(buf, lenOperand...)
+		buf = append(buf, operand...)
+	}
+	return buf
+}
+
+func decodeOperands(buf []byte) ([][]byte, error) {
+	if len(buf) < 4 {
+		return nil, errors.New("Malformed merge entry")
+	}
+	count := binary.LittleEndian.Uint32(buf)
+	buf = buf[4:]
+	operands := make([][]byte, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 4 {
+			return nil, errors.New("Malformed merge entry")
+		}
+		n := binary.LittleEndian.Uint32(buf)
+		if uint32(len(buf)-4) < n {
+			return nil, errors.New("Malformed merge entry")
+		}
+		operands = append(operands, buf[4:4+n])
+		buf = buf[4+n:]
+	}
+	return operands, nil
+}
+
+// foldOperands applies tagged operands, oldest first, to a base value.
+// Consecutive operands of the same operator are handed over in one call.
+func foldOperands(base []byte, exists bool, operands [][]byte) ([]byte, error) {
+	value := base
+	for i := 0; i < len(operands); {
+		name, _, err := decodeOperand(operands[i])
+		if err != nil {
+			return nil, err
+		}
+		op, ok := mergeOperators[name]
+		if !ok {
+			return nil, errors.New("Unknown merge operator: " + name)
+		}
+
+		var run [][]byte
+		for ; i < len(operands); i++ {
+			n, operand, err := decodeOperand(operands[i])
+			if err != nil {
+				return nil, err
+			}
+			if n != name {
+				break
+			}
+			run = append(run, operand)
+		}
+
+		value, err = op.Merge(value, exists, run)
+		if err != nil {
+			return nil, err
+		}
+		exists = true
+	}
+	return value, nil
+}
+
+// resolve returns the value an entry stands for once its pending operands
+// are folded in. Entries with op merge have no base of their own, so it is
+// looked up in the SSTs.
+func (e entry) resolve(dir string, key []byte) ([]byte, error) {
+	switch e.op {
+	case set:
+		if len(e.operands) == 0 {
+			return e.value.([]byte), nil
+		}
+		return foldOperands(e.value.([]byte), true, e.operands)
+	case del:
+		if len(e.operands) == 0 {
+			return nil, errors.New("Key not found")
+		}
+		return foldOperands(nil, false, e.operands)
+	default:
+		base, err := GetFromSST(dir, key)
+		return foldOperands(base, err == nil, e.operands)
+	}
+}
+
+func (mem *memDB) MergeMap(key, operand []byte) error {
+	//Stack the operand on top of whatever the memtable holds for the key
+
+	v, ok := mem.values.Get(string(key))
+	if !ok {
+		mem.values.Set(string(key), entry{op: merge, operands: [][]byte{operand}})
+		return nil
+	}
+	e := v.(entry)
+	e.operands = append(append([][]byte{}, e.operands...), operand)
+	mem.values.Set(string(key), e)
+
+	return nil
+}
+
+func (mem *memDB) MergeWithNoLock(key []byte, name string, operand []byte) error {
+	op, ok := mergeOperators[name]
+	if !ok {
+		return errors.New("Unknown merge operator: " + name)
+	}
+	if err := op.Validate(operand); err != nil {
+		return err
+	}
+	if mem.dropped {
+		return ErrColumnFamilyDropped
+	}
+	if err := mem.writableWithNoLock(); err != nil {
+		return err
+	}
+	tagged := encodeOperand(name, operand)
+
+	err := mem.MergeMap(key, tagged)
+	if err != nil {
+		return err
+	}
+	seq, err := mem.logWAL(Merge, key, tagged)
+	if err != nil {
+		return err
+	}
+	mem.publish(Event{Type: EventMerge, Key: key, Value: operand, Operator: name, Seq: seq})
+	mem.checkSizeAndFlush()
+
+	return nil
+}
+
+// Merge records operand against key for the named operator without reading
+// the current value.
+func (mem *memDB) Merge(key []byte, name string, operand []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	return mem.MergeWithNoLock(key, name, operand)
+}
+
+// mergeAndGet merges operand and returns the resulting value in one step.
+// The value is worked out first, so an operand the current value can't
+// take, like adding to a string, is refused instead of written.
+func (mem *memDB) mergeAndGet(key []byte, name string, operand []byte) ([]byte, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	op, ok := mergeOperators[name]
+	if !ok {
+		return nil, errors.New("Unknown merge operator: " + name)
+	}
+	current, err := mem.GetWithNoLock(key)
+	if err == ErrColumnFamilyDropped {
+		return nil, err
+	}
+	value, err := op.Merge(current, err == nil, [][]byte{operand})
+	if err != nil {
+		return nil, err
+	}
+	if err := mem.MergeWithNoLock(key, name, operand); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Incr adds delta to the int64 counter stored at key and returns the new value.
+func (mem *memDB) Incr(key []byte, delta int64) ([]byte, error) {
+	return mem.mergeAndGet(key, "add", []byte(strconv.FormatInt(delta, 10)))
+}
+
+// Append appends value to key and returns the new value.
+func (mem *memDB) Append(key, value []byte) ([]byte, error) {
+	return mem.mergeAndGet(key, "append", value)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMergeAcrossFlushAndRecovery(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+
+	// Enough writes to flush the counter's operands into SSTs several times
+	for i := 0; i < 10; i++ {
+		if _, err := db.Incr([]byte("counter"), 2); err != nil {
+			t.Fatalf("Error incrementing: %v", err)
+		}
+		if err := db.Set([]byte("filler"), []byte("x")); err != nil {
+			t.Fatalf("Error setting key: %v", err)
+		}
+	}
+	if _, err := db.Append([]byte("log"), []byte("a")); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if _, err := db.Append([]byte("log"), []byte("b")); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if err := db.Merge([]byte("high"), "max", []byte("7")); err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+	if err := db.Merge([]byte("high"), "max", []byte("3")); err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+
+	// Reopen and replay the WAL on top of the SSTs
+	db.wal.file.Close()
+	repl, err = NewInMem()
+	if err != nil {
+		t.Fatalf("Error reopening database: %v", err)
+	}
+	db = repl.handler.(*memDB)
+	if err := recoverFromWAL(db); err != nil {
+		t.Fatalf("Error recovering from WAL: %v", err)
+	}
+
+	for key, expected := range map[string]string{"counter": "20", "log": "ab", "high": "7"} {
+		v, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Error getting %s: %v", key, err)
+		}
+		if string(v) != expected {
+			t.Fatalf("Expected %s to be %s, got %s", key, expected, v)
+		}
+	}
+
+	// A set replaces the counter, later merges start from it
+	if err := db.Set([]byte("counter"), []byte("100")); err != nil {
+		t.Fatalf("Error setting key: %v", err)
+	}
+	if v, err := db.Incr([]byte("counter"), -1); err != nil || string(v) != "99" {
+		t.Fatalf("Expected 99, got %s (%v)", v, err)
+	}
+}
+
+func TestMergeRejectsBadOperands(t *testing.T) {
+	useTempDir(t)
+	db := openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	mem = db
+	seq := db.wal.seq
+
+	// Refused before anything is written, so the key stays readable
+	if err := db.Merge([]byte("counter"), "add", []byte("abc")); err != ErrBadOperand {
+		t.Fatalf("Expected ErrBadOperand, got %v", err)
+	}
+	b := &WriteBatch{}
+	b.Merge("", []byte("counter"), "add", []byte("1.5"))
+	if err := db.Write(b); err != ErrBadOperand {
+		t.Fatalf("Expected ErrBadOperand from a batch, got %v", err)
+	}
+	if db.wal.seq != seq {
+		t.Fatal("Expected nothing to be written to the WAL")
+	}
+
+	// Adding to a string is an error, not a reset to 0
+	db.Set([]byte("name"), []byte("alice"))
+	if _, err := db.Incr([]byte("name"), 1); err != ErrNotInteger {
+		t.Fatalf("Expected ErrNotInteger, got %v", err)
+	}
+	if v, err := db.Get([]byte("name")); err != nil || string(v) != "alice" {
+		t.Fatalf("Expected name to be left alone, got %s (%v)", v, err)
+	}
+	if _, err := (addOperator{}).Merge([]byte("alice"), true, [][]byte{[]byte("1")}); err != ErrNotInteger {
+		t.Fatalf("Expected ErrNotInteger, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	IncrHandler(rec, httptest.NewRequest("GET", "/incr?key=name", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	IncrHandler(rec, httptest.NewRequest("GET", "/incr?key=counter&by=2", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "2" {
+		t.Fatalf("Expected 2, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms, in
+// seconds.
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts durations in buckets, like a Prometheus histogram.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// since observes the time since start, for a defer.
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+// counter is a number that only goes up.
+type counter struct {
+	n uint64
+}
+
+func (c *counter) add(n int) {
+	atomic.AddUint64(&c.n, uint64(n))
+}
+
+func (c *counter) value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// metrics are kept by the engine as it works, for /metrics. They are for
+// the whole process, the stores it has open together.
+var metrics = struct {
+	ops        map[string]*histogram
+	walBytes   counter
+	walRecords counter
+	walFsync   *histogram
+	flushes    *histogram
+	compaction *histogram
+	stalls     *histogram
+	sstOpens   counter
+	sstBlocks  counter
+	sstRead    counter
+	sstRaw     counter
+}{
+	ops:        map[string]*histogram{"get": newHistogram(), "set": newHistogram(), "del": newHistogram()},
+	walFsync:   newHistogram(),
+	flushes:    newHistogram(),
+	compaction: newHistogram(),
+	stalls:     newHistogram(),
+}
+
+// familyMetrics are read from a family when /metrics is scraped.
+type familyMetrics struct {
+	name            string
+	memtableEntries int
+	memtableBytes   int
+	ssts            int
+}
+
+// familyMetrics sizes up the memtable and the SSTs of the family.
+func (mem *memDB) familyMetrics(name string) (familyMetrics, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.dropped {
+		return familyMetrics{}, ErrColumnFamilyDropped
+	}
+
+	m := familyMetrics{name: name, memtableEntries: mem.values.Len()}
+	for el := mem.values.Front(); el != nil; el = el.Next() {
+		m.memtableBytes += len(el.Key.(string))
+		e := el.Value.(entry)
+		if value, ok := e.value.([]byte); ok {
+			m.memtableBytes += len(value)
+		}
+		for _, operand := range e.operands {
+			m.memtableBytes += len(operand)
+		}
+	}
+	ssts, err := countSSTFiles(mem.dir)
+	if err != nil {
+		return m, err
+	}
+	m.ssts = ssts
+	return m, nil
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format. The
+// store has a single level of SSTs, so they are all level 0. There is no
+// block cache yet: its hits stay at 0 and every block read is a miss.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles GET /metrics
+	memMutex.Lock()
+	names := append([]string{""}, mem.ColumnFamilies()...)
+	sort.Strings(names)
+	families := map[string]*memDB{}
+	for _, name := range names {
+		if cf, err := mem.Family(name); err == nil {
+			families[name] = cf
+		}
+	}
+	memMutex.Unlock()
+
+	var stats []familyMetrics
+	for _, name := range names {
+		cf, ok := families[name]
+		if !ok {
+			continue
+		}
+		if name == "" {
+			name = "default"
+		}
+		m, err := cf.familyMetrics(name)
+		if err == ErrColumnFamilyDropped {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats = append(stats, m)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	writeMetrics(out, stats)
+}
+
+func writeMetrics(out io.Writer, stats []familyMetrics) {
+	header := func(name, kind, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("kv_operations_total", "counter", "Gets, sets and deletes of keys.")
+	for _, op := range []string{"get", "set", "del"} {
+		fmt.Fprintf(out, "kv_operations_total{op=%q} %d\n", op, metrics.ops[op].snapshot().count)
+	}
+	header("kv_operation_duration_seconds", "histogram", "Time to get, set and delete a key, with the store locked.")
+	for _, op := range []string{"get", "set", "del"} {
+		writeHistogram(out, "kv_operation_duration_seconds", fmt.Sprintf("op=%q", op), metrics.ops[op])
+	}
+
+	header("kv_wal_bytes_total", "counter", "Bytes appended to the WAL.")
+	fmt.Fprintf(out, "kv_wal_bytes_total %d\n", metrics.walBytes.value())
+	header("kv_wal_records_total", "counter", "Records appended to the WAL.")
+	fmt.Fprintf(out, "kv_wal_records_total %d\n", metrics.walRecords.value())
+	header("kv_wal_fsync_duration_seconds", "histogram", "Time to fsync a WAL file. Records aren't synced as they are appended, a segment is before it is sealed, and the WALs a restore or a key rotation writes.")
+	writeHistogram(out, "kv_wal_fsync_duration_seconds", "", metrics.walFsync)
+
+	header("kv_flush_duration_seconds", "histogram", "Time to flush the memtables to SSTs.")
+	writeHistogram(out, "kv_flush_duration_seconds", "", metrics.flushes)
+	header("kv_compaction_duration_seconds", "histogram", "Time to compact the SSTs of a region.")
+	writeHistogram(out, "kv_compaction_duration_seconds", "", metrics.compaction)
+	header("kv_write_stall_duration_seconds", "histogram", "Time a write waited for the flush of a full memtable, with the store locked for the writes behind it.")
+	writeHistogram(out, "kv_write_stall_duration_seconds", "", metrics.stalls)
+
+	header("kv_sst_opens_total", "counter", "SSTs opened for reading.")
+	fmt.Fprintf(out, "kv_sst_opens_total %d\n", metrics.sstOpens.value())
+	header("kv_sst_blocks_read_total", "counter", "Compressed SST blocks read.")
+	fmt.Fprintf(out, "kv_sst_blocks_read_total %d\n", metrics.sstBlocks.value())
+	header("kv_block_cache_hits_total", "counter", "SST blocks found in the block cache. There is none, so always 0.")
+	fmt.Fprintln(out, "kv_block_cache_hits_total 0")
+	header("kv_block_cache_misses_total", "counter", "SST blocks read from their file, without a block cache all of them.")
+	fmt.Fprintf(out, "kv_block_cache_misses_total %d\n", metrics.sstBlocks.value())
+	header("kv_sst_block_bytes_read_total", "counter", "Bytes of the SST blocks read, as stored.")
+	fmt.Fprintf(out, "kv_sst_block_bytes_read_total %d\n", metrics.sstRead.value())
+	header("kv_sst_block_bytes_decompressed_total", "counter", "Bytes of the SST blocks read, decompressed.")
+	fmt.Fprintf(out, "kv_sst_block_bytes_decompressed_total %d\n", metrics.sstRaw.value())
+
+	header("kv_sst_files", "gauge", "SSTs of each family and level.")
+	for _, m := range stats {
+		fmt.Fprintf(out, "kv_sst_files{cf=%q,level=\"0\"} %d\n", m.name, m.ssts)
+	}
+	header("kv_memtable_entries", "gauge", "Keys in the memtable of each family.")
+	for _, m := range stats {
+		fmt.Fprintf(out, "kv_memtable_entries{cf=%q} %d\n", m.name, m.memtableEntries)
+	}
+	header("kv_memtable_bytes", "gauge", "Bytes of the keys and values in the memtable of each family.")
+	for _, m := range stats {
+		fmt.Fprintf(out, "kv_memtable_bytes{cf=%q} %d\n", m.name, m.memtableBytes)
+	}
+}
+
+// histogramSnapshot is a copy of a histogram, to write without its lock.
+type histogramSnapshot struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return histogramSnapshot{append([]uint64{}, h.counts...), h.sum, h.count}
+}
+
+// writeHistogram writes the cumulative buckets of h, its sum and its count.
+func writeHistogram(out io.Writer, name, labels string, h *histogram) {
+	s := h.snapshot()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += s.counts[i]
+		fmt.Fprintf(out, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, s.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(out, "%s_sum%s %s\n", name, labels, formatFloat(s.sum))
+	fmt.Fprintf(out, "%s_count%s %d\n", name, labels, s.count)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var metricLine = regexp.MustCompile(`^([a-z_]+)(\{[^}]*\})? ([0-9.e+-]+|\+Inf)$`)
+
+// scrapeMetrics reads /metrics into values by name and labels, checking
+// every line is in the text format.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	MetricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	values := map[string]float64{}
+	typed := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			typed[strings.Fields(line)[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		m := metricLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("Bad metric line %q", line)
+		}
+		base := regexp.MustCompile(`_(bucket|sum|count)$`).ReplaceAllString(m[1], "")
+		if !typed[m[1]] && !typed[base] {
+			t.Fatalf("Metric %s has no type", m[1])
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatalf("Bad value in %q", line)
+		}
+		values[m[1]+m[2]] = v
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	useTempDir(t)
+	defer func(files int) { regionCompactFiles = files }(regionCompactFiles)
+	regionCompactFiles = 2
+	defer func() { sstCompression = nil }()
+	sstCompression = []string{"snappy"}
+	db := openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	mem = db
+	cf, err := db.CreateColumnFamily("docs", CFOptions{FlushThreshold: 1000, RegionSplitBytes: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating family: %v", err)
+	}
+	before := scrapeMetrics(t)
+
+	for i := 0; i < 10; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), jsonValue(i))
+		cf.Set([]byte(fmt.Sprintf("doc%d", i)), jsonValue(i))
+	}
+	for i := 0; i < 4; i++ {
+		db.Get([]byte(fmt.Sprintf("key%d", i)))
+	}
+	db.Del([]byte("key0"))
+	// The reads of conditional writes and merges aren't gets
+	db.SetIfAbsent([]byte("key0"), jsonValue(0))
+	db.mergeAndGet([]byte("count"), "add", []byte("1"))
+	cf.Set([]byte("doc99"), jsonValue(99))
+
+	after := scrapeMetrics(t)
+	delta := func(name string) float64 { return after[name] - before[name] }
+	for name, expected := range map[string]float64{
+		`kv_operations_total{op="set"}`:                            22,
+		`kv_operations_total{op="get"}`:                            4,
+		`kv_operations_total{op="del"}`:                            1,
+		`kv_operation_duration_seconds_count{op="set"}`:            22,
+		`kv_operation_duration_seconds_bucket{op="get",le="+Inf"}`: 4,
+		`kv_wal_records_total`:                                     24,
+	} {
+		if delta(name) != expected {
+			t.Fatalf("Expected %s to go up by %v, got %v", name, expected, delta(name))
+		}
+	}
+	// The default family flushes every 3 writes, taking the other along,
+	// and the regions of docs get compacted
+	for _, name := range []string{"kv_wal_bytes_total", "kv_wal_fsync_duration_seconds_count", "kv_flush_duration_seconds_count",
+		"kv_write_stall_duration_seconds_count", "kv_compaction_duration_seconds_count", "kv_sst_opens_total", "kv_sst_blocks_read_total"} {
+		if delta(name) <= 0 {
+			t.Fatalf("Expected %s to go up", name)
+		}
+	}
+	if after["kv_sst_block_bytes_decompressed_total"] <= after["kv_sst_block_bytes_read_total"] {
+		t.Fatal("Expected the blocks read to be compressed")
+	}
+	if after["kv_block_cache_hits_total"] != 0 || after["kv_block_cache_misses_total"] != after["kv_sst_blocks_read_total"] {
+		t.Fatal("Expected every block read to be a block cache miss")
+	}
+	if after[`kv_flush_duration_seconds_bucket{le="10"}`] > after["kv_flush_duration_seconds_count"] {
+		t.Fatal("Expected cumulative buckets")
+	}
+
+	ssts, _ := countSSTFiles(sstDir)
+	if after[`kv_sst_files{cf="default",level="0"}`] != float64(ssts) || ssts == 0 {
+		t.Fatalf("Expected %d SSTs in the default family, got %v", ssts, after[`kv_sst_files{cf="default",level="0"}`])
+	}
+	if after[`kv_memtable_entries{cf="docs"}`] != float64(cf.values.Len()) || after[`kv_memtable_bytes{cf="docs"}`] < float64(len(jsonValue(99))) {
+		t.Fatalf("Unexpected memtable of docs: %v entries, %v bytes", after[`kv_memtable_entries{cf="docs"}`], after[`kv_memtable_bytes{cf="docs"}`])
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// archivedSegment is a sealed WAL segment kept in the archive, with the time
+// it was sealed at.
+type archivedSegment struct {
+	first  uint64
+	sealed time.Time
+	path   string
+}
+
+func archivedSegments(archive string) ([]archivedSegment, error) {
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		return nil, err
+	}
+	var segments []archivedSegment
+	for _, entry := range entries {
+		var first uint64
+		var sealed int64
+		if _, err := fmt.Sscanf(entry.Name(), "wal%d-%d.txt", &first, &sealed); err != nil {
+			continue
+		}
+		segments = append(segments, archivedSegment{first, time.Unix(sealed, 0), archive + "/" + entry.Name()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+// pruneWALArchive deletes the archived segments a restore from the oldest
+// backup of repo doesn't need, the ones it already has every write of. last
+// is the sequence number of the last record archived. Without a backup,
+// everything is kept.
+func pruneWALArchive(archive, repo string, last uint64) error {
+	backups, err := listBackups(repo)
+	if err != nil || len(backups) == 0 {
+		return err
+	}
+	manifest, err := readManifest(repo + "/" + backups[0] + "/MANIFEST")
+	if err != nil {
+		return err
+	}
+
+	segments, err := archivedSegments(archive)
+	if err != nil {
+		return err
+	}
+	for i, segment := range segments {
+		// The last record of a segment is the one before the next one starts
+		end := last
+		if i+1 < len(segments) {
+			end = segments[i+1].first - 1
+		}
+		if end > manifest.Seq {
+			break
+		}
+		if err := os.Remove(segment.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreToPoint brings a store restored from a checkpoint in dir forward to
+// a point in time, by appending the archived WAL records written after the
+// checkpoint to its WAL. It stops before the first write past stopSeq or
+// written after stopTime, whichever comes first; zero means no limit. A batch
+// is kept or dropped as a whole. The records are replayed by recoverFromWAL,
+// once here to check them and then whenever the store is opened.
+//
+// Writes still in the live WAL of the source store haven't been archived yet;
+// liveWAL, if set, is read after the archive to reach them too.
+//
+// It returns the sequence number of the last write kept.
+func RestoreToPoint(archive, liveWAL, dir string, stopSeq uint64, stopTime time.Time) (uint64, error) {
+	segments, err := archivedSegments(archive)
+	if err != nil {
+		return 0, err
+	}
+	sources := make([]string, 0, len(segments)+1)
+	for _, segment := range segments {
+		sources = append(sources, segment.path)
+	}
+	if liveWAL != "" {
+		sources = append(sources, liveWAL)
+	}
+
+	wal, err := os.OpenFile(dir+"/wal.txt", os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	last, end, err := lastWALSeq(wal)
+	if err != nil {
+		wal.Close()
+		return 0, err
+	}
+	if err := wal.Truncate(end); err != nil {
+		wal.Close()
+		return 0, err
+	}
+	if _, err := wal.Seek(end, io.SeekStart); err != nil {
+		wal.Close()
+		return 0, err
+	}
+
+	// The records copied are encrypted again under a key of the restored WAL
+	var key *fileKey
+	if encryption != nil {
+		if key, err = newFileKey(); err != nil {
+			wal.Close()
+			return 0, err
+		}
+	}
+	writer := bufio.NewWriter(wal)
+	stopped := false
+	for _, source := range sources {
+		if stopped {
+			break
+		}
+		stopped, last, err = appendWALRecords(writer, key, source, last, stopSeq, stopTime)
+		if err != nil {
+			wal.Close()
+			return 0, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		wal.Close()
+		return 0, err
+	}
+	start := time.Now()
+	if err := wal.Sync(); err != nil {
+		wal.Close()
+		return 0, err
+	}
+	metrics.walFsync.since(start)
+	if err := wal.Close(); err != nil {
+		return 0, err
+	}
+
+	seq, err := replayRestoredWAL(dir)
+	if err != nil {
+		return 0, err
+	}
+	if seq != last {
+		return 0, fmt.Errorf("Replay stopped at seq %d, expected %d", seq, last)
+	}
+	return last, nil
+}
+
+// lastWALSeq returns the sequence number of the last whole record in a WAL
+// and the offset right after it.
+func lastWALSeq(wal *os.File) (uint64, int64, error) {
+	_, last, err := readWALHeader(wal)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := wal.Seek(walHeaderSize, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReader(wal)
+	offset := int64(walHeaderSize)
+	for {
+		rec, err := readWALRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return last, offset, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		last = rec.seq
+		offset += rec.size()
+	}
+}
+
+// appendWALRecords copies the records of source after last to out, until
+// one is past the stop point, encrypting them with key if it isn't nil. It
+// reports whether it stopped there.
+func appendWALRecords(out io.Writer, key *fileKey, source string, last, stopSeq uint64, stopTime time.Time) (bool, uint64, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return false, last, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(walHeaderSize, io.SeekStart); err != nil {
+		return false, last, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		rec, err := readWALRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A torn record can only be the end of the live WAL
+			return false, last, nil
+		}
+		if err != nil {
+			return false, last, err
+		}
+		if rec.seq <= last {
+			continue
+		}
+
+		first := rec.seq
+		if Cmd(rec.op) == Batch {
+			records, err := rec.batchRecords()
+			if err != nil {
+				return false, last, err
+			}
+			first = rec.seq - uint64(len(records)) + 1
+		}
+		if first != last+1 {
+			return false, last, fmt.Errorf("Missing WAL records %d to %d in the archive", last+1, first-1)
+		}
+		if (stopSeq != 0 && rec.seq > stopSeq) || (!stopTime.IsZero() && rec.time > stopTime.UnixNano()) {
+			return true, last, nil
+		}
+
+		sealed, err := key.sealRecord(rec.encode())
+		if err != nil {
+			return false, last, err
+		}
+		if _, err := out.Write(sealed); err != nil {
+			return false, last, err
+		}
+		last = rec.seq
+	}
+}
+
+// replayRestoredWAL opens the store in dir and recovers it from its WAL,
+// returning the sequence number it got to.
+func replayRestoredWAL(dir string) (uint64, error) {
+	db, err := OpenStore(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.wal.file.Close()
+	return db.wal.seq, nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// The messages of kvrpc.proto. Their names and fields follow the .proto so
+// the API reads the same whatever the transport.
+
+type RPCHeader struct {
+	CallID   uint64
+	Deadline int64
+	CF       string
+}
+
+type GetRequest struct {
+	Header RPCHeader
+	Key    []byte
+}
+
+type GetResponse struct {
+	Value []byte
+	Found bool
+}
+
+type PutRequest struct {
+	Header RPCHeader
+	Key    []byte
+	Value  []byte
+}
+
+// PutResponse carries the sequence number of the write, to Watch from.
+type PutResponse struct {
+	Seq uint64
+}
+
+type DeleteRequest struct {
+	Header RPCHeader
+	Key    []byte
+}
+
+type DeleteResponse struct {
+	Found bool
+	Seq   uint64
+}
+
+type BatchOp struct {
+	CF     string
+	Delete bool
+	Key    []byte
+	Value  []byte
+}
+
+type BatchWriteRequest struct {
+	Header RPCHeader
+	Ops    []BatchOp
+}
+
+type BatchWriteResponse struct {
+	Seq uint64
+}
+
+type ScanRequest struct {
+	Header RPCHeader
+	Start  []byte
+	End    []byte
+	Limit  int
+}
+
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+type WatchRequest struct {
+	Header RPCHeader
+	Prefix string
+	Since  uint64
+}
+
+// The messages net/rpc needs on top of the .proto ones to carry streams and
+// cancellation: a stream is opened, then pulled with Recv until EOF.
+
+type StreamOpened struct {
+	Stream uint64
+}
+
+type RecvRequest struct {
+	Header RPCHeader
+	Stream uint64
+	// Max is how many messages one Recv may return
+	Max int
+}
+
+type RecvResponse struct {
+	Pairs  []KeyValue
+	Events []Event
+	EOF    bool
+}
+
+type CloseStreamRequest struct {
+	Stream uint64
+}
+
+type CancelRequest struct {
+	CallID uint64
+}
+
+// Done reports whether there was something to close or cancel.
+type Done struct {
+	Done bool
+}
+
+var ErrStreamNotFound = errors.New("Stream not found")
+
+// recvMax is the default number of messages of a Recv.
+const recvMax = 128
+
+// ServeRPC accepts RPC clients on l until it is closed. Every connection has
+// its own service, so the streams and calls a client leaves behind are
+// dropped when it goes away.
+func ServeRPC(l net.Listener, db *memDB) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveRPCConn(conn, db)
+	}
+}
+
+func serveRPCConn(conn net.Conn, db *memDB) {
+	s := &rpcService{db: db, calls: map[uint64]context.CancelFunc{}, streams: map[uint64]*rpcStream{}}
+	server := rpc.NewServer()
+	server.RegisterName("KV", s)
+	server.ServeConn(conn)
+	s.closeAll()
+}
+
+// rpcService is what net/rpc calls: its exported methods are the RPCs.
+type rpcService struct {
+	db         *memDB
+	mu         sync.Mutex
+	calls      map[uint64]context.CancelFunc
+	streams    map[uint64]*rpcStream
+	nextStream uint64
+}
+
+// rpcStream is an open Scan or Watch. Its context carries the deadline of
+// the call that opened it.
+type rpcStream struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	it     *Iterator
+	limit  int
+	sent   int
+	family *memDB
+	events <-chan Event
+}
+
+// begin makes the context of a call, done at its deadline or when the
+// client cancels it. end must be called when the call returns.
+func (s *rpcService) begin(h RPCHeader) (ctx context.Context, end func()) {
+	ctx, cancel := s.context(h)
+	s.mu.Lock()
+	s.calls[h.CallID] = cancel
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.calls, h.CallID)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+func (s *rpcService) context(h RPCHeader) (context.Context, context.CancelFunc) {
+	if h.Deadline != 0 {
+		return context.WithDeadline(context.Background(), time.Unix(0, h.Deadline))
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (s *rpcService) family(h RPCHeader) (*memDB, error) {
+	return s.db.Family(h.CF)
+}
+
+func (s *rpcService) Get(req GetRequest, resp *GetResponse) error {
+	ctx, end := s.begin(req.Header)
+	defer end()
+	family, err := s.family(req.Header)
+	if err != nil {
+		return err
+	}
+
+	value, err := family.GetContext(ctx, req.Key)
+	if err != nil && err.Error() == "Key not found" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Value, resp.Found = value, true
+	return nil
+}
+
+func (s *rpcService) Put(req PutRequest, resp *PutResponse) error {
+	ctx, end := s.begin(req.Header)
+	defer end()
+	family, err := s.family(req.Header)
+	if err != nil {
+		return err
+	}
+
+	family.mu.Lock()
+	defer family.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := family.SetWithNoLock(req.Key, req.Value); err != nil {
+		return err
+	}
+	resp.Seq = family.wal.seq
+	return nil
+}
+
+func (s *rpcService) Delete(req DeleteRequest, resp *DeleteResponse) error {
+	ctx, end := s.begin(req.Header)
+	defer end()
+	family, err := s.family(req.Header)
+	if err != nil {
+		return err
+	}
+
+	family.mu.Lock()
+	defer family.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = family.DelWithNoLock(req.Key)
+	if err != nil && err.Error() == "Key not found" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Found, resp.Seq = true, family.wal.seq
+	return nil
+}
+
+func (s *rpcService) BatchWrite(req BatchWriteRequest, resp *BatchWriteResponse) error {
+	ctx, end := s.begin(req.Header)
+	defer end()
+
+	b := &WriteBatch{}
+	for _, op := range req.Ops {
+		if op.Delete {
+			b.Del(op.CF, op.Key)
+		} else {
+			b.Set(op.CF, op.Key, op.Value)
+		}
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.db.WriteWithNoLock(b); err != nil {
+		return err
+	}
+	resp.Seq = s.db.wal.seq
+	return nil
+}
+
+// Scan opens a stream of the keys in a range, read from one iterator so the
+// whole stream sees the store as it was when it was opened.
+func (s *rpcService) Scan(req ScanRequest, resp *StreamOpened) error {
+	family, err := s.family(req.Header)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.context(req.Header)
+	var start, end []byte
+	if len(req.Start) > 0 {
+		start = req.Start
+	}
+	if len(req.End) > 0 {
+		end = req.End
+	}
+	it, err := family.NewIteratorContext(ctx, start, end)
+	if err != nil {
+		cancel()
+		return err
+	}
+	resp.Stream = s.open(&rpcStream{ctx: ctx, cancel: cancel, it: it, limit: req.Limit})
+	return nil
+}
+
+// Watch opens a stream of the writes to keys starting with a prefix.
+func (s *rpcService) Watch(req WatchRequest, resp *StreamOpened) error {
+	family, err := s.family(req.Header)
+	if err != nil {
+		return err
+	}
+	var events <-chan Event
+	if req.Since > 0 {
+		events, err = family.WatchFrom(req.Prefix, req.Since)
+		if err != nil {
+			return err
+		}
+	} else {
+		events = family.Watch(req.Prefix)
+	}
+	ctx, cancel := s.context(req.Header)
+	resp.Stream = s.open(&rpcStream{ctx: ctx, cancel: cancel, family: family, events: events})
+	return nil
+}
+
+func (s *rpcService) open(stream *rpcStream) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextStream++
+	s.streams[s.nextStream] = stream
+	return s.nextStream
+}
+
+// Recv returns the next messages of a stream. A Watch waits for at least one
+// event, so a Recv without a deadline may block until the next write.
+func (s *rpcService) Recv(req RecvRequest, resp *RecvResponse) error {
+	ctx, end := s.begin(req.Header)
+	defer end()
+	s.mu.Lock()
+	stream, ok := s.streams[req.Stream]
+	s.mu.Unlock()
+	if !ok {
+		return ErrStreamNotFound
+	}
+	max := req.Max
+	if max <= 0 {
+		max = recvMax
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.it != nil {
+		return stream.recvPairs(ctx, max, resp)
+	}
+	return stream.recvEvents(ctx, max, resp)
+}
+
+func (stream *rpcStream) recvPairs(ctx context.Context, max int, resp *RecvResponse) error {
+	for len(resp.Pairs) < max {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if stream.limit > 0 && stream.sent >= stream.limit {
+			resp.EOF = true
+			return nil
+		}
+		if !stream.it.Next() {
+			if err := stream.it.Err(); err != nil {
+				return err
+			}
+			resp.EOF = true
+			return nil
+		}
+		resp.Pairs = append(resp.Pairs, KeyValue{stream.it.Key(), stream.it.Value()})
+		stream.sent++
+	}
+	return nil
+}
+
+func (stream *rpcStream) recvEvents(ctx context.Context, max int, resp *RecvResponse) error {
+	select {
+	case ev, ok := <-stream.events:
+		if !ok {
+			resp.EOF = true
+			return nil
+		}
+		resp.Events = append(resp.Events, ev)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stream.ctx.Done():
+		return stream.ctx.Err()
+	}
+
+	// Then whatever else is already there
+	for len(resp.Events) < max {
+		select {
+		case ev, ok := <-stream.events:
+			if !ok {
+				resp.EOF = true
+				return nil
+			}
+			resp.Events = append(resp.Events, ev)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// CloseStream drops a stream before its end.
+func (s *rpcService) CloseStream(req CloseStreamRequest, resp *Done) error {
+	s.mu.Lock()
+	stream, ok := s.streams[req.Stream]
+	delete(s.streams, req.Stream)
+	s.mu.Unlock()
+	if ok {
+		stream.close()
+	}
+	resp.Done = ok
+	return nil
+}
+
+// Cancel cancels a call still running.
+func (s *rpcService) Cancel(req CancelRequest, resp *Done) error {
+	s.mu.Lock()
+	cancel, ok := s.calls[req.CallID]
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	resp.Done = ok
+	return nil
+}
+
+func (stream *rpcStream) close() {
+	// Cancelled first so a Recv holding the stream lets go of it
+	stream.cancel()
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.it != nil {
+		stream.it.Close()
+	}
+	if stream.events != nil {
+		stream.family.Unwatch(stream.events)
+	}
+}
+
+func (s *rpcService) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cancel := range s.calls {
+		cancel()
+	}
+	for id, stream := range s.streams {
+		stream.close()
+		delete(s.streams, id)
+	}
+}
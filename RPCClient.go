@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// KVServiceClient is the client of the KV service of kvrpc.proto, shaped like
+// what protoc-gen-go-grpc generates: one method per RPC, and a stream to
+// Recv from for the server-streaming ones. A context's deadline goes to the
+// server with the call, and cancelling it cancels the call there.
+type KVServiceClient interface {
+	Get(ctx context.Context, in *GetRequest) (*GetResponse, error)
+	Put(ctx context.Context, in *PutRequest) (*PutResponse, error)
+	Delete(ctx context.Context, in *DeleteRequest) (*DeleteResponse, error)
+	BatchWrite(ctx context.Context, in *BatchWriteRequest) (*BatchWriteResponse, error)
+	Scan(ctx context.Context, in *ScanRequest) (KV_ScanClient, error)
+	Watch(ctx context.Context, in *WatchRequest) (KV_WatchClient, error)
+}
+
+// KV_ScanClient returns the pairs of a Scan, then io.EOF. Close drops the
+// stream early.
+type KV_ScanClient interface {
+	Recv() (*KeyValue, error)
+	Close() error
+}
+
+// KV_WatchClient returns the events of a Watch until it is closed.
+type KV_WatchClient interface {
+	Recv() (*Event, error)
+	Close() error
+}
+
+type kvServiceClient struct {
+	cc    *rpc.Client
+	calls uint64
+}
+
+func NewKVServiceClient(cc *rpc.Client) KVServiceClient {
+	return &kvServiceClient{cc: cc}
+}
+
+// invoke makes a call, giving up on it when ctx is done. h is the header of
+// args, filled in before it is sent.
+func (c *kvServiceClient) invoke(ctx context.Context, method string, h *RPCHeader, args, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	h.CallID = atomic.AddUint64(&c.calls, 1)
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Deadline = deadline.UnixNano()
+	}
+
+	call := c.cc.Go("KV."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return rpcError(call.Error)
+	case <-ctx.Done():
+		c.cc.Go("KV.Cancel", CancelRequest{h.CallID}, &Done{}, nil)
+		return ctx.Err()
+	}
+}
+
+// rpcError turns the errors the server sent as text back into the ones
+// callers can compare against.
+func rpcError(err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	for _, known := range []error{context.DeadlineExceeded, context.Canceled, ErrColumnFamilyNotFound, ErrColumnFamilyDropped, ErrStreamNotFound, ErrReadOnlyReplica} {
+		if string(serverErr) == known.Error() {
+			return known
+		}
+	}
+	return err
+}
+
+func (c *kvServiceClient) Get(ctx context.Context, in *GetRequest) (*GetResponse, error) {
+	out := &GetResponse{}
+	if err := c.invoke(ctx, "Get", &in.Header, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvServiceClient) Put(ctx context.Context, in *PutRequest) (*PutResponse, error) {
+	out := &PutResponse{}
+	if err := c.invoke(ctx, "Put", &in.Header, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvServiceClient) Delete(ctx context.Context, in *DeleteRequest) (*DeleteResponse, error) {
+	out := &DeleteResponse{}
+	if err := c.invoke(ctx, "Delete", &in.Header, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvServiceClient) BatchWrite(ctx context.Context, in *BatchWriteRequest) (*BatchWriteResponse, error) {
+	out := &BatchWriteResponse{}
+	if err := c.invoke(ctx, "BatchWrite", &in.Header, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kvServiceClient) Scan(ctx context.Context, in *ScanRequest) (KV_ScanClient, error) {
+	stream, err := c.openStream(ctx, "Scan", &in.Header, in)
+	if err != nil {
+		return nil, err
+	}
+	return &kvScanClient{stream}, nil
+}
+
+func (c *kvServiceClient) Watch(ctx context.Context, in *WatchRequest) (KV_WatchClient, error) {
+	stream, err := c.openStream(ctx, "Watch", &in.Header, in)
+	if err != nil {
+		return nil, err
+	}
+	return &kvWatchClient{stream}, nil
+}
+
+// clientStream pulls the messages of a stream a Recv at a time.
+type clientStream struct {
+	c      *kvServiceClient
+	ctx    context.Context
+	id     uint64
+	pairs  []KeyValue
+	events []Event
+	eof    bool
+	err    error
+}
+
+func (c *kvServiceClient) openStream(ctx context.Context, method string, h *RPCHeader, args interface{}) (*clientStream, error) {
+	opened := &StreamOpened{}
+	if err := c.invoke(ctx, method, h, args, opened); err != nil {
+		return nil, err
+	}
+	return &clientStream{c: c, ctx: ctx, id: opened.Stream}, nil
+}
+
+// fill reads the next messages once the ones already read are used up. It
+// reports whether there are any.
+func (s *clientStream) fill() bool {
+	for len(s.pairs) == 0 && len(s.events) == 0 {
+		if s.err != nil {
+			return false
+		}
+		if s.eof {
+			s.err = io.EOF
+			return false
+		}
+		req := &RecvRequest{Stream: s.id}
+		resp := &RecvResponse{}
+		if err := s.c.invoke(s.ctx, "Recv", &req.Header, req, resp); err != nil {
+			s.Close()
+			s.err = err
+			return false
+		}
+		s.pairs, s.events, s.eof = resp.Pairs, resp.Events, resp.EOF
+		if s.eof {
+			// The server is done with it
+			s.Close()
+		}
+	}
+	return true
+}
+
+// Close drops the stream on the server. It can be called more than once.
+func (s *clientStream) Close() error {
+	if s.id == 0 {
+		return nil
+	}
+	req := CloseStreamRequest{s.id}
+	s.id = 0
+	return s.c.cc.Call("KV.CloseStream", req, &Done{})
+}
+
+type kvScanClient struct {
+	*clientStream
+}
+
+func (s *kvScanClient) Recv() (*KeyValue, error) {
+	if !s.fill() {
+		return nil, s.err
+	}
+	pair := s.pairs[0]
+	s.pairs = s.pairs[1:]
+	return &pair, nil
+}
+
+type kvWatchClient struct {
+	*clientStream
+}
+
+func (s *kvWatchClient) Recv() (*Event, error) {
+	if !s.fill() {
+		return nil, s.err
+	}
+	ev := s.events[0]
+	s.events = s.events[1:]
+	return &ev, nil
+}
+
+var ErrKeyNotFound = errors.New("Key not found")
+
+// RPCClient is a typed wrapper around KVServiceClient, for Go services that
+// just want keys and values.
+type RPCClient struct {
+	conn   *rpc.Client
+	client KVServiceClient
+	cf     string
+}
+
+// DialRPC connects to a store serving RPCs on addr, like one started with
+// -rpc.
+func DialRPC(addr string) (*RPCClient, error) {
+	conn, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCClient{conn: conn, client: NewKVServiceClient(conn)}, nil
+}
+
+// Family returns a client of the same connection working on another column
+// family.
+func (c *RPCClient) Family(cf string) *RPCClient {
+	return &RPCClient{conn: c.conn, client: c.client, cf: cf}
+}
+
+func (c *RPCClient) Close() error {
+	return c.conn.Close()
+}
+
+// Get returns ErrKeyNotFound if the key isn't there.
+func (c *RPCClient) Get(ctx context.Context, key []byte) ([]byte, error) {
+	resp, err := c.client.Get(ctx, &GetRequest{Header: RPCHeader{CF: c.cf}, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Found {
+		return nil, ErrKeyNotFound
+	}
+	return resp.Value, nil
+}
+
+// Put returns the sequence number of the write.
+func (c *RPCClient) Put(ctx context.Context, key, value []byte) (uint64, error) {
+	resp, err := c.client.Put(ctx, &PutRequest{Header: RPCHeader{CF: c.cf}, Key: key, Value: value})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Seq, nil
+}
+
+// Delete returns ErrKeyNotFound if there was nothing to delete.
+func (c *RPCClient) Delete(ctx context.Context, key []byte) (uint64, error) {
+	resp, err := c.client.Delete(ctx, &DeleteRequest{Header: RPCHeader{CF: c.cf}, Key: key})
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Found {
+		return 0, ErrKeyNotFound
+	}
+	return resp.Seq, nil
+}
+
+// BatchWrite applies ops all or nothing. An op without a family goes to the
+// client's.
+func (c *RPCClient) BatchWrite(ctx context.Context, ops ...BatchOp) (uint64, error) {
+	for i := range ops {
+		if ops[i].CF == "" {
+			ops[i].CF = c.cf
+		}
+	}
+	resp, err := c.client.BatchWrite(ctx, &BatchWriteRequest{Ops: ops})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Seq, nil
+}
+
+// Scan calls fn with the keys from start to end, in order, until fn returns
+// an error, which Scan returns. A limit of 0 is no limit.
+func (c *RPCClient) Scan(ctx context.Context, start, end []byte, limit int, fn func(key, value []byte) error) error {
+	stream, err := c.client.Scan(ctx, &ScanRequest{Header: RPCHeader{CF: c.cf}, Start: start, End: end, Limit: limit})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	for {
+		pair, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(pair.Key, pair.Value); err != nil {
+			return err
+		}
+	}
+}
+
+// Watch calls fn with the writes to keys starting with prefix, after the one
+// numbered since if it isn't 0, until ctx is done or fn returns an error.
+// It returns io.EOF if the server closed the watch, after an EventOverflow.
+func (c *RPCClient) Watch(ctx context.Context, prefix string, since uint64, fn func(Event) error) error {
+	stream, err := c.client.Watch(ctx, &WatchRequest{Header: RPCHeader{CF: c.cf}, Prefix: prefix, Since: since})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := fn(*ev); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRPC(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+	if _, err := db.CreateColumnFamily("users", CFOptions{}); err != nil {
+		t.Fatalf("Error creating column family: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go ServeRPC(l, db)
+
+	client, err := DialRPC(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	// Get, Put and Delete
+	if _, err := client.Get(ctx, []byte("a")); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	first, err := client.Put(ctx, []byte("a"), []byte("1"))
+	if err != nil {
+		t.Fatalf("Error putting: %v", err)
+	}
+	if v, err := client.Get(ctx, []byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Expected 1, got %s (%v)", v, err)
+	}
+	if _, err := client.Delete(ctx, []byte("a")); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	if _, err := client.Delete(ctx, []byte("a")); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound deleting again, got %v", err)
+	}
+	if _, err := client.Family("missing").Get(ctx, []byte("a")); err != ErrColumnFamilyNotFound {
+		t.Fatalf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+
+	// A batch across two families
+	users := client.Family("users")
+	if _, err := users.BatchWrite(ctx, BatchOp{Key: []byte("u1"), Value: []byte("ann")}, BatchOp{CF: "default", Key: []byte("count"), Value: []byte("1")}); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	if v, err := users.Get(ctx, []byte("u1")); err != nil || string(v) != "ann" {
+		t.Fatalf("Expected ann, got %s (%v)", v, err)
+	}
+	if v, err := client.Get(ctx, []byte("count")); err != nil || string(v) != "1" {
+		t.Fatalf("Expected count 1, got %s (%v)", v, err)
+	}
+
+	// Watch from the first Put: its delete, then the batch
+	errStop := errors.New("stop")
+	var events []Event
+	err = client.Watch(ctx, "", first, func(ev Event) error {
+		events = append(events, ev)
+		if len(events) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || events[0].Type != EventDelete || string(events[1].Key) != "count" {
+		t.Fatalf("Unexpected watch: %v %+v", err, events)
+	}
+
+	// Scan, over more keys than one Recv returns
+	var ops []BatchOp
+	for i := 0; i < 300; i++ {
+		ops = append(ops, BatchOp{Key: []byte(fmt.Sprintf("k%03d", i)), Value: []byte(fmt.Sprint(i))})
+	}
+	if _, err := client.BatchWrite(ctx, ops...); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	count := 0
+	err = client.Scan(ctx, []byte("k"), []byte("l"), 0, func(key, value []byte) error {
+		if expected := fmt.Sprintf("k%03d", count); string(key) != expected {
+			return fmt.Errorf("expected %s, got %s", expected, key)
+		}
+		count++
+		return nil
+	})
+	if err != nil || count != 300 {
+		t.Fatalf("Expected 300 keys, got %d (%v)", count, err)
+	}
+	count = 0
+	client.Scan(ctx, []byte("k"), nil, 10, func(key, value []byte) error { count++; return nil })
+	if count != 10 {
+		t.Fatalf("Expected the limit to stop the scan at 10, got %d", count)
+	}
+
+	// A live watch, cancelled by its context
+	watchCtx, cancel := context.WithCancel(ctx)
+	got := make(chan Event, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- users.Watch(watchCtx, "u", 0, func(ev Event) error {
+			got <- ev
+			return nil
+		})
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		users.Put(ctx, []byte("u2"), []byte("bob"))
+		select {
+		case ev := <-got:
+			if string(ev.Key) != "u2" || ev.CF != "users" {
+				t.Fatalf("Unexpected event: %+v", ev)
+			}
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("No event from the watch")
+			}
+			continue
+		}
+		break
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	db.mu.Lock()
+	watchers := len(db.hub.watchers)
+	db.mu.Unlock()
+	if watchers != 0 {
+		t.Fatalf("Expected the server to drop the watch, %d left", watchers)
+	}
+
+	// A live watch running into its deadline
+	shortCtx, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := client.Watch(shortCtx, "nothing", 0, func(Event) error { return nil }); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The deadline is enforced by the server too
+	var resp GetResponse
+	err = client.conn.Call("KV.Get", GetRequest{Header: RPCHeader{Deadline: time.Now().Add(-time.Second).UnixNano()}, Key: []byte("count")}, &resp)
+	if rpcError(err) != context.DeadlineExceeded {
+		t.Fatalf("Expected the server to report context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestReadPathCancellation(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+	for i := 0; i < 10; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+	if err := db.flushAll(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if v, err := db.GetContext(ctx, []byte("key3")); err != nil || string(v) != "value" {
+		t.Fatalf("Expected value, got %s (%v)", v, err)
+	}
+	it, err := db.NewIteratorContext(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %v", err)
+	}
+	defer it.Close()
+	if !it.Next() {
+		t.Fatalf("Expected a key, got %v", it.Err())
+	}
+
+	cancel()
+	if _, err := db.GetContext(ctx, []byte("key3")); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := getFromSST(ctx, db.dir, []byte("key3"), nil); err != context.Canceled {
+		t.Fatalf("Expected the SST lookup to stop, got %v", err)
+	}
+	if it.Next() || it.Err() != context.Canceled {
+		t.Fatalf("Expected the iterator to stop with context.Canceled, got %v", it.Err())
+	}
+}
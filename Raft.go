@@ -0,0 +1,1409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In Raft mode the store is replicated over several nodes. Every write, and
+// every read so that reads are linearizable too, is an entry of a Raft log,
+// applied to the store only once a majority of the members has it. The
+// store is the state machine: the index of the last entry applied is
+// written in the _raft family, in the same batch as the entry's writes, so
+// a restarted node carries on from where its store is. A snapshot is a
+// checkpoint of the store, sent as the tar replicas bootstrap from.
+//
+// The node itself is deterministic: it only changes on Tick and Step and
+// sends its messages through a transport, so a test can run a whole cluster
+// in one goroutine.
+
+const raftFamily = "_raft"
+
+var raftAppliedKey = []byte("applied")
+
+var (
+	// raftTickInterval is the clock of the nodes. Elections time out after
+	// raftElectionTicks to twice that, leaders send heartbeats every
+	// raftHeartbeatTicks.
+	raftTickInterval   = 50 * time.Millisecond
+	raftElectionTicks  = 10
+	raftHeartbeatTicks = 2
+	// raftMaxEntries is the most entries sent in one message
+	raftMaxEntries = 64
+	// raftSnapshotEvery is how many applied entries the log keeps before
+	// they are dropped, followers further behind get a snapshot
+	raftSnapshotEvery = uint64(1000)
+	// raftProposalTimeout is how long the HTTP API waits for a write to be
+	// committed
+	raftProposalTimeout = 5 * time.Second
+)
+
+var ErrNotLeader = errors.New("Not the leader")
+var ErrProposalLost = errors.New("Proposal lost to a new leader")
+var ErrProposalUnknown = errors.New("Proposal outcome unknown, leadership lost")
+var ErrMembershipChange = errors.New("A membership change is in progress")
+
+type raftEntryType byte
+
+const (
+	raftNoop raftEntryType = iota
+	// raftCommand holds a batch, encoded as the records of a WAL batch
+	raftCommand
+	// raftRead holds cf\x00key, read when applied
+	raftRead
+	// raftConfig holds the members, ID to address, as JSON
+	raftConfig
+)
+
+type raftEntry struct {
+	Term  uint64
+	Index uint64
+	Type  raftEntryType
+	Data  []byte
+}
+
+// encode lays an entry out as its term, index and type, then its data
+// prefixed with its length.
+func (e raftEntry) encode() []byte {
+	buf := make([]byte, 21, 21+len(e.Data))
+	binary.LittleEndian.PutUint64(buf, e.Term)
+	binary.LittleEndian.PutUint64(buf[8:], e.Index)
+	buf[16] = byte(e.Type)
+	binary.LittleEndian.PutUint32(buf[17:], uint32(len(e.Data)))
+	return append(buf, e.Data...)
+}
+
+func readRaftEntry(r io.Reader) (raftEntry, error) {
+	header := make([]byte, 21)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return raftEntry{}, err
+	}
+	e := raftEntry{
+		Term:  binary.LittleEndian.Uint64(header),
+		Index: binary.LittleEndian.Uint64(header[8:]),
+		Type:  raftEntryType(header[16]),
+		Data:  make([]byte, binary.LittleEndian.Uint32(header[17:])),
+	}
+	if _, err := io.ReadFull(r, e.Data); err != nil {
+		return raftEntry{}, io.ErrUnexpectedEOF
+	}
+	return e, nil
+}
+
+type raftMessageType int
+
+const (
+	raftAppend raftMessageType = iota
+	raftAppendReply
+	raftVote
+	raftVoteReply
+	raftInstallSnapshot
+)
+
+// raftMessage is any message between nodes, with the fields its type uses.
+type raftMessage struct {
+	Type     raftMessageType
+	From     string
+	FromAddr string
+	To       string
+	Term     uint64
+	// Append
+	PrevIndex uint64        `json:",omitempty"`
+	PrevTerm  uint64        `json:",omitempty"`
+	Entries   []raftEntry   `json:",omitempty"`
+	Commit    uint64        `json:",omitempty"`
+	Snapshot  *raftSnapshot `json:",omitempty"`
+	// Replies, Match being the last index known to match the leader's log,
+	// or a hint where to look when Success is false
+	Success bool   `json:",omitempty"`
+	Match   uint64 `json:",omitempty"`
+	// Vote
+	LastIndex uint64 `json:",omitempty"`
+	LastTerm  uint64 `json:",omitempty"`
+	Granted   bool   `json:",omitempty"`
+}
+
+// raftSnapshot is a checkpoint of the store with everything up to Index.
+type raftSnapshot struct {
+	Index   uint64
+	Term    uint64
+	Members map[string]string
+	Data    []byte
+}
+
+// raftTransport delivers messages to the node at addr, or drops them.
+// Send must not block.
+type raftTransport interface {
+	Send(addr string, m raftMessage)
+}
+
+type RaftOptions struct {
+	ID   string
+	Addr string
+	// Peers are the first members, ID to address, this node included. A
+	// node joining a running cluster has none and waits to be added.
+	Peers map[string]string
+}
+
+type raftState int
+
+const (
+	raftFollower raftState = iota
+	raftCandidate
+	raftLeader
+)
+
+func (s raftState) String() string {
+	return [...]string{"follower", "candidate", "leader"}[s]
+}
+
+type raftResult struct {
+	value []byte
+	err   error
+}
+
+// raftWaiter is an HTTP request waiting for its entry to be applied.
+type raftWaiter struct {
+	term uint64
+	ch   chan raftResult
+}
+
+// raftHardState is what a node must not forget across restarts.
+type raftHardState struct {
+	Term        uint64
+	Vote        string
+	SnapIndex   uint64
+	SnapTerm    uint64
+	SnapMembers map[string]string
+}
+
+type RaftNode struct {
+	id        string
+	addr      string
+	db        *memDB
+	dir       string
+	transport raftTransport
+
+	mu     sync.Mutex
+	state  raftState
+	term   uint64
+	vote   string
+	leader string
+	// log[0] stands for the entries dropped, up to the last snapshot
+	log         []raftEntry
+	commit      uint64
+	applied     uint64
+	snapMembers map[string]string
+	members     map[string]string
+	// addrs are the addresses of nodes that aren't members yet
+	addrs map[string]string
+
+	votes        map[string]bool
+	next         map[string]uint64
+	match        map[string]uint64
+	heardFrom    map[string]bool
+	snapshotSent map[string]int
+
+	ticks            int
+	electionElapsed  int
+	electionTimeout  int
+	heartbeatElapsed int
+	rand             *rand.Rand
+
+	outbox  []raftMessage
+	waiters map[uint64]*raftWaiter
+	// proposals and resolved count the waiters, for the test harness
+	proposals int
+	resolved  int
+
+	stateDirty bool
+	logRewrite bool
+	logSynced  int
+	logFile    *os.File
+	stop       chan struct{}
+}
+
+// StartRaftNode runs db, an open store, as a node of a Raft cluster, talking
+// to the other nodes over HTTP.
+func StartRaftNode(db *memDB, options RaftOptions) (*RaftNode, error) {
+	h := fnv.New64a()
+	h.Write([]byte(options.ID))
+	n, err := newRaftNode(db, options, newHTTPRaftTransport(), time.Now().UnixNano()^int64(h.Sum64()))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		ticker := time.NewTicker(raftTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.stop:
+				return
+			case <-ticker.C:
+				n.Tick()
+			}
+		}
+	}()
+	return n, nil
+}
+
+func newRaftNode(db *memDB, options RaftOptions, transport raftTransport, seed int64) (*RaftNode, error) {
+	if options.ID == "" {
+		return nil, errors.New("Raft node ID not provided")
+	}
+	n := &RaftNode{
+		id:           options.ID,
+		addr:         options.Addr,
+		db:           db,
+		dir:          storePath(db.wal.root, "Raft"),
+		transport:    transport,
+		addrs:        map[string]string{},
+		snapshotSent: map[string]int{},
+		rand:         rand.New(rand.NewSource(seed)),
+		waiters:      map[uint64]*raftWaiter{},
+		stop:         make(chan struct{}),
+	}
+	if _, err := db.Family(raftFamily); err == ErrColumnFamilyNotFound {
+		if _, err := db.CreateColumnFamily(raftFamily, CFOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(n.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	if n.snapMembers == nil && len(n.log) == 1 {
+		n.snapMembers = map[string]string{}
+		for id, addr := range options.Peers {
+			n.snapMembers[id] = addr
+		}
+		n.stateDirty = true
+	}
+
+	applied, err := n.readApplied()
+	if err != nil {
+		return nil, err
+	}
+	if applied < n.log[0].Index || applied > n.lastIndex() {
+		return nil, fmt.Errorf("Store applied up to %d, Raft log holds %d to %d", applied, n.log[0].Index, n.lastIndex())
+	}
+	n.applied, n.commit = applied, applied
+	n.recomputeMembers()
+	n.resetElectionTimer()
+	if err := n.persist(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Stop stops the node's clock. Messages still delivered are handled.
+func (n *RaftNode) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.stop:
+	default:
+		close(n.stop)
+		n.logFile.Close()
+	}
+}
+
+// load reads the hard state and the log, keeping the entries up to the
+// first torn one.
+func (n *RaftNode) load() error {
+	var hard raftHardState
+	data, err := os.ReadFile(n.dir + "/state")
+	if err == nil {
+		if err := json.Unmarshal(data, &hard); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	n.term, n.vote, n.snapMembers = hard.Term, hard.Vote, hard.SnapMembers
+	n.log = []raftEntry{{Index: hard.SnapIndex, Term: hard.SnapTerm}}
+
+	file, err := os.OpenFile(n.dir+"/log", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(file)
+	for {
+		e, err := readRaftEntry(r)
+		if err != nil {
+			break
+		}
+		if e.Index == n.lastIndex()+1 {
+			n.log = append(n.log, e)
+		}
+	}
+	file.Close()
+	// Rewritten without what was dropped or torn
+	n.logRewrite = true
+	return nil
+}
+
+// persist writes what changed since the last call, before any message
+// that depends on it is sent.
+func (n *RaftNode) persist() error {
+	if n.stateDirty {
+		data, err := json.Marshal(raftHardState{
+			Term:        n.term,
+			Vote:        n.vote,
+			SnapIndex:   n.log[0].Index,
+			SnapTerm:    n.log[0].Term,
+			SnapMembers: n.snapMembers,
+		})
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(n.dir+"/state.tmp", data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(n.dir+"/state.tmp", n.dir+"/state"); err != nil {
+			return err
+		}
+		n.stateDirty = false
+	}
+
+	if n.logRewrite {
+		var buf bytes.Buffer
+		for _, e := range n.log[1:] {
+			buf.Write(e.encode())
+		}
+		if err := os.WriteFile(n.dir+"/log.tmp", buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(n.dir+"/log.tmp", n.dir+"/log"); err != nil {
+			return err
+		}
+		if n.logFile != nil {
+			n.logFile.Close()
+		}
+		file, err := os.OpenFile(n.dir+"/log", os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		n.logFile = file
+		n.logSynced = len(n.log)
+		n.logRewrite = false
+		return nil
+	}
+	if n.logSynced < len(n.log) {
+		var buf bytes.Buffer
+		for _, e := range n.log[n.logSynced:] {
+			buf.Write(e.encode())
+		}
+		if _, err := n.logFile.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		n.logSynced = len(n.log)
+	}
+	return nil
+}
+
+func (n *RaftNode) readApplied() (uint64, error) {
+	cf, err := n.db.Family(raftFamily)
+	if err != nil {
+		return 0, err
+	}
+	v, err := cf.Get(raftAppliedKey)
+	if err != nil {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(v), 10, 64)
+}
+
+func (n *RaftNode) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+// termAt returns the term of the entry at i, if the log still has it.
+func (n *RaftNode) termAt(i uint64) (uint64, bool) {
+	if i < n.log[0].Index || i > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[i-n.log[0].Index].Term, true
+}
+
+func (n *RaftNode) entry(i uint64) raftEntry {
+	return n.log[i-n.log[0].Index]
+}
+
+// truncate drops the entries from i on.
+func (n *RaftNode) truncate(i uint64) {
+	n.log = n.log[:i-n.log[0].Index]
+	if n.logSynced > len(n.log) {
+		n.logRewrite = true
+	}
+	n.recomputeMembers()
+}
+
+// membersAt returns the members as of the entry at i: the configuration
+// last appended applies, committed or not.
+func (n *RaftNode) membersAt(i uint64) map[string]string {
+	members := n.snapMembers
+	for _, e := range n.log[1:] {
+		if e.Index > i {
+			break
+		}
+		if e.Type == raftConfig {
+			members = decodeMembers(e.Data)
+		}
+	}
+	return members
+}
+
+func (n *RaftNode) recomputeMembers() {
+	n.members = n.membersAt(n.lastIndex())
+}
+
+func decodeMembers(data []byte) map[string]string {
+	members := map[string]string{}
+	json.Unmarshal(data, &members)
+	return members
+}
+
+// peers lists the other members, sorted so that a node sends its messages
+// in the same order every time.
+func (n *RaftNode) peers() []string {
+	var ids []string
+	for id := range n.members {
+		if id != n.id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (n *RaftNode) hasQuorum(set map[string]bool) bool {
+	count := 0
+	for id := range n.members {
+		if set[id] {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+func (n *RaftNode) send(m raftMessage) {
+	m.From, m.FromAddr = n.id, n.addr
+	if m.Term == 0 {
+		m.Term = n.term
+	}
+	n.outbox = append(n.outbox, m)
+}
+
+// flush persists the state, applies what was committed, then sends.
+func (n *RaftNode) flush() {
+	if err := n.persist(); err != nil {
+		// Nothing can be sent that the node might forget
+		fmt.Println("Error persisting Raft state:", err)
+		n.outbox = nil
+		return
+	}
+	n.apply()
+	for _, m := range n.outbox {
+		addr := n.members[m.To]
+		if addr == "" {
+			addr = n.addrs[m.To]
+		}
+		n.transport.Send(addr, m)
+	}
+	n.outbox = nil
+}
+
+func (n *RaftNode) resetElectionTimer() {
+	n.electionElapsed = 0
+	n.electionTimeout = raftElectionTicks + n.rand.Intn(raftElectionTicks)
+}
+
+func (n *RaftNode) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term, n.vote = term, ""
+		n.stateDirty = true
+	}
+	if n.state == raftLeader {
+		n.abandonWaiters()
+	}
+	n.state = raftFollower
+	n.leader = leader
+	n.resetElectionTimer()
+}
+
+// abandonWaiters answers the requests of a leader stepping down: their
+// entries may still be committed by the next one, or not.
+func (n *RaftNode) abandonWaiters() {
+	for index, w := range n.waiters {
+		delete(n.waiters, index)
+		w.ch <- raftResult{err: ErrProposalUnknown}
+		n.resolved++
+	}
+}
+
+func (n *RaftNode) campaign() {
+	n.resetElectionTimer()
+	if _, ok := n.members[n.id]; !ok {
+		// Not a member, or not yet
+		return
+	}
+	n.state = raftCandidate
+	n.term++
+	n.vote = n.id
+	n.leader = ""
+	n.stateDirty = true
+	n.votes = map[string]bool{n.id: true}
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+		return
+	}
+	lastTerm, _ := n.termAt(n.lastIndex())
+	for _, id := range n.peers() {
+		n.send(raftMessage{Type: raftVote, To: id, LastIndex: n.lastIndex(), LastTerm: lastTerm})
+	}
+}
+
+func (n *RaftNode) becomeLeader() {
+	n.state = raftLeader
+	n.leader = n.id
+	n.next = map[string]uint64{}
+	n.match = map[string]uint64{}
+	n.heardFrom = map[string]bool{}
+	n.heartbeatElapsed = 0
+	for id := range n.members {
+		n.next[id] = n.lastIndex() + 1
+	}
+	// Entries of earlier terms are only committed with one of this term
+	n.appendEntry(raftEntry{Type: raftNoop})
+	n.broadcastAppend()
+}
+
+// appendEntry adds an entry of the leader's term to its log.
+func (n *RaftNode) appendEntry(e raftEntry) {
+	e.Term = n.term
+	e.Index = n.lastIndex() + 1
+	n.log = append(n.log, e)
+	if e.Type == raftConfig {
+		n.recomputeMembers()
+	}
+	n.match[n.id] = e.Index
+	n.maybeCommit()
+}
+
+// maybeCommit commits the last entry of the leader's term a majority has.
+func (n *RaftNode) maybeCommit() {
+	for i := n.lastIndex(); i > n.commit; i-- {
+		if term, _ := n.termAt(i); term != n.term {
+			return
+		}
+		count := 0
+		for id := range n.members {
+			if n.match[id] >= i {
+				count++
+			}
+		}
+		if count > len(n.members)/2 {
+			n.commit = i
+			return
+		}
+	}
+}
+
+func (n *RaftNode) broadcastAppend() {
+	for _, id := range n.peers() {
+		n.sendAppend(id)
+	}
+}
+
+func (n *RaftNode) sendAppend(to string) {
+	next := n.next[to]
+	if next == 0 {
+		next = n.lastIndex() + 1
+		n.next[to] = next
+	}
+	prevTerm, ok := n.termAt(next - 1)
+	if !ok {
+		n.sendSnapshot(to)
+		return
+	}
+	var entries []raftEntry
+	if next <= n.lastIndex() {
+		// Copied, the log may change before the message is read
+		from := n.log[next-n.log[0].Index:]
+		if len(from) > raftMaxEntries {
+			from = from[:raftMaxEntries]
+		}
+		entries = append(entries, from...)
+	}
+	n.send(raftMessage{Type: raftAppend, To: to, PrevIndex: next - 1, PrevTerm: prevTerm, Entries: entries, Commit: n.commit})
+}
+
+// sendSnapshot sends a checkpoint of the store to a follower that needs
+// entries the log no longer has, at most once per election timeout.
+func (n *RaftNode) sendSnapshot(to string) {
+	if sent, ok := n.snapshotSent[to]; ok && n.ticks-sent < raftElectionTicks {
+		return
+	}
+	snapshot, err := n.takeSnapshot()
+	if err != nil {
+		fmt.Println("Error taking a Raft snapshot:", err)
+		return
+	}
+	n.snapshotSent[to] = n.ticks
+	n.send(raftMessage{Type: raftInstallSnapshot, To: to, Snapshot: snapshot})
+}
+
+// takeSnapshot checkpoints the store. Entries are applied under the node's
+// lock, so the checkpoint stops exactly at the last one applied.
+func (n *RaftNode) takeSnapshot() (*raftSnapshot, error) {
+	tmp, err := os.MkdirTemp(storePath(n.db.wal.root, "."), "raft-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// The index goes with the checkpoint, even if no batch wrote it
+	if err := n.writeApplied(); err != nil {
+		return nil, err
+	}
+	manifest, err := n.db.Checkpoint(tmp + "/checkpoint")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeCheckpointTar(&buf, tmp+"/checkpoint", manifest); err != nil {
+		return nil, err
+	}
+	term, _ := n.termAt(n.applied)
+	return &raftSnapshot{Index: n.applied, Term: term, Members: n.membersAt(n.applied), Data: buf.Bytes()}, nil
+}
+
+func (n *RaftNode) writeApplied() error {
+	b := &WriteBatch{}
+	b.Set(raftFamily, raftAppliedKey, []byte(strconv.FormatUint(n.applied, 10)))
+	return n.db.Write(b)
+}
+
+// Tick advances the node's clock by one tick.
+func (n *RaftNode) Tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.ticks++
+	n.electionElapsed++
+	if n.state == raftLeader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= raftHeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+		// A leader that lost touch with a majority steps down, rather than
+		// keep requests waiting on entries it can't commit
+		if n.electionElapsed >= n.electionTimeout {
+			n.heardFrom[n.id] = true
+			if !n.hasQuorum(n.heardFrom) {
+				n.becomeFollower(n.term, "")
+			} else {
+				n.resetElectionTimer()
+			}
+			n.heardFrom = map[string]bool{}
+		}
+	} else if n.electionElapsed >= n.electionTimeout {
+		n.campaign()
+	}
+	n.flush()
+}
+
+// Step handles a message of another node.
+func (n *RaftNode) Step(m raftMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m.FromAddr != "" {
+		n.addrs[m.From] = m.FromAddr
+	}
+	if m.Type == raftVote && m.Term > n.term && (n.state == raftLeader || n.leader != "" && n.electionElapsed < raftElectionTicks) {
+		// A leader was heard from lately, or this is the leader and still
+		// has a majority: a node back from a partition or removed from the
+		// cluster must not depose it
+		return
+	}
+	if m.Term > n.term {
+		leader := ""
+		if m.Type == raftAppend || m.Type == raftInstallSnapshot {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	}
+
+	switch m.Type {
+	case raftAppend:
+		n.handleAppend(m)
+	case raftAppendReply:
+		n.handleAppendReply(m)
+	case raftVote:
+		n.handleVote(m)
+	case raftVoteReply:
+		n.handleVoteReply(m)
+	case raftInstallSnapshot:
+		n.handleSnapshot(m)
+	}
+	n.flush()
+}
+
+func (n *RaftNode) handleAppend(m raftMessage) {
+	if m.Term < n.term {
+		n.send(raftMessage{Type: raftAppendReply, To: m.From})
+		return
+	}
+	n.becomeFollower(m.Term, m.From)
+
+	// Entries up to the last snapshot are committed and the same
+	if first := n.log[0].Index; m.PrevIndex < first {
+		skip := first - m.PrevIndex
+		if uint64(len(m.Entries)) < skip {
+			n.send(raftMessage{Type: raftAppendReply, To: m.From, Success: true, Match: first})
+			return
+		}
+		m.Entries = m.Entries[skip:]
+		m.PrevIndex, m.PrevTerm = first, n.log[0].Term
+	}
+	if term, ok := n.termAt(m.PrevIndex); !ok || term != m.PrevTerm {
+		hint := m.PrevIndex - 1
+		if m.PrevIndex > n.lastIndex() {
+			hint = n.lastIndex()
+		}
+		n.send(raftMessage{Type: raftAppendReply, To: m.From, Match: hint})
+		return
+	}
+
+	for i, e := range m.Entries {
+		if term, ok := n.termAt(e.Index); ok {
+			if term == e.Term {
+				continue
+			}
+			n.truncate(e.Index)
+		}
+		n.log = append(n.log, m.Entries[i:]...)
+		n.recomputeMembers()
+		break
+	}
+	last := m.PrevIndex + uint64(len(m.Entries))
+	if commit := m.Commit; commit > n.commit {
+		if commit > last {
+			commit = last
+		}
+		if commit > n.commit {
+			n.commit = commit
+		}
+	}
+	n.send(raftMessage{Type: raftAppendReply, To: m.From, Success: true, Match: last})
+}
+
+func (n *RaftNode) handleAppendReply(m raftMessage) {
+	if n.state != raftLeader || m.Term < n.term {
+		return
+	}
+	n.heardFrom[m.From] = true
+	if _, ok := n.members[m.From]; !ok {
+		return
+	}
+	if m.Success {
+		if m.Match > n.match[m.From] {
+			n.match[m.From] = m.Match
+		}
+		if n.next[m.From] < n.match[m.From]+1 {
+			n.next[m.From] = n.match[m.From] + 1
+		}
+		delete(n.snapshotSent, m.From)
+		n.maybeCommit()
+		if n.next[m.From] <= n.lastIndex() {
+			n.sendAppend(m.From)
+		}
+		return
+	}
+	// Stale replies to earlier attempts are ignored
+	if m.Match+1 < n.next[m.From] {
+		n.next[m.From] = m.Match + 1
+		if n.next[m.From] <= n.match[m.From] {
+			n.next[m.From] = n.match[m.From] + 1
+		}
+		n.sendAppend(m.From)
+	}
+}
+
+func (n *RaftNode) handleVote(m raftMessage) {
+	lastTerm, _ := n.termAt(n.lastIndex())
+	upToDate := m.LastTerm > lastTerm || m.LastTerm == lastTerm && m.LastIndex >= n.lastIndex()
+	granted := m.Term == n.term && (n.vote == "" || n.vote == m.From) && upToDate
+	if granted {
+		n.vote = m.From
+		n.stateDirty = true
+		n.resetElectionTimer()
+	}
+	n.send(raftMessage{Type: raftVoteReply, To: m.From, Granted: granted})
+}
+
+func (n *RaftNode) handleVoteReply(m raftMessage) {
+	if n.state != raftCandidate || m.Term != n.term || !m.Granted {
+		return
+	}
+	n.votes[m.From] = true
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+	}
+}
+
+func (n *RaftNode) handleSnapshot(m raftMessage) {
+	if m.Term < n.term {
+		n.send(raftMessage{Type: raftAppendReply, To: m.From})
+		return
+	}
+	n.becomeFollower(m.Term, m.From)
+	if snapshot := m.Snapshot; snapshot.Index > n.commit {
+		if err := n.installSnapshot(snapshot); err != nil {
+			fmt.Println("Error installing Raft snapshot:", err)
+			return
+		}
+	}
+	n.send(raftMessage{Type: raftAppendReply, To: m.From, Success: true, Match: n.commit})
+}
+
+// installSnapshot replaces the store, and the log up to its index, with a
+// snapshot.
+func (n *RaftNode) installSnapshot(snapshot *raftSnapshot) error {
+	dir := storePath(n.db.wal.root, "RaftSnapshot")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := extractCheckpoint(bytes.NewReader(snapshot.Data), dir); err != nil {
+		return err
+	}
+	n.db.mu.Lock()
+	err := n.db.replaceWithCheckpointWithNoLock(dir)
+	n.db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Entries after the snapshot were acknowledged, they must stay if the
+	// log agrees with it
+	log := []raftEntry{{Index: snapshot.Index, Term: snapshot.Term}}
+	if term, ok := n.termAt(snapshot.Index); ok && term == snapshot.Term {
+		log = append(log, n.log[snapshot.Index-n.log[0].Index+1:]...)
+	}
+	n.log = log
+	n.snapMembers = snapshot.Members
+	n.recomputeMembers()
+	n.commit, n.applied = snapshot.Index, snapshot.Index
+	n.stateDirty, n.logRewrite = true, true
+	return nil
+}
+
+// apply applies the committed entries, answers the requests waiting on
+// them, then drops the entries applied if there are enough of them.
+func (n *RaftNode) apply() {
+	for n.applied < n.commit {
+		e := n.entry(n.applied + 1)
+		result := n.applyEntry(e)
+		n.applied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				result = raftResult{err: ErrProposalLost}
+			}
+			w.ch <- result
+			n.resolved++
+		}
+		if _, ok := n.members[n.id]; !ok && e.Type == raftConfig && n.state == raftLeader {
+			// Removed, it leaves the others to elect a new leader
+			n.becomeFollower(n.term, "")
+		}
+	}
+
+	if n.applied-n.log[0].Index >= raftSnapshotEvery {
+		if err := n.writeApplied(); err != nil {
+			fmt.Println("Error compacting Raft log:", err)
+			return
+		}
+		term, _ := n.termAt(n.applied)
+		n.snapMembers = n.membersAt(n.applied)
+		n.log = append([]raftEntry{{Index: n.applied, Term: term}}, n.log[n.applied-n.log[0].Index+1:]...)
+		n.stateDirty, n.logRewrite = true, true
+		if err := n.persist(); err != nil {
+			fmt.Println("Error compacting Raft log:", err)
+		}
+	}
+}
+
+func (n *RaftNode) applyEntry(e raftEntry) raftResult {
+	switch e.Type {
+	case raftCommand:
+		return n.applyCommand(e)
+	case raftRead:
+		parts := bytes.SplitN(e.Data, []byte{0}, 2)
+		cf, err := n.db.Family(string(parts[0]))
+		if err != nil {
+			return raftResult{err: err}
+		}
+		value, err := cf.Get(parts[1])
+		return raftResult{value: value, err: err}
+	}
+	return raftResult{}
+}
+
+// applyCommand writes a batch with the index of its entry. A batch the
+// store rejects is rejected on every node, its entry is still applied.
+func (n *RaftNode) applyCommand(e raftEntry) raftResult {
+	records, err := walRecord{op: byte(Batch), value: e.Data}.batchRecords()
+	if err != nil {
+		return raftResult{err: err}
+	}
+	b := &WriteBatch{}
+	var result raftResult
+	for _, rec := range records {
+		name, op, key := splitWALKey(rec.op, rec.key)
+		if Cmd(op) == Del && len(records) == 1 {
+			// A single delete answers with the value it deleted
+			if cf, err := n.db.Family(name); err == nil {
+				result.value, result.err = cf.Get(key)
+			}
+		}
+		b.ops = append(b.ops, batchOp{cf: name, op: Cmd(op), key: key, value: rec.value})
+	}
+	b.Set(raftFamily, raftAppliedKey, []byte(strconv.FormatUint(e.Index, 10)))
+	if err := n.db.Write(b); err != nil {
+		n.writeApplied()
+		return raftResult{err: err}
+	}
+	return result
+}
+
+// propose appends an entry to the leader's log and returns what to wait on.
+func (n *RaftNode) propose(t raftEntryType, data []byte) (*raftWaiter, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state != raftLeader {
+		return nil, ErrNotLeader
+	}
+	if t == raftConfig {
+		for _, e := range n.log[1:] {
+			if e.Index > n.commit && e.Type == raftConfig {
+				return nil, ErrMembershipChange
+			}
+		}
+	}
+	n.appendEntry(raftEntry{Type: t, Data: data})
+	w := &raftWaiter{term: n.term, ch: make(chan raftResult, 1)}
+	n.waiters[n.lastIndex()] = w
+	n.proposals++
+	n.broadcastAppend()
+	n.flush()
+	return w, nil
+}
+
+func (n *RaftNode) proposeAndWait(ctx context.Context, t raftEntryType, data []byte) ([]byte, error) {
+	w, err := n.propose(t, data)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case result := <-w.ch:
+		return result.value, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Write commits a batch through the log.
+func (n *RaftNode) Write(ctx context.Context, b *WriteBatch) error {
+	_, err := n.proposeAndWait(ctx, raftCommand, encodeRaftBatch(b))
+	return err
+}
+
+// encodeRaftBatch encodes a batch the way a WAL batch record holds it.
+func encodeRaftBatch(b *WriteBatch) []byte {
+	var data []byte
+	for _, o := range b.ops {
+		name := o.cf
+		if name == "default" {
+			name = ""
+		}
+		op, key := walKey(name, byte(o.op), o.key)
+		data = append(data, encodeWALRecord(0, op, key, o.value)...)
+	}
+	return data
+}
+
+// Get reads a key once everything committed before is applied.
+func (n *RaftNode) Get(ctx context.Context, cf string, key []byte) ([]byte, error) {
+	if cf == "default" {
+		cf = ""
+	}
+	return n.proposeAndWait(ctx, raftRead, append([]byte(cf+"\x00"), key...))
+}
+
+// Del deletes a key and returns the value it had.
+func (n *RaftNode) Del(ctx context.Context, cf string, key []byte) ([]byte, error) {
+	b := &WriteBatch{}
+	b.Del(cf, key)
+	return n.proposeAndWait(ctx, raftCommand, encodeRaftBatch(b))
+}
+
+// AddMember adds a node, at addr, to the cluster. It catches up from the
+// leader, from a snapshot if the log doesn't go back far enough.
+func (n *RaftNode) AddMember(ctx context.Context, id, addr string) error {
+	n.mu.Lock()
+	members := map[string]string{}
+	for member, memberAddr := range n.members {
+		members[member] = memberAddr
+	}
+	n.mu.Unlock()
+	members[id] = addr
+	data, _ := json.Marshal(members)
+	_, err := n.proposeAndWait(ctx, raftConfig, data)
+	return err
+}
+
+// RemoveMember removes a node from the cluster, the leader itself possibly.
+func (n *RaftNode) RemoveMember(ctx context.Context, id string) error {
+	n.mu.Lock()
+	members := map[string]string{}
+	for member, memberAddr := range n.members {
+		members[member] = memberAddr
+	}
+	n.mu.Unlock()
+	if _, ok := members[id]; !ok {
+		return errors.New("Not a member: " + id)
+	}
+	delete(members, id)
+	data, _ := json.Marshal(members)
+	_, err := n.proposeAndWait(ctx, raftConfig, data)
+	return err
+}
+
+type RaftStatus struct {
+	ID      string            `json:"id"`
+	State   string            `json:"state"`
+	Term    uint64            `json:"term"`
+	Leader  string            `json:"leader"`
+	Commit  uint64            `json:"commit"`
+	Applied uint64            `json:"applied"`
+	Members map[string]string `json:"members"`
+}
+
+func (n *RaftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return RaftStatus{ID: n.id, State: n.state.String(), Term: n.term, Leader: n.leader, Commit: n.commit, Applied: n.applied, Members: n.members}
+}
+
+// leaderAddr returns the address of the leader, "" if there is none known.
+func (n *RaftNode) leaderAddr() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if addr := n.members[n.leader]; addr != "" {
+		return addr
+	}
+	return n.addrs[n.leader]
+}
+
+// Handler serves the HTTP API with the writes and reads going through the
+// log, plus the Raft endpoints, and passes the rest to next. Writes the log
+// doesn't carry, like creating families or importing, are refused.
+func (n *RaftNode) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/get" || r.URL.Path == "/set" || r.URL.Path == "/del":
+			n.serveKV(w, r, r.URL.Query().Get("cf"), strings.TrimPrefix(r.URL.Path, "/"), r.URL.Query().Get("key"), []byte(r.URL.Query().Get("value")))
+		case strings.HasPrefix(r.URL.Path, "/cf/") && strings.Contains(r.URL.Path, "/kv/"):
+			cf, key, _ := kvPath(r)
+			op := map[string]string{http.MethodGet: "get", http.MethodPut: "set", http.MethodPost: "set", http.MethodDelete: "del"}[r.Method]
+			if op == "" {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			value, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			n.serveKV(w, r, cf, op, key, value)
+		case r.URL.Path == "/batch":
+			n.serveBatch(w, r)
+		case r.URL.Path == "/raft/message":
+			n.serveMessage(w, r)
+		case r.URL.Path == "/raft/status":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(n.Status())
+		case r.URL.Path == "/admin/raft/members":
+			n.serveMembers(w, r)
+		case isWrite(r):
+			http.Error(w, "Not supported in Raft mode", http.StatusNotImplemented)
+		case next != nil:
+			next.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// raftContext bounds how long a request waits for its entry.
+func raftContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), raftProposalTimeout)
+}
+
+// serveRaftError answers a request that the node couldn't serve. A
+// follower redirects to the leader, keeping the method and the body.
+func (n *RaftNode) serveRaftError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ErrNotLeader:
+		if addr := n.leaderAddr(); addr != "" {
+			http.Redirect(w, r, strings.TrimSuffix(addr, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		http.Error(w, "No leader", http.StatusServiceUnavailable)
+	case ErrProposalLost, ErrProposalUnknown, ErrMembershipChange, context.DeadlineExceeded, context.Canceled:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case ErrColumnFamilyNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (n *RaftNode) serveKV(w http.ResponseWriter, r *http.Request, cf, op, key string, value []byte) {
+	if key == "" {
+		http.Error(w, "Key not provided", http.StatusBadRequest)
+		return
+	}
+	if preconditions(r) != nil {
+		http.Error(w, "Preconditions are not supported in Raft mode", http.StatusNotImplemented)
+		return
+	}
+	ctx, cancel := raftContext(r)
+	defer cancel()
+
+	var err error
+	switch op {
+	case "get":
+		value, err = n.Get(ctx, cf, []byte(key))
+	case "set":
+		b := &WriteBatch{}
+		b.Set(cf, []byte(key), value)
+		err = n.Write(ctx, b)
+		value = []byte("OK")
+	case "del":
+		value, err = n.Del(ctx, cf, []byte(key))
+	}
+	if err != nil && err.Error() == "Key not found" {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		n.serveRaftError(w, r, err)
+		return
+	}
+	w.Write(value)
+}
+
+func (n *RaftNode) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Ops []batchOpJSON `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := &WriteBatch{}
+	for _, op := range req.Ops {
+		switch op.Op {
+		case "set":
+			b.Set(op.CF, []byte(op.Key), op.Value)
+		case "del":
+			b.Del(op.CF, []byte(op.Key))
+		default:
+			http.Error(w, "Unknown batch op: "+op.Op, http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := raftContext(r)
+	defer cancel()
+	if err := n.Write(ctx, b); err != nil {
+		n.serveRaftError(w, r, err)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func (n *RaftNode) serveMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var m raftMessage
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.To != n.id {
+		http.Error(w, "Wrong node", http.StatusBadRequest)
+		return
+	}
+	n.Step(m)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveMembers adds a member with POST ?id=&addr= or removes one with
+// DELETE ?id=.
+func (n *RaftNode) serveMembers(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Node ID not provided", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := raftContext(r)
+	defer cancel()
+
+	var err error
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		addr := r.URL.Query().Get("addr")
+		if addr == "" {
+			http.Error(w, "Address not provided", http.StatusBadRequest)
+			return
+		}
+		err = n.AddMember(ctx, id, addr)
+	case http.MethodDelete:
+		err = n.RemoveMember(ctx, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		n.serveRaftError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.Status())
+}
+
+// httpRaftTransport posts messages to /raft/message, in order, one queue
+// per node. A full queue drops messages, Raft sends them again.
+type httpRaftTransport struct {
+	mu     sync.Mutex
+	queues map[string]chan raftMessage
+	client *http.Client
+}
+
+func newHTTPRaftTransport() *httpRaftTransport {
+	return &httpRaftTransport{queues: map[string]chan raftMessage{}, client: &http.Client{Timeout: 10 * time.Second, Transport: &tokenTransport{token: apiToken, base: clientTransport()}}}
+}
+
+func (t *httpRaftTransport) Send(addr string, m raftMessage) {
+	if addr == "" {
+		return
+	}
+	t.mu.Lock()
+	queue, ok := t.queues[addr]
+	if !ok {
+		queue = make(chan raftMessage, 256)
+		t.queues[addr] = queue
+		go t.run(addr, queue)
+	}
+	t.mu.Unlock()
+
+	select {
+	case queue <- m:
+	default:
+	}
+}
+
+func (t *httpRaftTransport) run(addr string, queue chan raftMessage) {
+	for m := range queue {
+		body, err := json.Marshal(m)
+		if err != nil {
+			continue
+		}
+		resp, err := t.client.Post(strings.TrimSuffix(addr, "/")+"/raft/message", "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// parsePeers parses id=url,id=url, the Raft peers or the router nodes.
+func parsePeers(s string) (map[string]string, error) {
+	peers := map[string]string{}
+	for _, peer := range strings.Split(s, ",") {
+		if peer == "" {
+			continue
+		}
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("Invalid peer: " + peer)
+		}
+		peers[parts[0]] = parts[1]
+	}
+	return peers, nil
+}
+
+// raftAdmin runs kvctl raft status, add id addr and remove id against
+// server. Changes are redirected to the leader.
+func raftAdmin(server, command string, args []string) (*RaftStatus, error) {
+	server = strings.TrimSuffix(server, "/")
+	var req *http.Request
+	var err error
+	switch {
+	case command == "status" && len(args) == 0:
+		req, err = http.NewRequest(http.MethodGet, server+"/raft/status", nil)
+	case command == "add" && len(args) == 2:
+		req, err = http.NewRequest(http.MethodPost, server+"/admin/raft/members?"+url.Values{"id": {args[0]}, "addr": {args[1]}}.Encode(), nil)
+	case command == "remove" && len(args) == 1:
+		req, err = http.NewRequest(http.MethodDelete, server+"/admin/raft/members?"+url.Values{"id": {args[0]}}.Encode(), nil)
+	default:
+		return nil, errors.New("Usage: kvctl raft status | add <id> <addr> | remove <id>")
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tokenClient(apiToken).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(message)))
+	}
+	status := &RaftStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// raftHarness runs a cluster in the test's goroutine: it ticks the nodes
+// and delivers their messages itself, in an order drawn from a seeded
+// source, dropping some and those crossing a partition. Clients call the
+// HTTP handlers of the nodes from goroutines of their own, but the harness
+// only moves on once a request has been proposed or answered, so a seed
+// always plays the same way.
+type raftHarness struct {
+	t     *testing.T
+	rand  *rand.Rand
+	nodes map[string]*RaftNode
+	dirs  map[string]string
+	queue []raftMessage
+	// group partitions the nodes, messages only go within a group
+	group map[string]int
+
+	results   chan raftClientResult
+	clock     int64
+	collected int
+	// resolvedBase counts the requests answered by nodes since restarted
+	resolvedBase int
+	history      []histOp
+}
+
+type harnessTransport struct {
+	h *raftHarness
+}
+
+func (t harnessTransport) Send(addr string, m raftMessage) {
+	t.h.queue = append(t.h.queue, m)
+}
+
+// histOp is a request of a client and its answer. ret is math.MaxInt64
+// when the outcome is unknown: the write may have been applied or not.
+type histOp struct {
+	client  int
+	kind    string
+	key     string
+	value   string
+	found   bool
+	unknown bool
+	call    int64
+	ret     int64
+}
+
+type raftClient struct {
+	id      int
+	target  string
+	admin   bool
+	pending *histOp
+	cancel  context.CancelFunc
+	node    string
+	seq     int
+}
+
+type raftClientResult struct {
+	client *raftClient
+	rec    *httptest.ResponseRecorder
+}
+
+func newRaftHarness(t *testing.T, seed int64) *raftHarness {
+	return &raftHarness{
+		t:       t,
+		rand:    rand.New(rand.NewSource(seed)),
+		nodes:   map[string]*RaftNode{},
+		dirs:    map[string]string{},
+		group:   map[string]int{},
+		results: make(chan raftClientResult, 64),
+	}
+}
+
+func (h *raftHarness) startNode(id string, peers map[string]string) {
+	if h.dirs[id] == "" {
+		h.dirs[id] = h.t.TempDir()
+	}
+	db, err := OpenStore(h.dirs[id])
+	if err != nil {
+		h.t.Fatalf("Error opening %s: %v", id, err)
+	}
+	n, err := newRaftNode(db, RaftOptions{ID: id, Addr: "http://" + id, Peers: peers}, harnessTransport{h}, h.rand.Int63())
+	if err != nil {
+		h.t.Fatalf("Error starting %s: %v", id, err)
+	}
+	h.nodes[id] = n
+}
+
+// restart stops a node and opens its store again, as after a crash.
+func (h *raftHarness) restart(id string, clients []*raftClient) {
+	h.drain()
+	// Requests waiting on it are never answered
+	for _, c := range clients {
+		if c.pending != nil && c.node == id {
+			c.cancel()
+			h.finish(<-h.results)
+		}
+	}
+	n := h.nodes[id]
+	h.resolvedBase += n.resolved
+	n.Stop()
+	n.db.wal.file.Close()
+	h.startNode(id, nil)
+}
+
+func (h *raftHarness) ids() []string {
+	var ids []string
+	for id := range h.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (h *raftHarness) leader() string {
+	for _, id := range h.ids() {
+		if status := h.nodes[id].Status(); status.State == "leader" && h.group[id] == 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+// round ticks every node, then delivers the messages sent so far, shuffled,
+// dropping or delaying some.
+func (h *raftHarness) round(dropPercent int) {
+	for _, id := range h.ids() {
+		h.nodes[id].Tick()
+	}
+	pending := h.queue
+	h.queue = nil
+	h.rand.Shuffle(len(pending), func(i, j int) { pending[i], pending[j] = pending[j], pending[i] })
+	for _, m := range pending {
+		to := h.nodes[m.To]
+		if to == nil || h.group[m.From] != h.group[m.To] {
+			continue
+		}
+		switch r := h.rand.Intn(100); {
+		case r < dropPercent:
+		case r < 2*dropPercent:
+			h.queue = append(h.queue, m)
+		default:
+			to.Step(m)
+		}
+	}
+	h.drain()
+}
+
+func (h *raftHarness) resolved() int {
+	total := h.resolvedBase
+	for _, n := range h.nodes {
+		n.mu.Lock()
+		total += n.resolved
+		n.mu.Unlock()
+	}
+	return total
+}
+
+// drain waits for the clients whose requests the nodes answered.
+func (h *raftHarness) drain() {
+	h.clock++
+	for h.collected < h.resolved() {
+		h.finish(<-h.results)
+	}
+}
+
+// issue sends a request of c to the node it thinks is the leader, and waits
+// until the node proposed it or answered.
+func (h *raftHarness) issue(c *raftClient, op histOp, target string) {
+	node := h.nodes[c.target]
+	if node == nil {
+		c.target = h.ids()[h.rand.Intn(len(h.nodes))]
+		node = h.nodes[c.target]
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+	if c.admin {
+		req.Method = http.MethodPost
+		if op.kind == "remove" {
+			req.Method = http.MethodDelete
+		}
+	}
+	h.clock++
+	op.call = h.clock
+	c.pending, c.cancel, c.node = &op, cancel, c.target
+
+	node.mu.Lock()
+	before := node.proposals
+	node.mu.Unlock()
+	go func() {
+		rec := httptest.NewRecorder()
+		node.Handler(nil).ServeHTTP(rec, req)
+		h.results <- raftClientResult{c, rec}
+	}()
+	for c.pending != nil {
+		select {
+		case result := <-h.results:
+			h.finish(result)
+			continue
+		default:
+		}
+		node.mu.Lock()
+		proposed := node.proposals > before
+		node.mu.Unlock()
+		if proposed {
+			break
+		}
+		runtime.Gosched()
+	}
+	h.drain()
+}
+
+// finish records the answer to a request. Requests not proposed, or lost
+// with the entry of another leader, didn't happen.
+func (h *raftHarness) finish(result raftClientResult) {
+	c, rec := result.client, result.rec
+	op := *c.pending
+	c.pending = nil
+	c.cancel()
+	op.ret = h.clock
+	body := strings.TrimSpace(rec.Body.String())
+
+	// Answered by a node that proposed the request
+	answered := true
+	switch {
+	case rec.Code == http.StatusTemporaryRedirect:
+		location, _ := url.Parse(rec.Header().Get("Location"))
+		c.target = location.Host
+		return
+	case rec.Code == http.StatusServiceUnavailable:
+		c.target = h.ids()[h.rand.Intn(len(h.nodes))]
+		switch body {
+		case "No leader":
+			answered = false
+		case context.Canceled.Error():
+			answered = false
+			op.unknown = true
+		case ErrProposalUnknown.Error():
+			op.unknown = true
+		case ErrProposalLost.Error(), ErrMembershipChange.Error():
+		default:
+			h.t.Fatalf("Unexpected answer: %d %s", rec.Code, body)
+		}
+	case rec.Code == http.StatusOK:
+		op.found = true
+		if op.kind != "set" {
+			op.value = body
+		}
+		c.admin = false
+	case c.admin && strings.HasPrefix(body, "Not a member"):
+		// Removed by an earlier attempt of unknown outcome
+		c.admin = false
+		answered = false
+	case rec.Code == http.StatusNotFound && (op.kind == "get" || op.kind == "del"):
+		op.value = ""
+	default:
+		h.t.Fatalf("Unexpected answer to %s %s: %d %s", op.kind, op.key, rec.Code, body)
+	}
+	if answered {
+		h.collected++
+	}
+	if op.unknown {
+		op.ret = math.MaxInt64
+	}
+	if (rec.Code == http.StatusOK || rec.Code == http.StatusNotFound || op.unknown) && op.key != "" {
+		h.history = append(h.history, op)
+	}
+}
+
+type regState struct {
+	present bool
+	value   string
+}
+
+// stepRegister applies an operation to a key, reporting whether its answer
+// fits.
+func stepRegister(s regState, op histOp) (regState, bool) {
+	switch op.kind {
+	case "set":
+		return regState{true, op.value}, true
+	case "del":
+		if op.unknown {
+			return regState{}, true
+		}
+		return regState{}, op.found == s.present && op.value == s.value
+	default:
+		return s, op.found == s.present && op.value == s.value
+	}
+}
+
+// linearizable checks the history of one key in the way of Wing and Gong:
+// it looks for an order of the operations, each taking effect between its
+// call and its answer, in which every answer fits. Operations of unknown
+// outcome may also never take effect.
+func linearizable(ops []histOp) bool {
+	done := make([]bool, len(ops))
+	left := 0
+	for _, op := range ops {
+		if !op.unknown {
+			left++
+		}
+	}
+	seen := map[string]bool{}
+	var search func(s regState, left int) bool
+	search = func(s regState, left int) bool {
+		if left == 0 {
+			return true
+		}
+		key := fmt.Sprint(done, s)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+
+		minRet := int64(math.MaxInt64)
+		for i, op := range ops {
+			if !done[i] && op.ret < minRet {
+				minRet = op.ret
+			}
+		}
+		for i, op := range ops {
+			if done[i] || op.call >= minRet {
+				continue
+			}
+			next, ok := stepRegister(s, op)
+			if !ok {
+				continue
+			}
+			done[i] = true
+			remaining := left
+			if !op.unknown {
+				remaining--
+			}
+			if search(next, remaining) {
+				return true
+			}
+			done[i] = false
+		}
+		return false
+	}
+	return search(regState{}, left)
+}
+
+func TestLinearizabilityChecker(t *testing.T) {
+	ok := []histOp{
+		{kind: "set", key: "a", value: "1", call: 1, ret: 4},
+		{kind: "get", key: "a", found: true, value: "1", call: 2, ret: 3},
+		{kind: "get", key: "a", found: false, call: 2, ret: 3},
+		{kind: "del", key: "a", unknown: true, call: 5, ret: math.MaxInt64},
+		{kind: "get", key: "a", found: true, value: "1", call: 6, ret: 7},
+	}
+	if !linearizable(ok) {
+		t.Fatalf("Expected a linearizable history")
+	}
+	stale := []histOp{
+		{kind: "set", key: "a", value: "1", call: 1, ret: 2},
+		{kind: "set", key: "a", value: "2", call: 3, ret: 4},
+		{kind: "get", key: "a", found: true, value: "1", call: 5, ret: 6},
+	}
+	if linearizable(stale) {
+		t.Fatalf("Expected a stale read to be caught")
+	}
+	// A delete that took effect must have deleted something
+	phantom := []histOp{
+		{kind: "del", key: "a", found: true, value: "1", call: 1, ret: 2},
+	}
+	if linearizable(phantom) {
+		t.Fatalf("Expected a delete of nothing to be caught")
+	}
+}
+
+var raftSeed int64 = 1
+
+func TestRaftLinearizable(t *testing.T) {
+	useTempDir(t)
+	defer func(every uint64, timeout time.Duration) {
+		raftSnapshotEvery, raftProposalTimeout = every, timeout
+	}(raftSnapshotEvery, raftProposalTimeout)
+	raftSnapshotEvery = 30
+	raftProposalTimeout = time.Hour
+
+	h := newRaftHarness(t, raftSeed)
+	peers := map[string]string{"n1": "http://n1", "n2": "http://n2", "n3": "http://n3"}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		h.startNode(id, peers)
+	}
+	var clients []*raftClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, &raftClient{id: i, target: "n1"})
+	}
+	admin := &raftClient{id: -1, target: "n1"}
+	var adminOp histOp
+	adminTarget := ""
+	keys := []string{"a", "b", "c"}
+
+	terms := map[uint64]bool{}
+	for round := 0; round < 1500; round++ {
+		switch round {
+		case 200, 700:
+			// Cut the leader off
+			if leader := h.leader(); leader != "" {
+				h.group[leader] = 1
+			}
+		case 350, 800, 1100:
+			h.group = map[string]int{}
+		case 450:
+			h.restart("n2", clients)
+		case 500:
+			// The log no longer goes back to the start, n4 needs a snapshot
+			if leader := h.leader(); leader == "" || h.nodes[leader].log[0].Index == 0 {
+				t.Fatalf("Expected a leader with a compacted log")
+			}
+			h.startNode("n4", nil)
+			admin.admin, adminOp, adminTarget = true, histOp{kind: "add"}, "/admin/raft/members?id=n4&addr=http://n4"
+		case 900:
+			admin.admin, adminOp, adminTarget = true, histOp{kind: "remove"}, "/admin/raft/members?id=n1"
+		case 1000:
+			// Split the nodes at random
+			for _, id := range h.ids() {
+				h.group[id] = h.rand.Intn(2)
+			}
+		}
+		if admin.admin && admin.pending == nil {
+			h.issue(admin, adminOp, adminTarget)
+		}
+
+		if round < 1300 {
+			for _, c := range clients {
+				if c.pending != nil || h.rand.Intn(100) >= 30 {
+					continue
+				}
+				op := histOp{client: c.id, key: keys[h.rand.Intn(len(keys))]}
+				var target string
+				switch r := h.rand.Intn(10); {
+				case r < 4:
+					op.kind, target = "get", "/get?key="+op.key
+				case r < 8:
+					c.seq++
+					op.kind, op.value = "set", fmt.Sprintf("c%d-%d", c.id, c.seq)
+					target = "/set?key=" + op.key + "&value=" + op.value
+				default:
+					op.kind, target = "del", "/del?key="+op.key
+				}
+				h.issue(c, op, target)
+			}
+		}
+		if round < 1400 {
+			h.round(5)
+		} else {
+			// Quiet at the end, so that everything committed is applied
+			h.round(0)
+		}
+		if leader := h.leader(); leader != "" {
+			terms[h.nodes[leader].Status().Term] = true
+		}
+	}
+
+	// Whatever is still waiting has an unknown outcome
+	for _, c := range append(clients, admin) {
+		if c.pending != nil {
+			c.cancel()
+			h.finish(<-h.results)
+		}
+	}
+	if admin.admin {
+		t.Fatalf("Membership change not done")
+	}
+	if len(terms) < 3 {
+		t.Fatalf("Expected the partitions to elect new leaders, saw terms %v", terms)
+	}
+
+	byKey := map[string][]histOp{}
+	definite := 0
+	for _, op := range h.history {
+		if op.kind == "get" && op.unknown {
+			continue
+		}
+		if !op.unknown {
+			definite++
+		}
+		byKey[op.key] = append(byKey[op.key], op)
+	}
+	if definite < 200 {
+		t.Fatalf("Expected a longer history, got %d answers", definite)
+	}
+	for key, ops := range byKey {
+		if !linearizable(ops) {
+			for _, op := range ops {
+				t.Logf("%+v", op)
+			}
+			t.Fatalf("History of %s is not linearizable", key)
+		}
+	}
+
+	// The members agree
+	status := h.nodes["n2"].Status()
+	if _, ok := status.Members["n1"]; ok || status.Members["n4"] == "" {
+		t.Fatalf("Unexpected members: %v", status.Members)
+	}
+	for _, id := range []string{"n2", "n3", "n4"} {
+		if applied := h.nodes[id].Status().Applied; applied != status.Applied {
+			t.Fatalf("Expected %s to have applied %d, got %d", id, status.Applied, applied)
+		}
+		for _, key := range keys {
+			expected, expectedErr := h.nodes["n2"].db.Get([]byte(key))
+			got, err := h.nodes[id].db.Get([]byte(key))
+			if string(got) != string(expected) || (err == nil) != (expectedErr == nil) {
+				t.Fatalf("Expected %s on %s to be %q, got %q", key, id, expected, got)
+			}
+		}
+	}
+}
+
+// TestRaftHTTP runs a cluster over real HTTP: writes sent to a follower are
+// redirected to the leader and reads see them on any node.
+func TestRaftHTTP(t *testing.T) {
+	useTempDir(t)
+	defer func(tick time.Duration) { raftTickInterval = tick }(raftTickInterval)
+	raftTickInterval = 5 * time.Millisecond
+
+	// The servers are up before the nodes, which may call each other as
+	// soon as they start
+	var nodesMu sync.Mutex
+	nodes := map[string]*RaftNode{}
+	servers := map[string]*httptest.Server{}
+	peers := map[string]string{}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		id := id
+		servers[id] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodesMu.Lock()
+			n := nodes[id]
+			nodesMu.Unlock()
+			if n == nil {
+				http.Error(w, "Not started", http.StatusServiceUnavailable)
+				return
+			}
+			n.Handler(nil).ServeHTTP(w, r)
+		}))
+		defer servers[id].Close()
+		peers[id] = servers[id].URL
+	}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		db, err := OpenStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("Error opening store: %v", err)
+		}
+		defer db.wal.file.Close()
+		n, err := StartRaftNode(db, RaftOptions{ID: id, Addr: peers[id], Peers: peers})
+		if err != nil {
+			t.Fatalf("Error starting node: %v", err)
+		}
+		defer n.Stop()
+		nodesMu.Lock()
+		nodes[id] = n
+		nodesMu.Unlock()
+	}
+
+	// Wait for every node to follow the same leader, a follower that hasn't
+	// heard from it yet has nowhere to redirect to
+	deadline := time.Now().Add(10 * time.Second)
+	leader := ""
+	for leader == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("No leader elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+		status := nodes["n1"].Status()
+		leader = status.Leader
+		for _, n := range nodes {
+			if s := n.Status(); s.Term != status.Term || s.Leader != status.Leader || (s.ID == leader) != (s.State == "leader") {
+				leader = ""
+			}
+		}
+	}
+	follower := "n1"
+	if leader == "n1" {
+		follower = "n2"
+	}
+
+	resp, err := http.Get(servers[follower].URL + "/set?key=a&value=1")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the write to be redirected to the leader, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+	for id, server := range servers {
+		resp, err := http.Get(server.URL + "/get?key=a")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected %s to read a, got %v (%v)", id, resp, err)
+		}
+		resp.Body.Close()
+	}
+	if v, err := nodes[leader].db.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Expected a = 1 on the leader, got %q (%v)", v, err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, servers[leader].URL+"/cf/users", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Expected writes around the log to be refused, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+
+	status, err := raftAdmin(servers[follower].URL, "status", nil)
+	if err != nil || len(status.Members) != 3 {
+		t.Fatalf("Unexpected status: %+v (%v)", status, err)
+	}
+	if _, err := raftAdmin(servers[follower].URL, "remove", []string{"n9"}); err == nil {
+		t.Fatalf("Expected removing a stranger to fail")
+	}
+}
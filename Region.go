@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elliotchance/orderedmap"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// regionFamily holds the regions of the families that have them, under
+// "{family}\x00{start key}", as JSON.
+const regionFamily = "_regions"
+
+// regionCompactFiles is how many SSTs a region can have before they are
+// compacted into one.
+var regionCompactFiles = 4
+
+var ErrNoRegions = errors.New("Column family has no regions")
+
+// Region is a range of keys of a family, from Start, inclusive, to End,
+// exclusive; an empty End is no end. The regions of a family cover every
+// key and don't overlap. Each SST of the family holds the keys of a single
+// region, so a region owns the SSTs whose key range is within its own, as
+// given by their headers. Epoch goes up on every split and merge, so a
+// stale copy of a region can be told apart.
+type Region struct {
+	ID    uint64 `json:"id"`
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+	Epoch uint64 `json:"epoch"`
+}
+
+// RegionStatus is a region with the SSTs it owns.
+type RegionStatus struct {
+	Region
+	Files []string `json:"files"`
+	Size  int64    `json:"size"`
+}
+
+func (r Region) contains(key []byte) bool {
+	return string(key) >= r.Start && (r.End == "" || string(key) < r.End)
+}
+
+// overlaps reports whether the keys from smallest to biggest, inclusive,
+// has some of the region's.
+func (r Region) overlaps(smallest, biggest []byte) bool {
+	return string(biggest) >= r.Start && (r.End == "" || string(smallest) < r.End)
+}
+
+func (r Region) holds(smallest, biggest []byte) bool {
+	return r.contains(smallest) && r.contains(biggest)
+}
+
+func (r Region) bounds() ([]byte, []byte) {
+	var start, end []byte
+	if r.Start != "" {
+		start = []byte(r.Start)
+	}
+	if r.End != "" {
+		end = []byte(r.End)
+	}
+	return start, end
+}
+
+func regionKey(cf, start string) []byte {
+	return []byte(cf + "\x00" + start)
+}
+
+func (mem *memDB) regionsEnabled() bool {
+	return mem.options.RegionSplitBytes > 0
+}
+
+// regionMergeBytes is at most half the split size, or a merge could make a
+// region that splits right away.
+func (mem *memDB) regionMergeBytes() int64 {
+	split := mem.options.RegionSplitBytes
+	merge := mem.options.RegionMergeBytes
+	if merge <= 0 {
+		merge = split / 4
+	}
+	if merge > split/2 {
+		merge = split / 2
+	}
+	return merge
+}
+
+// loadRegionsWithNoLock reads the regions of the family. A family without
+// any has a single region with every key.
+func (mem *memDB) loadRegionsWithNoLock() error {
+	mem.regions = nil
+	if meta, ok := mem.families[regionFamily]; ok {
+		it, err := meta.iteratorWithNoLock(context.Background(), regionKey(mem.name, ""), regionKey(mem.name+"\x01", ""))
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for it.Next() {
+			var r Region
+			if err := json.Unmarshal(it.Value(), &r); err != nil {
+				return fmt.Errorf("Corrupt region %q: %v", it.Key(), err)
+			}
+			mem.regions = append(mem.regions, r)
+		}
+		if it.Err() != nil {
+			return it.Err()
+		}
+	}
+	if len(mem.regions) == 0 {
+		mem.regions = []Region{{ID: 1}}
+	}
+	return nil
+}
+
+// saveRegionsWithNoLock replaces the regions of the family with regions.
+// The region family is flushed right away rather than logged in the WAL:
+// regions describe the SSTs of this store, which a replica has its own of.
+func (mem *memDB) saveRegionsWithNoLock(regions []Region) error {
+	meta, ok := mem.families[regionFamily]
+	if !ok {
+		return ErrColumnFamilyNotFound
+	}
+	kept := map[string]bool{}
+	for _, r := range regions {
+		kept[r.Start] = true
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		meta.SetMap(regionKey(mem.name, r.Start), value)
+	}
+	for _, r := range mem.regions {
+		if !kept[r.Start] {
+			meta.DelMap(regionKey(mem.name, r.Start))
+		}
+	}
+	if err := meta.flushToSST(); err != nil {
+		return err
+	}
+	mem.regions = regions
+	return nil
+}
+
+// Regions lists the regions of the family with the SSTs they own.
+func (mem *memDB) Regions() ([]RegionStatus, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if mem.dropped {
+		return nil, ErrColumnFamilyDropped
+	}
+	if !mem.regionsEnabled() {
+		return nil, ErrNoRegions
+	}
+	files, err := readSSTFiles(mem.dir)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []RegionStatus
+	for _, r := range mem.regions {
+		status := RegionStatus{Region: r, Files: []string{}}
+		for _, f := range regionFiles(r, files) {
+			status.Files = append(status.Files, filepath.Base(f.name))
+			status.Size += f.size
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// sstFileInfo is an SST of a family with its header.
+type sstFileInfo struct {
+	name   string
+	header sstHeader
+	size   int64
+}
+
+// readSSTFiles returns the SSTs of dir, oldest first.
+func readSSTFiles(dir string) ([]sstFileInfo, error) {
+	count, err := countSSTFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []sstFileInfo
+	for i := 1; i <= count; i++ {
+		name := fmt.Sprintf("%s/sst%d.txt", dir, i)
+		header, err := readSSTFileHeader(name)
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt SST %s: %v", name, err)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sstFileInfo{name, header, info.Size()})
+	}
+	return files, nil
+}
+
+// regionFiles returns the SSTs with keys of the region, oldest first.
+func regionFiles(r Region, files []sstFileInfo) []sstFileInfo {
+	var owned []sstFileInfo
+	for _, f := range files {
+		if r.overlaps(f.header.smallest, f.header.biggest) {
+			owned = append(owned, f)
+		}
+	}
+	return owned
+}
+
+func regionSize(r Region, files []sstFileInfo) int64 {
+	var size int64
+	for _, f := range regionFiles(r, files) {
+		size += f.size
+	}
+	return size
+}
+
+// filesIterator iterates over some SSTs only, which must be oldest first.
+func filesIterator(files []sstFileInfo, start, end []byte) (*Iterator, error) {
+	it := &Iterator{ctx: context.Background(), end: end}
+	for i := len(files) - 1; i >= 0; i-- {
+		source, err := openSSTSource(files[i].name, start, end)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.sources = append(it.sources, source)
+	}
+	return it, nil
+}
+
+// flushToRegions is flushToSST for a family with regions: it writes an SST
+// per region with keys in the memtable.
+func (mem *memDB) flushToRegions() error {
+	if mem.values.Len() == 0 {
+		return nil
+	}
+	existingSSTFiles, err := countSSTFiles(mem.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := mem.sortedKeys()
+	var entries []sstEntry
+	next := existingSSTFiles + 1
+	region := 0
+	writeRegion := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := writeSSTFile(fmt.Sprintf("%s/sst%d.txt", mem.dir, next), entries, mem.codecForLevel(0)); err != nil {
+			return err
+		}
+		next++
+		entries = nil
+		return nil
+	}
+	for _, key := range keys {
+		for !mem.regions[region].contains([]byte(key)) {
+			if err := writeRegion(); err != nil {
+				return err
+			}
+			region++
+		}
+		e, err := mem.flushEntry(key)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	if err := writeRegion(); err != nil {
+		return err
+	}
+
+	mem.values = orderedmap.NewOrderedMap()
+	fmt.Println("Flush to SST completed successfully.")
+	return nil
+}
+
+// maintainRegionsWithNoLock splits the regions of every family that has
+// them, merges them and compacts their SSTs, right after a flush.
+func (mem *memDB) maintainRegionsWithNoLock() error {
+	for _, cf := range mem.families {
+		if cf.regionsEnabled() && !cf.dropped {
+			if err := cf.maintainFamilyRegionsWithNoLock(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// maintainFamilyRegionsWithNoLock splits the regions bigger than
+// RegionSplitBytes at their middle key and merges neighbours smaller than
+// RegionMergeBytes together. Then the regions with an SST that isn't entirely theirs, as after
+// a split or an ingestion, or with too many SSTs are compacted: their SSTs
+// are read and written back as one, without the tombstones and the values
+// overwritten since.
+func (mem *memDB) maintainFamilyRegionsWithNoLock() error {
+	files, err := readSSTFiles(mem.dir)
+	if err != nil {
+		return err
+	}
+
+	regions := append([]Region{}, mem.regions...)
+	var lastID uint64
+	for _, r := range regions {
+		if r.ID > lastID {
+			lastID = r.ID
+		}
+	}
+	changed := false
+	for i := 0; i < len(regions); i++ {
+		if regionSize(regions[i], files) <= mem.options.RegionSplitBytes {
+			continue
+		}
+		key, err := regionSplitKey(regions[i], files)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			continue
+		}
+		lastID++
+		right := Region{ID: lastID, Start: key, End: regions[i].End, Epoch: regions[i].Epoch + 1}
+		regions[i].End = key
+		regions[i].Epoch++
+		regions = append(regions[:i+1], append([]Region{right}, regions[i+1:]...)...)
+		// The halves are only looked at again after the next flush
+		i++
+		changed = true
+	}
+	for i := 0; i+1 < len(regions); {
+		left, right := regions[i], regions[i+1]
+		if regionSize(left, files)+regionSize(right, files) > mem.regionMergeBytes() {
+			i++
+			continue
+		}
+		regions[i].End = right.End
+		if right.Epoch > left.Epoch {
+			regions[i].Epoch = right.Epoch
+		}
+		regions[i].Epoch++
+		regions = append(regions[:i+1], regions[i+2:]...)
+		changed = true
+	}
+
+	if err := mem.compactRegionsWithNoLock(regions, files); err != nil {
+		return err
+	}
+	if changed {
+		return mem.saveRegionsWithNoLock(regions)
+	}
+	return nil
+}
+
+// regionSplitKey returns the middle live key of a region, empty if it has
+// fewer than two.
+func regionSplitKey(r Region, files []sstFileInfo) (string, error) {
+	start, end := r.bounds()
+	it, err := filesIterator(regionFiles(r, files), start, end)
+	if err != nil {
+		return "", err
+	}
+	defer it.Close()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if it.Err() != nil {
+		return "", it.Err()
+	}
+	if len(keys) < 2 {
+		return "", nil
+	}
+	return keys[len(keys)/2], nil
+}
+
+// compactRegionsWithNoLock compacts the regions that need it, see
+// maintainFamilyRegionsWithNoLock. An SST is only dropped with every region it
+// has keys of, so all the history of a key is read and tombstones can go.
+func (mem *memDB) compactRegionsWithNoLock(regions []Region, files []sstFileInfo) error {
+	compact := make([]bool, len(regions))
+	for i, r := range regions {
+		owned := regionFiles(r, files)
+		compact[i] = len(owned) > regionCompactFiles
+		for _, f := range owned {
+			if !r.holds(f.header.smallest, f.header.biggest) {
+				compact[i] = true
+			}
+		}
+	}
+	// A shared SST takes the other regions it has keys of along
+	for spread := true; spread; {
+		spread = false
+		for i, r := range regions {
+			if !compact[i] {
+				continue
+			}
+			for _, f := range regionFiles(r, files) {
+				for j, other := range regions {
+					if !compact[j] && other.overlaps(f.header.smallest, f.header.biggest) {
+						compact[j], spread = true, true
+					}
+				}
+			}
+		}
+	}
+
+	obsolete := map[string]bool{}
+	var outputs []string
+	for i, r := range regions {
+		if !compact[i] {
+			continue
+		}
+		owned := regionFiles(r, files)
+		if len(owned) == 0 {
+			continue
+		}
+		for _, f := range owned {
+			obsolete[f.name] = true
+		}
+		output, err := compactRegion(r, owned, fmt.Sprintf("%s/compact-%d.tmp", mem.dir, len(outputs)), mem.codecForLevel(1))
+		if err != nil {
+			return err
+		}
+		if output != "" {
+			outputs = append(outputs, output)
+		}
+	}
+	if len(obsolete) == 0 {
+		return nil
+	}
+
+	// The SSTs that stay keep their order, the new ones have keys no other
+	// SST has so they can go anywhere
+	var sources, dropped []string
+	for _, f := range files {
+		if obsolete[f.name] {
+			dropped = append(dropped, filepath.Base(f.name))
+		} else {
+			sources = append(sources, filepath.Base(f.name))
+		}
+	}
+	for _, output := range outputs {
+		sources = append(sources, filepath.Base(output))
+	}
+	return replaceSSTs(mem.dir, sources, dropped)
+}
+
+// compactRegion writes the live keys of a region in files to path, and
+// returns it, or nothing for a region without any.
+func compactRegion(r Region, files []sstFileInfo, path string, codec byte) (string, error) {
+	defer metrics.compaction.since(time.Now())
+	start, end := r.bounds()
+	it, err := filesIterator(files, start, end)
+	if err != nil {
+		return "", err
+	}
+	defer it.Close()
+
+	sw, err := NewSSTWriter(path)
+	if err != nil {
+		return "", err
+	}
+	sw.codec = codec
+	count := 0
+	for it.Next() {
+		if err := sw.Put(it.Key(), it.Value()); err != nil {
+			sw.Abort()
+			return "", err
+		}
+		count++
+	}
+	if it.Err() != nil {
+		sw.Abort()
+		return "", it.Err()
+	}
+	if count == 0 {
+		sw.Abort()
+		return "", nil
+	}
+	return path, sw.Finish()
+}
+
+// sstRewrite is the plan of replaceSSTs, kept in the family directory
+// until it is done so a crash halfway is finished on the next start.
+type sstRewrite struct {
+	Phase    int      `json:"phase"`
+	Sources  []string `json:"sources"`
+	Obsolete []string `json:"obsolete"`
+}
+
+const sstRewriteFile = "REWRITE"
+
+// replaceSSTs makes sources, oldest first, the SSTs of dir, numbered from 1,
+// and deletes the obsolete ones. Sources are moved out of the way first,
+// then the obsolete SSTs are deleted, then the sources are given their new
+// names; each step can be run again.
+func replaceSSTs(dir string, sources, obsolete []string) error {
+	if err := writeSSTRewrite(dir, sstRewrite{Phase: 1, Sources: sources, Obsolete: obsolete}); err != nil {
+		return err
+	}
+	return finishSSTRewrite(dir)
+}
+
+func writeSSTRewrite(dir string, plan sstRewrite) error {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, sstRewriteFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, sstRewriteFile))
+}
+
+// finishSSTRewrite finishes an interrupted replaceSSTs, if there is one,
+// and deletes the compactions it never got to.
+func finishSSTRewrite(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, sstRewriteFile))
+	if os.IsNotExist(err) {
+		leftovers, _ := filepath.Glob(filepath.Join(dir, "compact-*.tmp*"))
+		for _, name := range leftovers {
+			os.Remove(name)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var plan sstRewrite
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return err
+	}
+
+	moved := func(i int) string { return filepath.Join(dir, fmt.Sprintf("rewrite-%d.tmp", i+1)) }
+	if plan.Phase == 1 {
+		// No SST has a new name yet, a source still there wasn't moved
+		for i, source := range plan.Sources {
+			if err := os.Rename(filepath.Join(dir, source), moved(i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		for _, name := range plan.Obsolete {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		plan.Phase = 2
+		if err := writeSSTRewrite(dir, plan); err != nil {
+			return err
+		}
+	}
+	for i := range plan.Sources {
+		if err := os.Rename(moved(i), fmt.Sprintf("%s/sst%d.txt", dir, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(filepath.Join(dir, sstRewriteFile))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkRegions checks that the regions cover every key once and that each
+// SST is within one of them.
+func checkRegions(t *testing.T, cf *memDB) []RegionStatus {
+	t.Helper()
+	regions, err := cf.Regions()
+	if err != nil {
+		t.Fatalf("Error listing regions: %v", err)
+	}
+	if regions[0].Start != "" || regions[len(regions)-1].End != "" {
+		t.Fatalf("Expected the regions to cover every key: %+v", regions)
+	}
+	owners := map[string]int{}
+	for i, r := range regions {
+		if i > 0 && regions[i-1].End != r.Start {
+			t.Fatalf("Expected region %d to start where %d ends: %+v", i, i-1, regions)
+		}
+		for _, file := range r.Files {
+			owners[file]++
+		}
+	}
+	files, err := readSSTFiles(cf.dir)
+	if err != nil {
+		t.Fatalf("Error reading SSTs: %v", err)
+	}
+	for _, f := range files {
+		if owners[filepath.Base(f.name)] != 1 {
+			t.Fatalf("Expected %s in one region, it is in %d: %+v", f.name, owners[filepath.Base(f.name)], regions)
+		}
+	}
+	return regions
+}
+
+func checkKeys(t *testing.T, cf *memDB, expected map[string]string) {
+	t.Helper()
+	for key, value := range expected {
+		v, err := cf.Get([]byte(key))
+		if err != nil || string(v) != value {
+			t.Fatalf("Expected %s = %q, got %q (%v)", key, value, v, err)
+		}
+	}
+	it, err := cf.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatalf("Error iterating: %v", err)
+	}
+	defer it.Close()
+	count := 0
+	var last string
+	for it.Next() {
+		key := string(it.Key())
+		if count > 0 && key <= last {
+			t.Fatalf("Keys out of order: %s after %s", key, last)
+		}
+		if expected[key] != string(it.Value()) {
+			t.Fatalf("Unexpected %s = %q", key, it.Value())
+		}
+		last = key
+		count++
+	}
+	if count != len(expected) {
+		t.Fatalf("Expected %d keys, iterated over %d", len(expected), count)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	useTempDir(t)
+	dir := t.TempDir()
+	db, err := OpenStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	cf, err := db.CreateColumnFamily("ranges", CFOptions{FlushThreshold: 20, RegionSplitBytes: 2000})
+	if err != nil {
+		t.Fatalf("Error creating family: %v", err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	expected := map[string]string{}
+	for i := 0; i < 600; i++ {
+		key := fmt.Sprintf("key%04d", rng.Intn(400))
+		if rng.Intn(10) == 0 {
+			cf.Del([]byte(key))
+			delete(expected, key)
+			continue
+		}
+		value := fmt.Sprintf("value%d", i)
+		cf.Set([]byte(key), []byte(value))
+		expected[key] = value
+	}
+	cf.Merge([]byte("key0001"), "append", []byte("+"))
+	expected["key0001"] += "+"
+	if err := db.flushAll(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	regions := checkRegions(t, cf)
+	if len(regions) < 3 {
+		t.Fatalf("Expected the family to split, got %+v", regions)
+	}
+	for _, r := range regions {
+		if len(r.Files) > regionCompactFiles {
+			t.Fatalf("Expected regions to be compacted, got %+v", r)
+		}
+	}
+	checkKeys(t, cf, expected)
+
+	// The regions are kept in the region family
+	db.wal.file.Close()
+	db, err = OpenStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	defer func() { db.wal.file.Close() }()
+	cf, err = db.Family("ranges")
+	if err != nil {
+		t.Fatalf("Error reopening family: %v", err)
+	}
+	reopened := checkRegions(t, cf)
+	if len(reopened) != len(regions) {
+		t.Fatalf("Expected %d regions after reopening, got %+v", len(regions), reopened)
+	}
+	checkKeys(t, cf, expected)
+
+	// Regions left small merge
+	for key := range expected {
+		if key >= "key0050" {
+			cf.Del([]byte(key))
+			delete(expected, key)
+		}
+	}
+	for i := 0; i < regionCompactFiles+1; i++ {
+		cf.Set([]byte("key0000"), []byte(fmt.Sprint(i)))
+		expected["key0000"] = fmt.Sprint(i)
+		if err := db.flushAll(); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+	merged := checkRegions(t, cf)
+	if len(merged) >= len(regions) {
+		t.Fatalf("Expected regions to merge, got %+v", merged)
+	}
+	checkKeys(t, cf, expected)
+
+	// A family dropped takes its regions along
+	if err := db.DropColumnFamily("ranges"); err != nil {
+		t.Fatalf("Error dropping family: %v", err)
+	}
+	cf, err = db.CreateColumnFamily("ranges", CFOptions{RegionSplitBytes: 2000})
+	if err != nil {
+		t.Fatalf("Error creating family again: %v", err)
+	}
+	if regions := checkRegions(t, cf); len(regions) != 1 {
+		t.Fatalf("Expected a new family to have one region, got %+v", regions)
+	}
+}
+
+func TestFinishSSTRewrite(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, key string) {
+		if err := writeSSTFile(filepath.Join(dir, name), []sstEntry{{byte(set), []byte(key), []byte("v")}}, codecNone); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+	write("sst1.txt", "old1")
+	write("sst2.txt", "old2")
+	write("sst3.txt", "kept")
+	write("compact-0.tmp", "compacted")
+	if err := writeSSTRewrite(dir, sstRewrite{Phase: 1, Sources: []string{"sst3.txt", "compact-0.tmp"}, Obsolete: []string{"sst1.txt", "sst2.txt"}}); err != nil {
+		t.Fatalf("Error writing plan: %v", err)
+	}
+	// As if the crash came after the first move
+	if err := os.Rename(filepath.Join(dir, "sst3.txt"), filepath.Join(dir, "rewrite-1.tmp")); err != nil {
+		t.Fatalf("Error moving: %v", err)
+	}
+
+	if err := finishSSTRewrite(dir); err != nil {
+		t.Fatalf("Error finishing the rewrite: %v", err)
+	}
+	files, err := readSSTFiles(dir)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 SSTs, got %+v (%v)", files, err)
+	}
+	if string(files[0].header.smallest) != "kept" || string(files[1].header.smallest) != "compacted" {
+		t.Fatalf("Unexpected SSTs: %s, %s", files[0].header.smallest, files[1].header.smallest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, sstRewriteFile)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the plan to be gone: %v", err)
+	}
+}
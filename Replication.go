@@ -0,0 +1,722 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elliotchance/orderedmap"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A replica follows a primary over HTTP. It starts from a checkpoint of the
+// primary, fetched from /replication/checkpoint as a tar, then streams
+// /replication/wal: the primary's WAL records, each written to the
+// replica's own WAL and applied the way recoverFromWAL applies them, so the
+// replica has the same sequence numbers and can restart where it stopped.
+
+// The frames of the WAL stream: a record as encoded in the WAL, or a
+// heartbeat with the primary's last sequence number and its Unix time in
+// nanoseconds, sent whenever the stream is idle.
+const (
+	frameRecord    = 'r'
+	frameHeartbeat = 'h'
+)
+
+// replicationPoll is how often the primary looks for new records when the
+// stream is idle, and how long a replica waits before reconnecting.
+var replicationPoll = 100 * time.Millisecond
+
+// replicaCheckpointDir is where a replica downloads the primary's
+// checkpoint before swapping it in.
+const replicaCheckpointDir = "ReplicaCheckpoint"
+
+var ErrReadOnlyReplica = errors.New("Read-only replica")
+
+// errResync makes a replica start over from a new checkpoint, when it can't
+// follow the WAL stream: the records it needs are gone from the primary,
+// one needs files that aren't in the WAL, like ingested SSTs, or one is for
+// a family the replica doesn't have as the primary had it.
+var errResync = errors.New("Replica needs a new checkpoint")
+
+// serveCheckpointStream sends a fresh checkpoint of db as a tar, MANIFEST
+// last. With ?replica=, the WAL after the checkpoint is kept for that
+// replica from then on, so that it can stream it once it has loaded the
+// checkpoint.
+func serveCheckpointStream(w http.ResponseWriter, r *http.Request, db *memDB) {
+	if name := r.URL.Query().Get("replica"); name != "" {
+		consumer := "replica-" + name
+		if !validColumnFamilyName(consumer) {
+			http.Error(w, "Invalid replica name", http.StatusBadRequest)
+			return
+		}
+		db.mu.Lock()
+		seq := db.wal.seq
+		db.mu.Unlock()
+		if err := commitWALCheckpoint(db.wal.root, consumer, seq); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tmp, err := os.MkdirTemp(storePath(db.wal.root, "."), "replication-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := tmp + "/checkpoint"
+	manifest, err := db.Checkpoint(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("X-Checkpoint-Seq", strconv.FormatUint(manifest.Seq, 10))
+	writeCheckpointTar(w, dir, manifest)
+}
+
+// ReplicaConsumer is a replica the primary keeps WAL segments for: the
+// last record it was sent and when.
+type ReplicaConsumer struct {
+	Name    string    `json:"name"`
+	Seq     uint64    `json:"seq"`
+	Updated time.Time `json:"updated"`
+}
+
+// replicaConsumers lists the replicas db keeps WAL for.
+func replicaConsumers(db *memDB) ([]ReplicaConsumer, error) {
+	consumers := []ReplicaConsumer{}
+	entries, err := os.ReadDir(storePath(db.wal.root, walSegmentDir+"/consumers"))
+	if os.IsNotExist(err) {
+		return consumers, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := strings.TrimPrefix(entry.Name(), "replica-")
+		if name == entry.Name() || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		seq, ok := walCheckpoint(db.wal.root, entry.Name())
+		info, err := entry.Info()
+		if !ok || err != nil {
+			continue
+		}
+		consumers = append(consumers, ReplicaConsumer{Name: name, Seq: seq, Updated: info.ModTime().UTC()})
+	}
+	return consumers, nil
+}
+
+// serveReplicaConsumers lists the replicas db keeps WAL for, and with
+// DELETE ?name= forgets one, retired or promoted, so its segments can go.
+func serveReplicaConsumers(w http.ResponseWriter, r *http.Request, db *memDB) {
+	switch r.Method {
+	case http.MethodGet:
+		consumers, err := replicaConsumers(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(consumers)
+	case http.MethodDelete:
+		consumer := "replica-" + r.URL.Query().Get("name")
+		if !validColumnFamilyName(consumer) {
+			http.Error(w, "Invalid replica name", http.StatusBadRequest)
+			return
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if err := removeWALConsumer(db.wal.root, consumer); os.IsNotExist(err) {
+			http.Error(w, "Replica not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := purgeWALSegments(db.wal.root); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeCheckpointTar writes the files of the checkpoint in dir as a tar,
+// MANIFEST last.
+func writeCheckpointTar(w io.Writer, dir string, manifest *Manifest) error {
+	tw := tar.NewWriter(w)
+	var paths []string
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+	}
+	for _, path := range append(paths, "MANIFEST") {
+		if err := addTarFile(tw, dir, path); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addTarFile(tw *tar.Writer, dir, path string) error {
+	file, err := os.Open(dir + "/" + path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: path, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// serveWALStream sends the records of db's WAL after ?since=, then the new
+// ones as they are written, until the replica goes away. ?replica= names
+// it: the primary keeps the WAL segments it hasn't been sent yet, as for a
+// CDC consumer. A replica asking for records the WAL no longer has, or
+// that the primary never wrote, gets a 410 and needs a new checkpoint.
+func serveWALStream(w http.ResponseWriter, r *http.Request, db *memDB) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Sequence is not an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	consumer := "replica-" + r.URL.Query().Get("replica")
+	if !validColumnFamilyName(consumer) {
+		http.Error(w, "Invalid replica name", http.StatusBadRequest)
+		return
+	}
+
+	db.mu.Lock()
+	last := db.wal.seq
+	db.mu.Unlock()
+	if since > last {
+		http.Error(w, fmt.Sprintf("Sequence %d is ahead of the primary", since), http.StatusGone)
+		return
+	}
+	tailer := NewWALTailer(TailOptions{Since: since, Dir: db.wal.root})
+	defer tailer.Close()
+	rec, err := tailer.NextRecord()
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err := commitWALCheckpoint(db.wal.root, consumer, since); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+	sent, committed := since, since
+	for {
+		switch err {
+		case nil:
+			out.WriteByte(frameRecord)
+			out.Write(rec.encode())
+			sent = rec.seq
+		case io.EOF:
+			db.mu.Lock()
+			last := db.wal.seq
+			db.mu.Unlock()
+			heartbeat := make([]byte, 17)
+			heartbeat[0] = frameHeartbeat
+			binary.LittleEndian.PutUint64(heartbeat[1:], last)
+			binary.LittleEndian.PutUint64(heartbeat[9:], uint64(time.Now().UnixNano()))
+			out.Write(heartbeat)
+			if err := out.Flush(); err != nil {
+				return
+			}
+			flusher.Flush()
+			if sent != committed {
+				// A replica removed through /admin/replicas stays removed
+				db.mu.Lock()
+				_, ok := walCheckpoint(db.wal.root, consumer)
+				if ok {
+					commitWALCheckpoint(db.wal.root, consumer, sent)
+				}
+				db.mu.Unlock()
+				if !ok {
+					return
+				}
+				committed = sent
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(replicationPoll):
+			}
+		default:
+			return
+		}
+		rec, err = tailer.NextRecord()
+	}
+}
+
+// ReplicaStatus is the replication state of a node. The lag is how many
+// records the replica is behind the primary's last heartbeat, and for how
+// long it has been behind.
+type ReplicaStatus struct {
+	Role        string    `json:"role"`
+	Primary     string    `json:"primary,omitempty"`
+	Connected   bool      `json:"connected"`
+	AppliedSeq  uint64    `json:"applied_seq"`
+	PrimarySeq  uint64    `json:"primary_seq"`
+	LagRecords  uint64    `json:"lag_records"`
+	LagSeconds  float64   `json:"lag_seconds"`
+	LastContact time.Time `json:"last_contact,omitempty"`
+	Resyncs     int       `json:"resyncs"`
+}
+
+// Replica keeps a store up to date with a primary until it is stopped or
+// promoted.
+type Replica struct {
+	db      *memDB
+	primary string
+	name    string
+	client  *http.Client
+
+	mu         sync.Mutex
+	status     ReplicaStatus
+	caughtUpAt time.Time
+	promoted   bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// StartReplica makes db, the default family of an open store, a replica of
+// the primary at primary, like http://host:8080. An empty store is first
+// loaded from a checkpoint; one that has been a replica before resumes from
+// its last record. name identifies the replica to the primary.
+func StartReplica(db *memDB, primary, name string) (*Replica, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replica{
+		db:         db,
+		primary:    strings.TrimSuffix(primary, "/"),
+		name:       name,
+		client:     tokenClient(apiToken),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		caughtUpAt: time.Now(),
+	}
+	r.status.Role = "replica"
+	r.status.Primary = r.primary
+
+	db.mu.Lock()
+	db.wal.readOnly = true
+	empty := db.wal.seq == 0
+	db.mu.Unlock()
+	if empty {
+		if err := r.resync(ctx); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	r.setApplied(r.appliedSeq())
+
+	go r.run(ctx)
+	return r, nil
+}
+
+func (r *Replica) appliedSeq() uint64 {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	return r.db.wal.seq
+}
+
+// run streams from the primary, reconnecting after errors, until stopped.
+func (r *Replica) run(ctx context.Context) {
+	defer close(r.done)
+	for ctx.Err() == nil {
+		err := r.stream(ctx)
+		r.mu.Lock()
+		r.status.Connected = false
+		r.mu.Unlock()
+		if err == errResync {
+			err = r.resync(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			fmt.Println("Replication from", r.primary, "interrupted:", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(replicationPoll):
+		}
+	}
+}
+
+// stream applies the records of one connection to the primary.
+func (r *Replica) stream(ctx context.Context) error {
+	target := fmt.Sprintf("%s/replication/wal?since=%d&replica=%s", r.primary, r.appliedSeq(), url.QueryEscape(r.name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errResync
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WAL stream failed: %s", resp.Status)
+	}
+
+	r.mu.Lock()
+	r.status.Connected = true
+	r.mu.Unlock()
+	reader := bufio.NewReader(resp.Body)
+	for {
+		kind, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case frameRecord:
+			rec, err := readWALRecord(reader)
+			if err != nil {
+				return err
+			}
+			if err := r.apply(rec); err != nil {
+				return err
+			}
+			r.setApplied(rec.seq)
+		case frameHeartbeat:
+			heartbeat := make([]byte, 16)
+			if _, err := io.ReadFull(reader, heartbeat); err != nil {
+				return err
+			}
+			r.mu.Lock()
+			r.status.PrimarySeq = binary.LittleEndian.Uint64(heartbeat)
+			r.status.LastContact = time.Now()
+			r.mu.Unlock()
+			r.setApplied(r.appliedSeq())
+		default:
+			return fmt.Errorf("Unknown replication frame %q", kind)
+		}
+	}
+}
+
+// apply writes a record of the primary to the replica's WAL and applies it,
+// under the store's lock like any write.
+func (r *Replica) apply(rec walRecord) error {
+	db := r.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if rec.seq <= db.wal.seq {
+		return nil
+	}
+	records, err := rec.batchRecords()
+	if err != nil {
+		return err
+	}
+	dropped := false
+	for _, sub := range records {
+		name, op, _ := splitWALKey(sub.op, sub.key)
+		cf, ok := db.families[name]
+		switch op {
+		case byte(CreateCF):
+			// A family of the same name the primary has since dropped
+			if _, incarnation := parseCFOptions(sub.value); ok && cf.incarnation != incarnation {
+				return errResync
+			}
+		case byte(DropCF):
+			if !ok || strconv.FormatUint(cf.incarnation, 10) != string(sub.value) {
+				return errResync
+			}
+			dropped = true
+		case byte(Ingest):
+			return errResync
+		default:
+			if !ok {
+				return errResync
+			}
+		}
+	}
+
+	if err := db.wal.append(rec.encode()); err != nil {
+		return err
+	}
+	db.wal.seq = rec.seq
+	db.applyWALRecord(rec)
+	db.publishRecord(rec)
+	if dropped {
+		// As the primary does, so recovery doesn't replay the family
+		return db.flushAll()
+	}
+	for _, cf := range db.families {
+		cf.checkSizeAndFlush()
+	}
+	return nil
+}
+
+func (r *Replica) setApplied(seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.AppliedSeq = seq
+	if r.status.PrimarySeq < seq {
+		r.status.PrimarySeq = seq
+	}
+	if seq >= r.status.PrimarySeq {
+		r.caughtUpAt = time.Now()
+	}
+}
+
+// Status returns the replication state. A promoted replica reports itself
+// as a primary.
+func (r *Replica) Status() ReplicaStatus {
+	applied := r.appliedSeq()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	if r.promoted {
+		status.Role = "primary"
+		status.Connected = false
+		status.AppliedSeq = applied
+		status.PrimarySeq = applied
+		return status
+	}
+	status.LagRecords = status.PrimarySeq - status.AppliedSeq
+	if status.LagRecords > 0 {
+		status.LagSeconds = time.Since(r.caughtUpAt).Seconds()
+	}
+	return status
+}
+
+// ReadOnly reports whether writes must be refused, until promotion.
+func (r *Replica) ReadOnly() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.promoted
+}
+
+// Stop stops following the primary and waits for the stream to end.
+func (r *Replica) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+// Promote stops following the primary and makes the store writable. It
+// keeps the sequence numbers where replication left them. The primary is
+// told to stop keeping WAL for the replica, in the background as it may
+// well be down; /admin/replicas on it does the same by hand.
+func (r *Replica) Promote() {
+	r.Stop()
+	r.db.mu.Lock()
+	r.db.wal.readOnly = false
+	r.db.mu.Unlock()
+	r.mu.Lock()
+	r.promoted = true
+	r.mu.Unlock()
+	go func() {
+		if err := r.forget(); err != nil {
+			fmt.Println("Error removing the replica from its primary:", err)
+		}
+	}()
+}
+
+// forget removes the replica's WAL consumer on the primary.
+func (r *Replica) forget() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, r.primary+"/admin/replicas?name="+url.QueryEscape(r.name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		message, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// resync replaces the replica's store with a new checkpoint of the primary.
+func (r *Replica) resync(ctx context.Context) error {
+	root := r.db.wal.root
+	dir := storePath(root, replicaCheckpointDir)
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := r.fetchCheckpoint(ctx, dir); err != nil {
+		return err
+	}
+
+	r.db.mu.Lock()
+	err := r.db.replaceWithCheckpointWithNoLock(dir)
+	r.db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.status.Resyncs++
+	r.mu.Unlock()
+	return nil
+}
+
+// fetchCheckpoint downloads a checkpoint of the primary into dir.
+func (r *Replica) fetchCheckpoint(ctx context.Context, dir string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.primary+"/replication/checkpoint?replica="+url.QueryEscape(r.name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Checkpoint failed: %s", resp.Status)
+	}
+
+	return extractCheckpoint(resp.Body, dir)
+}
+
+// extractCheckpoint writes the checkpoint tar read from r to dir and checks
+// it against its manifest.
+func extractCheckpoint(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("Invalid path in checkpoint: %s", header.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			return err
+		}
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := readManifest(dir + "/MANIFEST")
+	if err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		got, err := describeFile(dir, file.Path)
+		if err != nil {
+			return err
+		}
+		if got.SHA256 != file.SHA256 {
+			return fmt.Errorf("Checksum mismatch for %s in the checkpoint", file.Path)
+		}
+	}
+	// The SST directory must exist even if the primary has no SST yet
+	return os.MkdirAll(dir+"/"+sstDir, 0755)
+}
+
+// replaceWithCheckpointWithNoLock swaps the files of the store for the ones
+// of a checkpoint and reloads it, in place so handles on the default family
+// stay valid. Handles on other families are dropped.
+func (mem *memDB) replaceWithCheckpointWithNoLock(dir string) error {
+	root := mem.wal.root
+	mem.wal.file.Close()
+
+	segments, err := walSegments(root)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := os.Remove(segment.path); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(storePath(root, sstDir)); err != nil {
+		return err
+	}
+	if err := os.Rename(dir+"/"+sstDir, storePath(root, sstDir)); err != nil {
+		return err
+	}
+	if err := os.Rename(dir+"/wal.txt", storePath(root, "wal.txt")); err != nil {
+		return err
+	}
+
+	wal, err := instantiateWal(root)
+	if err != nil {
+		return err
+	}
+	wal.readOnly = mem.wal.readOnly
+	*mem.wal = *wal
+	for name, cf := range mem.families {
+		if name != "" {
+			cf.dropped = true
+			delete(mem.families, name)
+		}
+	}
+	mem.values = orderedmap.NewOrderedMap()
+	if err := mem.openColumnFamilies(); err != nil {
+		return err
+	}
+	return recoverFromWAL(mem)
+}
+
+// promote asks the replica at server to become a primary, for kvctl.
+func promote(server string) (*ReplicaStatus, error) {
+	resp, err := tokenClient(apiToken).Post(strings.TrimSuffix(server, "/")+"/admin/promote", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(message)))
+	}
+	status := &ReplicaStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
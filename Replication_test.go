@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// waitForSeq waits until the replica has applied everything the primary
+// wrote.
+func waitForSeq(t *testing.T, r *Replica, primary *memDB) {
+	t.Helper()
+	primary.mu.Lock()
+	seq := primary.wal.seq
+	primary.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.appliedSeq() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica stuck at %d, primary at %d", r.appliedSeq(), seq)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func expectValue(t *testing.T, db *memDB, key, expected string) {
+	t.Helper()
+	v, err := db.Get([]byte(key))
+	if err != nil || string(v) != expected {
+		t.Fatalf("Expected %s = %q, got %q (%v)", key, expected, v, err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	useTempDir(t)
+	defer func(poll time.Duration) { replicationPoll = poll }(replicationPoll)
+	replicationPoll = 10 * time.Millisecond
+
+	primary, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening primary: %v", err)
+	}
+	defer primary.wal.file.Close()
+	users, err := primary.CreateColumnFamily("users", CFOptions{})
+	if err != nil {
+		t.Fatalf("Error creating column family: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		primary.Set([]byte(fmt.Sprintf("sst%d", i)), []byte("flushed"))
+	}
+	users.Set([]byte("u1"), []byte("ann"))
+	if err := primary.flushAll(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	primary.Set([]byte("mem"), []byte("in the WAL"))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/wal", func(w http.ResponseWriter, r *http.Request) { serveWALStream(w, r, primary) })
+	mux.HandleFunc("/replication/checkpoint", func(w http.ResponseWriter, r *http.Request) { serveCheckpointStream(w, r, primary) })
+	mux.HandleFunc("/admin/replicas", func(w http.ResponseWriter, r *http.Request) { serveReplicaConsumers(w, r, primary) })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Bootstrap from a checkpoint
+	replicaDir := t.TempDir()
+	db, err := OpenStore(replicaDir)
+	if err != nil {
+		t.Fatalf("Error opening replica: %v", err)
+	}
+	r, err := StartReplica(db, server.URL, "r1")
+	if err != nil {
+		t.Fatalf("Error starting replica: %v", err)
+	}
+	expectValue(t, db, "sst3", "flushed")
+	expectValue(t, db, "mem", "in the WAL")
+	replicaUsers, err := db.Family("users")
+	if err != nil {
+		t.Fatalf("Expected the users family on the replica: %v", err)
+	}
+	expectValue(t, replicaUsers, "u1", "ann")
+
+	// Live records
+	b := &WriteBatch{}
+	b.Set("", []byte("batched"), []byte("1"))
+	b.Set("users", []byte("u2"), []byte("bob"))
+	primary.Write(b)
+	primary.Del([]byte("sst3"))
+	primary.Merge([]byte("counter"), "add", []byte("5"))
+	primary.Merge([]byte("counter"), "add", []byte("2"))
+	waitForSeq(t, r, primary)
+	expectValue(t, db, "batched", "1")
+	expectValue(t, replicaUsers, "u2", "bob")
+	expectValue(t, db, "counter", "7")
+	if _, err := db.Get([]byte("sst3")); err == nil {
+		t.Fatalf("Expected sst3 to be deleted on the replica")
+	}
+	status := r.Status()
+	if !status.Connected || status.LagRecords != 0 || status.AppliedSeq != primary.wal.seq || status.Resyncs != 1 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+
+	// Families are created and dropped through the WAL
+	orders, err := primary.CreateColumnFamily("orders", CFOptions{})
+	if err != nil {
+		t.Fatalf("Error creating column family: %v", err)
+	}
+	orders.Set([]byte("o1"), []byte("pending"))
+	waitForSeq(t, r, primary)
+	replicaOrders, err := db.Family("orders")
+	if err != nil {
+		t.Fatalf("Expected the orders family on the replica: %v", err)
+	}
+	expectValue(t, replicaOrders, "o1", "pending")
+	if err := primary.DropColumnFamily("orders"); err != nil {
+		t.Fatalf("Error dropping column family: %v", err)
+	}
+	if _, err := primary.CreateColumnFamily("orders", CFOptions{}); err != nil {
+		t.Fatalf("Error creating column family: %v", err)
+	}
+	waitForSeq(t, r, primary)
+	if replicaOrders, err = db.Family("orders"); err != nil {
+		t.Fatalf("Expected the new orders family on the replica: %v", err)
+	}
+	if _, err := replicaOrders.Get([]byte("o1")); err == nil || err.Error() != "Key not found" {
+		t.Fatalf("Expected o1 to go with the dropped family, got %v", err)
+	}
+	expectValue(t, db, "counter", "7")
+	if status := r.Status(); status.Resyncs != 1 {
+		t.Fatalf("Expected no new checkpoint, got %+v", status)
+	}
+
+	// A family the replica has under the name, but not the primary's, takes
+	// a new checkpoint
+	db.mu.Lock()
+	_, err = db.addColumnFamilyWithNoLock("audit", CFOptions{}, 0)
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Error adding column family: %v", err)
+	}
+	audit, err := primary.CreateColumnFamily("audit", CFOptions{})
+	if err != nil {
+		t.Fatalf("Error creating column family: %v", err)
+	}
+	audit.Set([]byte("a1"), []byte("logged"))
+	waitForSeq(t, r, primary)
+	replicaAudit, err := db.Family("audit")
+	if err != nil || replicaAudit.incarnation != audit.incarnation {
+		t.Fatalf("Expected the primary's audit family on the replica, got %+v (%v)", replicaAudit, err)
+	}
+	expectValue(t, replicaAudit, "a1", "logged")
+	if status := r.Status(); status.Resyncs != 2 {
+		t.Fatalf("Expected a second checkpoint, got %+v", status)
+	}
+
+	// A restarted replica resumes where it stopped
+	r.Stop()
+	for i := 0; i < 5; i++ {
+		primary.Set([]byte(fmt.Sprintf("late%d", i)), []byte("while down"))
+	}
+	db.wal.file.Close()
+	db, err = OpenStore(replicaDir)
+	if err != nil {
+		t.Fatalf("Error reopening replica: %v", err)
+	}
+	r, err = StartReplica(db, server.URL, "r1")
+	if err != nil {
+		t.Fatalf("Error restarting replica: %v", err)
+	}
+	waitForSeq(t, r, primary)
+	expectValue(t, db, "late4", "while down")
+	expectValue(t, db, "batched", "1")
+	if status := r.Status(); status.Resyncs != 0 {
+		t.Fatalf("Expected no checkpoint on restart, got %+v", status)
+	}
+
+	// The other front ends are refused by the store itself
+	respListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer respListener.Close()
+	go ServeRESP(respListener, db)
+	conn, err := net.Dial("tcp", respListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "*3\r\n$3\r\nSET\r\n$1\r\nx\r\n$1\r\n1\r\n")
+	if got := readRESP(t, bufio.NewReader(conn)); got != "-ERR "+ErrReadOnlyReplica.Error() {
+		t.Fatalf("Expected SET to be refused on the replica, got %q", got)
+	}
+	rpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer rpcListener.Close()
+	go ServeRPC(rpcListener, db)
+	client, err := DialRPC(rpcListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Put(context.Background(), []byte("x"), []byte("1")); err != ErrReadOnlyReplica {
+		t.Fatalf("Expected Put to be refused on the replica, got %v", err)
+	}
+	if _, err := client.Delete(context.Background(), []byte("late1")); err != ErrReadOnlyReplica {
+		t.Fatalf("Expected Delete to be refused on the replica, got %v", err)
+	}
+	expectValue(t, db, "late1", "while down")
+
+	// Over HTTP: reads, refused writes, status and promotion
+	memMutex.Lock()
+	savedMem := mem
+	mem, replica = db, r
+	memMutex.Unlock()
+	defer func() {
+		memMutex.Lock()
+		mem, replica = savedMem, nil
+		memMutex.Unlock()
+	}()
+	api := http.NewServeMux()
+	registerRoutes(api)
+	node := httptest.NewServer(readOnlyGuard(api))
+	defer node.Close()
+
+	resp, err := http.Get(node.URL + "/get?key=late1")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a read on the replica, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+	for _, write := range []func() (*http.Response, error){
+		func() (*http.Response, error) { return http.Get(node.URL + "/set?key=x&value=1") },
+		func() (*http.Response, error) { return http.Post(node.URL+"/batch", "application/json", nil) },
+		func() (*http.Response, error) {
+			req, _ := http.NewRequest(http.MethodPut, node.URL+"/cf/default/kv/x", nil)
+			return http.DefaultClient.Do(req)
+		},
+	} {
+		resp, err := write()
+		if err != nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected a write to be refused, got %v (%v)", resp, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(node.URL + "/replication/status")
+	if err != nil {
+		t.Fatalf("Error getting status: %v", err)
+	}
+	var remote ReplicaStatus
+	json.NewDecoder(resp.Body).Decode(&remote)
+	resp.Body.Close()
+	if remote.Role != "replica" || remote.Primary != server.URL || remote.AppliedSeq == 0 {
+		t.Fatalf("Unexpected status: %+v", remote)
+	}
+
+	promoted, err := promote(node.URL)
+	if err != nil || promoted.Role != "primary" {
+		t.Fatalf("Error promoting: %+v (%v)", promoted, err)
+	}
+	// The primary no longer keeps WAL for it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := walCheckpoint(primary.wal.root, "replica-r1"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the promoted replica's WAL consumer to be removed")
+		}
+		time.Sleep(replicationPoll)
+	}
+	resp, err = http.PostForm(node.URL+"/set?key=x&value=1", url.Values{})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a write after promotion, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+	expectValue(t, db, "x", "1")
+	if _, err := client.Put(context.Background(), []byte("y"), []byte("2")); err != nil {
+		t.Fatalf("Expected Put after promotion, got %v", err)
+	}
+	expectValue(t, db, "y", "2")
+
+	// The old primary's writes no longer reach it
+	primary.Set([]byte("after"), []byte("promotion"))
+	time.Sleep(5 * replicationPoll)
+	if _, err := db.Get([]byte("after")); err == nil {
+		t.Fatalf("Expected a promoted replica to stop following the primary")
+	}
+	if _, err := promote(node.URL); err == nil {
+		t.Fatalf("Expected promoting twice to fail")
+	}
+}
+
+func TestReplicationStreamGone(t *testing.T) {
+	useTempDir(t)
+	primary, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening primary: %v", err)
+	}
+	defer primary.wal.file.Close()
+	primary.Set([]byte("a"), []byte("1"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { serveWALStream(w, r, primary) }))
+	defer server.Close()
+
+	// Ahead of the primary, as after a primary lost its data
+	resp, err := http.Get(server.URL + "?since=100&replica=r1")
+	if err != nil || resp.StatusCode != http.StatusGone {
+		t.Fatalf("Expected 410, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+
+	// Behind what the WAL still has
+	for i := 0; i < 2*flushThreshold; i++ {
+		primary.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+	}
+	resp, err = http.Get(server.URL + "?since=1&replica=r2")
+	if err != nil || resp.StatusCode != http.StatusGone {
+		t.Fatalf("Expected 410, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestReplicaConsumers(t *testing.T) {
+	primary, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening primary: %v", err)
+	}
+	primary.Set([]byte("a"), []byte("1"))
+	if err := commitWALCheckpoint(primary.wal.root, "replica-gone", primary.wal.seq); err != nil {
+		t.Fatalf("Error committing checkpoint: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { serveReplicaConsumers(w, r, primary) }))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error listing replicas: %v", err)
+	}
+	var consumers []ReplicaConsumer
+	json.NewDecoder(resp.Body).Decode(&consumers)
+	resp.Body.Close()
+	if len(consumers) != 1 || consumers[0].Name != "gone" || consumers[0].Seq != primary.wal.seq {
+		t.Fatalf("Unexpected replicas: %+v", consumers)
+	}
+
+	remove := func(name string) int {
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+"?name="+name, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error removing replica: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := remove("gone"); code != http.StatusOK {
+		t.Fatalf("Expected the replica to be removed, got %d", code)
+	}
+	if _, ok := walCheckpoint(primary.wal.root, "replica-gone"); ok {
+		t.Fatalf("Expected the replica's WAL consumer to be removed")
+	}
+	if code := remove("gone"); code != http.StatusNotFound {
+		t.Fatalf("Expected a removed replica to be not found, got %d", code)
+	}
+	if code := remove("../x"); code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid name to be refused, got %d", code)
+	}
+}
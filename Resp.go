@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// respServer speaks the Redis protocol, RESP2 or RESP3 once a client sends
+// HELLO 3, on top of the default column family. Deadlines given with SET EX
+// or PX go to the expiry family.
+type respServer struct {
+	db          *memDB
+	started     time.Time
+	clients     int64
+	connections int64
+	commands    int64
+}
+
+// ServeRESP accepts Redis clients on l until it is closed.
+func ServeRESP(l net.Listener, db *memDB) error {
+	if err := db.ensureExpiryFamily(); err != nil {
+		return err
+	}
+	s := &respServer{db: db, started: time.Now()}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+type respConn struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	proto int
+}
+
+var errRESPProtocol = errors.New("Protocol error")
+
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	atomic.AddInt64(&s.clients, 1)
+	defer atomic.AddInt64(&s.clients, -1)
+	atomic.AddInt64(&s.connections, 1)
+
+	c := &respConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), proto: 2}
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			if err == errRESPProtocol {
+				c.error("ERR Protocol error")
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		atomic.AddInt64(&s.commands, 1)
+		if strings.ToUpper(string(args[0])) == "QUIT" {
+			c.simple("OK")
+			c.w.Flush()
+			return
+		}
+		s.execute(c, args)
+		// Pipelined commands are answered together
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings, or an inline command as typed
+// in telnet.
+func (c *respConn) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, field := range strings.Fields(line) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024*1024 {
+		return nil, errRESPProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > 512*1024*1024 {
+			return nil, errRESPProtocol
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, arg); err != nil {
+			return nil, err
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *respConn) simple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) error(s string) {
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+func (c *respConn) integer(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) bulk(b []byte) {
+	c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) null() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+	} else {
+		c.w.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respConn) array(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader starts a map of n pairs, a flat array of 2n items in RESP2.
+func (c *respConn) mapHeader(n int) {
+	if c.proto == 3 {
+		c.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.array(2 * n)
+	}
+}
+
+func (s *respServer) execute(c *respConn, args [][]byte) {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	// Exactly n arguments, at least -n when negative, any number when 0
+	arity := map[string]int{
+		"GET": 1, "SET": -2, "DEL": -1, "EXISTS": -1, "MGET": -1, "MSET": -2,
+		"INCR": 1, "SCAN": -1, "TTL": 1, "PING": 0, "INFO": 0, "HELLO": 0,
+		"ECHO": 1, "SELECT": 1, "COMMAND": 0, "CLIENT": -1,
+	}
+	n, ok := arity[name]
+	if !ok {
+		c.error(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+		return
+	}
+	if (n > 0 && len(args) != n) || (n < 0 && len(args) < -n) || (name == "MSET" && len(args)%2 != 0) {
+		c.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	db := s.db
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			c.bulk(args[0])
+		} else {
+			c.simple("PONG")
+		}
+	case "ECHO":
+		c.bulk(args[0])
+	case "SELECT":
+		if string(args[0]) != "0" {
+			c.error("ERR DB index is out of range")
+			return
+		}
+		c.simple("OK")
+	case "COMMAND", "CLIENT":
+		// Asked for by clients when they connect, nothing to tell them
+		if name == "COMMAND" {
+			c.array(0)
+		} else {
+			c.simple("OK")
+		}
+	case "HELLO":
+		s.hello(c, args)
+	case "GET":
+		db.mu.Lock()
+		value, ok := db.liveWithNoLock(args[0])
+		db.mu.Unlock()
+		if !ok {
+			c.null()
+			return
+		}
+		c.bulk(value)
+	case "SET":
+		s.set(c, args)
+	case "DEL", "EXISTS":
+		db.mu.Lock()
+		count := int64(0)
+		b := &WriteBatch{}
+		for _, key := range args {
+			if _, ok := db.liveWithNoLock(key); ok {
+				count++
+				if name == "DEL" {
+					b.Del("", key)
+					if _, ok := db.expiryWithNoLock(key); ok {
+						b.Del(expiryFamily, key)
+					}
+				}
+			}
+		}
+		var err error
+		if len(b.ops) > 0 {
+			err = db.WriteWithNoLock(b)
+		}
+		db.mu.Unlock()
+		if err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+		c.integer(count)
+	case "MGET":
+		db.mu.Lock()
+		values := make([][]byte, len(args))
+		found := make([]bool, len(args))
+		for i, key := range args {
+			values[i], found[i] = db.liveWithNoLock(key)
+		}
+		db.mu.Unlock()
+		c.array(len(values))
+		for i, value := range values {
+			if found[i] {
+				c.bulk(value)
+			} else {
+				c.null()
+			}
+		}
+	case "MSET":
+		db.mu.Lock()
+		b := &WriteBatch{}
+		for i := 0; i < len(args); i += 2 {
+			db.batchSetWithNoLock(b, args[i], args[i+1], time.Time{})
+		}
+		err := db.WriteWithNoLock(b)
+		db.mu.Unlock()
+		if err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+		c.simple("OK")
+	case "INCR":
+		s.incr(c, args[0])
+	case "TTL":
+		db.mu.Lock()
+		_, exists := db.liveWithNoLock(args[0])
+		deadline, hasExpiry := db.expiryWithNoLock(args[0])
+		db.mu.Unlock()
+		switch {
+		case !exists:
+			c.integer(-2)
+		case !hasExpiry:
+			c.integer(-1)
+		default:
+			c.integer(int64((time.Until(deadline) + 500*time.Millisecond) / time.Second))
+		}
+	case "SCAN":
+		s.scan(c, args)
+	case "INFO":
+		c.bulk([]byte(s.info()))
+	}
+}
+
+func (s *respServer) hello(c *respConn, args [][]byte) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil || proto < 2 || proto > 3 {
+			c.error("NOPROTO unsupported protocol version")
+			return
+		}
+		c.proto = proto
+	}
+	c.mapHeader(4)
+	c.bulk([]byte("server"))
+	c.bulk([]byte("redis"))
+	c.bulk([]byte("version"))
+	c.bulk([]byte("7.0.0"))
+	c.bulk([]byte("proto"))
+	c.integer(int64(c.proto))
+	c.bulk([]byte("mode"))
+	c.bulk([]byte("standalone"))
+}
+
+// set handles SET key value [EX seconds | PX milliseconds | KEEPTTL] [NX | XX].
+func (s *respServer) set(c *respConn, args [][]byte) {
+	key, value := args[0], args[1]
+	var deadline time.Time
+	var nx, xx, keepTTL bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 >= len(args) || !deadline.IsZero() {
+				c.error("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				c.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if strings.ToUpper(string(args[i])) == "PX" {
+				unit = time.Millisecond
+			}
+			deadline = time.Now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+	}
+	if (nx && xx) || (keepTTL && !deadline.IsZero()) {
+		c.error("ERR syntax error")
+		return
+	}
+
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, exists := db.liveWithNoLock(key)
+	if (nx && exists) || (xx && !exists) {
+		c.null()
+		return
+	}
+	if keepTTL {
+		deadline, _ = db.expiryWithNoLock(key)
+	}
+	b := &WriteBatch{}
+	db.batchSetWithNoLock(b, key, value, deadline)
+	if err := db.WriteWithNoLock(b); err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	c.simple("OK")
+}
+
+func (s *respServer) incr(c *respConn, key []byte) {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Checked here too for the error Redis gives, and for expired values
+	current, exists := db.liveWithNoLock(key)
+	if exists {
+		if _, err := strconv.ParseInt(string(current), 10, 64); err != nil {
+			c.error("ERR value is not an integer or out of range")
+			return
+		}
+	}
+	root := db.families[""]
+	if err := root.MergeWithNoLock(key, "add", []byte("1")); err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	value, err := root.GetWithNoLock(key)
+	if err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	n, _ := strconv.ParseInt(string(value), 10, 64)
+	c.integer(n)
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. The cursor is the
+// number of keys already walked, so a scan sees every key that is there for
+// its whole duration, like Redis guarantees.
+func (s *respServer) scan(c *respConn, args [][]byte) {
+	cursor, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || cursor < 0 {
+		c.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				c.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+	}
+
+	it, err := s.db.families[""].NewIterator(nil, nil)
+	if err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	defer it.Close()
+	expiries, _ := s.db.Family(expiryFamily)
+	now := unixMillis(time.Now())
+
+	var keys [][]byte
+	position := int64(0)
+	next := int64(0)
+	for it.Next() {
+		position++
+		if position <= cursor {
+			continue
+		}
+		key := it.Key()
+		if expiries != nil {
+			if v, err := expiries.Get(key); err == nil {
+				if ms, err := strconv.ParseInt(string(v), 10, 64); err == nil && ms <= now {
+					continue
+				}
+			}
+		}
+		if globMatch(pattern, string(key)) {
+			keys = append(keys, key)
+		}
+		if position-cursor >= int64(count) {
+			next = position
+			break
+		}
+	}
+	if it.Err() != nil {
+		c.error("ERR " + it.Err().Error())
+		return
+	}
+
+	c.array(2)
+	c.bulk([]byte(strconv.FormatInt(next, 10)))
+	c.array(len(keys))
+	for _, key := range keys {
+		c.bulk(key)
+	}
+}
+
+func (s *respServer) info() string {
+	s.db.mu.Lock()
+	seq := s.db.wal.seq
+	s.db.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	b.WriteString("redis_version:7.0.0\r\n")
+	b.WriteString("redis_mode:standalone\r\n")
+	fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(time.Since(s.started)/time.Second))
+	b.WriteString("\r\n# Clients\r\n")
+	fmt.Fprintf(&b, "connected_clients:%d\r\n", atomic.LoadInt64(&s.clients))
+	b.WriteString("\r\n# Stats\r\n")
+	fmt.Fprintf(&b, "total_connections_received:%d\r\n", atomic.LoadInt64(&s.connections))
+	fmt.Fprintf(&b, "total_commands_processed:%d\r\n", atomic.LoadInt64(&s.commands))
+	b.WriteString("\r\n# Persistence\r\n")
+	fmt.Fprintf(&b, "wal_seq:%d\r\n", seq)
+	return b.String()
+}
+
+// globMatch matches Redis glob patterns: *, ?, [abc], [^a-z] and \ escapes.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// No closing bracket, a literal [
+				if s[0] != '[' {
+					return false
+				}
+				break
+			}
+			class := pattern[1 : end+1]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if class[i] <= s[0] && s[0] <= class[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end+2:]
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
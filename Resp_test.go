@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readRESP reads one reply, flattened to a string: arrays and maps as their
+// items in brackets, nulls as (nil).
+func readRESP(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '_':
+		return "(nil)"
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := r.Read(buf); err != nil {
+			t.Fatalf("Error reading bulk string: %v", err)
+		}
+		return string(buf[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		var items []string
+		for i := 0; i < n; i++ {
+			items = append(items, readRESP(t, r))
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	t.Fatalf("Unexpected reply: %q", line)
+	return ""
+}
+
+func TestRESPServer(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go ServeRESP(l, db)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	do := func(args ...string) string {
+		fmt.Fprintf(conn, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		return readRESP(t, r)
+	}
+	expect := func(expected string, args ...string) {
+		if got := do(args...); got != expected {
+			t.Fatalf("%v: expected %q, got %q", args, expected, got)
+		}
+	}
+
+	expect("+PONG", "PING")
+	expect("+OK", "SET", "a", "1")
+	expect("1", "GET", "a")
+	expect("(nil)", "GET", "missing")
+	expect("(nil)", "SET", "a", "2", "NX")
+	expect("(nil)", "SET", "b", "2", "XX")
+	expect("+OK", "SET", "b", "2", "NX")
+	expect(":2", "INCR", "a")
+	expect("-ERR wrong number of arguments for 'incr' command", "INCR", "c", "x")
+	expect("+OK", "MSET", "c", "3", "d", "text")
+	expect("-ERR value is not an integer or out of range", "INCR", "d")
+	expect("[2 (nil) 3]", "MGET", "a", "missing", "c")
+	expect(":2", "EXISTS", "a", "b", "missing")
+	expect(":1", "DEL", "b", "missing")
+	expect("[0 [a c d]]", "SCAN", "0")
+	expect("[2 [a]]", "SCAN", "0", "MATCH", "[ab]*", "COUNT", "2")
+	expect("[0 [d]]", "SCAN", "2", "COUNT", "2")
+	if info := do("INFO"); !strings.Contains(info, "redis_version:") {
+		t.Fatalf("Unexpected INFO: %s", info)
+	}
+
+	// Expiry, seen by TTL and once passed by every read
+	expect(":-1", "TTL", "a")
+	expect(":-2", "TTL", "missing")
+	expect("+OK", "SET", "e", "v", "EX", "100")
+	expect(":100", "TTL", "e")
+	expect("+OK", "SET", "e", "v", "PX", "20")
+	time.Sleep(30 * time.Millisecond)
+	expect("(nil)", "GET", "e")
+	expect(":-2", "TTL", "e")
+	expect("+OK", "SET", "f", "v", "PX", "20")
+	time.Sleep(30 * time.Millisecond)
+	if err := db.sweepExpired(); err != nil {
+		t.Fatalf("Error sweeping: %v", err)
+	}
+	if _, err := db.Get([]byte("f")); err == nil {
+		t.Fatalf("Expected the sweeper to delete f")
+	}
+
+	// RESP3 after HELLO 3, inline commands too
+	expect("[server redis version 7.0.0 proto :3 mode standalone]", "HELLO", "3")
+	expect("(nil)", "GET", "missing")
+	fmt.Fprintf(conn, "GET a\r\n")
+	if got := readRESP(t, r); got != "2" {
+		t.Fatalf("Inline GET: expected 2, got %q", got)
+	}
+	expect("-ERR unknown command 'flushall'", "FLUSHALL")
+}
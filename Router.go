@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"PersistentKVstoreGo/kvclient"
+)
+
+// routerMigrationPage is how many keys a migration scans at a time, and
+// routerRetry how long it waits after an error before scanning again.
+var (
+	routerMigrationPage = 256
+	routerRetry         = time.Second
+)
+
+var (
+	ErrMigrating      = errors.New("A node is already being added")
+	ErrNodeExists     = errors.New("Node already exists")
+	ErrNotRoutable    = errors.New("Not supported by the router")
+	errScanLineFormat = errors.New("Invalid scan line")
+)
+
+// Ring is a consistent-hash ring. Each node is hashed at vnodes points and
+// a key belongs to the first point at or after its own hash, so a new node
+// only takes keys from the others. A Ring is never changed, withNode
+// returns a new one.
+type Ring struct {
+	vnodes int
+	points []ringPoint
+	nodes  map[string]string
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// NewRing returns a ring of the nodes, by name to URL.
+func NewRing(nodes map[string]string, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	r := &Ring{vnodes: vnodes, nodes: map[string]string{}}
+	for name, addr := range nodes {
+		r.nodes[name] = addr
+		r.points = append(r.points, nodePoints(name, vnodes)...)
+	}
+	r.sortPoints()
+	return r
+}
+
+func nodePoints(name string, vnodes int) []ringPoint {
+	points := make([]ringPoint, vnodes)
+	for i := range points {
+		points[i] = ringPoint{ringHash(name + "#" + strconv.Itoa(i)), name}
+	}
+	return points
+}
+
+func (r *Ring) sortPoints() {
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+}
+
+// ringHash is FNV-1a with a final mix, plain FNV puts keys that only differ
+// at the end too close together.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (r *Ring) withNode(name, addr string) *Ring {
+	next := &Ring{vnodes: r.vnodes, nodes: map[string]string{}}
+	for n, a := range r.nodes {
+		next.nodes[n] = a
+	}
+	next.nodes[name] = addr
+	next.points = append(append([]ringPoint{}, r.points...), nodePoints(name, r.vnodes)...)
+	next.sortPoints()
+	return next
+}
+
+// Owner returns the name of the node the key belongs to, empty if the ring
+// has no node.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the names of the nodes, sorted.
+func (r *Ring) Nodes() []string {
+	names := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RouterStatus is what /admin/nodes answers.
+type RouterStatus struct {
+	Nodes     map[string]string `json:"nodes"`
+	Migrating string            `json:"migrating,omitempty"`
+	Moved     int64             `json:"moved"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// RouterOptions configures a Router. StateFile, if set, keeps the nodes
+// across restarts, with the one being added.
+type RouterOptions struct {
+	Nodes     map[string]string
+	VNodes    int
+	StateFile string
+	// Token is sent to the nodes by the router's own requests, the
+	// migrations and the family checks, when they have an ACL. Client
+	// requests are forwarded with the client's token.
+	Token string
+}
+
+// Router partitions keys across store nodes on a consistent-hash ring. It
+// forwards /get, /set, /del and /cf/{cf}/kv/{key} to the node of the key
+// and merges the scans of all nodes.
+//
+// While a node is added, the ring it will have is next. A key whose owner
+// differs between the two is moving: it is copied to its new owner and
+// deleted from the old one, by the migration or by the first request that
+// touches it, and the request then goes to the new owner. Moves are
+// serialized with moveMu, which scans hold for reading so no key moves
+// behind them.
+type Router struct {
+	mu      sync.RWMutex
+	ring    *Ring
+	next    *Ring
+	clients map[string]*kvclient.Client
+	http    *http.Client
+	options RouterOptions
+
+	moveMu  sync.RWMutex
+	moved   int64
+	lastErr atomic.Value
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// routerState is what the state file has.
+type routerState struct {
+	Nodes  map[string]string `json:"nodes"`
+	Adding string            `json:"adding,omitempty"`
+}
+
+// NewRouter returns a router of options.Nodes, or of the nodes saved in
+// options.StateFile when it exists. A node that was being added is added
+// again, the migration picks up the keys that are left.
+func NewRouter(options RouterOptions) (*Router, error) {
+	state := routerState{Nodes: options.Nodes}
+	if options.StateFile != "" {
+		data, err := ioutil.ReadFile(options.StateFile)
+		if err == nil {
+			state = routerState{}
+			if err := json.Unmarshal(data, &state); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	nodes := map[string]string{}
+	for name, addr := range state.Nodes {
+		if name != state.Adding {
+			nodes[name] = addr
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("No nodes to route to")
+	}
+
+	rt := &Router{
+		ring:    NewRing(nodes, options.VNodes),
+		clients: map[string]*kvclient.Client{},
+		http:    tokenClient(options.Token),
+		options: options,
+	}
+	rt.ctx, rt.cancel = context.WithCancel(context.Background())
+	for name, addr := range nodes {
+		if err := rt.addClient(name, addr); err != nil {
+			return nil, err
+		}
+	}
+	if state.Adding != "" {
+		if err := rt.AddNode(state.Adding, state.Nodes[state.Adding]); err != nil {
+			return nil, err
+		}
+	}
+	return rt, nil
+}
+
+func (rt *Router) addClient(name, addr string) error {
+	client, err := kvclient.New(addr, kvclient.Options{HTTPClient: rt.http})
+	if err != nil {
+		return err
+	}
+	rt.clients[name] = client
+	return nil
+}
+
+// Close stops a migration in progress. With a state file, it resumes when
+// the router is started again.
+func (rt *Router) Close() {
+	rt.cancel()
+}
+
+// AddNode adds a node to the ring and moves its keys to it in the
+// background. The router answers for every key throughout.
+func (rt *Router) AddNode(name, addr string) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.next != nil {
+		return ErrMigrating
+	}
+	if _, ok := rt.ring.nodes[name]; ok {
+		return ErrNodeExists
+	}
+	if err := rt.addClient(name, addr); err != nil {
+		return err
+	}
+	next := rt.ring.withNode(name, addr)
+	// Saved first, keys on the new node must not be lost to a restart
+	if err := rt.saveState(routerState{Nodes: next.nodes, Adding: name}); err != nil {
+		return err
+	}
+	rt.next = next
+	atomic.StoreInt64(&rt.moved, 0)
+	rt.lastErr.Store("")
+	go rt.migrate(name)
+	return nil
+}
+
+// migrate runs until every key of the other nodes that belongs to the new
+// node is moved, then switches to the new ring.
+func (rt *Router) migrate(node string) {
+	for {
+		err := rt.migratePass(node)
+		if err == nil {
+			break
+		}
+		rt.lastErr.Store(err.Error())
+		select {
+		case <-rt.ctx.Done():
+			return
+		case <-time.After(routerRetry):
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.ring, rt.next = rt.next, nil
+	rt.lastErr.Store("")
+	if err := rt.saveState(routerState{Nodes: rt.ring.nodes}); err != nil {
+		rt.lastErr.Store(err.Error())
+	}
+}
+
+func (rt *Router) migratePass(node string) error {
+	rt.mu.RLock()
+	ring, next := rt.ring, rt.next
+	rt.mu.RUnlock()
+
+	// The new node needs the families before their keys
+	var families []string
+	seen := map[string]bool{}
+	for _, name := range ring.Nodes() {
+		names, err := rt.families(rt.ctx, ring.nodes[name])
+		if err != nil {
+			return err
+		}
+		for _, cf := range names {
+			if !seen[cf] {
+				seen[cf] = true
+				families = append(families, cf)
+			}
+		}
+	}
+	for _, cf := range families {
+		if err := rt.createFamily(rt.ctx, next.nodes[node], cf); err != nil {
+			return err
+		}
+	}
+
+	for _, from := range ring.Nodes() {
+		for _, cf := range append([]string{"default"}, families...) {
+			if err := rt.migrateFamily(from, cf, next); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateFamily scans a family of a node page by page and moves the keys
+// that now belong elsewhere.
+func (rt *Router) migrateFamily(from, cf string, next *Ring) error {
+	client := rt.clients[from].Family(cf)
+	start := ""
+	for {
+		var keys []string
+		err := client.Scan(rt.ctx, start, "", routerMigrationPage, func(key string, value []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err == kvclient.ErrColumnFamilyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if to := next.Owner(key); to != from {
+				if err := rt.moveKey(rt.ctx, cf, key, from, to); err != nil {
+					return err
+				}
+			}
+		}
+		if len(keys) < routerMigrationPage {
+			return nil
+		}
+		// Right after the last key
+		start = keys[len(keys)-1] + "\x00"
+	}
+}
+
+// moveKey copies a key to its new owner and deletes it from the old one.
+// A key the old owner doesn't have is already moved.
+func (rt *Router) moveKey(ctx context.Context, cf, key, from, to string) error {
+	rt.moveMu.Lock()
+	defer rt.moveMu.Unlock()
+
+	value, err := rt.clients[from].Family(cf).Get(ctx, key)
+	if err == kvclient.ErrKeyNotFound || err == kvclient.ErrColumnFamilyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := rt.clients[to].Family(cf).Set(ctx, key, value); err != nil {
+		return err
+	}
+	if _, err := rt.clients[from].Family(cf).Delete(ctx, key); err != nil && err != kvclient.ErrKeyNotFound {
+		return err
+	}
+	atomic.AddInt64(&rt.moved, 1)
+	return nil
+}
+
+func (rt *Router) families(ctx context.Context, addr string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/cf/", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(message)))
+	}
+	var names []string
+	err = json.NewDecoder(resp.Body).Decode(&names)
+	return names, err
+}
+
+func (rt *Router) createFamily(ctx context.Context, addr, cf string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(addr, "/")+"/cf/"+url.PathEscape(cf), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A family that exists is fine
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		message, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (rt *Router) saveState(state routerState) error {
+	if rt.options.StateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := rt.options.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rt.options.StateFile)
+}
+
+// Status returns the nodes, with the one being added.
+func (rt *Router) Status() RouterStatus {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	status := RouterStatus{Nodes: map[string]string{}, Moved: atomic.LoadInt64(&rt.moved)}
+	ring := rt.ring
+	if rt.next != nil {
+		ring = rt.next
+		for name := range rt.next.nodes {
+			if _, ok := rt.ring.nodes[name]; !ok {
+				status.Migrating = name
+			}
+		}
+	}
+	for name, addr := range ring.nodes {
+		status.Nodes[name] = addr
+	}
+	if err, _ := rt.lastErr.Load().(string); err != "" {
+		status.Error = err
+	}
+	return status
+}
+
+// owner returns the node to send a request on the key to, moving the key
+// first if it is moving. The caller holds rt.mu for reading.
+func (rt *Router) owner(ctx context.Context, cf, key string) (string, error) {
+	owner := rt.ring.Owner(key)
+	if rt.next == nil {
+		return owner, nil
+	}
+	to := rt.next.Owner(key)
+	if to != owner {
+		if err := rt.moveKey(ctx, cf, key, owner, to); err != nil {
+			return "", err
+		}
+	}
+	return to, nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/get" || r.URL.Path == "/set" || r.URL.Path == "/del":
+		rt.forward(w, r, "default", r.URL.Query().Get("key"))
+	case r.URL.Path == "/scan":
+		rt.serveScan(w, r)
+	case r.URL.Path == "/admin/nodes":
+		rt.serveNodes(w, r)
+	case strings.HasPrefix(r.URL.Path, "/cf/"):
+		if cf, key, ok := kvPath(r); ok {
+			rt.forward(w, r, cf, key)
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/cf/"), "/", 3)
+		if len(parts) == 1 {
+			rt.serveFamily(w, r, parts[0])
+			return
+		}
+		http.NotFound(w, r)
+	default:
+		// Writes over several nodes can't be all or nothing
+		http.Error(w, ErrNotRoutable.Error(), http.StatusNotImplemented)
+	}
+}
+
+func (rt *Router) forward(w http.ResponseWriter, r *http.Request, cf, key string) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	node, err := rt.owner(r.Context(), cf, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	rt.proxy(w, r, rt.nodeAddr(node))
+}
+
+// nodeAddr returns the URL of a node of either ring. The caller holds
+// rt.mu for reading.
+func (rt *Router) nodeAddr(node string) string {
+	if rt.next != nil {
+		return rt.next.nodes[node]
+	}
+	return rt.ring.nodes[node]
+}
+
+// proxy sends r to the node at addr and copies its response.
+func (rt *Router) proxy(w http.ResponseWriter, r *http.Request, addr string) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, strings.TrimSuffix(addr, "/")+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.ContentLength = r.ContentLength
+	resp, err := rt.http.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// serveFamily creates and drops a family on every node. Reads go to any
+// node, they all have the same families.
+func (rt *Router) serveFamily(w http.ResponseWriter, r *http.Request, cf string) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	ring := rt.ring
+	if rt.next != nil {
+		ring = rt.next
+	}
+	nodes := ring.Nodes()
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		rt.proxy(w, r, ring.nodes[nodes[0]])
+		return
+	}
+
+	for _, node := range nodes {
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, strings.TrimSuffix(ring.nodes[node], "/")+r.URL.RequestURI(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Header = r.Header.Clone()
+		resp, err := rt.http.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		message, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, node+": "+strings.TrimSpace(string(message)), resp.StatusCode)
+			return
+		}
+	}
+	w.Write([]byte("OK"))
+}
+
+func (rt *Router) serveNodes(w http.ResponseWriter, r *http.Request) {
+	//Handles the nodes, GET for the status and POST name&addr to add one
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name, addr := r.URL.Query().Get("name"), r.URL.Query().Get("addr")
+		if name == "" || addr == "" {
+			http.Error(w, "Name and addr are required", http.StatusBadRequest)
+			return
+		}
+		err := rt.AddNode(name, addr)
+		if err == ErrMigrating || err == ErrNodeExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(rt.Status())
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rt.Status())
+}
+
+// scanStream reads the JSONL of a node's /scan one record at a time.
+type scanStream struct {
+	body io.ReadCloser
+	r    *bufio.Reader
+	key  string
+	line []byte
+	done bool
+}
+
+// next reads the next record, done at the end of the scan.
+func (s *scanStream) next() error {
+	line, err := s.r.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		s.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rec struct {
+		Key   *string `json:"key"`
+		Error string  `json:"error"`
+	}
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return errScanLineFormat
+	}
+	if rec.Key == nil {
+		return errors.New(rec.Error)
+	}
+	s.key, s.line = *rec.Key, line
+	return nil
+}
+
+// serveScan scans every node and merges their keys in order. Each node
+// sends at most limit keys, which is enough for the merge.
+func (rt *Router) serveScan(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "Limit is not an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	// No key moves while we read, it could be missed or seen twice
+	rt.moveMu.RLock()
+	defer rt.moveMu.RUnlock()
+
+	ring := rt.ring
+	if rt.next != nil {
+		ring = rt.next
+	}
+	var streams []*scanStream
+	defer func() {
+		for _, s := range streams {
+			s.body.Close()
+		}
+	}()
+	for _, node := range ring.Nodes() {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, strings.TrimSuffix(ring.nodes[node], "/")+r.URL.RequestURI(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Header = r.Header.Clone()
+		resp, err := rt.http.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			message, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			http.Error(w, strings.TrimSpace(string(message)), resp.StatusCode)
+			return
+		}
+		s := &scanStream{body: resp.Body, r: bufio.NewReader(resp.Body)}
+		streams = append(streams, s)
+		if err := s.next(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for count := 0; limit <= 0 || count < limit; count++ {
+		var min *scanStream
+		for _, s := range streams {
+			if !s.done && (min == nil || s.key < min.key) {
+				min = s
+			}
+		}
+		if min == nil {
+			return
+		}
+		if _, err := w.Write(min.line); err != nil {
+			return
+		}
+		// A key is on one node only, but skip copies all the same
+		key := min.key
+		for _, s := range streams {
+			if !s.done && s.key == key {
+				if err := s.next(); err != nil {
+					// Too late for a status, a last line tells the client the scan is cut
+					enc.Encode(map[string]string{"error": err.Error()})
+					return
+				}
+			}
+		}
+	}
+}
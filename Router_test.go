@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startNode serves a store of its own, like a node behind the router.
+func startNode(t *testing.T) (*memDB, *httptest.Server) {
+	t.Helper()
+	db, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening node: %v", err)
+	}
+	t.Cleanup(func() { db.wal.file.Close() })
+
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		serveGet(w, r, db, r.URL.Query().Get("key"))
+	})
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		serveSet(w, r, db, r.URL.Query().Get("key"), []byte(r.URL.Query().Get("value")))
+	})
+	mux.HandleFunc("/del", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		serveDel(w, r, db, r.URL.Query().Get("key"))
+	})
+	mux.HandleFunc("/cf/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		serveCF(w, r, db)
+	})
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		cf, err := db.Family(r.URL.Query().Get("cf"))
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		serveScan(w, r, cf)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return db, server
+}
+
+func routerGet(t *testing.T, base, path string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(base + path)
+	if err != nil {
+		t.Fatalf("Error getting %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// routerScan returns the keys of a scan through the router.
+func routerScan(t *testing.T, base string, query url.Values) []string {
+	t.Helper()
+	code, body := routerGet(t, base, "/scan?"+query.Encode())
+	if code != http.StatusOK {
+		t.Fatalf("Error scanning: %d %s", code, body)
+	}
+	keys := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec struct {
+			Key   *string `json:"key"`
+			Error string  `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Key == nil {
+			t.Fatalf("Unexpected scan line %q", line)
+		}
+		keys = append(keys, *rec.Key)
+	}
+	return keys
+}
+
+func waitForMigration(t *testing.T, rt *Router) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for rt.Status().Migrating != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Migration stuck: %+v", rt.Status())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRing(t *testing.T) {
+	nodes := map[string]string{"a": "http://a", "b": "http://b", "c": "http://c"}
+	ring := NewRing(nodes, 64)
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[ring.Owner(fmt.Sprintf("key%d", i))]++
+	}
+	for name := range nodes {
+		if counts[name] < 600 || counts[name] > 1400 {
+			t.Fatalf("Uneven ring: %v", counts)
+		}
+	}
+
+	// A new node only takes keys, about its share of them
+	next := ring.withNode("d", "http://d")
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if before, after := ring.Owner(key), next.Owner(key); before != after {
+			if after != "d" {
+				t.Fatalf("Expected %s to move to d only, went from %s to %s", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 400 || moved > 1100 {
+		t.Fatalf("Expected about a quarter of the keys to move, got %d", moved)
+	}
+	if owner := NewRing(nil, 64).Owner("x"); owner != "" {
+		t.Fatalf("Expected no owner on an empty ring, got %q", owner)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	useTempDir(t)
+	defer func(page int) { routerMigrationPage = page }(routerMigrationPage)
+	routerMigrationPage = 16
+
+	dbs := map[string]*memDB{}
+	addrs := map[string]string{}
+	for _, name := range []string{"n1", "n2", "n3"} {
+		db, server := startNode(t)
+		dbs[name], addrs[name] = db, server.URL
+	}
+	state := filepath.Join(t.TempDir(), "router.json")
+	rt, err := NewRouter(RouterOptions{Nodes: addrs, VNodes: 32, StateFile: state})
+	if err != nil {
+		t.Fatalf("Error creating router: %v", err)
+	}
+	defer rt.Close()
+	router := httptest.NewServer(rt)
+	defer router.Close()
+
+	var expected []string
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if code, body := routerGet(t, router.URL, "/set?key="+key+"&value=v"+key); code != http.StatusOK {
+			t.Fatalf("Error setting %s: %d %s", key, code, body)
+		}
+		expected = append(expected, key)
+	}
+
+	// Each key is on its node only
+	ownedBy := func(ring *Ring) {
+		t.Helper()
+		for _, key := range expected {
+			for name, db := range dbs {
+				_, err := db.Get([]byte(key))
+				if owner := ring.Owner(key); (err == nil) != (name == owner) {
+					t.Fatalf("Expected %s on %s only, %s has it: %v", key, owner, name, err == nil)
+				}
+			}
+		}
+	}
+	ownedBy(rt.ring)
+	if code, body := routerGet(t, router.URL, "/get?key=k042"); code != http.StatusOK || body != "vk042" {
+		t.Fatalf("Expected vk042, got %d %q", code, body)
+	}
+	if code, _ := routerGet(t, router.URL, "/del?key=k199"); code != http.StatusOK {
+		t.Fatalf("Error deleting k199: %d", code)
+	}
+	expected = expected[:199]
+	if code, _ := routerGet(t, router.URL, "/get?key=k199"); code != http.StatusNotFound {
+		t.Fatalf("Expected k199 to be deleted, got %d", code)
+	}
+	if code, _ := routerGet(t, router.URL, "/incr?key=k1"); code != http.StatusNotImplemented {
+		t.Fatalf("Expected /incr to be refused, got %d", code)
+	}
+
+	// Scans are merged in order
+	keys := routerScan(t, router.URL, url.Values{})
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected scan: %v", keys)
+	}
+	keys = routerScan(t, router.URL, url.Values{"start": {"k050"}, "end": {"k100"}, "limit": {"10"}})
+	if strings.Join(keys, ",") != strings.Join(expected[50:60], ",") {
+		t.Fatalf("Unexpected range scan: %v", keys)
+	}
+
+	// Families are created on every node
+	req, _ := http.NewRequest(http.MethodPut, router.URL+"/cf/users", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Error creating a family: %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+	for _, db := range dbs {
+		if _, err := db.Family("users"); err != nil {
+			t.Fatalf("Expected the family on every node: %v", err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/cf/users/kv/u%02d", router.URL, i), strings.NewReader("user"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Error setting a user: %v (%v)", resp, err)
+		}
+		resp.Body.Close()
+	}
+	if keys := routerScan(t, router.URL, url.Values{"cf": {"users"}}); len(keys) != 20 {
+		t.Fatalf("Expected 20 users, got %v", keys)
+	}
+
+	// Add a node while clients keep reading and writing
+	db4, server4 := startNode(t)
+	dbs["n4"] = db4
+	if err := rt.AddNode("n4", server4.URL); err != nil {
+		t.Fatalf("Error adding a node: %v", err)
+	}
+	if err := rt.AddNode("n5", server4.URL); err != ErrMigrating {
+		t.Fatalf("Expected a second node to wait, got %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := c; i < len(expected); i += 4 {
+				key := expected[i]
+				resp, err := http.Get(router.URL + "/get?key=" + key)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || string(body) != "v"+key {
+					errs <- fmt.Sprintf("%s: %d %q", key, resp.StatusCode, body)
+				}
+				if i%10 == 0 {
+					resp, err := http.Get(router.URL + "/set?key=" + key + "&value=v" + key)
+					if err != nil {
+						errs <- err.Error()
+						return
+					}
+					resp.Body.Close()
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Error during the migration: %s", err)
+	}
+	waitForMigration(t, rt)
+
+	status := rt.Status()
+	if len(status.Nodes) != 4 || status.Moved == 0 || status.Error != "" {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	ownedBy(rt.ring)
+	if _, err := db4.Family("users"); err != nil {
+		t.Fatalf("Expected the family on the new node: %v", err)
+	}
+	if keys := routerScan(t, router.URL, url.Values{}); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected scan after the migration: %v", keys)
+	}
+	if keys := routerScan(t, router.URL, url.Values{"cf": {"users"}}); len(keys) != 20 {
+		t.Fatalf("Expected 20 users after the migration, got %v", keys)
+	}
+
+	// Over HTTP
+	code, body := routerGet(t, router.URL, "/admin/nodes")
+	var remote RouterStatus
+	if err := json.Unmarshal([]byte(body), &remote); code != http.StatusOK || err != nil || remote.Nodes["n4"] != server4.URL {
+		t.Fatalf("Unexpected nodes: %d %s", code, body)
+	}
+	resp, err = http.Post(router.URL+"/admin/nodes?name=n4&addr="+url.QueryEscape(server4.URL), "", nil)
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected adding n4 twice to fail, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+
+	// The state file has the new node, and a node being added resumes
+	restarted, err := NewRouter(RouterOptions{Nodes: map[string]string{"n1": addrs["n1"]}, VNodes: 32, StateFile: state})
+	if err != nil || len(restarted.Status().Nodes) != 4 {
+		t.Fatalf("Expected the router to restart with 4 nodes: %+v (%v)", restarted, err)
+	}
+	restarted.Close()
+
+	db5, server5 := startNode(t)
+	dbs["n5"] = db5
+	nodes := map[string]string{"n5": server5.URL}
+	for name, addr := range rt.Status().Nodes {
+		nodes[name] = addr
+	}
+	data, _ := json.Marshal(routerState{Nodes: nodes, Adding: "n5"})
+	if err := os.WriteFile(state, data, 0644); err != nil {
+		t.Fatalf("Error writing the state: %v", err)
+	}
+	resumed, err := NewRouter(RouterOptions{VNodes: 32, StateFile: state})
+	if err != nil {
+		t.Fatalf("Error resuming: %v", err)
+	}
+	defer resumed.Close()
+	if status := resumed.Status(); status.Migrating != "n5" {
+		t.Fatalf("Expected n5 to be added again, got %+v", status)
+	}
+	waitForMigration(t, resumed)
+	ownedBy(resumed.ring)
+}
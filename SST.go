@@ -2,10 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
+	"io"
 )
 
 // compareKeys compares two byte slices to determine their order, so i
@@ -37,107 +38,207 @@ func isEqual(slice1, slice2 []byte) bool {
 	return true
 }
 
-// GetFromSST retrieves a value from SST files based on the given key.
-func GetFromSST(key []byte) ([]byte, error) {
+// GetFromSST retrieves a value from the SST files in dir based on the given key.
+// Merge entries don't end the search: their operands are collected and
+// folded onto the first set or delete found in an older file.
+func GetFromSST(dir string, key []byte) ([]byte, error) {
+	return getFromSST(context.Background(), dir, key, nil)
+}
+
+// sstLookup is one file visited by a lookup, for kvctl get --trace.
+type sstLookup struct {
+	File  string `json:"file"`
+	Found bool   `json:"found"`
+	Op    string `json:"op,omitempty"`
+}
+
+func getFromSST(ctx context.Context, dir string, key []byte, trace func(sstLookup)) ([]byte, error) {
 	// Count the number of SST files
-	fileCount, err := countSSTFiles()
-	fmt.Println("count sst ", fileCount)
+	fileCount, err := countSSTFiles(dir)
+	if trace == nil {
+		fmt.Println("count sst ", fileCount)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	var foundValue []byte
+	var operands [][]byte
 
 	// Iterate through SST files
 	for i := fileCount; i > 0; i-- {
-		sstFileName := fmt.Sprintf("SSTFiles/sst%d.txt", i)
-		sstFile, err := os.Open(sstFileName)
-		if err != nil {
+		// Checked between files, a lookup reading many of them can be given up
+		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
-		defer sstFile.Close()
-
-		// Read entry count
-		var entryCount uint32
-		if err := binary.Read(sstFile, binary.LittleEndian, &entryCount); err != nil {
+		sstFileName := fmt.Sprintf("%s/sst%d.txt", dir, i)
+		op, value, found, err := getFromSSTFile(sstFileName, key)
+		if err != nil {
 			return nil, err
 		}
-
-		var smallestKey, biggestKey []byte
-		// Read smallest key length
-		var smallestKeyLen uint32
-		binary.Read(sstFile, binary.LittleEndian, &smallestKeyLen)
-
-		smallestKey = make([]byte, smallestKeyLen)
-		sstFile.Read(smallestKey)
-
-		// Read biggest key length
-		var biggestKeyLen uint32
-		binary.Read(sstFile, binary.LittleEndian, &biggestKeyLen)
-		biggestKey = make([]byte, biggestKeyLen)
-		sstFile.Read(biggestKey)
-
-		foundInFile := false
-
-		// Check if the key is within the range of smallest and biggest keys
-		if (compareKeys(key, smallestKey) >= 0 && compareKeys(key, biggestKey) <= 0) || isEqual(key, smallestKey) || isEqual(key, biggestKey) {
-
-			// Iterate through entries in the SST file
-			for j := 0; j < int(entryCount); j++ {
-
-				var op byte
-				if err := binary.Read(sstFile, binary.LittleEndian, &op); err != nil {
-					break // End of file
-				}
-
-				var lenKey, lenValue uint32
-				// Read the key length
-				if err := binary.Read(sstFile, binary.LittleEndian, &lenKey); err != nil {
-					fmt.Printf("Error reading key length: %v\n", err)
-					break
-				}
-
-				// Read the key
-				readKey := make([]byte, lenKey)
-				n, err := sstFile.Read(readKey)
-				fmt.Printf("Read key (%d): %v, err: %v\n", n, readKey, err)
-
-				// Read the value length
-				if err := binary.Read(sstFile, binary.LittleEndian, &lenValue); err != nil {
-					fmt.Printf("Error reading value length: %v\n", err)
-					break
-				}
-
-				// Read the value
-				readValue := make([]byte, lenValue)
-				n, err = sstFile.Read(readValue)
-
-				// Check if the key matches
-				if compareKeys(key, readKey) == 0 {
-					foundInFile = true
-					// If the operation is a deletion, set foundValue to nil
-					if op == byte(0x01) {
-						foundValue = nil
-					} else {
-						foundValue = readValue
-					}
-					// Continue iterating to find the latest value
-				}
+		if trace != nil {
+			lookup := sstLookup{File: sstFileName, Found: found}
+			if found {
+				lookup.Op = sstOpName(op)
 			}
+			trace(lookup)
+		}
+		if !found {
+			continue
 		}
 
-		if foundInFile {
-			if foundValue != nil {
-				return foundValue, nil
+		switch op {
+		case byte(merge):
+			newer, err := decodeOperands(value)
+			if err != nil {
+				return nil, err
+			}
+			operands = append(newer, operands...)
+			continue
+		case byte(del):
+			if len(operands) > 0 {
+				return foldOperands(nil, false, operands)
 			}
 			return nil, errors.New("Key not found")
+		default:
+			if len(operands) > 0 {
+				return foldOperands(value, true, operands)
+			}
+			return value, nil
 		}
 	}
 
-	if foundValue != nil {
-		return foundValue, nil
+	if len(operands) > 0 {
+		return foldOperands(nil, false, operands)
 	}
 
 	// Key not found in any SST file
 	return nil, errors.New("Key not found")
 }
+
+// sstHeader is what an SST starts with: its number of entries and its
+// smallest and biggest keys.
+type sstHeader struct {
+	count    uint32
+	smallest []byte
+	biggest  []byte
+}
+
+type sstEntry struct {
+	op    byte
+	key   []byte
+	value []byte
+}
+
+func sstOpName(op byte) string {
+	switch op {
+	case byte(set):
+		return "set"
+	case byte(del):
+		return "del"
+	case byte(merge):
+		return "merge"
+	default:
+		return fmt.Sprintf("unknown(%d)", op)
+	}
+}
+
+// readSSTBytes reads a length-prefixed byte slice.
+func readSSTBytes(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	if remaining, ok := r.(interface{ Len() int }); ok && int64(length) > int64(remaining.Len()) {
+		// A damaged length, don't allocate it
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func readSSTHeader(r io.Reader) (sstHeader, error) {
+	var header sstHeader
+	if err := binary.Read(r, binary.LittleEndian, &header.count); err != nil {
+		return header, err
+	}
+	var err error
+	if header.smallest, err = readSSTBytes(r); err != nil {
+		return header, err
+	}
+	header.biggest, err = readSSTBytes(r)
+	return header, err
+}
+
+func readSSTEntry(r io.Reader) (sstEntry, error) {
+	var e sstEntry
+	if err := binary.Read(r, binary.LittleEndian, &e.op); err != nil {
+		return e, err
+	}
+	var err error
+	if e.key, err = readSSTBytes(r); err != nil {
+		return e, err
+	}
+	e.value, err = readSSTBytes(r)
+	return e, err
+}
+
+// getFromSSTFile looks key up in a single SST file and returns the op and
+// value of its entry.
+func getFromSSTFile(sstFileName string, key []byte) (byte, []byte, bool, error) {
+	sstFile, reader, err := openSST(sstFileName)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer sstFile.Close()
+
+	header, err := readSSTHeader(reader)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	// Check if the key is within the range of smallest and biggest keys
+	if compareKeys(key, header.smallest) < 0 || compareKeys(key, header.biggest) > 0 {
+		return 0, nil, false, nil
+	}
+
+	// Iterate through entries in the SST file
+	for j := 0; j < int(header.count); j++ {
+		e, err := readSSTEntry(reader)
+		if err != nil {
+			// Not finding the key here could be a wrong answer
+			return 0, nil, false, fmt.Errorf("Corrupt SST %s, entry %d: %v", sstFileName, j, err)
+		}
+
+		// Check if the key matches
+		if compareKeys(key, e.key) == 0 {
+			return e.op, e.value, true, nil
+		}
+	}
+
+	return 0, nil, false, nil
+}
+
+// writeSSTFile writes entries, which must be sorted by key, as an SST
+// compressed with codec.
+func writeSSTFile(name string, entries []sstEntry, codec byte) error {
+	sw, err := NewSSTWriter(name)
+	if err != nil {
+		return err
+	}
+	sw.codec = codec
+	for _, e := range entries {
+		if err := sw.add(e.op, e.key, e.value); err != nil {
+			sw.Abort()
+			return err
+		}
+	}
+	return sw.Finish()
+}
+
+func writeSSTBytes(w io.Writer, buf []byte) {
+	binary.Write(w, binary.LittleEndian, uint32(len(buf)))
+	w.Write(buf)
+}
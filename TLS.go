@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrNoCertificates = errors.New("No certificates in the CA file")
+
+// tlsReloadInterval is how often the files are looked at for changes, at
+// most, when connections come.
+var tlsReloadInterval = time.Second
+
+// TLSOptions are the PEM files of a TLS server or client.
+type TLSOptions struct {
+	// CertFile and KeyFile are the certificate of a server, or the client
+	// certificate of a client
+	CertFile string
+	KeyFile  string
+	// ClientCAFile turns on mutual TLS on a server: a client with a
+	// certificate signed by one of its CAs is identified by the common name
+	// of the certificate, which the ACL gives rights as cert:name
+	ClientCAFile string
+	// RequireClientCert refuses the clients without such a certificate,
+	// which otherwise may still use a bearer token
+	RequireClientCert bool
+	// CAFile verifies the servers a client connects to, instead of the
+	// system's CAs
+	CAFile string
+}
+
+// tlsFiles keeps the certificates of TLSOptions, read again when the
+// files change so new connections use the new ones. A change that doesn't
+// load keeps the old ones.
+type tlsFiles struct {
+	options TLSOptions
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	roots     *x509.CertPool
+	modTimes  map[string]time.Time
+	checked   time.Time
+}
+
+func newTLSFiles(options TLSOptions) (*tlsFiles, error) {
+	f := &tlsFiles{options: options}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *tlsFiles) paths() []string {
+	var paths []string
+	for _, path := range []string{f.options.CertFile, f.options.KeyFile, f.options.ClientCAFile, f.options.CAFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// load reads all the files, or changes nothing.
+func (f *tlsFiles) load() error {
+	modTimes := map[string]time.Time{}
+	for _, path := range f.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if f.options.CertFile != "" || f.options.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(f.options.CertFile, f.options.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	clientCAs, err := loadCertPool(f.options.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	roots, err := loadCertPool(f.options.CAFile)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert, f.clientCAs, f.roots, f.modTimes = cert, clientCAs, roots, modTimes
+	f.checked = time.Now()
+	return nil
+}
+
+// loadCertPool reads the CAs of a PEM file, nil without a file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNoCertificates)
+	}
+	return pool, nil
+}
+
+// refresh loads the files again when one of them changed since the last
+// look, which is at most once per tlsReloadInterval.
+func (f *tlsFiles) refresh() {
+	f.mu.Lock()
+	if time.Since(f.checked) < tlsReloadInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.checked = time.Now()
+	changed := false
+	for path, modTime := range f.modTimes {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			changed = true
+		}
+	}
+	f.mu.Unlock()
+
+	if changed {
+		if err := f.load(); err != nil {
+			// Often the certificate is written before its key
+			fmt.Println("Error reloading the TLS files, keeping the old ones:", err)
+		} else {
+			fmt.Println("Reloaded the TLS files")
+		}
+	}
+}
+
+// ServerConfig returns the configuration of a listener, which picks up the
+// certificates as they change.
+func (f *tlsFiles) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.refresh()
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.cert == nil {
+				return nil, errors.New("No server certificate")
+			}
+			config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*f.cert}}
+			if f.clientCAs != nil {
+				config.ClientCAs = f.clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				if f.options.RequireClientCert {
+					config.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig returns the configuration of a client, which presents the
+// certificate as it changes. The CAs are those at the time of the call.
+func (f *tlsFiles) ClientConfig() *tls.Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    f.roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			f.refresh()
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.cert == nil {
+				// No certificate is sent
+				return &tls.Certificate{}, nil
+			}
+			return f.cert, nil
+		},
+	}
+}
+
+// clientTLS is the configuration of the HTTPS requests this process makes,
+// nil for the defaults.
+var clientTLS *tls.Config
+
+// clientTransport returns a transport using clientTLS.
+func clientTransport() http.RoundTripper {
+	if clientTLS == nil {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = clientTLS
+	return transport
+}
+
+// serverTLSFlags adds the TLS flags of a server, and returns what loads
+// them once they are parsed: the configuration of its listeners, nil for
+// plain TCP. The server presents the same certificate to the nodes it
+// connects to, which with mutual TLS needs it to be good for client
+// authentication too.
+func serverTLSFlags(flags *flag.FlagSet) func() (*tls.Config, error) {
+	cert := flags.String("tls-cert", "", "certificate to serve TLS with, reloaded when it changes")
+	key := flags.String("tls-key", "", "key of the certificate")
+	clientCA := flags.String("tls-client-ca", "", "CA of the client certificates, for mutual TLS")
+	require := flags.Bool("tls-require-client-cert", false, "refuse the clients without a certificate of -tls-client-ca")
+	ca := flags.String("tls-ca", "", "CA to verify the other nodes with, instead of the system's")
+	return func() (*tls.Config, error) {
+		options := TLSOptions{CertFile: *cert, KeyFile: *key, ClientCAFile: *clientCA, RequireClientCert: *require, CAFile: *ca}
+		if options == (TLSOptions{}) {
+			return nil, nil
+		}
+		if options.ClientCAFile != "" && options.CertFile == "" {
+			return nil, errors.New("Mutual TLS needs -tls-cert")
+		}
+		if options.RequireClientCert && options.ClientCAFile == "" {
+			return nil, errors.New("Requiring client certificates needs -tls-client-ca")
+		}
+		files, err := newTLSFiles(options)
+		if err != nil {
+			return nil, err
+		}
+		clientTLS = files.ClientConfig()
+		if options.CertFile == "" {
+			return nil, nil
+		}
+		return files.ServerConfig(), nil
+	}
+}
+
+// listen listens on addr, with TLS when config isn't nil.
+func listen(addr string, config *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || config == nil {
+		return l, err
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// clientTLSFlags adds the flags of the TLS client of the tools, and returns
+// what sets clientTLS from them once they are parsed.
+func clientTLSFlags(flags *flag.FlagSet) func() error {
+	ca := flags.String("tls-ca", "", "CA file to verify an https -server with, instead of the system's")
+	cert := flags.String("tls-cert", "", "client certificate, for servers with mutual TLS")
+	key := flags.String("tls-key", "", "key of the client certificate")
+	return func() error {
+		if *ca == "" && *cert == "" && *key == "" {
+			return nil
+		}
+		files, err := newTLSFiles(TLSOptions{CertFile: *cert, KeyFile: *key, CAFile: *ca})
+		if err != nil {
+			return err
+		}
+		clientTLS = files.ClientConfig()
+		return nil
+	}
+}
+
+// certIdentity returns the common name of the verified client certificate
+// of a request, if there is one.
+func certIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestCA makes a self-signed CA, written to dir/name.pem.
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, path: filepath.Join(dir, name+".pem")}
+	writePEM(t, ca.path, "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate of the CA for name, good for servers on
+// 127.0.0.1 and for clients, to certPath and keyPath.
+func (ca *testCA) issue(t *testing.T, name string, serial int64, certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+}
+
+func TestTLS(t *testing.T) {
+	useTempDir(t)
+	db := openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	mem = db
+	db.Set([]byte("users/1"), []byte("v"))
+	defer func(interval time.Duration) { tlsReloadInterval = interval }(tlsReloadInterval)
+	tlsReloadInterval = 0
+	defer func() { clientTLS = nil }()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	other := newTestCA(t, dir, "other")
+	path := func(name string) string { return filepath.Join(dir, name) }
+	ca.issue(t, "node1", 10, path("server.pem"), path("server.key"))
+	ca.issue(t, "billing-svc", 11, path("billing.pem"), path("billing.key"))
+	other.issue(t, "billing-svc", 12, path("forged.pem"), path("forged.key"))
+
+	// The client certificate is an identity of the ACL
+	aclPath := path("acl")
+	writeACL(t, aclPath, "billing cert:billing-svc read users/", "node cert:node1 read *", "ops 0p3rat0r all *")
+	if err := useACLFile(aclPath); err != nil {
+		t.Fatalf("Error loading ACL: %v", err)
+	}
+	defer useACLFile("")
+
+	flags := flagSetOf("-tls-cert", path("server.pem"), "-tls-key", path("server.key"), "-tls-client-ca", ca.path, "-tls-ca", ca.path)
+	serverTLS, err := flags()
+	if err != nil {
+		t.Fatalf("Error loading the TLS files: %v", err)
+	}
+	l, err := listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	server := &http.Server{Handler: authGuard(mux)}
+	go server.Serve(l)
+	defer server.Close()
+	base := "https://" + l.Addr().String()
+
+	get := func(cert, target, token string) (*http.Response, string, error) {
+		t.Helper()
+		options := TLSOptions{CAFile: ca.path}
+		if cert != "" {
+			options.CertFile, options.KeyFile = path(cert+".pem"), path(cert+".key")
+		}
+		files, err := newTLSFiles(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A connection each time, to see the reloads
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: files.ClientConfig(), DisableKeepAlives: true}}
+		req, _ := http.NewRequest("GET", base+target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body), nil
+	}
+
+	resp, body, err := get("billing", "/get?key=users/1", "")
+	if err != nil || resp.StatusCode != http.StatusOK || body != "v" {
+		t.Fatalf("Expected the certificate to be allowed to read, got %v %q (%v)", resp, body, err)
+	}
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 10 {
+		t.Fatalf("Unexpected server certificate %v", resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+	if resp, _, err := get("billing", "/set?key=users/1&value=w", ""); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the certificate not to write, got %v (%v)", resp, err)
+	}
+	// Without a certificate, the token still works
+	if resp, _, err := get("", "/get?key=users/1", ""); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a certificate, got %v (%v)", resp, err)
+	}
+	if resp, _, err := get("", "/admin/stats", "0p3rat0r"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the token to work over TLS, got %v (%v)", resp, err)
+	}
+	if _, _, err := get("forged", "/get?key=users/1", ""); err == nil {
+		t.Fatal("Expected a certificate of another CA to be refused")
+	}
+
+	// A new certificate is picked up without a restart, and one that
+	// doesn't load keeps the old one
+	ca.issue(t, "node1", 20, path("server.pem"), path("server.key"))
+	resp, _, err = get("billing", "/get?key=users/1", "")
+	if err != nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 20 {
+		t.Fatalf("Expected the new server certificate, got %v (%v)", resp, err)
+	}
+	os.WriteFile(path("server.key"), []byte("garbage"), 0600)
+	resp, _, err = get("billing", "/get?key=users/1", "")
+	if err != nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 20 {
+		t.Fatalf("Expected the old certificate to stay, got %v (%v)", resp, err)
+	}
+
+	// Peers connect with the node's certificate
+	resp, err = tokenClient("").Get(base + "/get?key=users/1")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the node's client to use its certificate, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+
+	// Requiring a certificate
+	flags = flagSetOf("-tls-cert", path("billing.pem"), "-tls-key", path("billing.key"), "-tls-client-ca", ca.path, "-tls-require-client-cert")
+	required, err := flags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := listen("127.0.0.1:0", required)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	go http.Serve(l2, authGuard(mux))
+	base = "https://" + l2.Addr().String()
+	if _, _, err := get("", "/admin/stats", "0p3rat0r"); err == nil {
+		t.Fatal("Expected a client without a certificate to be refused")
+	}
+
+	if _, err := flagSetOf("-tls-require-client-cert")(); err == nil || !strings.Contains(err.Error(), "client-ca") {
+		t.Fatalf("Expected requiring certificates without a CA to fail, got %v", err)
+	}
+}
+
+// flagSetOf parses args as the TLS flags of a server.
+func flagSetOf(args ...string) func() (*tls.Config, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	load := serverTLSFlags(flags)
+	flags.Parse(args)
+	return load
+}
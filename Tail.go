@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// TailOptions says where a WALTailer starts. Since is exclusive, so a
+// consumer resumes from its last checkpoint; Offset, when set, is a byte
+// offset in the live WAL to start from instead.
+type TailOptions struct {
+	Since  uint64
+	Offset int64
+	// Follow keeps waiting for new records at the end of the live WAL
+	// instead of returning io.EOF.
+	Follow       bool
+	PollInterval time.Duration
+	// Dir is the directory of the store, the working directory if empty
+	Dir string
+}
+
+// WALTailer reads the records of the sealed segments and the live WAL in
+// sequence order. It only ever opens the files read-only, so it can run in
+// another process than the writer.
+type WALTailer struct {
+	opts    TailOptions
+	since   uint64
+	file    *os.File
+	reader  *bufio.Reader
+	first   uint64
+	live    bool
+	offset  int64
+	pending []Event
+}
+
+func NewWALTailer(opts TailOptions) *WALTailer {
+	if opts.PollInterval == 0 {
+		opts.PollInterval = 100 * time.Millisecond
+	}
+	return &WALTailer{opts: opts, since: opts.Since}
+}
+
+// Offset is the byte offset, in the file being read, of the next record.
+func (t *WALTailer) Offset() int64 {
+	return t.offset
+}
+
+func (t *WALTailer) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+// Next returns the next write after the ones already returned.
+func (t *WALTailer) Next() (Event, error) {
+	for len(t.pending) == 0 {
+		since := t.since
+		rec, err := t.NextRecord()
+		if err != nil {
+			return Event{}, err
+		}
+		events, err := eventsFromRecord(rec)
+		if err != nil {
+			return Event{}, err
+		}
+		for _, ev := range events {
+			if ev.Seq > since {
+				t.pending = append(t.pending, ev)
+			}
+		}
+	}
+	ev := t.pending[0]
+	t.pending = t.pending[1:]
+	return ev, nil
+}
+
+// NextRecord returns the next WAL record after the ones already returned,
+// a batch in one piece, as replicas apply it.
+func (t *WALTailer) NextRecord() (walRecord, error) {
+	for {
+		rec, ok, err := t.readRecord()
+		if err != nil {
+			return walRecord{}, err
+		}
+		if ok && rec.seq > t.since {
+			t.since = rec.seq
+			return rec, nil
+		}
+	}
+}
+
+// open picks the file holding the record after t.since.
+func (t *WALTailer) open() error {
+	segments, err := walSegments(t.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	live, err := os.Open(storePath(t.opts.Dir, "wal.txt"))
+	if err != nil {
+		return err
+	}
+	_, base, err := readWALHeader(live)
+	if err != nil {
+		live.Close()
+		return err
+	}
+
+	t.offset = walHeaderSize
+	if t.opts.Offset > 0 {
+		t.offset = t.opts.Offset
+		t.opts.Offset = 0
+		t.file, t.first, t.live = live, base+1, true
+	} else if t.since >= base {
+		t.file, t.first, t.live = live, base+1, true
+	} else {
+		live.Close()
+		var segment *walSegment
+		for i := range segments {
+			if segments[i].first <= t.since+1 {
+				segment = &segments[i]
+			}
+		}
+		if segment == nil {
+			return fmt.Errorf("Sequence %d is no longer in the WAL", t.since+1)
+		}
+		t.file, err = os.Open(segment.path)
+		if err != nil {
+			return err
+		}
+		t.first, t.live = segment.first, false
+	}
+
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+	t.reader = bufio.NewReader(t.file)
+	return nil
+}
+
+// rotated reports whether the live file being read has been sealed since.
+func (t *WALTailer) rotated() bool {
+	current, err := os.Stat(storePath(t.opts.Dir, "wal.txt"))
+	if err != nil {
+		return false
+	}
+	info, err := t.file.Stat()
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(current, info)
+}
+
+// readRecord reads the next record of the WAL, reporting false when it
+// moved to another file or waited for one instead.
+func (t *WALTailer) readRecord() (walRecord, bool, error) {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			return walRecord{}, false, err
+		}
+	}
+
+	rec, err := readWALRecord(t.reader)
+	if err == nil {
+		t.offset += rec.size()
+		return rec, true, nil
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return walRecord{}, false, err
+	}
+	if err == io.ErrUnexpectedEOF && !t.live {
+		return walRecord{}, false, fmt.Errorf("Truncated record in sealed WAL segment %s at offset %d", t.file.Name(), t.offset)
+	}
+
+	if t.live && !t.rotated() {
+		// At the end of the live WAL, a torn record is one still being
+		// written: wait for it, or let the caller try again later
+		if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+			return walRecord{}, false, err
+		}
+		t.reader.Reset(t.file)
+		if !t.opts.Follow {
+			return walRecord{}, false, io.EOF
+		}
+		time.Sleep(t.opts.PollInterval)
+		return walRecord{}, false, nil
+	}
+	if t.live {
+		// Sealed under us: whatever was appended before the rotation is
+		// still to be read from the same file
+		t.live = false
+		if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+			return walRecord{}, false, err
+		}
+		t.reader.Reset(t.file)
+		return walRecord{}, false, nil
+	}
+
+	// Done with this segment, move on to the next file
+	t.file.Close()
+	t.file = nil
+	return walRecord{}, false, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWALTailer(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+	if err := CommitWALCheckpoint("cdc", 0); err != nil {
+		t.Fatalf("Error registering consumer: %v", err)
+	}
+
+	// Seven writes with a flush threshold of 3 seal two segments
+	for i := 0; i < 7; i++ {
+		db.Set([]byte{'a' + byte(i)}, []byte("v"))
+	}
+	segments, _ := walSegments("")
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 sealed segments, got %d", len(segments))
+	}
+
+	tailer := NewWALTailer(TailOptions{Since: 2})
+	for seq := uint64(3); seq <= 7; seq++ {
+		ev, err := tailer.Next()
+		if err != nil || ev.Seq != seq {
+			t.Fatalf("Expected seq %d, got %+v (%v)", seq, ev, err)
+		}
+	}
+	if _, err := tailer.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF at the end of the WAL, got %v", err)
+	}
+	tailer.Close()
+
+	// Following picks up writes made after it reached the end, across a
+	// rotation of the live WAL
+	follower := NewWALTailer(TailOptions{Since: 7, Follow: true, PollInterval: time.Millisecond})
+	defer follower.Close()
+	done := make(chan []uint64)
+	go func() {
+		var seqs []uint64
+		for len(seqs) < 3 {
+			ev, err := follower.Next()
+			if err != nil {
+				break
+			}
+			seqs = append(seqs, ev.Seq)
+		}
+		done <- seqs
+	}()
+	time.Sleep(10 * time.Millisecond)
+	db.Set([]byte("h"), []byte("v"))
+	db.Set([]byte("i"), []byte("v"))
+	db.Set([]byte("j"), []byte("v"))
+	select {
+	case seqs := <-done:
+		if len(seqs) != 3 || seqs[0] != 8 || seqs[2] != 10 {
+			t.Fatalf("Expected seqs 8 to 10, got %v", seqs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out following the WAL")
+	}
+
+	// Segments are dropped once the consumer's checkpoint is past them
+	if err := CommitWALCheckpoint("cdc", 9); err != nil {
+		t.Fatalf("Error committing checkpoint: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		db.Set([]byte{'k', '0' + byte(i)}, []byte("v"))
+	}
+	segments, _ = walSegments("")
+	if len(segments) != 1 || segments[0].first != 10 {
+		t.Fatalf("Expected only the segment starting at 10 to be left, got %+v", segments)
+	}
+	if _, err := NewWALTailer(TailOptions{Since: 1}).Next(); err == nil {
+		t.Fatalf("Expected an error reading purged records")
+	}
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	if err := tailWAL(NewWALTailer(TailOptions{Since: 12}), out, ""); err != nil {
+		t.Fatalf("Error tailing the WAL: %v", err)
+	}
+	out.Flush()
+	if strings.TrimSpace(buf.String()) != `{"type":"put","key":"k3","value":"v","seq":13}` {
+		t.Fatalf("Unexpected JSON lines: %s", buf.String())
+	}
+}
+
+func TestRemoveWALConsumer(t *testing.T) {
+	useTempDir(t)
+	db, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	defer db.wal.file.Close()
+
+	// The consumer of a store opened elsewhere is removed from its own root
+	if err := commitWALCheckpoint(db.wal.root, "cdc", 0); err != nil {
+		t.Fatalf("Error registering consumer: %v", err)
+	}
+	if err := removeWALConsumer(db.wal.root, "cdc"); err != nil {
+		t.Fatalf("Error removing consumer: %v", err)
+	}
+	if _, ok := walCheckpoint(db.wal.root, "cdc"); ok {
+		t.Fatal("Expected the consumer to be gone")
+	}
+	if err := removeWALConsumer(db.wal.root, "../cdc"); err == nil {
+		t.Fatal("Expected an invalid name to be refused")
+	}
+}
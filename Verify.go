@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Corruption is a problem found by VerifyStore, at a byte offset of a file.
+type Corruption struct {
+	File    string `json:"file"`
+	Offset  int64  `json:"offset"`
+	Problem string `json:"problem"`
+}
+
+func (c Corruption) String() string {
+	return fmt.Sprintf("%s at offset %d: %s", c.File, c.Offset, c.Problem)
+}
+
+// quarantineDir is where repair moves the files it couldn't read in full.
+const quarantineDir = "Quarantine"
+
+// VerifyStore checks every SST and WAL file of the store in the current
+// directory, which must not be open: that each can be read to the end, that
+// SST keys are in order and match the header, that WAL sequence numbers
+// follow each other, and that the SSTs listed in a MANIFEST still have the
+// checksum it records.
+func VerifyStore() ([]Corruption, error) {
+	var found []Corruption
+
+	files, err := storeFiles("")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		if strings.HasPrefix(filepath.Base(path), "sst") {
+			problems, err := verifySST(path)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, problems...)
+		}
+	}
+
+	segments, err := walSegments("")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, segment := range segments {
+		problems, err := verifyWAL(segment.path, segment.first-1, false)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, problems...)
+	}
+	problems, err := verifyWAL("wal.txt", 0, true)
+	if err != nil {
+		return nil, err
+	}
+	found = append(found, problems...)
+
+	if _, err := os.Stat("MANIFEST"); err == nil {
+		problems, err := verifyManifest("MANIFEST")
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, problems...)
+	}
+
+	return found, nil
+}
+
+// verifySST reads an SST the way getFromSSTFile does, but to the end.
+// Offsets in an encrypted SST are in its plaintext.
+func verifySST(path string) ([]Corruption, error) {
+	var found []Corruption
+	data, err := readSSTData(path)
+	// What could be read is checked too
+	switch {
+	case errors.Is(err, ErrCorruptBlock):
+		found = append(found, Corruption{path, int64(len(data)), "Unreadable encrypted data: " + err.Error()})
+	case isDamaged(err):
+		found = append(found, Corruption{path, int64(len(data)), "Unreadable block: " + err.Error()})
+	case err != nil:
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	offset := func() int64 { return int64(len(data) - r.Len()) }
+
+	header, err := readSSTHeader(r)
+	if err != nil {
+		return append(found, Corruption{path, 0, "Unreadable header: " + err.Error()}), nil
+	}
+
+	var first, last []byte
+	for i := 0; i < int(header.count); i++ {
+		at := offset()
+		e, err := readSSTEntry(r)
+		if err != nil {
+			return append(found, Corruption{path, at, fmt.Sprintf("Unreadable entry %d of %d: %v", i, header.count, err)}), nil
+		}
+		if i == 0 {
+			first = e.key
+		} else if compareKeys(e.key, last) <= 0 {
+			found = append(found, Corruption{path, at, fmt.Sprintf("Key %q is not after %q", e.key, last)})
+		}
+		last = e.key
+
+		switch e.op {
+		case byte(set), byte(del):
+		case byte(merge):
+			if _, err := decodeOperands(e.value); err != nil {
+				found = append(found, Corruption{path, at, fmt.Sprintf("Bad merge operands for %q: %v", e.key, err)})
+			}
+		default:
+			found = append(found, Corruption{path, at, fmt.Sprintf("Unknown op %d for %q", e.op, e.key)})
+		}
+	}
+
+	if header.count > 0 && (!isEqual(first, header.smallest) || !isEqual(last, header.biggest)) {
+		found = append(found, Corruption{path, 0, fmt.Sprintf("Header says keys %q to %q, entries are %q to %q", header.smallest, header.biggest, first, last)})
+	}
+	if r.Len() > 0 {
+		found = append(found, Corruption{path, offset(), fmt.Sprintf("%d bytes after the last entry", r.Len())})
+	}
+	return found, nil
+}
+
+// verifyWAL reads a WAL file the way recoverFromWAL does. A sealed segment
+// must start right after base; the live WAL starts after its header's base,
+// and may end with a torn record, which recovery drops.
+func verifyWAL(path string, base uint64, live bool) ([]Corruption, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < walHeaderSize {
+		return []Corruption{{path, 0, "File is shorter than the WAL header"}}, nil
+	}
+	r := bytes.NewReader(data[walHeaderSize:])
+	watermark, headerBase := decodeWALHeader(data)
+
+	var found []Corruption
+	if live {
+		base = headerBase
+		if watermark > int64(len(data)) {
+			found = append(found, Corruption{path, 0, fmt.Sprintf("Watermark %d is past the end of the file", watermark)})
+		}
+	} else if headerBase != base {
+		found = append(found, Corruption{path, 0, fmt.Sprintf("Header says the segment follows seq %d, its name says %d", headerBase, base)})
+	}
+
+	next := base + 1
+	for {
+		at := int64(len(data) - r.Len())
+		rec, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF && live {
+			break
+		}
+		if err != nil && !isDamaged(err) {
+			// Not the file's fault, repair must leave it alone
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err != nil {
+			return append(found, Corruption{path, at, "Unreadable record: " + err.Error()}), nil
+		}
+
+		records, err := rec.batchRecords()
+		if err != nil {
+			return append(found, Corruption{path, at, err.Error()}), nil
+		}
+		if first := rec.seq - uint64(len(records)) + 1; first != next {
+			return append(found, Corruption{path, at, fmt.Sprintf("Expected seq %d, got %d", next, first)}), nil
+		}
+		for _, sub := range records {
+			_, op, key := splitWALKey(sub.op, sub.key)
+			switch Cmd(op) {
+			case Set, Del, Ingest, CreateCF, DropCF:
+			case Merge:
+				if _, _, err := decodeOperand(sub.value); err != nil {
+					return append(found, Corruption{path, at, fmt.Sprintf("Bad merge operand for %q: %v", key, err)}), nil
+				}
+			default:
+				return append(found, Corruption{path, at, fmt.Sprintf("Unknown op %d", op)}), nil
+			}
+		}
+		next = rec.seq + 1
+	}
+	return found, nil
+}
+
+// verifyManifest checks the SSTs a manifest lists. SSTs never change once
+// written, so a different checksum means a damaged file; the live WAL is
+// expected to change and isn't checked.
+func verifyManifest(path string) ([]Corruption, error) {
+	manifest, err := readManifest(path)
+	if err != nil {
+		return []Corruption{{path, 0, "Unreadable manifest: " + err.Error()}}, nil
+	}
+
+	var found []Corruption
+	for _, file := range manifest.Files {
+		if file.Path == "wal.txt" {
+			continue
+		}
+		sum, size, err := fileSHA256(file.Path)
+		if os.IsNotExist(err) {
+			found = append(found, Corruption{file.Path, 0, "Listed in " + path + " but missing"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sum != file.SHA256 || size != file.Size {
+			found = append(found, Corruption{file.Path, 0, fmt.Sprintf("Checksum mismatch: expected %s, got %s", file.SHA256, sum)})
+		}
+	}
+	return found, nil
+}
+
+// RepairReport says what RepairStore did.
+type RepairReport struct {
+	Salvaged    []string `json:"salvaged,omitempty"`
+	Quarantined []string `json:"quarantined,omitempty"`
+	Truncated   string   `json:"truncated,omitempty"`
+	Manifest    Manifest `json:"manifest"`
+}
+
+// RepairStore fixes what VerifyStore finds in the store in the current
+// directory. Damaged SSTs are moved to the quarantine directory and replaced
+// by the entries that could still be read, sorted, so that lookups give
+// "not found" rather than a wrong answer for the lost keys; damaged sealed
+// WAL segments are quarantined and the live WAL is cut before its first bad
+// record. The MANIFEST is then rebuilt from the files left on disk.
+func RepairStore() (*RepairReport, error) {
+	found, err := VerifyStore()
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{}
+
+	damaged := map[string]int64{}
+	for _, c := range found {
+		if offset, ok := damaged[c.File]; !ok || c.Offset < offset {
+			damaged[c.File] = c.Offset
+		}
+	}
+	var paths []string
+	for path := range damaged {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		switch {
+		case path == "MANIFEST":
+			// Rebuilt below
+		case path == "wal.txt":
+			if err := quarantine(path, true); err != nil {
+				return nil, err
+			}
+			if err := repairLiveWAL(damaged[path]); err != nil {
+				return nil, err
+			}
+			report.Truncated = fmt.Sprintf("%s at offset %d", path, damaged[path])
+		case strings.HasPrefix(path, walSegmentDir+"/"):
+			if err := quarantine(path, false); err != nil {
+				return nil, err
+			}
+			report.Quarantined = append(report.Quarantined, path)
+		case strings.HasPrefix(filepath.Base(path), "sst"):
+			kept, total, err := salvageSST(path)
+			if err != nil {
+				return nil, err
+			}
+			report.Quarantined = append(report.Quarantined, path)
+			report.Salvaged = append(report.Salvaged, fmt.Sprintf("%s: kept %d of %d entries", path, kept, total))
+		}
+	}
+
+	manifest, err := rebuildManifest()
+	if err != nil {
+		return nil, err
+	}
+	report.Manifest = *manifest
+	return report, nil
+}
+
+// repairLiveWAL cuts the live WAL at offset. A bad header only has its
+// watermark reset, so every record left is replayed.
+func repairLiveWAL(offset int64) error {
+	wal, err := os.OpenFile("wal.txt", os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+	if offset >= walHeaderSize {
+		return wal.Truncate(offset)
+	}
+	_, base, err := readWALHeader(wal)
+	if err != nil {
+		return err
+	}
+	return writeWALHeader(wal, 0, base)
+}
+
+// salvageSST quarantines an SST and writes the entries it could read back
+// in its place, so the numbering of the other SSTs doesn't change.
+func salvageSST(path string) (int, uint32, error) {
+	data, err := readSSTData(path)
+	if err != nil && !isDamaged(err) {
+		return 0, 0, err
+	}
+	r := bytes.NewReader(data)
+
+	var entries []sstEntry
+	header, err := readSSTHeader(r)
+	if err == nil {
+		for i := 0; i < int(header.count); i++ {
+			e, err := readSSTEntry(r)
+			if err != nil {
+				break
+			}
+			if e.op <= byte(merge) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	// Keep the first entry of a key, as a lookup would
+	sort.SliceStable(entries, func(i, j int) bool { return compareKeys(entries[i].key, entries[j].key) < 0 })
+	var kept []sstEntry
+	for _, e := range entries {
+		if len(kept) == 0 || !isEqual(kept[len(kept)-1].key, e.key) {
+			kept = append(kept, e)
+		}
+	}
+
+	if err := quarantine(path, false); err != nil {
+		return 0, 0, err
+	}
+	if err := writeSSTFile(path, kept, codecNone); err != nil {
+		return 0, 0, err
+	}
+	return len(kept), header.count, nil
+}
+
+// quarantine moves path under the quarantine directory, or copies it there
+// when the original is to be repaired in place.
+func quarantine(path string, keep bool) error {
+	target := fmt.Sprintf("%s/%d/%s", quarantineDir, time.Now().Unix(), path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if keep {
+		return copyFile(path, target)
+	}
+	return os.Rename(path, target)
+}
+
+// rebuildManifest describes the files on disk in a new MANIFEST.
+func rebuildManifest() (*Manifest, error) {
+	wal, err := os.Open("wal.txt")
+	if err != nil {
+		return nil, err
+	}
+	seq, _, err := lastWALSeq(wal)
+	wal.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := storeFiles("")
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{Seq: seq, Created: time.Now().UTC()}
+	for _, path := range append(files, "wal.txt") {
+		file, err := describeFile(".", path)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	if err := writeManifest("MANIFEST", manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ErrCorruption is what kvctl verify fails with when it found problems.
+var ErrCorruption = errors.New("Corruption found")
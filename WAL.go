@@ -1,59 +1,477 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type walFile struct {
+	// root is the directory of the store, the working directory if empty
+	root      string
 	file      *os.File
 	size      int
 	watermark int64
+	// seq is the sequence number of the last record written and base the
+	// one of the last record before this file
+	seq  uint64
+	base uint64
+	// key is the data key records are encrypted with, made with the file
+	key *fileKey
+	// readOnly is set while the store is a replica: its records only come
+	// from the primary, applied around the write path
+	readOnly bool
 }
 
-func writeWAL(wal *os.File, op byte, key, value []byte) error {
+// cfFlag is set on the op byte of records that belong to a named column
+// family. Their key field is then the family name, a 0 byte and the key.
+const cfFlag = 0x80
+
+// walRecord is one entry of the WAL. Batches are a single record whose
+// value holds the encoded records of the batch.
+type walRecord struct {
+	op    byte
+	seq   uint64
+	time  int64
+	key   []byte
+	value []byte
+	// sealed is the size of the record on disk when it was read encrypted
+	sealed int64
+}
+
+// walRecordHeaderSize is the size of a record without its key and value.
+const walRecordHeaderSize = 25
+
+// size is the size of the record in its file, for offsets.
+func (rec walRecord) size() int64 {
+	if rec.sealed > 0 {
+		return rec.sealed
+	}
+	return int64(walRecordHeaderSize + len(rec.key) + len(rec.value))
+}
+
+func writeWAL(wal *walFile, seq uint64, op byte, key, value []byte) error {
 	//write in the wal file
-	fmt.Printf("Writing to WAL. Op: %d, Key: %s, Value: %s\n", op, key, value)
+	return wal.append(encodeWALRecord(seq, op, key, value))
+}
+
+// append writes an encoded record, encrypted when a key provider is set.
+func (wal *walFile) append(record []byte) error {
+	if wal.key == nil && encryption != nil {
+		key, err := newFileKey()
+		if err != nil {
+			return err
+		}
+		wal.key = key
+	}
+	sealed, err := wal.key.sealRecord(record)
+	if err != nil {
+		return err
+	}
+	// One write per record so a crash can only tear the last one
+	n, err := wal.file.Write(sealed)
+	metrics.walBytes.add(n)
+	metrics.walRecords.add(1)
+	return err
+}
+
+// encodeWALRecord lays a record out as the op byte, the sequence number, the
+// time it was written in Unix nanoseconds, then the key and the value, each
+// prefixed with its length.
+func encodeWALRecord(seq uint64, op byte, key, value []byte) []byte {
+	rec := walRecord{op: op, seq: seq, time: time.Now().UnixNano(), key: key, value: value}
+	return rec.encode()
+}
+
+func (rec walRecord) encode() []byte {
+	record := make([]byte, 0, walRecordHeaderSize+len(rec.key)+len(rec.value))
 
+	seqBytes := make([]byte, 8)
+	timeBytes := make([]byte, 8)
 	lenKey := make([]byte, 4)
 	lenValue := make([]byte, 4)
 
-	binary.LittleEndian.PutUint32(lenKey, uint32(len(key)))
-	binary.LittleEndian.PutUint32(lenValue, uint32(len(value)))
+	binary.LittleEndian.PutUint64(seqBytes, rec.seq)
+	binary.LittleEndian.PutUint64(timeBytes, uint64(rec.time))
+	binary.LittleEndian.PutUint32(lenKey, uint32(len(rec.key)))
+	binary.LittleEndian.PutUint32(lenValue, uint32(len(rec.value)))
 
-	// Write operation byte
-	if _, err := wal.Write([]byte{op}); err != nil {
-		return err
+	record = append(record, rec.op)
+	record = append(record, seqBytes...)
+	record = append(record, timeBytes...)
+	record = append(record, lenKey...)
+	record = append(record, rec.key...)
+	record = append(record, lenValue...)
+	record = append(record, rec.value...)
+
+	return record
+}
+
+// readWALRecord reads the next record written by writeWAL. It returns io.EOF
+// at the end of the log and io.ErrUnexpectedEOF for a record cut short by a
+// crash. Encrypted records are decrypted, and a wrong key is an error of
+// its own.
+func readWALRecord(r io.Reader) (walRecord, error) {
+	var rec walRecord
+	if err := binary.Read(r, binary.LittleEndian, &rec.op); err != nil {
+		return rec, err
+	}
+	if rec.op == walSealed {
+		return openWALRecord(r)
+	}
+
+	var lenKey, lenValue uint32
+	if err := binary.Read(r, binary.LittleEndian, &rec.seq); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	if err := binary.Read(r, binary.LittleEndian, &rec.time); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	if err := binary.Read(r, binary.LittleEndian, &lenKey); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	if remaining, ok := r.(interface{ Len() int }); ok && int64(lenKey) > int64(remaining.Len()) {
+		return rec, io.ErrUnexpectedEOF
+	}
+	rec.key = make([]byte, lenKey)
+	if _, err := io.ReadFull(r, rec.key); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &lenValue); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	if remaining, ok := r.(interface{ Len() int }); ok && int64(lenValue) > int64(remaining.Len()) {
+		return rec, io.ErrUnexpectedEOF
+	}
+	rec.value = make([]byte, lenValue)
+	if _, err := io.ReadFull(r, rec.value); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+
+	return rec, nil
+}
+
+// batchRecords returns the records of a batch, or the record itself.
+func (rec walRecord) batchRecords() ([]walRecord, error) {
+	if rec.op != byte(Batch) {
+		return []walRecord{rec}, nil
+	}
+
+	var records []walRecord
+	r := bytes.NewReader(rec.value)
+	for {
+		sub, err := readWALRecord(r)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, errors.New("Malformed batch in WAL")
+		}
+		records = append(records, sub)
+	}
+}
+
+// walKey tags a record with its column family.
+func walKey(cf string, op byte, key []byte) (byte, []byte) {
+	if cf == "" {
+		return op, key
+	}
+	tagged := append([]byte(cf), 0)
+	return op | cfFlag, append(tagged, key...)
+}
+
+// splitWALKey undoes walKey.
+func splitWALKey(op byte, key []byte) (string, byte, []byte) {
+	if op&cfFlag == 0 {
+		return "", op, key
+	}
+	for i, b := range key {
+		if b == 0 {
+			return string(key[:i]), op &^ cfFlag, key[i+1:]
+		}
+	}
+	return "", op &^ cfFlag, key
+}
+
+// The live WAL starts with a header: the watermark, up to which records are
+// in SSTs, then the sequence number of the last record before this file.
+const walHeaderSize = 16
+
+// walSegmentDir holds the sealed WAL files, named after the sequence number
+// of their first record. They are kept until every CDC consumer is past them.
+const walSegmentDir = "WALSegments"
+
+// walArchiveDir keeps every sealed segment, named after its first sequence
+// number and the Unix time it was sealed, for point-in-time restores. Empty,
+// the default, disables archiving; -wal-archive turns it on.
+var walArchiveDir = ""
+
+// walArchiveRepo is the backup repository whose oldest backup bounds the
+// archive: segments with only writes older than it are pruned. Empty keeps
+// them all.
+var walArchiveRepo = ""
+
+// storePath is the path of name in the store rooted at root.
+func storePath(root, name string) string {
+	if root == "" {
+		return name
+	}
+	return filepath.Join(root, name)
+}
+
+func instantiateWal(root string) (*walFile, error) {
+	if err := os.MkdirAll(storePath(root, walSegmentDir+"/consumers"), 0755); err != nil {
+		return nil, err
+	}
+	if walArchiveDir != "" {
+		if err := os.MkdirAll(storePath(root, walArchiveDir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(storePath(root, "wal.txt"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the initial header at the top of a new file. Its sequence
+	// numbers follow the ones of the last sealed segment, if any.
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
 	}
+	if info.Size() == 0 {
+		base, err := lastSealedSeq(root)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeWALHeader(file, 0, base); err != nil {
+			return nil, err
+		}
+	}
+	_, base, err := readWALHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	file.Seek(0, io.SeekEnd)
 
-	// Write key length and key
-	if _, err := wal.Write(lenKey); err != nil {
+	return &walFile{root: root, file: file, seq: base, base: base}, nil
+}
+
+func writeWALHeader(file *os.File, watermark int64, base uint64) error {
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint64(header, uint64(watermark))
+	binary.LittleEndian.PutUint64(header[8:], base)
+	_, err := file.WriteAt(header, 0)
+	return err
+}
+
+func readWALHeader(file *os.File) (int64, uint64, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return 0, 0, err
+	}
+	watermark, base := decodeWALHeader(header)
+	return watermark, base, nil
+}
+
+func decodeWALHeader(header []byte) (int64, uint64) {
+	return int64(binary.LittleEndian.Uint64(header)), binary.LittleEndian.Uint64(header[8:])
+}
+
+type walSegment struct {
+	first uint64
+	path  string
+}
+
+// walSegments lists the sealed segments of the store in root, oldest first.
+func walSegments(root string) ([]walSegment, error) {
+	dir := storePath(root, walSegmentDir)
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []walSegment
+	for _, entry := range dirEntries {
+		var first uint64
+		if _, err := fmt.Sscanf(entry.Name(), "wal%d.txt", &first); err != nil || entry.IsDir() {
+			continue
+		}
+		segments = append(segments, walSegment{first: first, path: dir + "/" + entry.Name()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+// lastSealedSeq returns the sequence number of the last record of the newest
+// sealed segment, or 0.
+func lastSealedSeq(root string) (uint64, error) {
+	segments, err := walSegments(root)
+	if err != nil || len(segments) == 0 {
+		return 0, err
+	}
+
+	file, err := os.Open(segments[len(segments)-1].path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, last, err := readWALHeader(file)
+	if err != nil {
+		return 0, err
+	}
+	file.Seek(walHeaderSize, io.SeekStart)
+
+	reader := bufio.NewReader(file)
+	for {
+		rec, err := readWALRecord(reader)
+		if err != nil {
+			return last, nil
+		}
+		last = rec.seq
+	}
+}
+
+// rotateWAL seals the live WAL once everything in it has been flushed to
+// SSTs and starts a new one.
+func rotateWAL(wal *walFile) error {
+	if wal.seq == wal.base {
+		// Nothing was written since the last rotation
+		return nil
+	}
+
+	sealed := fmt.Sprintf("%s/wal%d.txt", storePath(wal.root, walSegmentDir), wal.base+1)
+	// Sealed segments are archived and tailed, they have to be on disk
+	start := time.Now()
+	if err := wal.file.Sync(); err != nil {
+		return err
+	}
+	metrics.walFsync.since(start)
+	if err := wal.file.Close(); err != nil {
 		return err
 	}
-	if _, err := wal.Write(key); err != nil {
+	if err := os.Rename(storePath(wal.root, "wal.txt"), sealed); err != nil {
 		return err
 	}
+	if walArchiveDir != "" {
+		archived := fmt.Sprintf("%s/wal%d-%d.txt", storePath(wal.root, walArchiveDir), wal.base+1, time.Now().Unix())
+		if err := linkOrCopy(sealed, archived); err != nil {
+			return err
+		}
+		if walArchiveRepo != "" {
+			if err := pruneWALArchive(storePath(wal.root, walArchiveDir), walArchiveRepo, wal.seq); err != nil {
+				fmt.Println("Error pruning the WAL archive:", err)
+			}
+		}
+	}
 
-	// Write value length and value
-	if _, err := wal.Write(lenValue); err != nil {
+	file, err := os.OpenFile(storePath(wal.root, "wal.txt"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
 		return err
 	}
-	if _, err := wal.Write(value); err != nil {
+	if err := writeWALHeader(file, 0, wal.seq); err != nil {
 		return err
 	}
+	file.Seek(0, io.SeekEnd)
+	wal.file = file
+	wal.base = wal.seq
+	wal.key = nil
 
-	return nil
+	return purgeWALSegments(wal.root)
+}
+
+// CommitWALCheckpoint records that the CDC consumer has processed every
+// record up to seq. Sealed segments are kept until all consumers are past
+// them.
+func CommitWALCheckpoint(consumer string, seq uint64) error {
+	return commitWALCheckpoint("", consumer, seq)
 }
 
-func instantiateWal() (*walFile, error) {
-	file, err := os.OpenFile("wal.txt", os.O_CREATE|os.O_RDWR, 0644)
+func commitWALCheckpoint(root, consumer string, seq uint64) error {
+	if !validColumnFamilyName(consumer) {
+		return errors.New("Invalid consumer name")
+	}
+	path := storePath(root, walSegmentDir+"/consumers/"+consumer)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatUint(seq, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// WALCheckpoint returns the last committed seq of a consumer.
+func WALCheckpoint(consumer string) (uint64, bool) {
+	return walCheckpoint("", consumer)
+}
+
+func walCheckpoint(root, consumer string) (uint64, bool) {
+	data, err := os.ReadFile(storePath(root, walSegmentDir+"/consumers/"+consumer))
 	if err != nil {
-		return nil, err
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return seq, err == nil
+}
+
+// RemoveWALConsumer forgets a consumer so it no longer holds segments back.
+func RemoveWALConsumer(consumer string) error {
+	return removeWALConsumer("", consumer)
+}
+
+func removeWALConsumer(root, consumer string) error {
+	if !validColumnFamilyName(consumer) {
+		return errors.New("Invalid consumer name")
+	}
+	return os.Remove(storePath(root, walSegmentDir+"/consumers/"+consumer))
+}
+
+// purgeWALSegments deletes the sealed segments every consumer is past. With
+// no consumer registered, nothing needs them.
+func purgeWALSegments(root string) error {
+	dirEntries, err := os.ReadDir(storePath(root, walSegmentDir+"/consumers"))
+	if err != nil {
+		return err
+	}
+	oldest := ^uint64(0)
+	for _, entry := range dirEntries {
+		if seq, ok := walCheckpoint(root, entry.Name()); ok && seq < oldest {
+			oldest = seq
+		}
 	}
 
-	// Write the initial watermark (0) at the top of the file
-	binary.Write(file, binary.LittleEndian, int64(0))
+	segments, err := walSegments(root)
+	if err != nil {
+		return err
+	}
+	for i, segment := range segments {
+		// The last record of a segment is the one before the next segment
+		// (or the live WAL) starts
+		var last uint64
+		if i+1 < len(segments) {
+			last = segments[i+1].first - 1
+		} else {
+			last, err = lastSealedSeq(root)
+			if err != nil {
+				return err
+			}
+		}
+		if last > oldest {
+			break
+		}
+		if err := os.Remove(segment.path); err != nil {
+			return err
+		}
+	}
 
-	return &walFile{file: file}, nil
+	return nil
 }
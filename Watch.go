@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+	EventMerge
+	// EventOverflow is the last event of a watch whose consumer fell too far
+	// behind. Its Seq is the last one delivered, to resume from.
+	EventOverflow
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventMerge:
+		return "merge"
+	default:
+		return "overflow"
+	}
+}
+
+// Event describes a committed write. Merge events carry the operand and
+// the name of its operator rather than the folded value.
+type Event struct {
+	Type     EventType
+	CF       string
+	Key      []byte
+	Value    []byte
+	Operator string
+	Seq      uint64
+}
+
+func (ev Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string `json:"type"`
+		CF       string `json:"cf,omitempty"`
+		Key      string `json:"key,omitempty"`
+		Value    string `json:"value,omitempty"`
+		Operator string `json:"operator,omitempty"`
+		Seq      uint64 `json:"seq"`
+	}{ev.Type.String(), ev.CF, string(ev.Key), string(ev.Value), ev.Operator, ev.Seq})
+}
+
+// watchBuffer is how many events a watcher may have pending before it is
+// closed with an EventOverflow.
+var watchBuffer = 256
+
+type watcher struct {
+	cf      string
+	prefix  []byte
+	ch      chan Event
+	lastSeq uint64
+}
+
+// watchHub holds the watchers of every column family of a store.
+type watchHub struct {
+	watchers []*watcher
+}
+
+func (w *watcher) matches(ev Event) bool {
+	return ev.CF == w.cf && bytes.HasPrefix(ev.Key, w.prefix)
+}
+
+// deliver hands ev to the watcher without blocking. The last slot of the
+// buffer is kept for the overflow event, so it reports false once the
+// watcher has been closed.
+func (w *watcher) deliver(ev Event) bool {
+	if len(w.ch) >= cap(w.ch)-1 {
+		w.ch <- Event{Type: EventOverflow, CF: w.cf, Seq: w.lastSeq}
+		close(w.ch)
+		return false
+	}
+	w.ch <- ev
+	w.lastSeq = ev.Seq
+	return true
+}
+
+// publish sends a write of this family to the matching watchers. It is
+// called with the lock held, right after the write is in the WAL.
+func (mem *memDB) publish(ev Event) {
+	ev.CF = mem.name
+
+	live := mem.hub.watchers[:0]
+	for _, w := range mem.hub.watchers {
+		if w.matches(ev) && !w.deliver(ev) {
+			continue
+		}
+		live = append(live, w)
+	}
+	mem.hub.watchers = live
+}
+
+// publishRecord publishes every write of a WAL record.
+func (mem *memDB) publishRecord(rec walRecord) {
+	events, err := eventsFromRecord(rec)
+	if err != nil {
+		return
+	}
+	for _, ev := range events {
+		if cf, ok := mem.families[ev.CF]; ok {
+			cf.publish(ev)
+		}
+	}
+}
+
+// eventsFromRecord turns a WAL record, or each record of a batch, into events.
+func eventsFromRecord(rec walRecord) ([]Event, error) {
+	records, err := rec.batchRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for _, rec := range records {
+		name, op, key := splitWALKey(rec.op, rec.key)
+		ev := Event{CF: name, Key: key, Seq: rec.seq}
+		switch op {
+		case byte(Set):
+			ev.Type = EventPut
+			ev.Value = rec.value
+		case byte(Del):
+			ev.Type = EventDelete
+		case byte(Merge):
+			ev.Type = EventMerge
+			ev.Operator, ev.Value, err = decodeOperand(rec.value)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// Watch streams the writes to keys of this family starting with prefix,
+// from now on.
+func (mem *memDB) Watch(prefix string) <-chan Event {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	w := &watcher{cf: mem.name, prefix: []byte(prefix), ch: make(chan Event, watchBuffer)}
+	mem.hub.watchers = append(mem.hub.watchers, w)
+	return w.ch
+}
+
+// WatchFrom is Watch resumed after the write numbered since: the writes
+// that followed it are read back from the WAL before the live ones.
+func (mem *memDB) WatchFrom(prefix string, since uint64) (<-chan Event, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	w := &watcher{cf: mem.name, prefix: []byte(prefix), ch: make(chan Event, watchBuffer), lastSeq: since}
+
+	// Holding the lock, nothing can be written between the backlog and
+	// the registration
+	err := readWALEvents(mem.wal.root, since, func(ev Event) bool {
+		if !w.matches(ev) {
+			return true
+		}
+		return w.deliver(ev)
+	})
+	if err == errWatchClosed {
+		return w.ch, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mem.hub.watchers = append(mem.hub.watchers, w)
+	return w.ch, nil
+}
+
+// Unwatch stops a watch and closes its channel.
+func (mem *memDB) Unwatch(ch <-chan Event) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	for i, w := range mem.hub.watchers {
+		if w.ch == ch {
+			close(w.ch)
+			mem.hub.watchers = append(mem.hub.watchers[:i], mem.hub.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+var errWatchClosed = errors.New("Watch closed")
+
+// readWALEvents calls fn with the events numbered after since that are
+// still in the WAL of the store in root, until fn returns false.
+func readWALEvents(root string, since uint64, fn func(Event) bool) error {
+	tailer := NewWALTailer(TailOptions{Since: since, Dir: root})
+	defer tailer.Close()
+
+	for {
+		ev, err := tailer.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(ev) {
+			return errWatchClosed
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+
+	// Keep the sealed WAL segments around to resume from
+	if err := CommitWALCheckpoint("test", 0); err != nil {
+		t.Fatalf("Error registering consumer: %v", err)
+	}
+
+	events := db.Watch("user/")
+	db.Set([]byte("user/1"), []byte("alice"))
+	db.Set([]byte("other"), []byte("x"))
+	db.Incr([]byte("user/visits"), 3)
+	db.Del([]byte("user/1"))
+
+	expected := []Event{
+		{Type: EventPut, Key: []byte("user/1"), Value: []byte("alice"), Seq: 1},
+		{Type: EventMerge, Key: []byte("user/visits"), Value: []byte("3"), Operator: "add", Seq: 3},
+		{Type: EventDelete, Key: []byte("user/1"), Seq: 4},
+	}
+	for _, e := range expected {
+		ev := <-events
+		if ev.Type != e.Type || string(ev.Key) != string(e.Key) || string(ev.Value) != string(e.Value) || ev.Operator != e.Operator || ev.Seq != e.Seq {
+			t.Fatalf("Expected %+v, got %+v", e, ev)
+		}
+	}
+	db.Unwatch(events)
+	if _, ok := <-events; ok {
+		t.Fatalf("Expected the channel to be closed by Unwatch")
+	}
+
+	// A consumer that doesn't keep up gets an overflow event and is dropped
+	watchBuffer = 3
+	slow := db.Watch("")
+	watchBuffer = 256
+	for i := 0; i < 5; i++ {
+		db.Set([]byte("k"), []byte("v"))
+	}
+	var last Event
+	for ev := range slow {
+		last = ev
+	}
+	if last.Type != EventOverflow || last.Seq != 6 {
+		t.Fatalf("Expected an overflow event after seq 6, got %+v", last)
+	}
+
+	// Resume after a restart from the WAL
+	db.wal.file.Close()
+	repl, err = NewInMem()
+	if err != nil {
+		t.Fatalf("Error reopening database: %v", err)
+	}
+	db = repl.handler.(*memDB)
+	if err := recoverFromWAL(db); err != nil {
+		t.Fatalf("Error recovering from WAL: %v", err)
+	}
+	resumed, err := db.WatchFrom("user/", 1)
+	if err != nil {
+		t.Fatalf("Error resuming watch: %v", err)
+	}
+	db.Set([]byte("user/2"), []byte("bob"))
+	for _, seq := range []uint64{3, 4, 10} {
+		if ev := <-resumed; ev.Seq != seq {
+			t.Fatalf("Expected seq %d, got %+v", seq, ev)
+		}
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	mem = repl.handler.(*memDB)
+	mem.Set([]byte("a/1"), []byte("old"))
+
+	server := httptest.NewServer(http.HandlerFunc(WatchHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/watch?prefix=a/&since=0")
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	mem.Set([]byte("b/1"), []byte("ignored"))
+	mem.Set([]byte("a/2"), []byte("new"))
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 6 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading stream: %v", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	expected := []string{
+		"id: 1", "event: put", `data: {"type":"put","key":"a/1","value":"old","seq":1}`, "",
+		"id: 3", "event: put",
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Fatalf("Expected line %d to be %q, got %q", i, expected[i], lines[i])
+		}
+	}
+}
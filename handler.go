@@ -2,13 +2,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/elliotchance/orderedmap"
 	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,19 +25,33 @@ type handler interface {
 	Set(key []byte, value []byte) error
 	Get(key []byte) ([]byte, error)
 	Del(key []byte) ([]byte, error)
+	CompareAndSwap(key, expected, value []byte) error
+	SetIfAbsent(key, value []byte) error
+	DeleteIfEquals(key, expected []byte) ([]byte, error)
+	Incr(key []byte, delta int64) ([]byte, error)
+	Append(key, value []byte) ([]byte, error)
 }
 
 func (mem *memDB) flushToSST() error {
+	if mem.regionsEnabled() {
+		return mem.flushToRegions()
+	}
+
+	// Nothing to write for an empty memtable
+	if mem.values.Len() == 0 {
+		return nil
+	}
+
 	// Count existing SST files
-	existingSSTFiles, err := countSSTFiles()
+	existingSSTFiles, err := countSSTFiles(mem.dir)
 	if err != nil {
 		return err
 	}
 
 	// Generate SST file name with the count of existing files
-	sstFileName := fmt.Sprintf("SSTFiles/sst%d.txt", existingSSTFiles+1)
+	sstFileName := fmt.Sprintf("%s/sst%d.txt", mem.dir, existingSSTFiles+1)
 
-	sstFile, err := os.Create(sstFileName)
+	sstFile, err := createSST(sstFileName, mem.codecForLevel(0))
 	if err != nil {
 		return err
 	}
@@ -46,11 +65,11 @@ func (mem *memDB) flushToSST() error {
 		return err
 	}
 
-	// Write keys to the SST file
-	keys := mem.values.Keys()
+	// Write keys to the SST file, sorted so the header holds the real key range
+	keys := mem.sortedKeys()
 
 	// Write smallest key to the SST file
-	smallestKey := keys[0].(string)
+	smallestKey := keys[0]
 	smallestKeyLenBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(smallestKeyLenBytes, uint32(len(smallestKey)))
 	if _, err := sstFile.Write(smallestKeyLenBytes); err != nil {
@@ -61,7 +80,7 @@ func (mem *memDB) flushToSST() error {
 	}
 
 	// Write biggest key to the SST file
-	biggestKey := keys[size-1].(string)
+	biggestKey := keys[size-1]
 	biggestKeyLenBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(biggestKeyLenBytes, uint32(len(biggestKey)))
 	if _, err := sstFile.Write(biggestKeyLenBytes); err != nil {
@@ -73,17 +92,19 @@ func (mem *memDB) flushToSST() error {
 
 	// Write keys and values to the SST file
 	for _, key := range keys {
-		value, _ := mem.values.Get(key)
-		entry := value.(entry)
+		e, err := mem.flushEntry(key)
+		if err != nil {
+			return err
+		}
+		opByte, valueBytes := e.op, e.value
 
 		// Write operation
-		opByte := byte(entry.op)
 		if _, err := sstFile.Write([]byte{opByte}); err != nil {
 			return err
 		}
 
 		// Write key
-		keyBytes := []byte(key.(string))
+		keyBytes := e.key
 		keyLenBytes := make([]byte, 4)
 		binary.LittleEndian.PutUint32(keyLenBytes, uint32(len(keyBytes)))
 
@@ -95,7 +116,6 @@ func (mem *memDB) flushToSST() error {
 		}
 
 		// Write value
-		valueBytes := entry.value.([]byte)
 		valueLenBytes := make([]byte, 4)
 		binary.LittleEndian.PutUint32(valueLenBytes, uint32(len(valueBytes)))
 
@@ -107,8 +127,7 @@ func (mem *memDB) flushToSST() error {
 		}
 	}
 
-	// Update the watermark in the WAL file
-	if err := updateWALWatermark(); err != nil {
+	if err := sstFile.Close(); err != nil {
 		return err
 	}
 
@@ -119,33 +138,57 @@ func (mem *memDB) flushToSST() error {
 	return nil
 }
 
-func updateWALWatermark() error {
-	// Open the WAL file
-	walFile, err := os.OpenFile("wal.txt", os.O_RDWR, 0644)
-	if err != nil {
-		return err
+func (mem *memDB) sortedKeys() []string {
+	keys := make([]string, 0, mem.values.Len())
+	for el := mem.values.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Key.(string))
 	}
-	defer walFile.Close()
+	sort.Strings(keys)
+	return keys
+}
 
-	// Read the watermark value
-	var watermark uint32
-	if err := binary.Read(walFile, binary.LittleEndian, &watermark); err != nil {
-		return err
+// flushEntry is the SST entry of a key of the memtable. Pending merge
+// operands are folded when the base is known, otherwise kept lazily as a
+// merge entry.
+func (mem *memDB) flushEntry(key string) (sstEntry, error) {
+	value, _ := mem.values.Get(key)
+	entry := value.(entry)
+
+	valueBytes, _ := entry.value.([]byte)
+	opByte := byte(entry.op)
+	if entry.op == merge {
+		valueBytes = encodeOperands(entry.operands)
+	} else if len(entry.operands) > 0 {
+		var err error
+		valueBytes, err = entry.resolve(mem.dir, []byte(key))
+		if err != nil {
+			return sstEntry{}, err
+		}
+		opByte = byte(set)
 	}
+	return sstEntry{opByte, []byte(key), valueBytes}, nil
+}
 
-	// Move the watermark to the end of the file
-	if _, err := walFile.Seek(0, io.SeekEnd); err != nil {
+func updateWALWatermark(root string) error {
+	// Open the WAL file
+	walFile, err := os.OpenFile(storePath(root, "wal.txt"), os.O_RDWR, 0644)
+	if err != nil {
 		return err
 	}
-	if err := binary.Write(walFile, binary.LittleEndian, watermark); err != nil {
+	defer walFile.Close()
+
+	// Everything written so far is now in an SST, so the watermark moves
+	// to the end of the file
+	end, err := walFile.Seek(0, io.SeekEnd)
+	if err != nil {
 		return err
 	}
 
 	// Update the watermark at the beginning of the file
-	if _, err := walFile.Seek(0, 0); err != nil {
+	if _, err := walFile.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	if err := binary.Write(walFile, binary.LittleEndian, watermark); err != nil {
+	if err := binary.Write(walFile, binary.LittleEndian, end); err != nil {
 		return err
 	}
 
@@ -170,17 +213,45 @@ func (mem *memDB) flushToSSTFromMap() error {
 	//mem.mu.Lock()
 	//defer mem.mu.Unlock()
 
-	return mem.flushToSST()
+	return mem.flushAll()
+}
+
+// flushAll flushes the memtables of every column family. They share one WAL
+// with one watermark, so they are always flushed together.
+func (mem *memDB) flushAll() error {
+	start := time.Now()
+	for _, cf := range mem.families {
+		if err := cf.flushToSST(); err != nil {
+			return err
+		}
+	}
+
+	// Update the watermark in the WAL file
+	if err := updateWALWatermark(mem.wal.root); err != nil {
+		return err
+	}
+
+	// Everything in the live WAL is in SSTs now, seal it
+	if err := rotateWAL(mem.wal); err != nil {
+		return err
+	}
+	metrics.flushes.since(start)
+
+	return mem.maintainRegionsWithNoLock()
 }
 
 func (mem *memDB) checkSizeAndFlush() {
-	// Check if the size of the ordered map exceeds flushThreshold
-	if mem.values.Len() >= flushThreshold {
+	// Check if the size of the ordered map exceeds the family's threshold
+	if mem.values.Len() >= mem.flushThreshold() {
 		// Acquire the lock
 		//mem.mu.Lock()
 		//defer mem.mu.Unlock()
 
-		err := mem.flushToSST()
+		// The write waits for the flush, and the writes behind it for the
+		// lock
+		start := time.Now()
+		err := mem.flushAll()
+		metrics.stalls.since(start)
 		if err != nil {
 			fmt.Println("Error flushing to SST:", err)
 		}
@@ -191,29 +262,26 @@ func (mem *memDB) Set(key, value []byte) error {
 
 	mem.mu.Lock()
 	defer mem.mu.Unlock()
-	err := mem.SetMap(key, value)
-	if err != nil {
-		return err
+	return mem.SetWithNoLock(key, value)
+}
+func (mem *memDB) SetWithNoLock(key, value []byte) error {
+	defer metrics.ops["set"].since(time.Now())
+	if mem.dropped {
+		return ErrColumnFamilyDropped
 	}
-	err = writeWAL(mem.wal.file, byte(Set), key, value)
-	if err != nil {
+	if err := mem.writableWithNoLock(); err != nil {
 		return err
 	}
-	fmt.Println("OK")
-	mem.checkSizeAndFlush()
-
-	return nil
-}
-func (mem *memDB) SetWithNoLock(key, value []byte) error {
 
 	err := mem.SetMap(key, value)
 	if err != nil {
 		return err
 	}
-	err = writeWAL(mem.wal.file, byte(Set), key, value)
+	seq, err := mem.logWAL(Set, key, value)
 	if err != nil {
 		return err
 	}
+	mem.publish(Event{Type: EventPut, Key: key, Value: value, Seq: seq})
 	fmt.Println("OK")
 	mem.checkSizeAndFlush()
 
@@ -223,39 +291,45 @@ func (mem *memDB) Get(key []byte) ([]byte, error) {
 	mem.mu.Lock()
 	defer mem.mu.Unlock()
 
-	// Check if the key is in the in-memory map
-	if v, ok := mem.values.Get(string(key)); ok {
-		entry := v.(entry)
-		if entry.op == del {
-			return nil, errors.New("Key not found")
-		}
-		fmt.Println(mem.values.Len())
-		return entry.value.([]byte), nil
-	}
+	defer metrics.ops["get"].since(time.Now())
+	return mem.getWithNoLock(context.Background(), key)
+}
 
-	// If not found in in-memory map, attempt to get from SST files
-	sstValue, err := GetFromSST(key)
-	if err != nil {
-		return nil, errors.New("Key not found")
-	}
+// GetWithNoLock reads a key for the engine itself, it isn't counted in the
+// metrics of gets.
+func (mem *memDB) GetWithNoLock(key []byte) ([]byte, error) {
+	return mem.getWithNoLock(context.Background(), key)
+}
 
-	return sstValue, nil
+// GetContext is Get giving up with ctx's error once it is done, even while
+// reading the SSTs.
+func (mem *memDB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	defer metrics.ops["get"].since(time.Now())
+	return mem.getWithNoLock(ctx, key)
 }
-func (mem *memDB) GetWithNoLock(key []byte) ([]byte, error) {
+func (mem *memDB) getWithNoLock(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if mem.dropped {
+		return nil, ErrColumnFamilyDropped
+	}
 
 	// Check if the key is in the in-memory map
 	if v, ok := mem.values.Get(string(key)); ok {
-		entry := v.(entry)
-		if entry.op == del {
-			return nil, errors.New("Key not found")
-		}
 		fmt.Println(mem.values.Len())
-		return entry.value.([]byte), nil
+		return v.(entry).resolve(mem.dir, key)
 	}
 
 	// If not found in in-memory map, attempt to get from SST files
-	sstValue, err := GetFromSST(key)
+	sstValue, err := getFromSST(ctx, mem.dir, key, nil)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, errors.New("Key not found")
 	}
 
@@ -266,41 +340,90 @@ func (mem *memDB) Del(key []byte) ([]byte, error) {
 	mem.mu.Lock()
 	defer mem.mu.Unlock()
 
-	value, er := mem.GetWithNoLock(key)
-	if er != nil {
-		return nil, errors.New("Key not found")
+	return mem.DelWithNoLock(key)
+}
+func (mem *memDB) DelWithNoLock(key []byte) ([]byte, error) {
+	defer metrics.ops["del"].since(time.Now())
+	if err := mem.writableWithNoLock(); err != nil {
+		return nil, err
 	}
-	er = mem.SetWithNoLock(key, value)
-	if er != nil {
-		return nil, errors.New("Error setting")
+
+	value, er := mem.getWithNoLock(context.Background(), key)
+	if er == ErrColumnFamilyDropped {
+		return nil, er
 	}
-	v, err := mem.DelMap(key)
-	if err != nil {
+	if er != nil {
 		return nil, errors.New("Key not found")
 	}
+	mem.DelMap(key)
 
-	err = writeWAL(mem.wal.file, byte(Del), []byte(key), v)
+	seq, err := mem.logWAL(Del, key, value)
 	if err != nil {
 		return nil, err
 	}
+	mem.publish(Event{Type: EventDelete, Key: key, Seq: seq})
 
 	fmt.Println("OK")
 	mem.checkSizeAndFlush()
 
-	return v, nil
+	return value, nil
+}
+
+// SetIf sets key to value only if cond accepts the current value of the key.
+// The check and the write happen under the same lock as Set, so no other
+// write can slip in between them.
+func (mem *memDB) SetIf(key, value []byte, cond func(current []byte, exists bool) bool) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	current, err := mem.GetWithNoLock(key)
+	if !cond(current, err == nil) {
+		return ErrPreconditionFailed
+	}
+
+	return mem.SetWithNoLock(key, value)
+}
+
+// DelIf deletes key only if cond accepts its current value.
+func (mem *memDB) DelIf(key []byte, cond func(current []byte, exists bool) bool) ([]byte, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	current, err := mem.GetWithNoLock(key)
+	if !cond(current, err == nil) {
+		return nil, ErrPreconditionFailed
+	}
+
+	return mem.DelWithNoLock(key)
+}
+
+// CompareAndSwap replaces the value of key with value if it currently holds expected.
+func (mem *memDB) CompareAndSwap(key, expected, value []byte) error {
+	return mem.SetIf(key, value, func(current []byte, exists bool) bool {
+		return exists && bytes.Equal(current, expected)
+	})
+}
+
+// SetIfAbsent sets key only if it does not exist yet.
+func (mem *memDB) SetIfAbsent(key, value []byte) error {
+	return mem.SetIf(key, value, func(current []byte, exists bool) bool {
+		return !exists
+	})
+}
+
+// DeleteIfEquals deletes key if it currently holds expected.
+func (mem *memDB) DeleteIfEquals(key, expected []byte) ([]byte, error) {
+	return mem.DelIf(key, func(current []byte, exists bool) bool {
+		return exists && bytes.Equal(current, expected)
+	})
 }
 
 func NewInMem() (*Repl, error) {
-	walFileInstance, err := instantiateWal()
+	memInstance, err := newStore("")
 	if err != nil {
 		return nil, err
 	}
 
-	memInstance := &memDB{
-		values: orderedmap.NewOrderedMap(),
-		wal:    walFileInstance,
-	}
-
 	return &Repl{
 		handler: memInstance,
 		in:      os.Stdin,
@@ -308,6 +431,49 @@ func NewInMem() (*Repl, error) {
 	}, nil
 }
 
+// newStore opens the store in root, the working directory if empty, without
+// recovering its WAL.
+func newStore(root string) (*memDB, error) {
+	walFileInstance, err := instantiateWal(root)
+	if err != nil {
+		return nil, err
+	}
+
+	memInstance := &memDB{
+		values:   orderedmap.NewOrderedMap(),
+		mu:       &sync.Mutex{},
+		wal:      walFileInstance,
+		dir:      storePath(root, sstDir),
+		families: map[string]*memDB{},
+		hub:      &watchHub{},
+	}
+	memInstance.families[""] = memInstance
+
+	// Reopen the column families created in earlier runs
+	if err := memInstance.openColumnFamilies(); err != nil {
+		return nil, err
+	}
+	return memInstance, nil
+}
+
+// OpenStore opens the store in dir, creating it if needed, and recovers it
+// from its WAL. Stores opened this way don't depend on the working
+// directory, so several can be open in one process.
+func OpenStore(dir string) (*memDB, error) {
+	if err := os.MkdirAll(storePath(dir, sstDir), 0755); err != nil {
+		return nil, err
+	}
+	db, err := newStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := recoverFromWAL(db); err != nil {
+		db.wal.file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
 func (re *Repl) parseCmd(buf []byte) (Cmd, []string, error) {
 	line := string(buf)
 	elements := strings.Fields(line)
@@ -323,6 +489,16 @@ func (re *Repl) parseCmd(buf []byte) (Cmd, []string, error) {
 		return Set, elements[1:], nil
 	case "del":
 		return Del, elements[1:], nil
+	case "incr":
+		return Incr, elements[1:], nil
+	case "append":
+		return Append, elements[1:], nil
+	case "use":
+		return Use, elements[1:], nil
+	case "createcf":
+		return CreateCF, elements[1:], nil
+	case "dropcf":
+		return DropCF, elements[1:], nil
 	case "exit":
 		return Ext, nil, nil
 	default:
@@ -377,6 +553,73 @@ func (re *Repl) Start() {
 				continue
 			}
 			fmt.Fprintln(re.out, string(v))
+		case Incr:
+			if len(elements) != 1 && len(elements) != 2 {
+				fmt.Fprintf(re.out, "Expected 1 or 2 arguments, received: %d\n", len(elements))
+				continue
+			}
+			delta := int64(1)
+			if len(elements) == 2 {
+				d, err := strconv.ParseInt(elements[1], 10, 64)
+				if err != nil {
+					fmt.Fprintln(re.out, "Increment is not an integer")
+					continue
+				}
+				delta = d
+			}
+			v, err := re.handler.Incr([]byte(elements[0]), delta)
+			if err != nil {
+				fmt.Fprintln(re.out, err.Error())
+				continue
+			}
+			fmt.Fprintln(re.out, string(v))
+		case Append:
+			if len(elements) != 2 {
+				fmt.Fprintf(re.out, "Expected 2 arguments, received: %d\n", len(elements))
+				continue
+			}
+			v, err := re.handler.Append([]byte(elements[0]), []byte(elements[1]))
+			if err != nil {
+				fmt.Fprintln(re.out, err.Error())
+				continue
+			}
+			fmt.Fprintln(re.out, string(v))
+		case Use:
+			if len(elements) != 1 {
+				fmt.Fprintf(re.out, "Expected 1 argument, received: %d\n", len(elements))
+				continue
+			}
+			cf, err := re.handler.(*memDB).Family(elements[0])
+			if err != nil {
+				fmt.Fprintln(re.out, err.Error())
+				continue
+			}
+			re.handler = cf
+		case CreateCF:
+			if len(elements) != 1 && len(elements) != 2 {
+				fmt.Fprintf(re.out, "Expected 1 or 2 arguments, received: %d\n", len(elements))
+				continue
+			}
+			var options CFOptions
+			if len(elements) == 2 {
+				threshold, err := strconv.Atoi(elements[1])
+				if err != nil {
+					fmt.Fprintln(re.out, "Flush threshold is not an integer")
+					continue
+				}
+				options.FlushThreshold = threshold
+			}
+			if _, err := re.handler.(*memDB).CreateColumnFamily(elements[0], options); err != nil {
+				fmt.Fprintln(re.out, err.Error())
+			}
+		case DropCF:
+			if len(elements) != 1 {
+				fmt.Fprintf(re.out, "Expected 1 argument, received: %d\n", len(elements))
+				continue
+			}
+			if err := re.handler.(*memDB).DropColumnFamily(elements[0]); err != nil {
+				fmt.Fprintln(re.out, err.Error())
+			}
 		case Ext:
 			fmt.Fprintln(re.out, "Bye!")
 			return
@@ -392,16 +635,10 @@ func (re *Repl) Start() {
 	}
 }
 
-func countSSTFiles() (int, error) {
-	dirPath, err := os.Getwd()
-	if err != nil {
-		fmt.Println("Error:", err)
-		return 0, err
-	}
-
+func countSSTFiles(dir string) (int, error) {
 	count := 0
 	// Open the directory
-	dirEntries, err := os.ReadDir(dirPath + "/SSTFiles")
+	dirEntries, err := os.ReadDir(dir)
 	if err != nil {
 		fmt.Println("Error reading directory:", err)
 		return 0, err
@@ -444,7 +681,7 @@ func UpToDate(wal *walFile) (bool, error) {
 	fileSize := fileInfo.Size()
 
 	// Seek to the beginning to read the stored watermark
-	_, err = wal.file.Seek(0, os.SEEK_SET)
+	_, err = wal.file.Seek(0, io.SeekStart)
 	if err != nil {
 		return false, err
 	}
@@ -456,8 +693,9 @@ func UpToDate(wal *walFile) (bool, error) {
 		return false, err
 	}
 
-	// Compare the stored watermark with the file size
-	return fileSize > 8 && uint64(fileSize)-8 == binary.LittleEndian.Uint64(storedWatermark), nil
+	// Nothing was written after the last flush
+	watermark := int64(binary.LittleEndian.Uint64(storedWatermark))
+	return fileSize <= walHeaderSize || fileSize == watermark, nil
 }
 
 func recoverFromWAL(mem *memDB) error {
@@ -469,60 +707,52 @@ func recoverFromWAL(mem *memDB) error {
 
 	if upToDate {
 		fmt.Println("WAL is up to date. No recovery needed.")
-		return nil
-	}
-
-	// Get the current offset before reading commands
-	currentOffset, err := mem.wal.file.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
 	}
 
-	// Seek to the beginning to read the stored watermark
-	_, err = mem.wal.file.Seek(0, io.SeekStart)
+	// Read the stored watermark
+	watermark, base, err := readWALHeader(mem.wal.file)
 	if err != nil {
 		return err
 	}
+	mem.wal.seq = base
 
-	// Read the stored watermark
-	storedWatermark := make([]byte, 8)
-	_, err = mem.wal.file.Read(storedWatermark)
+	// Records below the watermark are already in SSTs, they are only read
+	// to find the last sequence number
+	_, err = mem.wal.file.Seek(walHeaderSize, io.SeekStart)
 	if err != nil {
 		return err
 	}
+	reader := bufio.NewReader(mem.wal.file)
+	offset := int64(walHeaderSize)
 
-	// Execute commands below the watermark
+	// Execute commands above the watermark
 	for {
-		var op byte
-		if err := binary.Read(mem.wal.file, binary.LittleEndian, &op); err != nil {
-			if err == io.EOF {
-				break
-			} else {
+		rec, err := readWALRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// The last record was cut short by a crash and was never
+			// acknowledged, drop it so new records don't land behind it
+			fmt.Println("Truncating torn WAL record at offset", offset)
+			if err := mem.wal.file.Truncate(offset); err != nil {
 				return err
 			}
+			break
+		}
+		if err != nil {
+			return err
 		}
 
-		var lenKey, lenValue uint32
-		binary.Read(mem.wal.file, binary.LittleEndian, &lenKey)
-		key := make([]byte, lenKey)
-		mem.wal.file.Read(key)
-
-		binary.Read(mem.wal.file, binary.LittleEndian, &lenValue)
-		value := make([]byte, lenValue)
-		mem.wal.file.Read(value)
-
-		switch op {
-		case byte(set):
-			mem.SetMap(key, value)
-		case byte(del):
-			mem.DelMap(key)
-		default:
-			fmt.Printf("Unknown operation in WAL: %v\n", op)
+		if !upToDate && offset >= watermark {
+			mem.applyWALRecord(rec)
 		}
+		mem.wal.seq = rec.seq
+		offset += rec.size()
 	}
 
-	// Restore the original offset after reading commands
-	_, err = mem.wal.file.Seek(currentOffset, io.SeekStart)
+	// New records go after the ones we just replayed
+	_, err = mem.wal.file.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
@@ -3,11 +3,30 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 )
 
+// useTempDir runs the test inside a fresh directory so the wal.txt and
+// SSTFiles/ it writes don't touch the ones in the repository.
+func useTempDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/SSTFiles", 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
 func TestMemDB(t *testing.T) {
+	useTempDir(t)
 	mem, err := NewInMem()
 	if err != nil {
 		t.Fatalf("Error creating in-memory database: %v", err)
@@ -48,6 +67,7 @@ func TestMemDB(t *testing.T) {
 }
 
 func TestMemDBWithConcurrency(t *testing.T) {
+	useTempDir(t)
 	mem, err := NewInMem()
 	if err != nil {
 		t.Fatalf("Error creating in-memory database: %v", err)
@@ -65,31 +85,37 @@ func TestMemDBWithConcurrency(t *testing.T) {
 
 			err := mem.handler.Set(key, value)
 			if err != nil {
-				t.Fatalf("Error setting key: %v", err)
+				t.Errorf("Error setting key: %v", err)
+				return
 			}
 
 			result, err := mem.handler.Get(key)
 			if err != nil {
-				t.Fatalf("Error getting key: %v", err)
+				t.Errorf("Error getting key: %v", err)
+				return
 			}
 
 			if !bytes.Equal(result, value) {
-				t.Fatalf("Expected %v, got %v", value, result)
+				t.Errorf("Expected %v, got %v", value, result)
+				return
 			}
 
 			deletedValue, err := mem.handler.Del(key)
 			if err != nil {
-				t.Fatalf("Error deleting key: %v", err)
+				t.Errorf("Error deleting key: %v", err)
+				return
 			}
 
 			if !bytes.Equal(deletedValue, value) {
-				t.Fatalf("Expected deleted value %v, got %v", value, deletedValue)
+				t.Errorf("Expected deleted value %v, got %v", value, deletedValue)
+				return
 			}
 
 			// Test that the key is not present after deletion
 			_, err = mem.handler.Get(key)
 			if err == nil {
-				t.Fatalf("Expected key to be deleted, but it still exists")
+				t.Errorf("Expected key to be deleted, but it still exists")
+				return
 			}
 		}(i)
 
@@ -98,3 +124,39 @@ func TestMemDBWithConcurrency(t *testing.T) {
 	// Wait for goroutines to finish
 	time.Sleep(2 * time.Second)
 }
+
+func TestConditionalWrites(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	mem := repl.handler
+
+	if err := mem.SetIfAbsent([]byte("k"), []byte("v1")); err != nil {
+		t.Fatalf("SetIfAbsent on a new key: %v", err)
+	}
+	if err := mem.SetIfAbsent([]byte("k"), []byte("v2")); err != ErrPreconditionFailed {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+
+	if err := mem.CompareAndSwap([]byte("k"), []byte("nope"), []byte("v2")); err != ErrPreconditionFailed {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	if err := mem.CompareAndSwap([]byte("k"), []byte("v1"), []byte("v2")); err != nil {
+		t.Fatalf("CompareAndSwap with the right value: %v", err)
+	}
+	if v, _ := mem.Get([]byte("k")); !bytes.Equal(v, []byte("v2")) {
+		t.Fatalf("Expected v2, got %s", v)
+	}
+
+	if _, err := mem.DeleteIfEquals([]byte("k"), []byte("v1")); err != ErrPreconditionFailed {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	if _, err := mem.DeleteIfEquals([]byte("k"), []byte("v2")); err != nil {
+		t.Fatalf("DeleteIfEquals with the right value: %v", err)
+	}
+	if _, err := mem.Get([]byte("k")); err == nil {
+		t.Fatalf("Expected key to be deleted, but it still exists")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kvbackupMain backs a store up into a backup repository and restores it:
+//
+//	kvbackup backup -repo backups [-server https://localhost:8080 [-token t] [-tls-...] | -dir store]
+//	kvbackup list -repo backups
+//	kvbackup restore -repo backups [-id backup3] -dir target [-keyfile keys]
+//	    [-archive store/WALArchive [-wal store/wal.txt] [-to-seq N | -to-time 2024-05-01T12:00:00Z]]
+//
+// Files are stored once in the repository under their checksum, so a backup
+// only copies the SSTs written since the previous one. With -archive, the
+// restore replays the archived WAL on top of the backup, up to the given
+// point or to the end of the archive. Removing the directory of an old backup
+// lets a store started with -wal-archive-repo prune the archive up to the
+// next one. Encrypted files are backed up as they
+// are, and replaying the archive of an encrypted store needs its -keyfile.
+func kvbackupMain(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: kvbackup backup|list|restore [flags]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("kvbackup "+args[0], flag.ContinueOnError)
+	repo := flags.String("repo", "backups", "backup repository")
+	server := flags.String("server", "", "URL of a running store to back up")
+	dir := flags.String("dir", ".", "store directory to back up, or to restore into")
+	id := flags.String("id", "", "backup to restore, the latest by default")
+	archive := flags.String("archive", "", "WAL archive to replay after the backup")
+	liveWAL := flags.String("wal", "", "live WAL of the source store, replayed after the archive")
+	toSeq := flags.Uint64("to-seq", 0, "last sequence number to replay")
+	toTime := flags.String("to-time", "", "replay writes up to this time, RFC 3339")
+	keyfile := flags.String("keyfile", "", "file with the encryption keys of the store, for restores")
+	token := flags.String("token", "", "bearer token for the -server, when it has an ACL")
+	loadTLS := clientTLSFlags(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	apiToken = *token
+	if err := loadTLS(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := useKeyfile(*keyfile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var err error
+	switch args[0] {
+	case "backup":
+		var backup string
+		var copied int
+		backup, copied, err = runBackup(*repo, *server, *dir)
+		if err == nil {
+			fmt.Printf("Created %s, %d new files\n", backup, copied)
+		}
+	case "list":
+		var backups []string
+		backups, err = listBackups(*repo)
+		for _, backup := range backups {
+			manifest, err := readManifest(*repo + "/" + backup + "/MANIFEST")
+			if err != nil {
+				fmt.Printf("%s\tunreadable: %v\n", backup, err)
+				continue
+			}
+			fmt.Printf("%s\tseq %d\t%s\t%d files\n", backup, manifest.Seq, manifest.Created.Format("2006-01-02T15:04:05Z"), len(manifest.Files))
+		}
+	case "restore":
+		if *id == "" {
+			*id, err = latestBackup(*repo)
+		}
+		var stopTime time.Time
+		if err == nil && *toTime != "" {
+			stopTime, err = time.Parse(time.RFC3339, *toTime)
+		}
+		if err == nil && *archive == "" && (*toSeq != 0 || *toTime != "") {
+			err = errors.New("-to-seq and -to-time need -archive")
+		}
+		if err == nil {
+			err = RestoreBackup(*repo, *id, *dir)
+		}
+		if err == nil {
+			fmt.Printf("Restored %s into %s\n", *id, *dir)
+		}
+		if err == nil && *archive != "" {
+			var seq uint64
+			seq, err = RestoreToPoint(*archive, *liveWAL, *dir, *toSeq, stopTime)
+			if err == nil {
+				fmt.Printf("Replayed the WAL archive up to seq %d\n", seq)
+			}
+		}
+	default:
+		err = errors.New("Unknown subcommand: " + args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runBackup takes a checkpoint, through the server if one is given or by
+// opening the store directly otherwise, and adds it to the repository.
+func runBackup(repo, server, dir string) (string, int, error) {
+	if err := os.MkdirAll(repo+"/files", 0755); err != nil {
+		return "", 0, err
+	}
+	checkpoint, err := filepath.Abs(fmt.Sprintf("%s/.checkpoint%d", repo, os.Getpid()))
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.RemoveAll(checkpoint)
+
+	if server != "" {
+		resp, err := tokenClient(apiToken).Post(strings.TrimSuffix(server, "/")+"/admin/checkpoint?dir="+url.QueryEscape(checkpoint), "", nil)
+		if err != nil {
+			return "", 0, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", 0, fmt.Errorf("Checkpoint failed: %s", resp.Status)
+		}
+	} else {
+		if err := checkpointStore(dir, checkpoint); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return BackupCheckpoint(checkpoint, repo)
+}
+
+// checkpointStore opens the store in dir, which must not be running, and
+// checkpoints it.
+func checkpointStore(dir, checkpoint string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+
+	repl, err := NewInMem()
+	if err != nil {
+		return err
+	}
+	db := repl.handler.(*memDB)
+	defer db.wal.file.Close()
+	if err := recoverFromWAL(db); err != nil {
+		return err
+	}
+	_, err = db.Checkpoint(checkpoint)
+	return err
+}
+
+// BackupCheckpoint copies the files of a checkpoint the repository doesn't
+// have yet and records its manifest as a new backup.
+func BackupCheckpoint(checkpoint, repo string) (string, int, error) {
+	manifest, err := readManifest(checkpoint + "/MANIFEST")
+	if err != nil {
+		return "", 0, err
+	}
+
+	copied := 0
+	for _, file := range manifest.Files {
+		object := repo + "/files/" + file.SHA256
+		if _, err := os.Stat(object); err == nil {
+			continue
+		}
+		if err := copyFile(checkpoint+"/"+file.Path, object+".tmp"); err != nil {
+			return "", 0, err
+		}
+		if err := os.Rename(object+".tmp", object); err != nil {
+			return "", 0, err
+		}
+		copied++
+	}
+
+	backups, err := listBackups(repo)
+	if err != nil {
+		return "", 0, err
+	}
+	next := 1
+	if len(backups) > 0 {
+		fmt.Sscanf(backups[len(backups)-1], "backup%d", &next)
+		next++
+	}
+	backup := fmt.Sprintf("backup%d", next)
+	if err := os.Mkdir(repo+"/"+backup, 0755); err != nil {
+		return "", 0, err
+	}
+	if err := writeManifest(repo+"/"+backup+"/MANIFEST", manifest); err != nil {
+		return "", 0, err
+	}
+	return backup, copied, nil
+}
+
+// RestoreBackup writes the files of a backup into dir and checks each one
+// against the checksum recorded when it was backed up.
+func RestoreBackup(repo, backup, dir string) error {
+	manifest, err := readManifest(repo + "/" + backup + "/MANIFEST")
+	if err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return errors.New("Restore directory is not empty")
+	}
+	if err := os.MkdirAll(dir+"/"+sstDir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range manifest.Files {
+		target := dir + "/" + file.Path
+		if err := copyFile(repo+"/files/"+file.SHA256, target); err != nil {
+			return err
+		}
+		sum, size, err := fileSHA256(target)
+		if err != nil {
+			return err
+		}
+		if sum != file.SHA256 || size != file.Size {
+			return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", file.Path, file.SHA256, sum)
+		}
+	}
+
+	return writeManifest(dir+"/MANIFEST", manifest)
+}
+
+func listBackups(repo string) ([]string, error) {
+	entries, err := os.ReadDir(repo)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Old backups may have been removed, the numbers don't have to start at 1
+	var numbers []int
+	for _, entry := range entries {
+		var n int
+		if _, err := fmt.Sscanf(entry.Name(), "backup%d", &n); err == nil && entry.Name() == fmt.Sprintf("backup%d", n) {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	backups := make([]string, 0, len(numbers))
+	for _, n := range numbers {
+		backups = append(backups, fmt.Sprintf("backup%d", n))
+	}
+	return backups, nil
+}
+
+func latestBackup(repo string) (string, error) {
+	backups, err := listBackups(repo)
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", errors.New("No backups in " + repo)
+	}
+	return backups[len(backups)-1], nil
+}
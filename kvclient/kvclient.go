@@ -0,0 +1,440 @@
+// Package kvclient is the Go client of the store's HTTP API. Keys are sent
+// in the path, escaped, or in the query when the server would clean the path
+// up, so any key goes; values go in bodies.
+package kvclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The errors of the engine, with the same messages, for the statuses the
+// server answers them with.
+var (
+	ErrKeyNotFound          = errors.New("Key not found")
+	ErrPreconditionFailed   = errors.New("Precondition failed")
+	ErrColumnFamilyNotFound = errors.New("Column family not found")
+	ErrColumnFamilyDropped  = errors.New("Column family dropped")
+)
+
+// StatusError is any other error status of the server.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+type Options struct {
+	// HTTPClient replaces the client's own, which keeps MaxIdleConns
+	// connections to the server open
+	HTTPClient   *http.Client
+	MaxIdleConns int
+	// MaxRetries is how many times an idempotent call is retried after a
+	// network error or a 502, 503 or 504, waiting Backoff, then twice as
+	// long each time up to MaxBackoff
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Token is sent as a bearer token, to servers with an ACL
+	Token string
+	// TLSConfig is used for https URLs, to trust the server's CA or to
+	// present a client certificate
+	TLSConfig *tls.Config
+}
+
+// Client talks to one server. It is safe for concurrent use.
+type Client struct {
+	base    string
+	http    *http.Client
+	options Options
+	cf      string
+}
+
+// New returns a client of the server at baseURL, like http://localhost:8080.
+// Zero options get defaults.
+func New(baseURL string, options Options) (*Client, error) {
+	base := strings.TrimSuffix(baseURL, "/")
+	if _, err := url.Parse(base); err != nil {
+		return nil, err
+	}
+	if options.MaxIdleConns <= 0 {
+		options.MaxIdleConns = 16
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = 3
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = 50 * time.Millisecond
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = 2 * time.Second
+	}
+	client := options.HTTPClient
+	if client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = options.MaxIdleConns
+		transport.MaxIdleConnsPerHost = options.MaxIdleConns
+		transport.TLSClientConfig = options.TLSConfig
+		client = &http.Client{Transport: transport}
+	}
+	return &Client{base: base, http: client, options: options, cf: "default"}, nil
+}
+
+// Family returns a client of the same server working on another column
+// family. They share their connections.
+func (c *Client) Family(cf string) *Client {
+	family := *c
+	family.cf = cf
+	return &family
+}
+
+// Get returns ErrKeyNotFound if the key isn't there.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	keyPath, query := c.keyPath(key)
+	resp, err := c.do(ctx, http.MethodGet, keyPath, query, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	keyPath, query := c.keyPath(key)
+	resp, err := c.do(ctx, http.MethodPut, keyPath, query, value, true)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// Delete returns the value the key had, or ErrKeyNotFound. It is not
+// retried: a retry of a delete that went through would find nothing.
+func (c *Client) Delete(ctx context.Context, key string) ([]byte, error) {
+	keyPath, query := c.keyPath(key)
+	resp, err := c.do(ctx, http.MethodDelete, keyPath, query, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Batch groups writes applied all or nothing. An empty family is the
+// default one.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	Op    string `json:"op"`
+	CF    string `json:"cf,omitempty"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+func (b *Batch) Set(cf, key string, value []byte) {
+	b.ops = append(b.ops, batchOp{Op: "set", CF: cf, Key: key, Value: value})
+}
+
+func (b *Batch) Delete(cf, key string) {
+	b.ops = append(b.ops, batchOp{Op: "del", CF: cf, Key: key})
+}
+
+// Batch applies b. Deleting a missing key isn't an error in a batch, so it
+// is retried like Set.
+func (c *Client) Batch(ctx context.Context, b *Batch) error {
+	body, err := json.Marshal(struct {
+		Ops []batchOp `json:"ops"`
+	}{b.ops})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/batch", nil, body, true)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// Scan calls fn with the keys from start to end, exclusive, in order, until
+// fn returns an error, which Scan returns. An empty start or end leaves that
+// side open and a limit of 0 is no limit. A scan cut off by the network is
+// resumed after the last key.
+func (c *Client) Scan(ctx context.Context, start, end string, limit int, fn func(key string, value []byte) error) error {
+	var last *string
+	sent := 0
+	for attempt := 0; ; attempt++ {
+		query := url.Values{"cf": {c.cf}, "start": {start}, "end": {end}}
+		if last != nil {
+			// Right after the last key
+			query.Set("start", *last+"\x00")
+		}
+		if limit > 0 {
+			if sent >= limit {
+				return nil
+			}
+			query.Set("limit", strconv.Itoa(limit-sent))
+		}
+		resp, err := c.do(ctx, http.MethodGet, "/scan", query, nil, true)
+		if err != nil {
+			return err
+		}
+
+		broken, err := readScan(resp.Body, func(key string, value []byte) error {
+			last = &key
+			sent++
+			return fn(key, value)
+		})
+		resp.Body.Close()
+		if err == nil || !broken {
+			return err
+		}
+		// Cut off by the network, resumed if there is a retry left
+		if ctx.Err() != nil || attempt >= c.options.MaxRetries {
+			return err
+		}
+		if err := c.wait(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// readScan reads the JSONL of /scan. It reports whether an error is a read
+// error, which can be retried, rather than one of fn or of the server.
+func readScan(body io.Reader, fn func(key string, value []byte) error) (bool, error) {
+	r := bufio.NewReader(body)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return false, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		var rec struct {
+			Key   *string `json:"key"`
+			Value string  `json:"value"`
+			Error string  `json:"error"`
+		}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return false, err
+		}
+		if rec.Key == nil {
+			return false, errors.New(rec.Error)
+		}
+		value, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return false, err
+		}
+		if err := fn(*rec.Key, value); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Event is a write seen by Watch. Type is put, delete or merge.
+type Event struct {
+	Type     string `json:"type"`
+	CF       string `json:"cf"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Operator string `json:"operator"`
+	Seq      uint64 `json:"seq"`
+}
+
+// Watch calls fn with the writes to keys starting with prefix, after the
+// one numbered since if it isn't 0, until ctx is done or fn returns an
+// error, which Watch returns. When the stream breaks, or the server drops a
+// watch that fell behind, it reconnects from the last event seen.
+func (c *Client) Watch(ctx context.Context, prefix string, since uint64, fn func(Event) error) error {
+	for attempt := 0; ; attempt++ {
+		query := url.Values{"cf": {c.cf}, "prefix": {prefix}}
+		if since > 0 {
+			query.Set("since", strconv.FormatUint(since, 10))
+		}
+		resp, err := c.do(ctx, http.MethodGet, "/watch", query, nil, true)
+		if err != nil {
+			return err
+		}
+
+		received := false
+		err = readEvents(resp.Body, func(ev Event) error {
+			since = ev.Seq
+			if ev.Type == "overflow" {
+				return nil
+			}
+			received = true
+			return fn(ev)
+		})
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			if _, ok := err.(readError); !ok {
+				return err
+			}
+		}
+		if received {
+			attempt = 0
+		}
+		if attempt >= c.options.MaxRetries {
+			return errors.New("Watch stream closed")
+		}
+		if err := c.wait(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// readError is a broken stream, as opposed to an error of fn.
+type readError struct {
+	error
+}
+
+// readEvents reads Server-Sent Events until the stream ends.
+func readEvents(body io.Reader, fn func(Event) error) error {
+	r := bufio.NewReader(body)
+	var data []byte
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return err
+			}
+			return readError{err}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		case line == "" && len(data) > 0:
+			var ev Event
+			if err := json.Unmarshal(data, &ev); err != nil {
+				return err
+			}
+			data = nil
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// keyPath returns the path and query of key. The server's mux redirects
+// paths with ".", ".." or empty segments to their cleaned form, even
+// escaped, so those keys go in the query instead.
+func (c *Client) keyPath(key string) (string, url.Values) {
+	prefix := "/cf/" + url.PathEscape(c.cf) + "/kv/"
+	cleaned := path.Clean(prefix + key)
+	if strings.HasSuffix(key, "/") {
+		cleaned += "/"
+	}
+	if key == "" || cleaned != prefix+key {
+		return prefix, url.Values{"key": {key}}
+	}
+	return prefix + url.PathEscape(key), nil
+}
+
+// do sends a request, retrying it when idempotent, and turns error statuses
+// into errors. The caller closes the body of the response.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, idempotent bool) (*http.Response, error) {
+	// path is already escaped
+	target := c.base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if c.options.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.options.Token)
+		}
+		resp, err := c.http.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		retry := false
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			retry = true
+		} else {
+			message, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			err = statusError(resp.StatusCode, strings.TrimSpace(string(message)))
+			switch resp.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				retry = true
+			}
+		}
+		if !retry || !idempotent || attempt >= c.options.MaxRetries {
+			return nil, err
+		}
+		if err := c.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// statusError maps an error status to the engine's error, when it is one.
+func statusError(code int, message string) error {
+	switch {
+	case code == http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case message == ErrKeyNotFound.Error():
+		return ErrKeyNotFound
+	case message == ErrColumnFamilyNotFound.Error():
+		return ErrColumnFamilyNotFound
+	case message == ErrColumnFamilyDropped.Error():
+		return ErrColumnFamilyDropped
+	}
+	return &StatusError{Code: code, Message: message}
+}
+
+// wait sleeps before a retry, Backoff doubled attempt times.
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	delay := c.options.Backoff
+	for i := 0; i < attempt && delay < c.options.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.options.MaxBackoff {
+		delay = c.options.MaxBackoff
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func drain(resp *http.Response) error {
+	defer resp.Body.Close()
+	_, err := io.Copy(io.Discard, resp.Body)
+	return err
+}
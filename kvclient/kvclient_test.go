@@ -0,0 +1,21 @@
+package kvclient
+
+import "testing"
+
+func TestKeyPath(t *testing.T) {
+	client, err := New("http://localhost", Options{})
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+
+	// The keys the mux would clean go in the query, the others in the path
+	for key, expected := range map[string]string{"a/b": "/cf/default/kv/a%2Fb", ".hidden": "/cf/default/kv/.hidden", "..": "/cf/default/kv/?key=.."} {
+		target, query := client.keyPath(key)
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+		if target != expected {
+			t.Fatalf("Expected %q to go to %s, got %s", key, expected, target)
+		}
+	}
+}
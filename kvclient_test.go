@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"PersistentKVstoreGo/kvclient"
+)
+
+func TestKVClient(t *testing.T) {
+	useTempDir(t)
+	db := openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	mem = db
+	if _, err := db.CreateColumnFamily("users", CFOptions{}); err != nil {
+		t.Fatalf("Error creating family: %v", err)
+	}
+
+	// The real routes, behind a switch making the next requests fail
+	var failures int64
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&failures, -1) >= 0 {
+			http.Error(w, "Try again", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client, err := kvclient.New(server.URL, kvclient.Options{Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	ctx := context.Background()
+
+	// Keys that need escaping
+	for _, key := range []string{"plain", "a b/c?d&e=%f#g", "ünï"} {
+		if err := client.Set(ctx, key, []byte("v "+key)); err != nil {
+			t.Fatalf("Error setting %q: %v", key, err)
+		}
+		if v, err := client.Get(ctx, key); err != nil || string(v) != "v "+key {
+			t.Fatalf("Expected %q, got %q (%v)", "v "+key, v, err)
+		}
+	}
+	if v, err := db.Get([]byte("a b/c?d&e=%f#g")); err != nil || string(v) != "v a b/c?d&e=%f#g" {
+		t.Fatalf("Expected the key to be stored as is, got %q (%v)", v, err)
+	}
+	if v, err := client.Delete(ctx, "plain"); err != nil || string(v) != "v plain" {
+		t.Fatalf("Expected the deleted value, got %q (%v)", v, err)
+	}
+
+	// Typed errors
+	if _, err := client.Get(ctx, "plain"); err != kvclient.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := client.Delete(ctx, "plain"); err != kvclient.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound deleting again, got %v", err)
+	}
+	if _, err := client.Family("missing").Get(ctx, "a"); err != kvclient.ErrColumnFamilyNotFound {
+		t.Fatalf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+	if err := client.Set(ctx, "", []byte("x")); err == nil {
+		t.Fatalf("Expected an error setting an empty key")
+	} else if statusErr, ok := err.(*kvclient.StatusError); !ok || statusErr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a 400 StatusError, got %v", err)
+	}
+
+	// A batch across two families
+	b := &kvclient.Batch{}
+	for i := 0; i < 20; i++ {
+		b.Set("", fmt.Sprintf("k%02d", i), []byte{byte(i), 0, 255})
+	}
+	b.Set("users", "u1", []byte("ann"))
+	b.Delete("", "ünï")
+	if err := client.Batch(ctx, b); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	if v, err := client.Family("users").Get(ctx, "u1"); err != nil || string(v) != "ann" {
+		t.Fatalf("Expected ann, got %q (%v)", v, err)
+	}
+	if _, err := client.Get(ctx, "ünï"); err != kvclient.ErrKeyNotFound {
+		t.Fatalf("Expected the batch to delete ünï, got %v", err)
+	}
+
+	// Scan
+	var keys []string
+	err = client.Scan(ctx, "k05", "k10", 0, func(key string, value []byte) error {
+		if len(value) != 3 || value[2] != 255 {
+			return fmt.Errorf("unexpected value %v", value)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[k05 k06 k07 k08 k09]" {
+		t.Fatalf("Unexpected scan: %v (%v)", keys, err)
+	}
+	count := 0
+	client.Scan(ctx, "", "", 3, func(string, []byte) error { count++; return nil })
+	if count != 3 {
+		t.Fatalf("Expected the limit to stop the scan at 3, got %d", count)
+	}
+
+	// Retries: idempotent calls go through failures, deletes don't
+	atomic.StoreInt64(&failures, 2)
+	if v, err := client.Get(ctx, "k01"); err != nil || v[0] != 1 {
+		t.Fatalf("Expected the get to be retried, got %v (%v)", v, err)
+	}
+	atomic.StoreInt64(&failures, 1)
+	if _, err := client.Delete(ctx, "k01"); err == nil {
+		t.Fatalf("Expected the delete not to be retried")
+	} else if statusErr, ok := err.(*kvclient.StatusError); !ok || statusErr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a 503 StatusError, got %v", err)
+	}
+	atomic.StoreInt64(&failures, 10)
+	if _, err := client.Get(ctx, "k01"); err == nil {
+		t.Fatalf("Expected the get to give up after its retries")
+	}
+	atomic.StoreInt64(&failures, 0)
+
+	// Contexts
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.Get(cancelled, "k01"); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// Watch, until the context is cancelled
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	events := make(chan kvclient.Event, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Watch(watchCtx, "w", 0, func(ev kvclient.Event) error {
+			select {
+			case events <- ev:
+			default:
+			}
+			return nil
+		})
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	var ev kvclient.Event
+	for ev.Key == "" {
+		client.Set(ctx, "w1", []byte("watched"))
+		select {
+		case ev = <-events:
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("No event from the watch")
+			}
+		}
+	}
+	if ev.Type != "put" || ev.Key != "w1" || ev.Value != "watched" || ev.Seq == 0 {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	cancelWatch()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// Watch resumed from a sequence number
+	seq := ev.Seq
+	client.Set(ctx, "w2", []byte("later"))
+	errStop := fmt.Errorf("stop")
+	var resumed []kvclient.Event
+	err = client.Watch(ctx, "w", seq, func(ev kvclient.Event) error {
+		resumed = append(resumed, ev)
+		if ev.Key == "w2" {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || resumed[0].Seq <= seq {
+		t.Fatalf("Unexpected resumed watch: %+v (%v)", resumed, err)
+	}
+}
+
+func TestKVClientDotSegments(t *testing.T) {
+	useTempDir(t)
+	db := openTestStore(t)
+	defer func() { db.wal.file.Close() }()
+	mem = db
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Redirects would be followed to another key, they fail the test instead
+	httpClient := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return fmt.Errorf("redirected to %s", req.URL.Path)
+	}}
+	client, err := kvclient.New(server.URL, kvclient.Options{HTTPClient: httpClient})
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	ctx := context.Background()
+
+	keys := []string{".", "..", "./a", "a/..", "a/./b", "../x", "/lead", "a//b", "trail/", "a/.", "...", ".hidden"}
+	for _, key := range keys {
+		if err := client.Set(ctx, key, []byte("v"+key)); err != nil {
+			t.Fatalf("Error setting %q: %v", key, err)
+		}
+		if v, err := client.Get(ctx, key); err != nil || string(v) != "v"+key {
+			t.Fatalf("Expected %q, got %q (%v)", "v"+key, v, err)
+		}
+	}
+	for _, key := range keys {
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != "v"+key {
+			t.Fatalf("Expected %q stored as it is, got %q (%v)", key, v, err)
+		}
+	}
+	for _, key := range keys {
+		if v, err := client.Delete(ctx, key); err != nil || string(v) != "v"+key {
+			t.Fatalf("Expected to delete %q, got %q (%v)", key, v, err)
+		}
+	}
+
+}
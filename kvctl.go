@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elliotchance/orderedmap"
+)
+
+// kvctlMain inspects the files of a store without opening it:
+//
+//	kvctl sst dump [-json] SSTFiles/sst3.txt
+//	kvctl wal dump [-json] [wal.txt]
+//	kvctl manifest show [-json] [MANIFEST]
+//	kvctl get [-json] [-dir store] [-cf name] key [--trace]
+//	kvctl verify [-json] [-dir store]
+//	kvctl repair [-json] [-dir store]
+//	kvctl export [-dir store] [-cf name] [-format jsonl|csv] [file]
+//	kvctl import [-dir store] [-cf name] [-format jsonl|csv] [file]
+//	kvctl promote [-json] [-server url] [-token t] [-tls-ca ca] [-tls-cert cert -tls-key key]
+//	kvctl raft status|add|remove [-json] [-server url] [-token t] [-tls-...] [id] [addr]
+//	kvctl keygen id >> keyfile
+//	kvctl rotate-key [-json] [-dir store] -keyfile keyfile
+//	kvctl audit verify [-json] [-key key] [-principal name] [audit.log]
+//
+// export and import open the store, which must not be running; use
+// POST /import to import into a running one. promote and raft talk to a
+// running server: promote makes a replica a primary, raft changes the
+// members of a Raft cluster through its leader. An encrypted store is read
+// with -keyfile; rotate-key rewrites its files offline under the last key
+// of the keyfile, after keygen added one. audit verify checks the hash chain
+// of an audit log and shows its entries for a key or a principal.
+// Everything is read with the same code the engine reads its files with.
+func kvctlMain(args []string) int {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+		args = args[1:]
+	}
+	if (command == "sst" || command == "wal" || command == "manifest" || command == "raft" || command == "audit") && len(args) > 0 {
+		command += " " + args[0]
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("kvctl "+command, flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	dir := flags.String("dir", ".", "directory of the store")
+	cf := flags.String("cf", "", "column family of the key")
+	trace := flags.Bool("trace", false, "show which memtable or SST answered")
+	format := flags.String("format", FormatJSONL, "format of export and import, jsonl or csv")
+	server := flags.String("server", "http://localhost:8080", "server to promote")
+	keyfile := flags.String("keyfile", "", "file with the encryption keys of the store")
+	token := flags.String("token", "", "bearer token for the -server, when it has an ACL")
+	loadTLS := clientTLSFlags(flags)
+	auditKey := flags.String("key", "", "show the audit entries of this key only")
+	auditPrincipal := flags.String("principal", "", "show the audit entries of this principal only")
+	// Flags may come after the arguments too, as in get key --trace
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	apiToken = *token
+	if err := loadTLS(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var result interface{}
+	var err, failure error
+	if err := useKeyfile(*keyfile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch command {
+	case "sst dump":
+		if len(positional) != 1 {
+			err = errors.New("Usage: kvctl sst dump <file>")
+			break
+		}
+		result, err = dumpSST(positional[0])
+	case "wal dump":
+		result, err = dumpWAL(argOr(positional, "wal.txt"))
+	case "manifest show":
+		result, err = readManifest(argOr(positional, "MANIFEST"))
+	case "get":
+		if len(positional) != 1 {
+			err = errors.New("Usage: kvctl get <key> [--trace]")
+			break
+		}
+		var t *getTrace
+		t, err = traceGet(*dir, *cf, []byte(positional[0]))
+		if !*trace && err == nil {
+			if !t.Found {
+				err = errors.New(t.Error)
+			}
+			result = t.Value
+		} else {
+			result = t
+		}
+	case "verify", "repair":
+		if err = os.Chdir(*dir); err != nil {
+			break
+		}
+		if command == "repair" {
+			result, err = RepairStore()
+			break
+		}
+		var found []Corruption
+		found, err = VerifyStore()
+		result = append([]Corruption{}, found...)
+		if err == nil && len(found) > 0 {
+			// Printed before failing
+			failure = ErrCorruption
+		}
+	case "export", "import":
+		var count int
+		count, err = transfer(command, *dir, *cf, *format, argOr(positional, "-"))
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "%s: %d keys\n", command, count)
+			return 0
+		}
+	case "promote":
+		result, err = promote(*server)
+	case "raft status", "raft add", "raft remove":
+		result, err = raftAdmin(*server, strings.TrimPrefix(command, "raft "), positional)
+	case "keygen":
+		if len(positional) != 1 {
+			err = errors.New("Usage: kvctl keygen <id>")
+			break
+		}
+		result, err = newKeyfileLine(positional[0])
+	case "rotate-key":
+		if err = os.Chdir(*dir); err != nil {
+			break
+		}
+		result, err = RotateStoreKey()
+	case "audit verify":
+		var report *AuditReport
+		report, err = VerifyAuditLog(argOr(positional, "audit.log"), func(e AuditEntry) bool {
+			return (*auditKey == "" || e.Key == *auditKey) && (*auditPrincipal == "" || e.Principal == *auditPrincipal)
+		})
+		result = report
+		if err == nil && report.Broken != "" {
+			// Printed before failing
+			failure = fmt.Errorf("%w: %s", ErrAuditTampered, report.Broken)
+		}
+	default:
+		err = errors.New("Usage: kvctl sst dump|wal dump|manifest show|get|verify|repair|export|import|promote|raft|keygen|rotate-key|audit verify [flags]")
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+	} else {
+		err = printText(out, result)
+	}
+	if err == nil {
+		err = failure
+	}
+	if err != nil {
+		out.Flush()
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// transfer runs kvctl export or import on the store in dir, to or from
+// path, "-" being stdout or stdin.
+func transfer(command, dir, cf, format, path string) (int, error) {
+	stdin, stdout := io.Reader(os.Stdin), io.Writer(os.Stdout)
+	if path != "-" {
+		var file *os.File
+		var err error
+		if command == "export" {
+			file, err = os.Create(path)
+		} else {
+			file, err = os.Open(path)
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		stdin, stdout = file, file
+	}
+
+	// The store prints what it does, keep that out of the data
+	realStdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = realStdout }()
+
+	if err := os.Chdir(dir); err != nil {
+		return 0, err
+	}
+	repl, err := NewInMem()
+	if err != nil {
+		return 0, err
+	}
+	db := repl.handler.(*memDB)
+	defer db.wal.file.Close()
+	if err := recoverFromWAL(db); err != nil {
+		return 0, err
+	}
+	family, err := db.Family(cf)
+	if err != nil {
+		return 0, err
+	}
+
+	if command == "export" {
+		return family.Export(stdout, format)
+	}
+	return family.Import(stdin, format)
+}
+
+func argOr(positional []string, def string) string {
+	if len(positional) > 0 {
+		return positional[0]
+	}
+	return def
+}
+
+type sstDump struct {
+	File       string         `json:"file"`
+	Count      uint32         `json:"count"`
+	Smallest   string         `json:"smallest"`
+	Biggest    string         `json:"biggest"`
+	Tombstones int            `json:"tombstones"`
+	Entries    []sstDumpEntry `json:"entries"`
+}
+
+type sstDumpEntry struct {
+	Op       string   `json:"op"`
+	Key      string   `json:"key"`
+	Value    string   `json:"value,omitempty"`
+	Operands []string `json:"operands,omitempty"`
+}
+
+func dumpSST(name string) (*sstDump, error) {
+	file, reader, err := openSST(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, err := readSSTHeader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the header of %s: %v", name, err)
+	}
+	dump := &sstDump{File: name, Count: header.count, Smallest: string(header.smallest), Biggest: string(header.biggest)}
+	for i := 0; i < int(header.count); i++ {
+		e, err := readSSTEntry(reader)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading entry %d of %s: %v", i, name, err)
+		}
+		entry := sstDumpEntry{Op: sstOpName(e.op), Key: string(e.key)}
+		switch e.op {
+		case byte(del):
+			dump.Tombstones++
+		case byte(merge):
+			if entry.Operands, err = describeOperands(e.value); err != nil {
+				return nil, err
+			}
+		default:
+			entry.Value = string(e.value)
+		}
+		dump.Entries = append(dump.Entries, entry)
+	}
+	return dump, nil
+}
+
+func describeOperands(value []byte) ([]string, error) {
+	operands, err := decodeOperands(value)
+	if err != nil {
+		return nil, err
+	}
+	var described []string
+	for _, operand := range operands {
+		name, operand, err := decodeOperand(operand)
+		if err != nil {
+			return nil, err
+		}
+		described = append(described, name+":"+string(operand))
+	}
+	return described, nil
+}
+
+type walDump struct {
+	File      string          `json:"file"`
+	Watermark int64           `json:"watermark"`
+	Base      uint64          `json:"base"`
+	Records   []walDumpRecord `json:"records"`
+	Torn      bool            `json:"torn,omitempty"`
+}
+
+type walDumpRecord struct {
+	Offset  int64           `json:"offset,omitempty"`
+	Seq     uint64          `json:"seq"`
+	Time    *time.Time      `json:"time,omitempty"`
+	Op      string          `json:"op"`
+	CF      string          `json:"cf,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Value   string          `json:"value,omitempty"`
+	Flushed bool            `json:"flushed,omitempty"`
+	Batch   []walDumpRecord `json:"batch,omitempty"`
+}
+
+func walOpName(op byte) string {
+	switch Cmd(op) {
+	case Set:
+		return "set"
+	case Del:
+		return "del"
+	case Merge:
+		return "merge"
+	case Batch:
+		return "batch"
+	case Ingest:
+		return "ingest"
+	case CreateCF:
+		return "create_cf"
+	case DropCF:
+		return "drop_cf"
+	default:
+		return fmt.Sprintf("unknown(%d)", op)
+	}
+}
+
+func describeWALRecord(rec walRecord) (walDumpRecord, error) {
+	cf, op, key := splitWALKey(rec.op, rec.key)
+	d := walDumpRecord{Seq: rec.seq, Op: walOpName(op), CF: cf, Key: string(key), Value: string(rec.value)}
+	switch Cmd(op) {
+	case Merge:
+		name, operand, err := decodeOperand(rec.value)
+		if err != nil {
+			return d, err
+		}
+		d.Value = name + ":" + string(operand)
+	case Batch:
+		d.Value = ""
+		records, err := rec.batchRecords()
+		if err != nil {
+			return d, err
+		}
+		for _, sub := range records {
+			described, err := describeWALRecord(sub)
+			if err != nil {
+				return d, err
+			}
+			d.Batch = append(d.Batch, described)
+		}
+	}
+	return d, nil
+}
+
+func dumpWAL(name string) (*walDump, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	watermark, base, err := readWALHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the header of %s: %v", name, err)
+	}
+	if _, err := file.Seek(walHeaderSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	dump := &walDump{File: name, Watermark: watermark, Base: base}
+
+	reader := bufio.NewReader(file)
+	offset := int64(walHeaderSize)
+	for {
+		rec, err := readWALRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			dump.Torn = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		d, err := describeWALRecord(rec)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding record at offset %d: %v", offset, err)
+		}
+		written := time.Unix(0, rec.time).UTC()
+		d.Offset, d.Time, d.Flushed = offset, &written, offset < watermark
+		dump.Records = append(dump.Records, d)
+		offset += rec.size()
+	}
+	return dump, nil
+}
+
+// getTrace is how kvctl get found a key: the memtable entry rebuilt from the
+// unflushed part of the WAL, then the SSTs looked at, newest first.
+type getTrace struct {
+	CF       string         `json:"cf,omitempty"`
+	Key      string         `json:"key"`
+	Memtable *memtableTrace `json:"memtable,omitempty"`
+	SSTs     []sstLookup    `json:"ssts,omitempty"`
+	Found    bool           `json:"found"`
+	Value    string         `json:"value,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+type memtableTrace struct {
+	Op       string   `json:"op"`
+	Seqs     []uint64 `json:"seqs"`
+	Operands []string `json:"operands,omitempty"`
+}
+
+func traceGet(dir, cf string, key []byte) (*getTrace, error) {
+	if cf == "default" {
+		cf = ""
+	}
+	familyDir := dir + "/" + sstDir
+	if cf != "" {
+		familyDir += "/" + cf
+	}
+	if _, err := os.Stat(familyDir); err != nil {
+		return nil, ErrColumnFamilyNotFound
+	}
+
+	// Rebuild the key's memtable entry the way recovery would
+	scratch := &memDB{values: orderedmap.NewOrderedMap()}
+	memtable := &memtableTrace{}
+	file, err := os.Open(dir + "/wal.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	watermark, _, err := readWALHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(walHeaderSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	for offset := int64(walHeaderSize); ; {
+		rec, err := readWALRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if offset >= watermark {
+			records, err := rec.batchRecords()
+			if err != nil {
+				return nil, err
+			}
+			for _, sub := range records {
+				name, op, k := splitWALKey(sub.op, sub.key)
+				if name != cf || !isEqual(k, key) {
+					continue
+				}
+				switch Cmd(op) {
+				case Set:
+					scratch.SetMap(k, sub.value)
+				case Del:
+					scratch.DelMap(k)
+				case Merge:
+					scratch.MergeMap(k, sub.value)
+				}
+				memtable.Seqs = append(memtable.Seqs, sub.seq)
+			}
+		}
+		offset += rec.size()
+	}
+
+	t := &getTrace{CF: cf, Key: string(key)}
+	var value []byte
+	v, inMemtable := scratch.values.Get(string(key))
+	if inMemtable {
+		e := v.(entry)
+		memtable.Op = []string{"set", "del", "merge"}[e.op]
+		for _, operand := range e.operands {
+			name, operand, err := decodeOperand(operand)
+			if err != nil {
+				return nil, err
+			}
+			memtable.Operands = append(memtable.Operands, name+":"+string(operand))
+		}
+		t.Memtable = memtable
+	}
+
+	if inMemtable && v.(entry).op != merge {
+		value, err = v.(entry).resolve(familyDir, key)
+	} else {
+		value, err = getFromSST(context.Background(), familyDir, key, func(lookup sstLookup) {
+			lookup.File = strings.TrimPrefix(lookup.File, dir+"/")
+			t.SSTs = append(t.SSTs, lookup)
+		})
+		if inMemtable {
+			value, err = foldOperands(value, err == nil, v.(entry).operands)
+		}
+	}
+	if err != nil {
+		t.Error = err.Error()
+	} else {
+		t.Found, t.Value = true, string(value)
+	}
+	return t, nil
+}
+
+func printText(out io.Writer, result interface{}) error {
+	switch r := result.(type) {
+	case string:
+		fmt.Fprintln(out, r)
+	case *sstDump:
+		fmt.Fprintf(out, "%s: %d entries, %d tombstones, keys %s to %s\n", r.File, r.Count, r.Tombstones, strconv.Quote(r.Smallest), strconv.Quote(r.Biggest))
+		for _, e := range r.Entries {
+			switch {
+			case e.Op == "del":
+				fmt.Fprintf(out, "%-6s %s\n", e.Op, strconv.Quote(e.Key))
+			case e.Operands != nil:
+				fmt.Fprintf(out, "%-6s %s %s\n", e.Op, strconv.Quote(e.Key), strings.Join(e.Operands, " "))
+			default:
+				fmt.Fprintf(out, "%-6s %s = %s\n", e.Op, strconv.Quote(e.Key), strconv.Quote(e.Value))
+			}
+		}
+	case *walDump:
+		fmt.Fprintf(out, "%s: watermark %d, base seq %d, %d records\n", r.File, r.Watermark, r.Base, len(r.Records))
+		for _, rec := range r.Records {
+			printWALRecord(out, rec, "")
+		}
+		if r.Torn {
+			fmt.Fprintln(out, "torn record at the end")
+		}
+	case *RaftStatus:
+		fmt.Fprintf(out, "%s: %s in term %d, leader %s, commit %d, applied %d\n", r.ID, r.State, r.Term, r.Leader, r.Commit, r.Applied)
+		var ids []string
+		for id := range r.Members {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			fmt.Fprintf(out, "%s\t%s\n", id, r.Members[id])
+		}
+	case *AuditReport:
+		for _, e := range r.Matched {
+			key := strconv.Quote(e.Key)
+			if e.CF != "" {
+				key = e.CF + "/" + key
+			}
+			fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Seq, e.Time.Format(time.RFC3339Nano), e.Principal, e.Addr, e.Op, key, e.ValueHash)
+		}
+		fmt.Fprintf(out, "%s: %d entries, head %s\n", r.File, r.Entries, r.Head)
+		if r.Broken != "" {
+			fmt.Fprintln(out, "chain broken:", r.Broken)
+		}
+	case *RotationReport:
+		fmt.Fprintf(out, "rewrote %d SSTs and %d WAL files under key %s\n", r.SSTs, len(r.WALs), r.Key)
+	case *ReplicaStatus:
+		fmt.Fprintf(out, "%s at seq %d\n", r.Role, r.AppliedSeq)
+	case *Manifest:
+		fmt.Fprintf(out, "seq %d, created %s\n", r.Seq, r.Created.Format(time.RFC3339))
+		for _, file := range r.Files {
+			fmt.Fprintf(out, "%s\t%d\t%s\n", file.SHA256, file.Size, file.Path)
+		}
+	case []Corruption:
+		if len(r) == 0 {
+			fmt.Fprintln(out, "No corruption found")
+		}
+		for _, c := range r {
+			fmt.Fprintln(out, c)
+		}
+	case *RepairReport:
+		for _, salvaged := range r.Salvaged {
+			fmt.Fprintln(out, "salvaged", salvaged)
+		}
+		for _, path := range r.Quarantined {
+			fmt.Fprintf(out, "quarantined %s in %s\n", path, quarantineDir)
+		}
+		if r.Truncated != "" {
+			fmt.Fprintln(out, "truncated", r.Truncated)
+		}
+		fmt.Fprintf(out, "rebuilt MANIFEST: seq %d, %d files\n", r.Manifest.Seq, len(r.Manifest.Files))
+	case *getTrace:
+		if r.Memtable != nil {
+			fmt.Fprintf(out, "memtable: %s, seqs %v", r.Memtable.Op, r.Memtable.Seqs)
+			if len(r.Memtable.Operands) > 0 {
+				fmt.Fprintf(out, ", operands %s", strings.Join(r.Memtable.Operands, " "))
+			}
+			fmt.Fprintln(out)
+		} else {
+			fmt.Fprintln(out, "memtable: not found")
+		}
+		for _, lookup := range r.SSTs {
+			if lookup.Found {
+				fmt.Fprintf(out, "%s: %s\n", lookup.File, lookup.Op)
+			} else {
+				fmt.Fprintf(out, "%s: not found\n", lookup.File)
+			}
+		}
+		if r.Found {
+			fmt.Fprintf(out, "value: %s\n", strconv.Quote(r.Value))
+		} else {
+			fmt.Fprintf(out, "error: %s\n", r.Error)
+		}
+	default:
+		return fmt.Errorf("Cannot print %T", result)
+	}
+	return nil
+}
+
+func printWALRecord(out io.Writer, rec walDumpRecord, indent string) {
+	prefix := fmt.Sprintf("%s%8d seq %-6d", indent, rec.Offset, rec.Seq)
+	if indent != "" {
+		prefix = fmt.Sprintf("%s         seq %-6d", indent, rec.Seq)
+	}
+	if rec.Time != nil {
+		prefix += " " + rec.Time.Format(time.RFC3339Nano)
+	}
+	key := strconv.Quote(rec.Key)
+	if rec.CF != "" {
+		key = rec.CF + ":" + key
+	}
+	flushed := ""
+	if rec.Flushed {
+		flushed = " (flushed)"
+	}
+	switch rec.Op {
+	case "batch":
+		fmt.Fprintf(out, "%s batch of %d%s\n", prefix, len(rec.Batch), flushed)
+		for _, sub := range rec.Batch {
+			printWALRecord(out, sub, indent+"  ")
+		}
+	case "del":
+		fmt.Fprintf(out, "%s %-5s %s%s\n", prefix, rec.Op, key, flushed)
+	default:
+		fmt.Fprintf(out, "%s %-5s %s = %s%s\n", prefix, rec.Op, key, strconv.Quote(rec.Value), flushed)
+	}
+}
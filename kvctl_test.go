@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestKvctlInspection(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	db := repl.handler.(*memDB)
+
+	// a, b and c end up in sst1, the rest only in the WAL
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+	db.Set([]byte("c"), []byte("3"))
+	db.Incr([]byte("a"), 5)
+	db.Del([]byte("b"))
+
+	dump, err := dumpSST(sstDir + "/sst1.txt")
+	if err != nil {
+		t.Fatalf("Error dumping SST: %v", err)
+	}
+	if dump.Count != 3 || dump.Smallest != "a" || dump.Biggest != "c" || dump.Entries[1].Value != "2" {
+		t.Fatalf("Unexpected SST dump: %+v", dump)
+	}
+
+	wal, err := dumpWAL("wal.txt")
+	if err != nil {
+		t.Fatalf("Error dumping WAL: %v", err)
+	}
+	if wal.Base != 3 || len(wal.Records) != 2 || wal.Records[0].Op != "merge" || wal.Records[0].Value != "add:5" || wal.Records[1].Op != "del" {
+		t.Fatalf("Unexpected WAL dump: %+v", wal)
+	}
+
+	// a is folded from the memtable operand onto the SST value
+	trace, err := traceGet(".", "", []byte("a"))
+	if err != nil {
+		t.Fatalf("Error tracing get: %v", err)
+	}
+	if !trace.Found || trace.Value != "6" || trace.Memtable.Op != "merge" || len(trace.SSTs) != 1 || trace.SSTs[0].Op != "set" {
+		t.Fatalf("Unexpected trace for a: %+v", trace)
+	}
+
+	// b is answered by the tombstone in the memtable, no SST is read
+	trace, err = traceGet(".", "", []byte("b"))
+	if err != nil {
+		t.Fatalf("Error tracing get: %v", err)
+	}
+	if trace.Found || trace.Memtable.Op != "del" || len(trace.SSTs) != 0 {
+		t.Fatalf("Unexpected trace for b: %+v", trace)
+	}
+
+	trace, _ = traceGet(".", "", []byte("c"))
+	if !trace.Found || trace.Memtable != nil || trace.SSTs[0].File != sstDir+"/sst1.txt" {
+		t.Fatalf("Unexpected trace for c: %+v", trace)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// kvrouterMain runs a router in front of store nodes, which splits the keys
+// between them on a consistent-hash ring:
+//
+//	kvrouter -nodes a=http://h1:8080,b=http://h2:8080 [-port 8000] [-vnodes 64] [-state router.json] [-token t]
+//	    [-tls-cert cert -tls-key key [-tls-client-ca ca]] [-tls-ca ca]
+//
+// A node is added with POST /admin/nodes?name=c&addr=http://h3:8080, which
+// moves its keys to it in the background. GET /admin/nodes shows the nodes
+// and the progress. With -state, the nodes added are kept across restarts
+// and -nodes is only read the first time.
+func kvrouterMain(args []string) int {
+	flags := flag.NewFlagSet("kvrouter", flag.ContinueOnError)
+	nodes := flags.String("nodes", "", "store nodes, like a=http://h1:8080,b=http://h2:8080")
+	port := flags.Int("port", 8000, "port to serve on")
+	vnodes := flags.Int("vnodes", 64, "points of each node on the ring")
+	state := flags.String("state", "", "file to keep the nodes in")
+	token := flags.String("token", "", "bearer token of the router on the nodes, when they have an ACL")
+	loadTLS := serverTLSFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	serverTLS, err := loadTLS()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	members, err := parsePeers(*nodes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	router, err := NewRouter(RouterOptions{Nodes: members, VNodes: *vnodes, StateFile: *state, Token: *token})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer router.Close()
+
+	l, err := listen(fmt.Sprintf(":%d", *port), serverTLS)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Routing over %d nodes on :%d\n", len(router.Status().Nodes), *port)
+	if err := http.Serve(l, router); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// kvtailMain streams the WAL of the store in the current directory as JSON
+// lines, one per write:
+//
+//	kvtail [-dir store] [-since seq | -offset bytes] [-consumer name] [-follow=false] [-keyfile keys]
+//
+// With -consumer, it starts after the consumer's checkpoint and commits a
+// new one after every line, which keeps the WAL segments it still needs.
+func kvtailMain(args []string) int {
+	flags := flag.NewFlagSet("kvtail", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "directory of the store")
+	since := flags.Uint64("since", 0, "start after this sequence number")
+	offset := flags.Int64("offset", 0, "start at this byte offset of the live WAL")
+	consumer := flags.String("consumer", "", "name to keep a checkpoint under")
+	follow := flags.Bool("follow", true, "wait for new records at the end of the WAL")
+	poll := flags.Duration("poll", 100*time.Millisecond, "how often to look for new records")
+	keyfile := flags.String("keyfile", "", "file with the encryption keys of the store")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := useKeyfile(*keyfile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := os.Chdir(*dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *consumer != "" {
+		if seq, ok := WALCheckpoint(*consumer); ok && *since == 0 {
+			*since = seq
+		} else if !ok {
+			// Register right away so the segments from here on are kept
+			if err := CommitWALCheckpoint(*consumer, *since); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+	}
+
+	tailer := NewWALTailer(TailOptions{Since: *since, Offset: *offset, Follow: *follow, PollInterval: *poll})
+	defer tailer.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if err := tailWAL(tailer, out, *consumer); err != nil {
+		out.Flush()
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// tailWAL writes the events of tailer to out until the end of the WAL.
+func tailWAL(tailer *WALTailer, out *bufio.Writer, consumer string) error {
+	for {
+		ev, err := tailer.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+
+		// The line must be out before the checkpoint passes it
+		if consumer != "" {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			if err := CommitWALCheckpoint(consumer, ev.Seq); err != nil {
+				return err
+			}
+		} else if tailer.opts.Follow {
+			out.Flush()
+		}
+	}
+}
@@ -1,16 +1,122 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // memDB is my in-memory database implementation
 var mem *memDB
 var memMutex sync.Mutex
 
+// replica follows the primary given by -replica-of, nil on a primary
+var replica *Replica
+
+// raftNode is set in Raft mode, with -raft-id
+var raftNode *RaftNode
+
+// commands are the tools built into the same binary, run as
+// `PersistentKVstoreGo <command> [args]`.
+var commands = map[string]func(args []string) int{
+	"kvtail":   kvtailMain,
+	"kvbackup": kvbackupMain,
+	"kvctl":    kvctlMain,
+	"kvrouter": kvrouterMain,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
+	respAddr := flag.String("resp", "", "address to serve the Redis protocol on, like :6379")
+	memcachedAddr := flag.String("memcached", "", "address to serve the memcached protocol on, like :11211")
+	rpcAddr := flag.String("rpc", "", "address to serve the binary RPC API on, like :7070")
+	replicaOf := flag.String("replica-of", "", "URL of the primary to replicate, like http://primary:8080")
+	replicaName := flag.String("replica-name", "", "name of this replica on the primary, the host name if empty")
+	raftID := flag.String("raft-id", "", "ID of this node, to run in Raft mode")
+	raftPeers := flag.String("raft-peers", "", "first members of the Raft cluster, like n1=http://h1:8080,n2=http://h2:8080; none to join a running one")
+	raftAddr := flag.String("raft-addr", "", "URL of this node for the others, its entry in -raft-peers if empty")
+	port := flag.Int("port", 8080, "port of the HTTP API")
+	keyfile := flag.String("keyfile", "", "file with the keys to encrypt the WAL and SSTs with, the last one for new files")
+	compression := flag.String("compression", "", "codec of the SSTs of each level, like none,snappy,flate: none, flate or snappy")
+	aclFile := flag.String("acl", "", "file mapping bearer tokens to the keys and ops they are allowed, reloaded on SIGHUP")
+	token := flag.String("token", "", "bearer token to send to the primary and the Raft peers")
+	auditFile := flag.String("audit", "", "file to append a hash-chained entry to for every write of the HTTP API")
+	walArchive := flag.String("wal-archive", "", "directory to keep every sealed WAL segment in for point-in-time restores, like WALArchive; off if empty")
+	walArchiveBackups := flag.String("wal-archive-repo", "", "kvbackup repository: archived segments older than its oldest backup are pruned")
+	loadTLS := serverTLSFlags(flag.CommandLine)
+	flag.Parse()
+
+	levels, err := parseCompression(*compression)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sstCompression = levels
+	if *walArchiveBackups != "" && *walArchive == "" {
+		fmt.Println("-wal-archive-repo needs -wal-archive")
+		return
+	}
+	walArchiveDir, walArchiveRepo = *walArchive, *walArchiveBackups
+
+	if err := useKeyfile(*keyfile); err != nil {
+		fmt.Println("Error loading the keyfile:", err)
+		return
+	}
+
+	if (*aclFile != "" || *auditFile != "") && (*respAddr != "" || *memcachedAddr != "" || *rpcAddr != "") {
+		// They would go around the ACL and the audit log
+		fmt.Println("The Redis, memcached and RPC listeners don't authenticate or audit, they can't be used with -acl or -audit")
+		return
+	}
+	if err := useACLFile(*aclFile); err != nil {
+		fmt.Println("Error loading the ACL:", err)
+		return
+	}
+	apiToken = *token
+	if *auditFile != "" {
+		auditLog, err = OpenAuditLog(*auditFile)
+		if err != nil {
+			fmt.Println("Error opening the audit log:", err)
+			return
+		}
+		defer auditLog.Close()
+	}
+	serverTLS, err := loadTLS()
+	if err != nil {
+		fmt.Println("Error loading the TLS files:", err)
+		return
+	}
+	if *aclFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := ReloadACL(); err != nil {
+					fmt.Println("Error reloading the ACL, keeping the old one:", err)
+				} else {
+					fmt.Println("Reloaded the ACL")
+				}
+			}
+		}()
+	}
+
 	// New memdb
 	repl, err := NewInMem()
 	if err != nil {
@@ -24,14 +130,89 @@ func main() {
 		fmt.Println("Error recovering from WAL:", err)
 		return
 	}
+	mem = repl.handler.(*memDB)
+
+	if *replicaOf != "" {
+		name := *replicaName
+		if name == "" {
+			name, _ = os.Hostname()
+		}
+		replica, err = StartReplica(mem, *replicaOf, name)
+		if err != nil {
+			fmt.Println("Error starting replication:", err)
+			return
+		}
+	}
+
+	if *raftID != "" {
+		if *replicaOf != "" || *respAddr != "" || *memcachedAddr != "" || *rpcAddr != "" {
+			// Their writes would go around the log
+			fmt.Println("Raft mode only serves the HTTP API")
+			return
+		}
+		peers, err := parsePeers(*raftPeers)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		addr := *raftAddr
+		if addr == "" {
+			addr = peers[*raftID]
+		}
+		raftNode, err = StartRaftNode(mem, RaftOptions{ID: *raftID, Addr: addr, Peers: peers})
+		if err != nil {
+			fmt.Println("Error starting Raft:", err)
+			return
+		}
+	}
 
 	// API
-	http.HandleFunc("/get", GetHandler)
-	http.HandleFunc("/set", SetHandler)
-	http.HandleFunc("/del", DelHandler)
+	registerRoutes(http.DefaultServeMux)
+	var handler http.Handler = readOnlyGuard(http.DefaultServeMux)
+	if raftNode != nil {
+		handler = raftNode.Handler(handler)
+	}
+	handler = authGuard(auditGuard(handler))
 
-	// Start the REPL
-	repl.Start()
+	if *respAddr != "" {
+		l, err := listen(*respAddr, serverTLS)
+		if err != nil {
+			fmt.Println("Error starting the Redis listener:", err)
+			return
+		}
+		go func() {
+			fmt.Println("Redis listener stopped:", ServeRESP(l, mem))
+		}()
+	}
+	if *memcachedAddr != "" {
+		l, err := listen(*memcachedAddr, serverTLS)
+		if err != nil {
+			fmt.Println("Error starting the memcached listener:", err)
+			return
+		}
+		go func() {
+			fmt.Println("memcached listener stopped:", ServeMemcached(l, mem))
+		}()
+	}
+	if *rpcAddr != "" {
+		l, err := listen(*rpcAddr, serverTLS)
+		if err != nil {
+			fmt.Println("Error starting the RPC listener:", err)
+			return
+		}
+		go func() {
+			fmt.Println("RPC listener stopped:", ServeRPC(l, mem))
+		}()
+	}
+	if *respAddr != "" || *memcachedAddr != "" {
+		mem.startExpirySweeper(time.Second)
+	}
+
+	// Start the REPL, not in Raft mode or with -audit where its writes would
+	// go around the log
+	if raftNode == nil && auditLog == nil {
+		repl.Start()
+	}
 
 	// Ensure the WAL file is closed when the program exits
 	defer func() {
@@ -41,9 +222,64 @@ func main() {
 	}()
 
 	// Specify the port and start the server
-	port := 8080
-	fmt.Printf("Server is running on http://localhost:%d\n", port)
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	l, err := listen(fmt.Sprintf(":%d", *port), serverTLS)
+	if err != nil {
+		fmt.Println("Error starting the HTTP listener:", err)
+		return
+	}
+	scheme := "http"
+	if serverTLS != nil {
+		scheme = "https"
+	}
+	fmt.Printf("Server is running on %s://localhost:%d\n", scheme, *port)
+	http.Serve(l, handler)
+}
+
+// registerRoutes puts the HTTP API on mux.
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/get", GetHandler)
+	mux.HandleFunc("/set", SetHandler)
+	mux.HandleFunc("/del", DelHandler)
+	mux.HandleFunc("/incr", IncrHandler)
+	mux.HandleFunc("/append", AppendHandler)
+	mux.HandleFunc("/cf/", CFHandler)
+	mux.HandleFunc("/watch", WatchHandler)
+	mux.HandleFunc("/admin/checkpoint", CheckpointHandler)
+	mux.HandleFunc("/admin/regions", RegionsHandler)
+	mux.HandleFunc("/admin/stats", StatsHandler)
+	mux.HandleFunc("/import", ImportHandler)
+	mux.HandleFunc("/scan", ScanHandler)
+	mux.HandleFunc("/batch", BatchHandler)
+	mux.HandleFunc("/replication/wal", ReplicationWALHandler)
+	mux.HandleFunc("/replication/checkpoint", ReplicationCheckpointHandler)
+	mux.HandleFunc("/replication/status", ReplicationStatusHandler)
+	mux.HandleFunc("/admin/promote", PromoteHandler)
+	mux.HandleFunc("/admin/replicas", ReplicasHandler)
+	mux.HandleFunc("/admin/acl/reload", ACLReloadHandler)
+	mux.HandleFunc("/metrics", MetricsHandler)
+}
+
+// readOnlyGuard refuses writes while this server is a replica that hasn't
+// been promoted. The store refuses them too, this answers 403 up front.
+func readOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		memMutex.Lock()
+		readOnly := replica != nil && replica.ReadOnly()
+		memMutex.Unlock()
+		if readOnly && isWrite(r) {
+			http.Error(w, ErrReadOnlyReplica.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isWrite(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/set", "/del", "/incr", "/append", "/import", "/batch":
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/cf/") && r.Method != http.MethodGet && r.Method != http.MethodHead
 }
 
 func GetHandler(w http.ResponseWriter, r *http.Request) {
@@ -53,51 +289,468 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 	memMutex.Lock()
 	defer memMutex.Unlock()
 
-	result, err := mem.Get([]byte(key))
+	serveGet(w, r, mem, key)
+}
+
+func SetHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles set requests
+	key := r.URL.Query().Get("key")
+	value := r.URL.Query().Get("value")
+
+	memMutex.Lock()
+	defer memMutex.Unlock()
+
+	serveSet(w, r, mem, key, []byte(value))
+}
+
+func DelHandler(w http.ResponseWriter, r *http.Request) {
+	//handles del requests
+	key := r.URL.Query().Get("key")
+
+	memMutex.Lock()
+	defer memMutex.Unlock()
+
+	serveDel(w, r, mem, key)
+}
+
+// CFHandler serves the column families: /cf/ lists them, /cf/{name} to
+// create (PUT) or drop (DELETE) a family and /cf/{name}/kv/{key} to get, set
+// and delete its keys.
+func CFHandler(w http.ResponseWriter, r *http.Request) {
+	memMutex.Lock()
+	defer memMutex.Unlock()
+
+	serveCF(w, r, mem)
+}
+
+// kvPath splits /cf/{cf}/kv/{key}. The mux redirects paths with ".", ".." or
+// empty segments to their cleaned form, so keys with those come as
+// /cf/{cf}/kv/?key= instead.
+func kvPath(r *http.Request) (string, string, bool) {
+	if !strings.HasPrefix(r.URL.Path, "/cf/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/cf/"), "/", 3)
+	if len(parts) != 3 || parts[1] != "kv" {
+		return "", "", false
+	}
+	if parts[2] == "" {
+		return parts[0], r.URL.Query().Get("key"), true
+	}
+	return parts[0], parts[2], true
+}
+
+func serveCF(w http.ResponseWriter, r *http.Request, db *memDB) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/cf/"), "/", 3)
+	name := parts[0]
+
+	if r.URL.Path == "/cf/" && r.Method == http.MethodGet {
+		names := db.ColumnFamilies()
+		sort.Strings(names)
+		if names == nil {
+			names = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			var options CFOptions
+			if threshold := r.URL.Query().Get("flush_threshold"); threshold != "" {
+				t, err := strconv.Atoi(threshold)
+				if err != nil {
+					http.Error(w, "Flush threshold is not an integer", http.StatusBadRequest)
+					return
+				}
+				options.FlushThreshold = t
+			}
+			for param, option := range map[string]*int64{"region_split_bytes": &options.RegionSplitBytes, "region_merge_bytes": &options.RegionMergeBytes} {
+				if v := r.URL.Query().Get(param); v != "" {
+					n, err := strconv.ParseInt(v, 10, 64)
+					if err != nil {
+						http.Error(w, "Region size is not an integer", http.StatusBadRequest)
+						return
+					}
+					*option = n
+				}
+			}
+			compression, err := parseCompression(r.URL.Query().Get("compression"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			options.Compression = compression
+			if _, err := db.CreateColumnFamily(name, options); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.Write([]byte("OK"))
+		case http.MethodDelete:
+			if err := db.DropColumnFamily(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Write([]byte("OK"))
+		default:
+			if _, err := db.Family(name); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Write([]byte("OK"))
+		}
+		return
+	}
+
+	name, key, ok := kvPath(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cf, err := db.Family(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		serveGet(w, r, cf, key)
+	case http.MethodPut, http.MethodPost:
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveSet(w, r, cf, key, value)
+	case http.MethodDelete:
+		serveDel(w, r, cf, key)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func serveGet(w http.ResponseWriter, r *http.Request, db *memDB, key string) {
+	result, err := db.Get([]byte(key))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
+	w.Header().Set("ETag", etag(result))
+	if inm := r.Header.Get("If-None-Match"); inm != "" && matchesETag(inm, result, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Write(result)
 }
 
-func SetHandler(w http.ResponseWriter, r *http.Request) {
-	//Handles set requests
-	key := r.URL.Query().Get("key")
-	value := r.URL.Query().Get("value")
+func serveSet(w http.ResponseWriter, r *http.Request, db *memDB, key string, value []byte) {
+	if key == "" {
+		http.Error(w, "Key not provided", http.StatusBadRequest)
+		return
+	}
 
+	var err error
+	if cond := preconditions(r); cond != nil {
+		err = db.SetIf([]byte(key), value, cond)
+	} else {
+		err = db.Set([]byte(key), value)
+	}
+	if err == ErrPreconditionFailed {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag(value))
+	w.Write([]byte("OK"))
+}
+
+func serveDel(w http.ResponseWriter, r *http.Request, db *memDB, key string) {
+	var value []byte
+	var err error
+	if cond := preconditions(r); cond != nil {
+		value, err = db.DelIf([]byte(key), cond)
+	} else {
+		value, err = db.Del([]byte(key))
+	}
+	if err == ErrPreconditionFailed {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Write(value)
+}
+
+func IncrHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles incr requests, by defaults to 1
+	key := r.URL.Query().Get("key")
 	if key == "" {
 		http.Error(w, "Key not provided", http.StatusBadRequest)
 		return
 	}
 
+	delta := int64(1)
+	if by := r.URL.Query().Get("by"); by != "" {
+		d, err := strconv.ParseInt(by, 10, 64)
+		if err != nil {
+			http.Error(w, "Increment is not an integer", http.StatusBadRequest)
+			return
+		}
+		delta = d
+	}
+
 	memMutex.Lock()
 	defer memMutex.Unlock()
 
-	err := mem.Set([]byte(key), []byte(value))
+	value, err := mem.Incr([]byte(key), delta)
+	if err == ErrBadOperand || err == ErrNotInteger {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Write([]byte("OK"))
+	w.Write(value)
 }
 
-func DelHandler(w http.ResponseWriter, r *http.Request) {
-	//handles del requests
+func AppendHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles append requests
 	key := r.URL.Query().Get("key")
+	value := r.URL.Query().Get("value")
+	if key == "" {
+		http.Error(w, "Key not provided", http.StatusBadRequest)
+		return
+	}
 
 	memMutex.Lock()
 	defer memMutex.Unlock()
 
-	value, err := mem.Del([]byte(key))
+	result, err := mem.Append([]byte(key), []byte(value))
+	if err == ErrBadOperand || err == ErrNotInteger {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(result)
+}
+
+// WatchHandler streams the writes to keys starting with ?prefix= as
+// Server-Sent Events. ?since= or a Last-Event-ID header resumes after that
+// sequence number, ?cf= watches a column family.
+func WatchHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+
+	// Only the subscription needs the lock, not the whole stream
+	memMutex.Lock()
+	cf, err := mem.Family(r.URL.Query().Get("cf"))
+	memMutex.Unlock()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.Write(value)
+	prefix := r.URL.Query().Get("prefix")
+	var events <-chan Event
+	if since != "" {
+		seq, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, "Sequence is not an integer", http.StatusBadRequest)
+			return
+		}
+		events, err = cf.WatchFrom(prefix, seq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		events = cf.Watch(prefix)
+	}
+	defer cf.Unwatch(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func CheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles checkpoint requests, dir is a path on the server
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		http.Error(w, "Directory not provided", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	memMutex.Lock()
+	defer memMutex.Unlock()
+
+	manifest, err := mem.Checkpoint(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// RegionsHandler lists the regions of ?cf= with the SSTs they own, for
+// whoever routes ranges of keys to this store.
+func RegionsHandler(w http.ResponseWriter, r *http.Request) {
+	memMutex.Lock()
+	cf, err := mem.Family(r.URL.Query().Get("cf"))
+	memMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	regions, err := cf.Regions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(regions)
+}
+
+// StatsHandler reports how well the SSTs of each family compress, or of the
+// one family given with ?cf=.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles GET /admin/stats
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	memMutex.Lock()
+	names := []string{"default"}
+	if cf := r.URL.Query().Get("cf"); cf != "" {
+		names = []string{cf}
+	} else {
+		families := mem.ColumnFamilies()
+		sort.Strings(families)
+		names = append(names, families...)
+	}
+	var families []*memDB
+	for _, name := range names {
+		cf, err := mem.Family(name)
+		if err != nil {
+			memMutex.Unlock()
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		families = append(families, cf)
+	}
+	memMutex.Unlock()
+
+	stats := struct {
+		Families []*FamilyStats `json:"families"`
+	}{}
+	for _, cf := range families {
+		s, err := cf.CompressionStats()
+		if err == ErrColumnFamilyDropped {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats.Families = append(stats.Families, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// etag derives the entity tag of a value from its hash, so two nodes holding
+// the same value hand out the same tag.
+func etag(value []byte) string {
+	h := fnv.New64a()
+	h.Write(value)
+	return fmt.Sprintf("\"%016x\"", h.Sum64())
+}
+
+// matchesETag reports whether an If-Match / If-None-Match header matches the
+// current value of a key. "*" matches any existing key.
+func matchesETag(header string, current []byte, exists bool) bool {
+	if !exists {
+		return false
+	}
+	tag := etag(current)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditions turns the If-Match / If-None-Match headers of a write into a
+// condition for SetIf and DelIf, or nil when the write is unconditional.
+func preconditions(r *http.Request) func(current []byte, exists bool) bool {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+
+	return func(current []byte, exists bool) bool {
+		if ifMatch != "" && !matchesETag(ifMatch, current, exists) {
+			return false
+		}
+		if ifNoneMatch != "" && matchesETag(ifNoneMatch, current, exists) {
+			return false
+		}
+		return true
+	}
 }
 
 //THIS IS ANOTHER MAIN WHERE THERE IS NOT API
@@ -128,3 +781,208 @@ func main() {
 	}()
 }
 */
+
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles bulk imports, the body is JSONL or CSV as written by kvctl export
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatJSONL
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = FormatCSV
+		}
+	}
+
+	// Only the lookup needs the lock, the import takes the store's own
+	// lock when it ingests its SSTs
+	memMutex.Lock()
+	cf, err := mem.Family(r.URL.Query().Get("cf"))
+	memMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	count, err := cf.Import(r.Body, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"imported": count})
+}
+
+// ScanHandler streams the keys from ?start= to ?end=, exclusive, as JSONL in
+// the export format, up to ?limit= of them. ?cf= scans a column family.
+func ScanHandler(w http.ResponseWriter, r *http.Request) {
+	// Only the lookup needs the lock, the iterator reads a snapshot
+	memMutex.Lock()
+	cf, err := mem.Family(r.URL.Query().Get("cf"))
+	memMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	serveScan(w, r, cf)
+}
+
+func serveScan(w http.ResponseWriter, r *http.Request, cf *memDB) {
+	query := r.URL.Query()
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "Limit is not an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	var start, end []byte
+	if query.Get("start") != "" {
+		start = []byte(query.Get("start"))
+	}
+	if query.Get("end") != "" {
+		end = []byte(query.Get("end"))
+	}
+
+	it, err := cf.NewIteratorContext(r.Context(), start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer it.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for count := 0; (limit <= 0 || count < limit) && it.Next(); count++ {
+		if err := enc.Encode(exportRecord{string(it.Key()), base64.StdEncoding.EncodeToString(it.Value())}); err != nil {
+			return
+		}
+	}
+	if it.Err() != nil {
+		// Too late for a status, a last line tells the client the scan is cut
+		enc.Encode(map[string]string{"error": it.Err().Error()})
+	}
+}
+
+// batchOpJSON is one write of a /batch request. The value is base64, like
+// any []byte in JSON.
+type batchOpJSON struct {
+	Op    string `json:"op"`
+	CF    string `json:"cf,omitempty"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+func BatchHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles batches, {"ops": [{"op": "set" or "del", "cf", "key", "value"}]} applied all or nothing
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Ops []batchOpJSON `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := &WriteBatch{}
+	for _, op := range req.Ops {
+		switch op.Op {
+		case "set":
+			b.Set(op.CF, []byte(op.Key), op.Value)
+		case "del":
+			b.Del(op.CF, []byte(op.Key))
+		default:
+			http.Error(w, "Unknown batch op: "+op.Op, http.StatusBadRequest)
+			return
+		}
+	}
+
+	memMutex.Lock()
+	defer memMutex.Unlock()
+
+	err := mem.Write(b)
+	if err == ErrColumnFamilyNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
+func ReplicationWALHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles the WAL stream of replicas, without holding the lock
+	memMutex.Lock()
+	db := mem
+	memMutex.Unlock()
+
+	serveWALStream(w, r, db)
+}
+
+func ReplicationCheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles checkpoint downloads of new replicas
+	memMutex.Lock()
+	db := mem
+	memMutex.Unlock()
+
+	serveCheckpointStream(w, r, db)
+}
+
+func ReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles replication status requests, the lag of a replica
+	memMutex.Lock()
+	defer memMutex.Unlock()
+
+	writeReplicaStatus(w)
+}
+
+func ReplicasHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles the replicas this primary keeps WAL for
+	memMutex.Lock()
+	db := mem
+	memMutex.Unlock()
+
+	serveReplicaConsumers(w, r, db)
+}
+
+func PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	//Handles promotion of a replica to primary
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	memMutex.Lock()
+	defer memMutex.Unlock()
+
+	if replica == nil || !replica.ReadOnly() {
+		http.Error(w, "Not a replica", http.StatusConflict)
+		return
+	}
+	replica.Promote()
+	writeReplicaStatus(w)
+}
+
+func writeReplicaStatus(w http.ResponseWriter) {
+	status := ReplicaStatus{Role: "primary"}
+	if replica != nil {
+		status = replica.Status()
+	} else {
+		mem.mu.Lock()
+		status.AppliedSeq = mem.wal.seq
+		status.PrimarySeq = mem.wal.seq
+		mem.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPPreconditions(t *testing.T) {
+	useTempDir(t)
+	repl, err := NewInMem()
+	if err != nil {
+		t.Fatalf("Error creating in-memory database: %v", err)
+	}
+	mem = repl.handler.(*memDB)
+
+	do := func(h http.HandlerFunc, target string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	rec := do(SetHandler, "/set?key=k&value=v1", map[string]string{"If-None-Match": "*"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Create with If-None-Match: *: expected 200, got %d", rec.Code)
+	}
+	rec = do(SetHandler, "/set?key=k&value=v1", map[string]string{"If-None-Match": "*"})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Second create: expected 412, got %d", rec.Code)
+	}
+
+	rec = do(GetHandler, "/get?key=k", nil)
+	tag := rec.Header().Get("ETag")
+	if tag == "" {
+		t.Fatalf("Expected an ETag on get")
+	}
+
+	rec = do(SetHandler, "/set?key=k&value=v2", map[string]string{"If-Match": tag})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Update with matching ETag: expected 200, got %d", rec.Code)
+	}
+	rec = do(SetHandler, "/set?key=k&value=v3", map[string]string{"If-Match": tag})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Update with stale ETag: expected 412, got %d", rec.Code)
+	}
+	rec = do(DelHandler, "/del?key=k", map[string]string{"If-Match": tag})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Delete with stale ETag: expected 412, got %d", rec.Code)
+	}
+	rec = do(DelHandler, "/del?key=k", map[string]string{"If-Match": etag([]byte("v2"))})
+	if rec.Code != http.StatusOK || rec.Body.String() != "v2" {
+		t.Fatalf("Delete with current ETag: got %d %q", rec.Code, rec.Body.String())
+	}
+}